@@ -0,0 +1,152 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+// unmatchedRule is the rule name under which paths that match no mapping
+// are reported.
+const unmatchedRule = "<unmatched>"
+
+// ruleBenchmark is the matching cost of the paths handled by one rule.
+type ruleBenchmark struct {
+	Rule     string
+	Paths    int
+	Ops      int
+	Duration time.Duration
+}
+
+func (b ruleBenchmark) nsPerOp() float64 {
+	if b.Ops == 0 {
+		return 0
+	}
+	return float64(b.Duration.Nanoseconds()) / float64(b.Ops)
+}
+
+// benchMapping matches every path iterations times and returns the overall
+// cost and the cost per rule, slowest first.
+func benchMapping(m graphitecollector.MetricMapper, paths []string, iterations int) (ruleBenchmark, []ruleBenchmark) {
+	overall := ruleBenchmark{Rule: "total"}
+	byRule := map[string]*ruleBenchmark{}
+
+	for _, path := range paths {
+		rule := unmatchedRule
+		if mapping, _, present := m.GetMapping(path, mapper.MetricTypeGauge); present {
+			rule = mapping.Match
+		}
+
+		start := time.Now()
+		for i := 0; i < iterations; i++ {
+			m.GetMapping(path, mapper.MetricTypeGauge)
+		}
+		elapsed := time.Since(start)
+
+		b, ok := byRule[rule]
+		if !ok {
+			b = &ruleBenchmark{Rule: rule}
+			byRule[rule] = b
+		}
+		for _, b := range []*ruleBenchmark{b, &overall} {
+			b.Paths++
+			b.Ops += iterations
+			b.Duration += elapsed
+		}
+	}
+
+	rules := make([]ruleBenchmark, 0, len(byRule))
+	for _, b := range byRule {
+		rules = append(rules, *b)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].nsPerOp() != rules[j].nsPerOp() {
+			return rules[i].nsPerOp() > rules[j].nsPerOp()
+		}
+		return rules[i].Rule < rules[j].Rule
+	})
+	return overall, rules
+}
+
+func writeBenchMapping(w io.Writer, overall ruleBenchmark, rules []ruleBenchmark, top int) error {
+	pathsPerSecond := 0.0
+	if overall.Duration > 0 {
+		pathsPerSecond = float64(overall.Ops) / overall.Duration.Seconds()
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Paths:\t%d\n", overall.Paths)
+	fmt.Fprintf(tw, "Matches:\t%d\n", overall.Ops)
+	fmt.Fprintf(tw, "Throughput:\t%.0f paths/s\n", pathsPerSecond)
+	fmt.Fprintf(tw, "Cost:\t%.0f ns/op\n", overall.nsPerOp())
+
+	if top > 0 && len(rules) > top {
+		rules = rules[:top]
+	}
+	fmt.Fprintf(tw, "\nRULE\tPATHS\tNS/OP\tSHARE\n")
+	for _, b := range rules {
+		share := 0.0
+		if overall.Duration > 0 {
+			share = float64(b.Duration) / float64(overall.Duration) * 100
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%.0f\t%.1f%%\n", b.Rule, b.Paths, b.nsPerOp(), share)
+	}
+	return tw.Flush()
+}
+
+// runBenchMapping runs the bench-mapping command and returns the exit code.
+func runBenchMapping(logger log.Logger) int {
+	m, err := graphitecollector.LoadMapping(*mappingConfig)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error loading metric mapping config", "err", err)
+		return 1
+	}
+	f, err := os.Open(*benchMappingPaths)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error opening metric paths", "err", err)
+		return 1
+	}
+	defer f.Close()
+
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if path := strings.TrimSpace(scanner.Text()); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		level.Error(logger).Log("msg", "Error reading metric paths", "err", err)
+		return 1
+	}
+
+	overall, rules := benchMapping(m, paths, *benchMappingIterations)
+	if err := writeBenchMapping(os.Stdout, overall, rules, *benchMappingTop); err != nil {
+		level.Error(logger).Log("msg", "Error writing results", "err", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+func TestBenchMapping(t *testing.T) {
+	m := &graphitecollector.Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: servers.*.requests
+  name: requests
+  labels:
+    host: $1
+- match: 'servers\.(.*)\.errors'
+  match_type: regex
+  name: errors
+  labels:
+    host: $1
+`))
+	paths := []string{"servers.web1.requests", "servers.web2.requests", "servers.web1.errors", "other.metric"}
+
+	overall, rules := benchMapping(m, paths, 3)
+	assert.Equal(t, 4, overall.Paths)
+	assert.Equal(t, 12, overall.Ops)
+
+	byRule := map[string]int{}
+	for _, r := range rules {
+		byRule[r.Rule] = r.Paths
+	}
+	assert.Equal(t, map[string]int{
+		"servers.*.requests":    2,
+		`servers\.(.*)\.errors`: 1,
+		unmatchedRule:           1,
+	}, byRule)
+
+	var out bytes.Buffer
+	assert.NoError(t, writeBenchMapping(&out, overall, rules, 1))
+	assert.Contains(t, out.String(), "Paths:       4\n")
+	assert.Equal(t, 1, bytes.Count(out.Bytes(), []byte("%\n")), "only the slowest rule is shown")
+}
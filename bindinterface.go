@@ -0,0 +1,67 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// listenAddresses returns the addresses the Graphite listeners bind to:
+// address itself, or, if iface is set, each address of the network interface
+// iface with the port of address. The addresses of an interface are looked up
+// on every call, as they may only be assigned after startup, e.g. by DHCP.
+func listenAddresses(address, iface string) ([]string, error) {
+	if iface == "" {
+		return []string{address}, nil
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := interfaceIPs(iface)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addresses = append(addresses, net.JoinHostPort(ip.String(), port))
+	}
+	return addresses, nil
+}
+
+// interfaceIPs returns the IP addresses of the network interface name.
+// IPv6 link-local addresses are skipped, as binding to them requires a zone.
+func interfaceIPs(name string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("listing the addresses of interface %s: %v", name, err)
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || (ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast()) {
+			continue
+		}
+		ips = append(ips, ipNet.IP)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("interface %s has no addresses", name)
+	}
+	return ips, nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenAddresses(t *testing.T) {
+	addresses, err := listenAddresses(":9109", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{":9109"}, addresses)
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loopback string
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			loopback = iface.Name
+			break
+		}
+	}
+	if loopback == "" {
+		t.Skip("no loopback interface")
+	}
+	addresses, err = listenAddresses(":9109", loopback)
+	assert.NoError(t, err)
+	assert.Contains(t, addresses, "127.0.0.1:9109")
+
+	_, err = listenAddresses(":9109", "no-such-interface")
+	assert.Error(t, err)
+}
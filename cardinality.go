@@ -0,0 +1,223 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+// cardinalityReport is the result of mapping a corpus of metric paths.
+type cardinalityReport struct {
+	Paths   int
+	Dropped int
+	// Unmatched holds the paths no mapping matched. Under strict matching
+	// they are dropped.
+	Unmatched []string
+	// SeriesPaths holds the distinct paths mapped to each series.
+	SeriesPaths map[string][]string
+	// SeriesSamples holds the number of samples for each series, using the
+	// counts given in the input.
+	SeriesSamples map[string]int
+	// NameSeries holds the number of series for each metric name.
+	NameSeries map[string]int
+}
+
+// cardinalityLimits are the thresholds checked by the report. Negative
+// values disable a check.
+type cardinalityLimits struct {
+	MaxSeriesPerName int
+	MaxCollisions    int
+	MaxUnmatched     int
+}
+
+// buildCardinalityReport maps the metric paths read from r. Each line holds
+// a path, optionally followed by the number of samples seen for it.
+func buildCardinalityReport(m graphitecollector.MetricMapper, settings graphitecollector.MapSettings, r io.Reader) (*cardinalityReport, error) {
+	report := &cardinalityReport{
+		SeriesPaths:   map[string][]string{},
+		SeriesSamples: map[string]int{},
+		NameSeries:    map[string]int{},
+	}
+	// seen maps each path to its series, or to "" if it was dropped.
+	seen := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("line %d: expected a metric path and an optional count", lineno)
+		}
+		path, count := fields[0], 1
+		if len(fields) == 2 {
+			n, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid count: %v", lineno, err)
+			}
+			count = n
+		}
+		if series, ok := seen[path]; ok {
+			if series != "" {
+				report.SeriesSamples[series] += count
+			}
+			continue
+		}
+		seen[path] = ""
+		report.Paths++
+
+		if _, _, present := m.GetMapping(path, mapper.MetricTypeGauge); !present {
+			report.Unmatched = append(report.Unmatched, path)
+		}
+		mm, ok := graphitecollector.MapMetric(m, path, settings)
+		if !ok {
+			report.Dropped++
+			continue
+		}
+
+		metric := model.Metric{model.MetricNameLabel: model.LabelValue(mm.Name)}
+		for k, v := range mm.Labels {
+			metric[model.LabelName(k)] = model.LabelValue(v)
+		}
+		series := metric.String()
+		seen[path] = series
+		if _, ok := report.SeriesPaths[series]; !ok {
+			report.NameSeries[mm.Name]++
+		}
+		report.SeriesPaths[series] = append(report.SeriesPaths[series], path)
+		report.SeriesSamples[series] += count
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// collisions returns the series that more than one path maps to, in order.
+func (r *cardinalityReport) collisions() []string {
+	var series []string
+	for s, paths := range r.SeriesPaths {
+		if len(paths) > 1 {
+			series = append(series, s)
+		}
+	}
+	sort.Strings(series)
+	return series
+}
+
+// write prints the report to w and returns the limits that were exceeded.
+func (r *cardinalityReport) write(w io.Writer, limits cardinalityLimits) ([]string, error) {
+	var violations []string
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Paths:\t%d\n", r.Paths)
+	fmt.Fprintf(tw, "Dropped paths:\t%d\n", r.Dropped)
+	fmt.Fprintf(tw, "Unmatched paths:\t%d\n", len(r.Unmatched))
+	fmt.Fprintf(tw, "Series:\t%d\n", len(r.SeriesPaths))
+
+	names := make([]string, 0, len(r.NameSeries))
+	for name := range r.NameSeries {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if r.NameSeries[names[i]] != r.NameSeries[names[j]] {
+			return r.NameSeries[names[i]] > r.NameSeries[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	fmt.Fprintf(tw, "\nSERIES PER NAME\tSERIES\n")
+	for _, name := range names {
+		fmt.Fprintf(tw, "%s\t%d\n", name, r.NameSeries[name])
+		if limits.MaxSeriesPerName >= 0 && r.NameSeries[name] > limits.MaxSeriesPerName {
+			violations = append(violations, fmt.Sprintf("%s has %d series, more than %d", name, r.NameSeries[name], limits.MaxSeriesPerName))
+		}
+	}
+
+	collisions := r.collisions()
+	if len(collisions) > 0 {
+		fmt.Fprintf(tw, "\nCOLLIDING SERIES\tSAMPLES\tPATHS\n")
+		for _, s := range collisions {
+			paths := append([]string(nil), r.SeriesPaths[s]...)
+			sort.Strings(paths)
+			fmt.Fprintf(tw, "%s\t%d\t%s\n", s, r.SeriesSamples[s], strings.Join(paths, " "))
+		}
+	}
+	if limits.MaxCollisions >= 0 && len(collisions) > limits.MaxCollisions {
+		violations = append(violations, fmt.Sprintf("%d series receive more than one path, more than %d", len(collisions), limits.MaxCollisions))
+	}
+
+	if len(r.Unmatched) > 0 {
+		fmt.Fprintf(tw, "\nUNMATCHED PATHS\n")
+		for _, path := range r.Unmatched {
+			fmt.Fprintf(tw, "%s\n", path)
+		}
+	}
+	if limits.MaxUnmatched >= 0 && len(r.Unmatched) > limits.MaxUnmatched {
+		violations = append(violations, fmt.Sprintf("%d paths are unmatched, more than %d", len(r.Unmatched), limits.MaxUnmatched))
+	}
+	return violations, tw.Flush()
+}
+
+// runCardinalityReport runs the cardinality-report command and returns the
+// exit code.
+func runCardinalityReport(logger log.Logger) int {
+	m, err := graphitecollector.LoadMapping(*mappingConfig)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error loading metric mapping config", "err", err)
+		return 1
+	}
+	f, err := os.Open(*cardinalityPaths)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error opening metric paths", "err", err)
+		return 1
+	}
+	defer f.Close()
+
+	report, err := buildCardinalityReport(m, mapSettingsFromFlags(), f)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error reading metric paths", "err", err)
+		return 1
+	}
+	violations, err := report.write(os.Stdout, cardinalityLimits{
+		MaxSeriesPerName: *cardinalityMaxSeries,
+		MaxCollisions:    *cardinalityMaxCollisions,
+		MaxUnmatched:     *cardinalityMaxUnmatched,
+	})
+	if err != nil {
+		level.Error(logger).Log("msg", "Error writing report", "err", err)
+		return 1
+	}
+	for _, v := range violations {
+		level.Error(logger).Log("msg", "Limit exceeded", "limit", v)
+	}
+	if len(violations) > 0 {
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,72 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+func TestCardinalityReport(t *testing.T) {
+	m := &graphitecollector.Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: servers.*.*.requests
+  name: requests
+  labels:
+    host: $1
+- match: servers.*.debug
+  name: dropped
+  action: drop
+`))
+	input := `servers.web1.a.requests 10
+servers.web1.b.requests 5
+servers.web2.a.requests
+servers.web2.a.requests
+servers.web1.debug
+other.metric
+`
+
+	report, err := buildCardinalityReport(m, graphitecollector.MapSettings{StrictMatch: true}, strings.NewReader(input))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, report.Paths)
+	assert.Equal(t, 2, report.Dropped)
+	assert.Equal(t, []string{"other.metric"}, report.Unmatched)
+	assert.Equal(t, map[string]int{"requests": 2}, report.NameSeries)
+	assert.Equal(t, []string{`requests{host="web1"}`}, report.collisions())
+	assert.Equal(t, 15, report.SeriesSamples[`requests{host="web1"}`])
+	assert.Equal(t, 2, report.SeriesSamples[`requests{host="web2"}`])
+
+	var out bytes.Buffer
+	violations, err := report.write(&out, cardinalityLimits{MaxSeriesPerName: -1, MaxCollisions: -1, MaxUnmatched: -1})
+	assert.NoError(t, err)
+	assert.Empty(t, violations)
+	assert.Contains(t, out.String(), `requests{host="web1"}  15       servers.web1.a.requests servers.web1.b.requests`)
+
+	violations, err = report.write(&out, cardinalityLimits{MaxSeriesPerName: 1, MaxCollisions: 0, MaxUnmatched: 0})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"requests has 2 series, more than 1",
+		"1 series receive more than one path, more than 0",
+		"1 paths are unmatched, more than 0",
+	}, violations)
+
+	_, err = buildCardinalityReport(m, graphitecollector.MapSettings{StrictMatch: true}, strings.NewReader("my.metric many\n"))
+	assert.EqualError(t, err, `line 1: invalid count: strconv.Atoi: parsing "many": invalid syntax`)
+}
@@ -0,0 +1,257 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/alecthomas/units"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"gopkg.in/alecthomas/kingpin.v2"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+func init() {
+	graphitecollector.RegisterFeature("config_file")
+}
+
+// reloadableFlags returns the settings that a configuration reload applies
+// to c and the tenants. The sample expiry and the limits apply to the
+// tenants that do not set their own. All other settings only take effect on
+// restart.
+func reloadableFlags(c *graphitecollector.Collector, tenants []*tenant) map[string]func(value string) error {
+	return map[string]func(value string) error{
+		"graphite.sample-expiry": func(value string) error {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			c.SetSampleExpiry(d)
+			for _, t := range tenants {
+				if t.SampleExpiry == 0 {
+					t.c.SetSampleExpiry(d)
+				}
+			}
+			return nil
+		},
+		"graphite.max-samples-per-scrape": func(value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return err
+			}
+			if n < 0 {
+				return fmt.Errorf("must not be negative")
+			}
+			c.SetMaxSamplesPerScrape(n)
+			for _, t := range tenants {
+				if t.MaxSamplesPerScrape == 0 {
+					t.c.SetMaxSamplesPerScrape(n)
+				}
+			}
+			return nil
+		},
+		"graphite.parse-rate-limit": func(value string) error {
+			rate, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return err
+			}
+			if rate < 0 {
+				return fmt.Errorf("must not be negative")
+			}
+			c.SetParseRateLimit(rate)
+			for _, t := range tenants {
+				if t.ParseRateLimit == 0 {
+					t.c.SetParseRateLimit(rate)
+				}
+			}
+			return nil
+		},
+		"graphite.memory-soft-limit": func(value string) error {
+			limit, err := units.ParseBase2Bytes(value)
+			if err != nil {
+				return err
+			}
+			if limit < 0 {
+				return fmt.Errorf("must not be negative")
+			}
+			// The limit is enforced for the whole process, so the tenants
+			// share it.
+			soft := memorySoftLimitOrDefault(uint64(limit))
+			c.SetMemorySoftLimit(soft)
+			for _, t := range tenants {
+				t.c.SetMemorySoftLimit(soft)
+			}
+			return nil
+		},
+		"graphite.identity-labels": func(value string) error {
+			var id *graphitecollector.IdentityLabels
+			if value != "" {
+				var err error
+				if id, err = graphitecollector.LoadIdentityLabels(value); err != nil {
+					return err
+				}
+			}
+			c.SetIdentityLabels(id)
+			for _, t := range tenants {
+				t.c.SetIdentityLabels(t.identityLabels(id))
+			}
+			return nil
+		},
+	}
+}
+
+// configFile applies a YAML document mirroring the flag structure to the
+// flags of an application. Nested keys are joined with dots, so that
+//
+//	graphite:
+//	  sample-expiry: 10m
+//
+// sets --graphite.sample-expiry. Flags given on the command line take
+// precedence over the file.
+type configFile struct {
+	path     string
+	app      *kingpin.Application
+	explicit map[string]bool
+}
+
+// newConfigFile returns a configFile for path. args are the command line
+// arguments app was parsed from.
+func newConfigFile(app *kingpin.Application, path string, args []string) (*configFile, error) {
+	ctx, err := app.ParseContext(args)
+	if err != nil {
+		return nil, err
+	}
+	explicit := map[string]bool{}
+	for _, e := range ctx.Elements {
+		if f, ok := e.Clause.(*kingpin.FlagClause); ok {
+			explicit[f.Model().Name] = true
+		}
+	}
+	return &configFile{path: path, app: app, explicit: explicit}, nil
+}
+
+// read parses the file into flag values and rejects keys that do not name a
+// flag.
+func (f *configFile) read() (map[string]string, error) {
+	content, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[interface{}]interface{}
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	// The tenants are read by tenants.
+	delete(doc, "tenants")
+	values := map[string]string{}
+	if err := flattenConfig("", doc, values); err != nil {
+		return nil, err
+	}
+
+	flags := map[string]bool{}
+	for _, fm := range f.app.Model().Flags {
+		flags[fm.Name] = true
+	}
+	var unknown []string
+	for name := range values {
+		if !flags[name] || name == "config.file" || name == "help" || name == "version" {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown configuration keys %q", unknown)
+	}
+	return values, nil
+}
+
+func flattenConfig(prefix string, doc map[interface{}]interface{}, values map[string]string) error {
+	for k, v := range doc {
+		name := fmt.Sprint(k)
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		switch v := v.(type) {
+		case map[interface{}]interface{}:
+			if err := flattenConfig(name, v, values); err != nil {
+				return err
+			}
+		case []interface{}:
+			return fmt.Errorf("configuration key %q: lists are not supported", name)
+		case nil:
+			values[name] = ""
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// load sets every flag that was not given on the command line to its value
+// from the file.
+func (f *configFile) load() error {
+	values, err := f.read()
+	if err != nil {
+		return err
+	}
+	for _, fm := range f.app.Model().Flags {
+		value, ok := values[fm.Name]
+		if !ok || f.explicit[fm.Name] {
+			continue
+		}
+		if err := fm.Value.Set(value); err != nil {
+			return fmt.Errorf("configuration key %q: %v", fm.Name, err)
+		}
+	}
+	return nil
+}
+
+// reload re-reads the file and applies the reloadable settings that were not
+// given on the command line, using the functions in reloadable keyed by flag
+// name. Changes to any other setting are logged and ignored.
+func (f *configFile) reload(reloadable map[string]func(value string) error, logger log.Logger) error {
+	values, err := f.read()
+	if err != nil {
+		return err
+	}
+	for _, fm := range f.app.Model().Flags {
+		value, ok := values[fm.Name]
+		if !ok || f.explicit[fm.Name] {
+			continue
+		}
+		apply, ok := reloadable[fm.Name]
+		if !ok {
+			if value != fm.Value.String() {
+				level.Warn(logger).Log("msg", "Configuration change requires a restart", "key", fm.Name)
+			}
+			continue
+		}
+		if err := apply(value); err != nil {
+			return fmt.Errorf("configuration key %q: %v", fm.Name, err)
+		}
+		// The flag reflects the setting in use, e.g. for the identity
+		// labels file read again by later reloads.
+		if err := fm.Value.Set(value); err != nil {
+			return fmt.Errorf("configuration key %q: %v", fm.Name, err)
+		}
+	}
+	return nil
+}
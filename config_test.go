@@ -0,0 +1,116 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+func TestConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graphite_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := kingpin.New("test", "")
+	app.Flag("config.file", "").String()
+	listen := app.Flag("web.listen-address", "").Default(":9108").String()
+	graphite := app.Flag("graphite.listen-address", "").Default(":9109").String()
+	strict := app.Flag("graphite.mapping-strict-match", "").Bool()
+	expiry := app.Flag("graphite.sample-expiry", "").Default("5m").Duration()
+	maxSamples := app.Flag("graphite.max-samples-per-scrape", "").Default("0").Int()
+	app.Flag("graphite.parse-rate-limit", "").Default("0").Float64()
+	app.Flag("graphite.memory-soft-limit", "").Default("0").Bytes()
+	identity := app.Flag("graphite.identity-labels", "").Default("").String()
+	args := []string{"--config.file", path, "--web.listen-address=:8080"}
+	if _, err := app.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+
+	write(`
+web:
+  listen-address: ":9000"
+graphite:
+  listen-address: ":2003"
+  mapping-strict-match: true
+  sample-expiry: 10m
+`)
+	config, err := newConfigFile(app, path, args)
+	assert.NoError(t, err)
+	assert.NoError(t, config.load())
+	assert.Equal(t, ":8080", *listen, "command line flags take precedence")
+	assert.Equal(t, ":2003", *graphite)
+	assert.True(t, *strict)
+	assert.Equal(t, 10*time.Minute, *expiry)
+
+	identityPath := filepath.Join(dir, "identity")
+	if err := ioutil.WriteFile(identityPath, []byte("team=x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	write(`
+graphite:
+  sample-expiry: 1m
+  listen-address: ":2004"
+  max-samples-per-scrape: 100
+  parse-rate-limit: 50
+  memory-soft-limit: 1GiB
+  identity-labels: ` + identityPath + `
+`)
+	c := graphitecollector.NewCollector(graphitecollector.Options{})
+	tenants := []*tenant{
+		{tenantConfig: tenantConfig{Name: "a"}, c: graphitecollector.NewCollector(graphitecollector.Options{})},
+		{tenantConfig: tenantConfig{Name: "b", ParseRateLimit: 10, SampleExpiry: time.Hour}, c: graphitecollector.NewCollector(graphitecollector.Options{ParseRateLimit: 10, SampleExpiry: time.Hour})},
+	}
+	assert.NoError(t, config.reload(reloadableFlags(c, tenants), log.NewNopLogger()))
+	assert.Equal(t, time.Minute, c.SampleExpiry(), "sample expiry is reloadable")
+	assert.Equal(t, ":2003", *graphite, "listen address requires a restart")
+	assert.Equal(t, 100, c.MaxSamplesPerScrape())
+	assert.Equal(t, 100, *maxSamples, "the flag reflects the reloaded setting")
+	assert.Equal(t, 50.0, c.ParseRateLimit())
+	assert.Equal(t, uint64(1<<30), c.MemorySoftLimit())
+	assert.Equal(t, map[string]string{"team": "x"}, c.IdentityLabels().Labels)
+	assert.Equal(t, identityPath, *identity)
+	assert.Equal(t, time.Minute, tenants[0].c.SampleExpiry())
+	assert.Equal(t, time.Hour, tenants[1].c.SampleExpiry(), "the sample expiry of a tenant overrides the flags")
+	assert.Equal(t, 100, tenants[0].c.MaxSamplesPerScrape())
+	assert.Equal(t, 50.0, tenants[0].c.ParseRateLimit())
+	assert.Equal(t, 10.0, tenants[1].c.ParseRateLimit(), "the limits of a tenant override the flags")
+	assert.Equal(t, uint64(1<<30), tenants[1].c.MemorySoftLimit(), "the memory soft limit is shared")
+	assert.Equal(t, "x", tenants[1].c.IdentityLabels().Labels["team"])
+
+	write("graphite:\n  parse-rate-limit: -1\n")
+	assert.EqualError(t, config.reload(reloadableFlags(c, nil), log.NewNopLogger()), `configuration key "graphite.parse-rate-limit": must not be negative`)
+	assert.Equal(t, 50.0, c.ParseRateLimit())
+
+	write("graphite:\n  sample-expiry: 1m\n  unknown: true\n")
+	assert.EqualError(t, config.reload(reloadableFlags(c, nil), log.NewNopLogger()), `unknown configuration keys ["graphite.unknown"]`)
+	assert.Error(t, config.load())
+}
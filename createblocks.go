@@ -0,0 +1,367 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/kisielk/whisper-go/whisper"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+func init() {
+	graphitecollector.RegisterFeature("create_blocks")
+}
+
+// createBlocksOptions configures the conversion of a tree of whisper files
+// into TSDB blocks.
+type createBlocksOptions struct {
+	WhisperDir string
+	OutputDir  string
+	// MinTime and MaxTime restrict the converted points. Zero values leave
+	// the range open.
+	MinTime time.Time
+	MaxTime time.Time
+	// BlockDuration is the time range covered by each written block.
+	BlockDuration time.Duration
+	// BatchSize is the number of whisper files held in memory at once.
+	BatchSize int
+
+	Mapper   graphitecollector.MetricMapper
+	Settings graphitecollector.MapSettings
+}
+
+// createBlocksSummary reports the outcome of a conversion.
+type createBlocksSummary struct {
+	Files    int
+	Skipped  []string
+	Dropped  int
+	Series   int
+	Samples  int
+	Rejected int
+	Blocks   int
+}
+
+// whisperSeries holds the points of one whisper file that fall into one
+// block, in time order.
+type whisperSeries struct {
+	labels labels.Labels
+	points []whisper.Point
+	scale  float64
+}
+
+// createBlocks converts every whisper file below opts.WhisperDir into TSDB
+// blocks in opts.OutputDir. Metric names and labels are derived from the file
+// path with the same mapping as live samples. Files that cannot be read are
+// skipped and reported in the summary.
+func createBlocks(opts createBlocksOptions, logger log.Logger) (createBlocksSummary, error) {
+	var summary createBlocksSummary
+
+	var files []string
+	err := filepath.Walk(opts.WhisperDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(path, ".wsp") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return summary, err
+	}
+	if err := os.MkdirAll(opts.OutputDir, 0777); err != nil {
+		return summary, err
+	}
+
+	blockMillis := int64(opts.BlockDuration / time.Millisecond)
+	compactor, err := tsdb.NewLeveledCompactor(context.Background(), nil, logger, []int64{blockMillis}, nil)
+	if err != nil {
+		return summary, err
+	}
+
+	// Each batch writes its own block per time range. Blocks of the same
+	// range from different batches are merged once all files are converted.
+	blockDirs := map[int64][]string{}
+	for start := 0; start < len(files); start += opts.BatchSize {
+		end := start + opts.BatchSize
+		if end > len(files) {
+			end = len(files)
+		}
+
+		blocks := map[int64][]*whisperSeries{}
+		for _, path := range files[start:end] {
+			if err := readWhisperFile(path, opts, blockMillis, blocks, &summary); err != nil {
+				level.Warn(logger).Log("msg", "Skipping whisper file", "file", path, "err", err)
+				summary.Skipped = append(summary.Skipped, path)
+			}
+		}
+
+		if err := writeBlocks(compactor, opts, blockMillis, blocks, blockDirs, &summary); err != nil {
+			return summary, err
+		}
+		level.Info(logger).Log("msg", "Progress", "files", fmt.Sprintf("%d/%d", end, len(files)), "samples", summary.Samples)
+	}
+
+	for _, dirs := range blockDirs {
+		if len(dirs) < 2 {
+			summary.Blocks += len(dirs)
+			continue
+		}
+		uid, err := compactor.Compact(opts.OutputDir, dirs, nil)
+		if err != nil {
+			return summary, err
+		}
+		for _, dir := range dirs {
+			if err := os.RemoveAll(dir); err != nil {
+				return summary, err
+			}
+		}
+		if uid != (ulid.ULID{}) {
+			summary.Blocks++
+		}
+	}
+	return summary, nil
+}
+
+// whisperName derives the graphite metric path from the path of a whisper
+// file relative to the whisper root.
+func whisperName(root, path string) (string, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", err
+	}
+	rel = strings.TrimSuffix(rel, ".wsp")
+	return strings.Replace(rel, string(filepath.Separator), ".", -1), nil
+}
+
+func readWhisperFile(path string, opts createBlocksOptions, blockMillis int64, blocks map[int64][]*whisperSeries, summary *createBlocksSummary) error {
+	name, err := whisperName(opts.WhisperDir, path)
+	if err != nil {
+		return err
+	}
+	m, ok := graphitecollector.MapMetric(opts.Mapper, name, opts.Settings)
+	if !ok {
+		summary.Dropped++
+		return nil
+	}
+	ls := make(labels.Labels, 0, len(m.Labels)+1)
+	ls = append(ls, labels.Label{Name: "__name__", Value: m.Name})
+	for k, v := range m.Labels {
+		ls = append(ls, labels.Label{Name: k, Value: v})
+	}
+	sort.Sort(ls)
+
+	points, err := readWhisperPoints(path)
+	if err != nil {
+		return err
+	}
+	summary.Files++
+	if len(points) > 0 {
+		summary.Series++
+	}
+
+	var current *whisperSeries
+	currentBlock := int64(math.MinInt64)
+	for _, p := range points {
+		t := p.Time()
+		if (!opts.MinTime.IsZero() && t.Before(opts.MinTime)) || (!opts.MaxTime.IsZero() && t.After(opts.MaxTime)) {
+			continue
+		}
+		block := int64(p.Timestamp) * 1000 / blockMillis * blockMillis
+		if current == nil || block != currentBlock {
+			current = &whisperSeries{labels: ls, scale: m.Scale}
+			currentBlock = block
+			blocks[block] = append(blocks[block], current)
+		}
+		current.points = append(current.points, p)
+	}
+	return nil
+}
+
+// readWhisperPoints returns the points of all archives of a whisper file in
+// time order. Where archives overlap, the points of the most precise archive
+// are used.
+func readWhisperPoints(path string) ([]whisper.Point, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := whisper.OpenWhisper(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	defer w.Close()
+
+	var (
+		result []whisper.Point
+		oldest = uint32(math.MaxUint32)
+	)
+	// Archives are ordered from the most to the least precise.
+	for i := range w.Header.Archives {
+		points, err := w.DumpArchive(i)
+		if err != nil {
+			return nil, err
+		}
+		archiveOldest := oldest
+		for _, p := range points {
+			// Unwritten slots have a zero timestamp.
+			if p.Timestamp == 0 || p.Timestamp >= oldest {
+				continue
+			}
+			result = append(result, p)
+			if p.Timestamp < archiveOldest {
+				archiveOldest = p.Timestamp
+			}
+		}
+		oldest = archiveOldest
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Timestamp < result[j].Timestamp })
+	return result, nil
+}
+
+func writeBlocks(compactor *tsdb.LeveledCompactor, opts createBlocksOptions, blockMillis int64, blocks map[int64][]*whisperSeries, blockDirs map[int64][]string, summary *createBlocksSummary) error {
+	starts := make([]int64, 0, len(blocks))
+	for start := range blocks {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	for _, start := range starts {
+		// The head only accepts samples within half its chunk range of the
+		// newest sample, so it is sized to hold a whole block.
+		head, err := tsdb.NewHead(nil, nil, nil, 2*blockMillis)
+		if err != nil {
+			return err
+		}
+		app := head.Appender()
+		for _, s := range blocks[start] {
+			var ref uint64
+			for _, p := range s.points {
+				t := int64(p.Timestamp) * 1000
+				v := p.Value * s.scale
+				if ref != 0 {
+					err = app.AddFast(ref, t, v)
+				} else {
+					ref, err = app.Add(s.labels, t, v)
+				}
+				switch errors.Cause(err) {
+				case nil:
+					summary.Samples++
+				case tsdb.ErrOutOfOrderSample, tsdb.ErrAmendSample:
+					// Several files mapped to the same series.
+					summary.Rejected++
+				default:
+					app.Rollback()
+					head.Close()
+					return err
+				}
+			}
+		}
+		if err := app.Commit(); err != nil {
+			head.Close()
+			return err
+		}
+
+		uid, err := compactor.Write(opts.OutputDir, head, start, start+blockMillis, nil)
+		head.Close()
+		if err != nil {
+			return err
+		}
+		if uid != (ulid.ULID{}) {
+			blockDirs[start] = append(blockDirs[start], filepath.Join(opts.OutputDir, uid.String()))
+		}
+	}
+	return nil
+}
+
+// runCreateBlocks runs the create-blocks command and returns the exit code.
+func runCreateBlocks(logger log.Logger) int {
+	opts := createBlocksOptions{
+		WhisperDir:    *createBlocksWhisperDir,
+		OutputDir:     *createBlocksOutputDir,
+		BlockDuration: *createBlocksBlockDuration,
+		BatchSize:     *createBlocksBatchSize,
+		Settings:      mapSettingsFromFlags(),
+	}
+	var err error
+	if opts.MinTime, err = parseTime(*createBlocksMinTime); err != nil {
+		level.Error(logger).Log("msg", "Invalid --min-time", "err", err)
+		return 1
+	}
+	if opts.MaxTime, err = parseTime(*createBlocksMaxTime); err != nil {
+		level.Error(logger).Log("msg", "Invalid --max-time", "err", err)
+		return 1
+	}
+	if opts.BlockDuration < time.Minute || opts.BatchSize < 1 {
+		level.Error(logger).Log("msg", "--block-duration must be at least 1m and --batch-size at least 1")
+		return 1
+	}
+
+	if opts.Mapper, err = graphitecollector.LoadMapping(*mappingConfig); err != nil {
+		level.Error(logger).Log("msg", "Error loading metric mapping config", "err", err)
+		return 1
+	}
+
+	summary, err := createBlocks(opts, logger)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error creating blocks", "err", err)
+		return 1
+	}
+	level.Info(logger).Log(
+		"msg", "Finished creating blocks",
+		"files", summary.Files,
+		"skipped", len(summary.Skipped),
+		"dropped", summary.Dropped,
+		"series", summary.Series,
+		"samples", summary.Samples,
+		"rejected_samples", summary.Rejected,
+		"blocks", summary.Blocks,
+	)
+	for _, path := range summary.Skipped {
+		level.Warn(logger).Log("msg", "Skipped unreadable whisper file", "file", path)
+	}
+	if len(summary.Skipped) > 0 {
+		return 2
+	}
+	return 0
+}
+
+// parseTime parses a time given as RFC 3339 or as Unix seconds.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(t)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,128 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/kisielk/whisper-go/whisper"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+func TestCreateBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graphite_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	whisperDir := filepath.Join(dir, "whisper")
+	outputDir := filepath.Join(dir, "blocks")
+
+	now := time.Now().Truncate(time.Minute)
+	writeWhisper := func(name string, points map[time.Duration]float64) {
+		path := filepath.Join(whisperDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		w, err := whisper.Create(path, []whisper.ArchiveInfo{
+			whisper.NewArchiveInfo(60, 6*60),
+			whisper.NewArchiveInfo(3600, 24*7),
+		}, whisper.DefaultCreateOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		for ago, v := range points {
+			if err := w.Update(whisper.NewPoint(now.Add(-ago), v)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	writeWhisper("servers/web1/cpu.wsp", map[time.Duration]float64{
+		10 * time.Minute: 1,
+		5 * time.Minute:  2,
+		time.Minute:      3,
+	})
+	writeWhisper("other.wsp", map[time.Duration]float64{5 * time.Minute: 4})
+	if err := ioutil.WriteFile(filepath.Join(whisperDir, "corrupt.wsp"), []byte("not whisper"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &graphitecollector.Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: servers.*.cpu
+  name: cpu_usage
+  labels:
+    host: $1
+`))
+
+	summary, err := createBlocks(createBlocksOptions{
+		WhisperDir:    whisperDir,
+		OutputDir:     outputDir,
+		MinTime:       now.Add(-7 * time.Minute),
+		BlockDuration: 2 * time.Hour,
+		BatchSize:     1,
+		Mapper:        m,
+	}, log.NewNopLogger())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, summary.Files)
+	assert.Equal(t, []string{filepath.Join(whisperDir, "corrupt.wsp")}, summary.Skipped)
+	assert.Equal(t, 3, summary.Samples, "points before the minimum time are skipped")
+
+	db, err := tsdb.OpenDBReadOnly(outputDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	blocks, err := db.Blocks()
+	assert.NoError(t, err)
+	assert.Equal(t, summary.Blocks, len(blocks), "blocks from different batches are merged")
+
+	got := map[string][]float64{}
+	for _, b := range blocks {
+		q, err := tsdb.NewBlockQuerier(b, math.MinInt64, math.MaxInt64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss, err := q.Select(labels.NewMustRegexpMatcher("__name__", ".+"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for ss.Next() {
+			s := ss.At()
+			it := s.Iterator()
+			for it.Next() {
+				_, v := it.At()
+				got[s.Labels().String()] = append(got[s.Labels().String()], v)
+			}
+		}
+		assert.NoError(t, ss.Err())
+		q.Close()
+	}
+	assert.Equal(t, map[string][]float64{
+		`{__name__="cpu_usage",host="web1"}`: {2, 3},
+		`{__name__="other"}`:                 {4},
+	}, got)
+}
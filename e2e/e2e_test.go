@@ -93,7 +93,25 @@ rspamd.spam_count 3 NOW`
 		t.Fatalf("write error: %v", err)
 	}
 
-	resp, err := http.Get("http://" + path.Join(webAddr, "metrics"))
+	// The lines are processed asynchronously, so they show up in a scrape
+	// some time after they were written.
+	want := []string{"rspamd_actions{action=\"add_header\"} 2", "rspamd_connections 1"}
+	var b []byte
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(100 * time.Millisecond) {
+		b = scrape(t, "http://"+path.Join(webAddr, "metrics"))
+		if containsAll(string(b), want) || time.Now().After(deadline) {
+			break
+		}
+	}
+	for _, s := range want {
+		if !strings.Contains(string(b), s) {
+			t.Fatalf("Expected %q in %q – input: %q – time: %s", s, string(b), input, now)
+		}
+	}
+}
+
+func scrape(t *testing.T, url string) []byte {
+	resp, err := http.Get(url)
 	if err != nil {
 		t.Fatalf("get error: %v", err)
 	}
@@ -102,9 +120,14 @@ rspamd.spam_count 3 NOW`
 	if err != nil {
 		t.Fatalf("read error: %v", err)
 	}
-	for _, s := range []string{"rspamd_actions{action=\"add_header\"} 2", "rspamd_connections 1"} {
-		if !strings.Contains(string(b), s) {
-			t.Fatalf("Expected %q in %q – input: %q – time: %s", s, string(b), input, now)
+	return b
+}
+
+func containsAll(s string, substrs []string) bool {
+	for _, sub := range substrs {
+		if !strings.Contains(s, sub) {
+			return false
 		}
 	}
+	return true
 }
@@ -0,0 +1,148 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+var update = flag.Bool("update", false, "Update the golden files of TestGolden instead of comparing against them.")
+
+// goldenNow is the time of the golden tests. The timestamps of the input
+// lines are relative to it.
+var goldenNow = time.Unix(1600000000, 0)
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+// TestGolden ingests the lines of fixtures/golden/<case>/input.txt into a
+// collector using the mapping configuration mapping.yml, if any, and
+// compares the outcome of each line with results.json and the exposition of
+// the ingested metrics with output.om. Run with -update to write the files
+// after an intended change.
+func TestGolden(t *testing.T) {
+	dirs, err := filepath.Glob(filepath.Join("fixtures", "golden", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) == 0 {
+		t.Fatal("no golden test cases found")
+	}
+	for _, dir := range dirs {
+		dir := dir
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			results, exposition := runGolden(t, dir)
+			compareGolden(t, filepath.Join(dir, "results.json"), results)
+			compareGolden(t, filepath.Join(dir, "output.om"), exposition)
+		})
+	}
+}
+
+func runGolden(t *testing.T, dir string) ([]byte, []byte) {
+	m := &graphitecollector.Mapper{}
+	mappingFile := filepath.Join(dir, "mapping.yml")
+	if _, err := os.Stat(mappingFile); err == nil {
+		if err := m.InitFromFile(mappingFile); err != nil {
+			t.Fatalf("loading mapping config: %v", err)
+		}
+	}
+	input, err := ioutil.ReadFile(filepath.Join(dir, "input.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := graphitecollector.NewCollector(graphitecollector.Options{
+		Logger:  log.NewNopLogger(),
+		Mapper:  m,
+		Carbon2: true,
+		Clock:   fixedClock(goldenNow),
+		MapSettings: graphitecollector.MapSettings{
+			InvalidNamePrefix: graphitecollector.DefaultInvalidNamePrefix,
+		},
+	})
+	c.Run(context.Background())
+	defer c.Stop()
+
+	// The batch endpoint responds once the samples are stored, so the
+	// scrape sees all of them.
+	rec := httptest.NewRecorder()
+	graphitecollector.IngestBatchHandler(c, 1<<20, 10*time.Second).ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/ingest/batch", bytes.NewReader(input)))
+	if rec.Code != 200 {
+		t.Fatalf("ingesting lines: %d %s", rec.Code, rec.Body.String())
+	}
+	var results bytes.Buffer
+	if err := json.Indent(&results, rec.Body.Bytes(), "", "  "); err != nil {
+		t.Fatal(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	var exposition bytes.Buffer
+	enc := expfmt.NewEncoder(&exposition, expfmt.FmtOpenMetrics)
+	for _, f := range families {
+		// Only the ingested metrics are compared, as the exporter's own
+		// metrics depend on timing.
+		if !strings.HasPrefix(f.GetHelp(), "Graphite metric ") {
+			continue
+		}
+		if err := enc.Encode(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if closer, ok := enc.(expfmt.Closer); ok {
+		if err := closer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return results.Bytes(), exposition.Bytes()
+}
+
+func compareGolden(t *testing.T, path string, got []byte) {
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading golden file, run with -update to create it: %v", err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("%s differs, run with -update if the change is intended\nwant:\n%s\ngot:\n%s", path, want, got)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package e2e
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMappingReload(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "graphite_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mapping := filepath.Join(dir, "mapping.yml")
+	writeMapping := func(content string) {
+		if err := ioutil.WriteFile(mapping, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeMapping("mappings:\n- match: app.*.load\n  name: load\n  labels:\n    app: $1\n")
+
+	webAddr, graphiteAddr := fmt.Sprintf("127.0.0.1:%d", 9128), fmt.Sprintf("127.0.0.1:%d", 9129)
+	exporter := exec.Command(
+		filepath.Join(cwd, "..", "graphite_exporter"),
+		"--web.listen-address", webAddr,
+		"--graphite.listen-address", graphiteAddr,
+		"--graphite.mapping-config", mapping,
+	)
+	if err := exporter.Start(); err != nil {
+		t.Fatalf("execution error: %v", err)
+	}
+	defer exporter.Process.Kill()
+	for i := 0; i < 10; i++ {
+		if i > 0 {
+			time.Sleep(1 * time.Second)
+		}
+		resp, err := http.Get("http://" + webAddr)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			break
+		}
+	}
+
+	send := func(line string) {
+		conn, err := net.Dial("tcp", graphiteAddr)
+		if err != nil {
+			t.Fatalf("connection error: %v", err)
+		}
+		defer conn.Close()
+		if _, err := fmt.Fprintf(conn, "%s %d\n", line, time.Now().Unix()); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+	}
+	reload := func() int {
+		resp, err := http.Post("http://"+path.Join(webAddr, "-/reload"), "", nil)
+		if err != nil {
+			t.Fatalf("reload error: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	waitFor := func(want ...string) {
+		var b []byte
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(100 * time.Millisecond) {
+			b = scrape(t, "http://"+path.Join(webAddr, "metrics"))
+			if containsAll(string(b), want) || time.Now().After(deadline) {
+				break
+			}
+		}
+		for _, s := range want {
+			if !strings.Contains(string(b), s) {
+				t.Fatalf("Expected %q in %q", s, string(b))
+			}
+		}
+	}
+
+	send("app.web.load 1")
+	waitFor(`load{app="web"} 1`)
+
+	// A configuration that fails to load keeps the previous one in use.
+	writeMapping("mappings: [")
+	if code := reload(); code != http.StatusInternalServerError {
+		t.Fatalf("Expected the reload of a broken mapping config to fail, got status %d", code)
+	}
+	send("app.db.load 2")
+	waitFor(`load{app="db"} 2`, "graphite_mapping_config_last_reload_successful 0", "graphite_mapping_config_load_failures_total 1")
+
+	writeMapping("mappings:\n- match: app.*.load\n  name: app_load\n  labels:\n    app: $1\n")
+	if code := reload(); code != http.StatusOK {
+		t.Fatalf("Expected the reload to succeed, got status %d", code)
+	}
+	send("app.web.load 3")
+	waitFor(`app_load{app="web"} 3`, "graphite_mapping_config_last_reload_successful 1")
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	writeMapping("mappings:\n- match: app.*.load\n  name: host_load\n  labels:\n    host: $1\n")
+	if err := exporter.Process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("signal error: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(100 * time.Millisecond) {
+		send("app.web.load 4")
+		b := scrape(t, "http://"+path.Join(webAddr, "metrics"))
+		if strings.Contains(string(b), `host_load{host="web"} 4`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the mapping config to be reloaded on SIGHUP, got %q", string(b))
+		}
+	}
+}
@@ -1,13 +1,24 @@
 module github.com/prometheus/graphite_exporter
 
 require (
-	github.com/go-kit/kit v0.8.0
-	github.com/prometheus/client_golang v1.0.0
-	github.com/prometheus/common v0.4.1
+	github.com/alecthomas/units v0.0.0-20190924025748-f65c72e2690d
+	github.com/go-kit/kit v0.10.0
+	github.com/golang/snappy v0.0.1
+	github.com/kisielk/whisper-go v0.0.0-20140112135752-82e8091afdea
+	github.com/oklog/ulid v1.3.1
+	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.7.1
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.15.0
+	github.com/prometheus/exporter-toolkit v0.5.1
 	github.com/prometheus/statsd_exporter v0.8.1
-	github.com/sirupsen/logrus v1.4.2 // indirect
-	github.com/stretchr/testify v1.3.0
+	github.com/prometheus/tsdb v0.10.0
+	github.com/stretchr/testify v1.5.1
+	go.opentelemetry.io/proto/otlp v0.9.0
+	golang.org/x/sys v0.0.0-20200625212154-ddb9806d33ae
+	google.golang.org/grpc v1.37.1
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 go 1.13
@@ -16,325 +16,1114 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"net/http/pprof"
 	"os"
-	"regexp"
+	"os/exec"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	promconfig "github.com/prometheus/common/config"
 	"github.com/prometheus/common/promlog"
 	"github.com/prometheus/common/promlog/flag"
 	"github.com/prometheus/common/version"
+	"github.com/prometheus/exporter-toolkit/web"
+	"github.com/prometheus/exporter-toolkit/web/kingpinflag"
 	"github.com/prometheus/statsd_exporter/pkg/mapper"
 	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
 )
 
 var (
-	listenAddress   = kingpin.Flag("web.listen-address", "Address on which to expose metrics.").Default(":9108").String()
-	metricsPath     = kingpin.Flag("web.telemetry-path", "Path under which to expose Prometheus metrics.").Default("/metrics").String()
-	graphiteAddress = kingpin.Flag("graphite.listen-address", "TCP and UDP address on which to accept samples.").Default(":9109").String()
-	mappingConfig   = kingpin.Flag("graphite.mapping-config", "Metric mapping configuration file name.").Default("").String()
-	sampleExpiry    = kingpin.Flag("graphite.sample-expiry", "How long a sample is valid for.").Default("5m").Duration()
-	strictMatch     = kingpin.Flag("graphite.mapping-strict-match", "Only store metrics that match the mapping configuration.").Bool()
-	dumpFSMPath     = kingpin.Flag("debug.dump-fsm", "The path to dump internal FSM generated for glob matching as Dot file.").Default("").String()
-
-	lastProcessed = prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "graphite_last_processed_timestamp_seconds",
-			Help: "Unix timestamp of the last processed graphite metric.",
-		},
-	)
-	sampleExpiryMetric = prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "graphite_sample_expiry_seconds",
-			Help: "How long in seconds a metric sample is valid for.",
-		},
-	)
-	invalidMetricChars = regexp.MustCompile("[^a-zA-Z0-9_:]")
+	configFilePath     = kingpin.Flag("config.file", "YAML file with values for any of the other flags. Flags given on the command line take precedence.").Default("").String()
+	listenAddress      = kingpin.Flag("web.listen-address", "Address on which to expose metrics.").Default(":9108").String()
+	webConfig          = kingpinflag.AddFlags(kingpin.CommandLine)
+	webReadTimeout     = kingpin.Flag("web.read-timeout", "Maximum duration for reading an entire web request. 0 means no timeout.").Default("0s").Duration()
+	webWriteTimeout    = kingpin.Flag("web.write-timeout", "Maximum duration for writing a web response. 0 means no timeout.").Default("0s").Duration()
+	debugAddress       = kingpin.Flag("web.debug-address", "Address on which to expose profiling and debug endpoints. Disabled if empty.").Default("").String()
+	exposeMapping      = kingpin.Flag("web.expose-mapping-config", "Include the contents of the mapping configuration in /api/v1/status/config.").Bool()
+	enableLifecycle    = kingpin.Flag("web.enable-lifecycle", "Enable shutdown via HTTP request.").Bool()
+	enableBatchIngest  = kingpin.Flag("web.enable-batch-ingest", "Accept plaintext lines POSTed to /api/v1/ingest/batch, responding with the outcome of each line once stored.").Bool()
+	batchMaxBytes      = kingpin.Flag("web.batch-ingest-max-bytes", "Maximum size of the body of a batch ingestion request.").Default("10MB").Bytes()
+	batchTimeout       = kingpin.Flag("web.batch-ingest-timeout", "Maximum time a batch ingestion request may take to store its lines.").Default("30s").Duration()
+	readyWithin        = kingpin.Flag("web.ready-if-ingested-within", "Report not ready on /-/ready if no sample was processed within this duration. 0 disables the check.").Default("0").Duration()
+	metricsPath        = kingpin.Flag("web.telemetry-path", "Path under which to expose Prometheus metrics.").Default("/metrics").String()
+	tenantMetrics      = kingpin.Flag("web.tenant-metrics", "How the samples of the tenants of the configuration file are served: path serves them on <web.telemetry-path>/<tenant>, label adds them to <web.telemetry-path> with a tenant label.").Default("path").Enum("path", "label")
+	disableCompression = kingpin.Flag("web.disable-compression", "Never compress the responses of the metrics endpoint, even if the scraper accepts gzip.").Bool()
+	maxRequests        = kingpin.Flag("web.max-requests", "Maximum number of concurrent requests to the metrics endpoint. Further requests are answered with HTTP 503. 0 means no limit.").Default("0").Int()
+	metricsTimeout     = kingpin.Flag("web.telemetry-timeout", "Answer requests to the metrics endpoint with HTTP 503 if gathering the metrics takes longer than this. 0 means no timeout.").Default("0").Duration()
+	graphiteAddress    = kingpin.Flag("graphite.listen-address", "TCP and UDP address on which to accept samples.").Default(":9109").String()
+	bindInterface      = kingpin.Flag("graphite.bind-interface", "Network interface whose addresses the TCP and UDP listeners bind to, on the port of --graphite.listen-address. Until the interface has an address, binding is retried as set by --graphite.bind-retry-count.").Default("").String()
+	bindRetries        = kingpin.Flag("graphite.bind-retry-count", "Number of times binding the TCP and UDP listeners is retried before giving up, e.g. while the port is still held by a previous instance.").Default("0").Int()
+	bindRetryInterval  = kingpin.Flag("graphite.bind-retry-interval", "Wait before the first retry of a failed bind. Each further retry waits twice as long, up to 30s.").Default("1s").Duration()
+	identityFile       = kingpin.Flag("graphite.identity-labels", "File of labels to add to every exported sample, such as the team owning the exporter, one name=value per line. The file is read again on a POST to /-/reload. Reloadable with --config.file.").Default("").String()
+	carbon2Lines       = kingpin.Flag("graphite.carbon2", "Also accept lines in the carbon2 (metrics 2.0) format, with intrinsic tags as labels.").Bool()
+	drainTimeout       = kingpin.Flag("graphite.tcp-drain-timeout", "How long to keep reading the open TCP connections on shutdown, after announcing it by closing their sending side, for their senders to close them. Connections still open afterwards are closed. 0 closes them right away.").Default("0s").Duration()
+	udpMaxPending      = kingpin.Flag("graphite.udp-max-pending-packets", "Maximum number of received UDP packets waiting to be processed. Further packets are dropped. 0 means 256 per GOMAXPROCS.").Default("0").Int()
+	minUpdates         = kingpin.Flag("graphite.min-updates", "Only export a series once it received this many samples. Series with fewer samples expire after --graphite.probation-expiry, so that series that never update do not fill the exported series.").Default("1").Int()
+	probationExpiry    = kingpin.Flag("graphite.probation-expiry", "How long series with fewer samples than --graphite.min-updates are kept waiting for further samples. 0 means the sample expiry.").Default("1m").Duration()
+	parseRateLimit     = kingpin.Flag("graphite.parse-rate-limit", "Maximum number of lines processed per second. Further lines wait, which slows down TCP senders and makes UDP packets pile up until they are dropped. 0 means no limit. Reloadable with --config.file.").Default("0").Float64()
+	memorySoftLimit    = kingpin.Flag("graphite.memory-soft-limit", "Live heap size above which the oldest samples are removed and samples of new series are rejected. 0 means 90% of GOMEMLIMIT if it is set, and no limit otherwise. Reloadable with --config.file.").Default("0").Bytes()
+	observeValues      = kingpin.Flag("graphite.observe-values", "Observe the absolute value of every ingested sample in the graphite_ingested_values histogram. Costs one histogram observation per line.").Bool()
+	valueCoercions     = kingpin.Flag("graphite.value-coercion", "Number to accept in place of a value that is not a number, as value=number, e.g. on=1. Values are matched ignoring case. May be repeated.").StringMap()
+	defaultSuffixes    = kingpin.Flag("graphite.value-suffixes", "Accept values with a common unit suffix, e.g. 42ms or 17k, converted to the base unit: ns, us, µs, ms, s, k, K, M, G and T.").Bool()
+	valueSuffixes      = kingpin.Flag("graphite.value-suffix", "Unit suffix to accept after a value, as suffix=multiplier, e.g. ms=0.001. Suffixes are case sensitive. May be repeated, and overrides the suffixes of --graphite.value-suffixes.").StringMap()
+	commaDecimal       = kingpin.Flag("graphite.accept-comma-decimal", "Accept values with a single comma as the decimal separator, e.g. 3,14, as sent by agents on some locales. Values with both a comma and a dot are still rejected.").Bool()
+	stallThreshold     = kingpin.Flag("graphite.pipeline-stall-threshold", "How long the line or sample processing loop may go without a heartbeat while lines are waiting for it before /-/healthy reports the exporter as unhealthy. 0 disables the watchdog.").Default("1m").Duration()
+	maxNameLength      = kingpin.Flag("graphite.max-name-length", "Maximum length in bytes of metric names and the paths they were received as. 0 means no limit.").Default("0").Int()
+	maxLabelValueLen   = kingpin.Flag("graphite.max-label-value-length", "Maximum length in bytes of label values. 0 means no limit.").Default("0").Int()
+	lengthLimitAction  = kingpin.Flag("graphite.length-limit-action", "What to do with lines exceeding --graphite.max-name-length or --graphite.max-label-value-length: reject them, or truncate the name or value, ending it with a hash of the full string.").Default("reject").Enum("reject", "truncate")
+	multiDatapoints    = kingpin.Flag("graphite.multi-datapoint-lines", "Accept plaintext lines with several value and timestamp pairs, '<path> <value1> <timestamp1> <value2> <timestamp2> ...', ingesting each datapoint like a line of its own.").Bool()
+	lenientFieldOrder  = kingpin.Flag("graphite.lenient-field-order", "Swap the value and timestamp of plaintext lines whose value looks like a Unix timestamp and whose timestamp does not, as sent by agents writing '<path> <timestamp> <value>'.").Bool()
+	rejectMalformed    = kingpin.Flag("graphite.reject-malformed-paths", "Reject lines whose metric path has consecutive, leading or trailing dots instead of removing the empty components.").Bool()
+	dedupWindow        = kingpin.Flag("graphite.dedup-window", "Drop lines identical to one received within this window. 0 disables deduplication.").Default("0").Duration()
+	dedupMaxLines      = kingpin.Flag("graphite.dedup-max-lines", "Maximum number of recent lines remembered for deduplication.").Default("100000").Int()
+	mappingConfig      = kingpin.Flag("graphite.mapping-config", "Metric mapping configuration file name. The file is read again on a POST to /-/reload and on SIGHUP.").Default("").String()
+	strictMatch        = kingpin.Flag("graphite.mapping-strict-match", "Only store metrics that match the mapping configuration.").Bool()
+	strictMappedNames  = kingpin.Flag("graphite.mapping-strict-names", "Drop metrics whose mapped name holds characters that are invalid in metric names, e.g. from a capture, instead of replacing them.").Bool()
+	normalizeNames     = kingpin.Flag("graphite.normalize-names", "Apply Prometheus naming conventions to all mapped metrics, as if every mapping set normalize_name.").Bool()
+	defaultMetricType  = kingpin.Flag("graphite.metric-type", "Type of unmapped metrics and of mapped metrics whose mapping sets none: gauge or untyped.").Default("gauge").Enum("gauge", "untyped")
+	aggregation        = kingpin.Flag("graphite.same-timestamp-aggregation", "How samples of a series with the same timestamp are combined, unless their mapping sets an aggregation: last, sum or max.").Default("last").Enum("last", "sum", "max")
+	splitDepth         = kingpin.Flag("graphite.unmapped-split-depth", "Number of leading dot-separated components of unmapped paths moved into the --graphite.unmapped-split-label label. 0 keeps them in the name.").Default("0").Int()
+	splitLabel         = kingpin.Flag("graphite.unmapped-split-label", "Label holding the leading components of unmapped paths split by --graphite.unmapped-split-depth.").Default(graphitecollector.DefaultUnmappedSplitLabel).String()
+	instanceComponent  = kingpin.Flag("graphite.instance-component", "Position, starting at 1, of the component of unmapped paths naming the instance, e.g. 2 for servers.<host>.cpu, which is moved into the instance label. 0 keeps it in the name.").Default("0").Int()
+	invalidNamePrefix  = kingpin.Flag("graphite.invalid-name-prefix", "Prefix prepended to sanitized metric names that are not valid, e.g. start with a digit.").Default(graphitecollector.DefaultInvalidNamePrefix).String()
+	dropInvalidNames   = kingpin.Flag("graphite.drop-invalid-names", "Drop metrics whose sanitized name is not valid instead of prefixing it.").Bool()
+	decimalPlaces      = kingpin.Flag("graphite.value-decimal-places", "Round values to this many decimal places when they are stored, unless their mapping sets decimal_places. Negative disables rounding.").Default("-1").Int()
+	metricPrefix       = kingpin.Flag("graphite.metric-prefix", "Prefix prepended to the name of every exported metric, mapped or not.").Default("").String()
+	logDroppedPaths    = kingpin.Flag("graphite.log-dropped-paths", "Log the first drop of each metric path per hour by a drop mapping or strict matching.").Bool()
+	sampleExpiry       = kingpin.Flag("graphite.sample-expiry", "How long a sample is valid for. Reloadable with --config.file.").Default("5m").Duration()
+	sweepInitialJitter = kingpin.Flag("graphite.expiry-sweep-initial-jitter", "Run the first sweep for expired samples after a random delay up to this instead of after one minute, so that exporters started together do not sweep at the same time. 0 disables.").Default("0").Duration()
+	expireOnCollect    = kingpin.Flag("graphite.expire-on-scrape", "Remove the expired samples a scrape finds right away instead of at the next sweep.").Bool()
+	sweepJitter        = kingpin.Flag("graphite.expiry-sweep-jitter", "Move each sweep for expired samples randomly by up to this fraction of the one minute interval in either direction, e.g. 0.1 for 10%.").Default("0").Float64()
+	expiredTombstones  = kingpin.Flag("graphite.expired-tombstones", "Export a final sample of --graphite.tombstone-value for each expired series in the next scrape, so that rules on absent series fire deterministically.").Bool()
+	tombstoneValue     = kingpin.Flag("graphite.tombstone-value", "Value of the final sample of an expired series, e.g. NaN or 0.").Default("NaN").Float64()
+	tombstoneLabel     = kingpin.Flag("graphite.tombstone-label", "Label the final sample of an expired series with graphite_expired=\"true\".").Default("true").Bool()
+	replayMode         = kingpin.Flag("graphite.replay-mode", "Expire samples relative to the newest timestamp received instead of the current time, e.g. to ingest historical captures.").Bool()
+	backfillMode       = kingpin.Flag("graphite.backfill-mode", "Accept historical data, e.g. a replayed week of old samples: samples never expire and are exported with their own timestamps instead of as current values.").Bool()
+	backfillNoMetrics  = kingpin.Flag("graphite.backfill-disable-exposition", "In backfill mode, export none of the samples on the metrics endpoint, only to the outputs such as OTLP.").Bool()
+	storageSchemas     = kingpin.Flag("graphite.storage-schemas-file", "carbon storage-schemas.conf file. Samples of the paths it matches expire after --graphite.storage-schemas-expiry-factor times the resolution of the first retention. Disabled if empty.").Default("").String()
+	schemaFactor       = kingpin.Flag("graphite.storage-schemas-expiry-factor", "Multiple of the storage schema resolution after which samples expire.").Default("5").Float64()
+	collectTimeout     = kingpin.Flag("graphite.collect-timeout", "Stop emitting samples for a scrape once collecting them took this long. 0 means no timeout.").Default("0").Duration()
+	maxScrapeSamples   = kingpin.Flag("graphite.max-samples-per-scrape", "Maximum number of samples exported per scrape. Beyond it, the samples updated least recently are left out. 0 means no limit. Reloadable with --config.file.").Default("0").Int()
+	readOnlyReplica    = kingpin.Flag("graphite.read-only-replica", "Process all lines as usual but export only the exporter's own metrics, e.g. on a replica validating a mapping configuration on mirrored traffic.").Bool()
+	startupGrace       = kingpin.Flag("graphite.startup-grace-period", "Time after startup for senders to send their data again before it is exposed. 0 disables the grace period.").Default("0").Duration()
+	startupGraceMode   = kingpin.Flag("graphite.startup-grace-mode", "What the startup grace period holds back: collect exports only the exporter's own metrics, ready reports not ready on /-/ready.").Default("collect").Enum("collect", "ready")
+	deadLetterFile     = kingpin.Flag("graphite.dead-letter-file", "Append dropped lines to this file. Disabled if empty.").Default("").String()
+	deadLetterMaxBytes = kingpin.Flag("graphite.dead-letter-file-max-bytes", "Rotate the dead letter file once it reaches this size. 0 means no rotation.").Default("100MB").Bytes()
+	deadLetterMaxFiles = kingpin.Flag("graphite.dead-letter-file-max-files", "Number of rotated dead letter files to keep.").Default("5").Int()
+	deadLetterAddress  = kingpin.Flag("graphite.dead-letter-address", "Forward dropped lines to this TCP address. Disabled if empty.").Default("").String()
+	deadLetterTLS      = kingpin.Flag("graphite.dead-letter-tls.enabled", "Connect to the dead letter address with TLS.").Bool()
+	deadLetterCAFile   = kingpin.Flag("graphite.dead-letter-tls.ca-file", "CA certificate to verify the dead letter address with.").Default("").String()
+	deadLetterCertFile = kingpin.Flag("graphite.dead-letter-tls.cert-file", "Client certificate to present to the dead letter address.").Default("").String()
+	deadLetterKeyFile  = kingpin.Flag("graphite.dead-letter-tls.key-file", "Key of the client certificate.").Default("").String()
+	deadLetterSrvName  = kingpin.Flag("graphite.dead-letter-tls.server-name", "Server name to verify the dead letter address's certificate against. Defaults to the host of the address.").Default("").String()
+	deadLetterNoVerify = kingpin.Flag("graphite.dead-letter-tls.insecure-skip-verify", "Do not verify the dead letter address's certificate.").Bool()
+	deadLetterCompress = kingpin.Flag("graphite.dead-letter-compression", "Compression of the stream forwarded to the dead letter address.").Default("none").Enum("none", "gzip", "snappy")
+	deadLetterRate     = kingpin.Flag("graphite.dead-letter-rate", "Maximum number of dropped lines per second passed to the dead letter output. 0 means no limit.").Default("1000").Float64()
+	trackSources       = kingpin.Flag("graphite.track-sources", "Number of source IPs to count received lines for, keeping those sending the most. 0 disables tracking.").Default("0").Int()
+	exportSources      = kingpin.Flag("graphite.track-sources-export", "Number of tracked sources sending the most lines to export as metrics.").Default("10").Int()
+	trackIntervals     = kingpin.Flag("graphite.track-update-intervals", "Number of metric names to track the update intervals of on /debug/update-intervals. Names seen once as many are tracked are left out. 0 disables tracking.").Default("1000").Int()
+	trackSanitized     = kingpin.Flag("graphite.track-sanitized-names", "Number of metric names changed by sanitization to count samples for on /debug/sanitized, keeping the most frequent. 0 disables tracking.").Default("100").Int()
+	otlpEndpoint       = kingpin.Flag("otlp.endpoint", "host:port of an OTLP/gRPC receiver to push the stored samples to. Disabled if empty.").Default("").String()
+	otlpHeaders        = kingpin.Flag("otlp.header", "Header to send with every OTLP request, as name=value. May be repeated.").StringMap()
+	otlpInterval       = kingpin.Flag("otlp.interval", "How often to push the stored samples.").Default("30s").Duration()
+	otlpTimeout        = kingpin.Flag("otlp.timeout", "Timeout of each OTLP request.").Default("10s").Duration()
+	otlpBatchSize      = kingpin.Flag("otlp.batch-size", "Maximum number of data points per OTLP request.").Default("1000").Int()
+	otlpCompression    = kingpin.Flag("otlp.compression", "Compression of the OTLP requests.").Default("none").Enum("none", "gzip")
+	otlpBearerFile     = kingpin.Flag("otlp.bearer-token-file", "File containing a bearer token to authenticate to the OTLP receiver with.").Default("").String()
+	otlpUsername       = kingpin.Flag("otlp.basic-auth.username", "Username to authenticate to the OTLP receiver with basic auth.").Default("").String()
+	otlpPasswordFile   = kingpin.Flag("otlp.basic-auth.password-file", "File containing the basic auth password.").Default("").String()
+	otlpInsecure       = kingpin.Flag("otlp.insecure", "Connect to the OTLP receiver without TLS.").Bool()
+	otlpCAFile         = kingpin.Flag("otlp.tls.ca-file", "CA certificate to verify the OTLP receiver with.").Default("").String()
+	otlpCertFile       = kingpin.Flag("otlp.tls.cert-file", "Client certificate to present to the OTLP receiver.").Default("").String()
+	otlpKeyFile        = kingpin.Flag("otlp.tls.key-file", "Key of the client certificate.").Default("").String()
+	otlpServerName     = kingpin.Flag("otlp.tls.server-name", "Server name to verify the OTLP receiver's certificate against.").Default("").String()
+	otlpSkipVerify     = kingpin.Flag("otlp.tls.insecure-skip-verify", "Do not verify the OTLP receiver's certificate.").Bool()
+	pullURL            = kingpin.Flag("pull.url", "Base URL of a Graphite web API to fetch the --pull.target queries from with /render, for Graphite installations that cannot push to the exporter. Disabled if empty.").Default("").String()
+	pullTargets        = kingpin.Flag("pull.target", "Graphite target to fetch from the render API, e.g. servers.*.cpu. May be repeated.").Strings()
+	pullInterval       = kingpin.Flag("pull.interval", "How often to fetch the targets.").Default("1m").Duration()
+	pullTimeout        = kingpin.Flag("pull.timeout", "Timeout of fetching each target.").Default("10s").Duration()
+	pullFrom           = kingpin.Flag("pull.from", "Start of the fetched window relative to now, in the syntax of the render API. Datapoints ingested by an earlier poll are skipped.").Default("-5min").String()
+	pullMaxStaleness   = kingpin.Flag("pull.max-staleness", "Skip fetched datapoints older than this, so that a target whose data stopped is not exported as current. 0 disables the check.").Default("5m").Duration()
+	pullBearerFile     = kingpin.Flag("pull.bearer-token-file", "File containing a bearer token to authenticate to the Graphite web API with.").Default("").String()
+	pullUsername       = kingpin.Flag("pull.basic-auth.username", "Username to authenticate to the Graphite web API with basic auth.").Default("").String()
+	pullPasswordFile   = kingpin.Flag("pull.basic-auth.password-file", "File containing the basic auth password.").Default("").String()
+	pullCAFile         = kingpin.Flag("pull.tls.ca-file", "CA certificate to verify the Graphite web API with.").Default("").String()
+	pullCertFile       = kingpin.Flag("pull.tls.cert-file", "Client certificate to present to the Graphite web API.").Default("").String()
+	pullKeyFile        = kingpin.Flag("pull.tls.key-file", "Key of the client certificate.").Default("").String()
+	pullServerName     = kingpin.Flag("pull.tls.server-name", "Server name to verify the Graphite web API's certificate against.").Default("").String()
+	pullSkipVerify     = kingpin.Flag("pull.tls.insecure-skip-verify", "Do not verify the Graphite web API's certificate.").Bool()
+	dumpFSMPath        = kingpin.Flag("debug.dump-fsm", "The path to dump internal FSM generated for glob matching as Dot file, or - for stdout.").Default("").String()
+	dumpFSMFormat      = kingpin.Flag("debug.dump-fsm-format", "Format of the FSM dump: dot, or svg rendered by the Graphviz dot command.").Default("dot").Enum("dot", "svg")
+	dumpFSMAndExit     = kingpin.Flag("debug.dump-fsm-and-exit", "Exit after dumping the FSM instead of starting the exporter.").Default("false").Bool()
+	snapshotDir        = kingpin.Flag("debug.snapshot-dir", "Directory that POST /debug/snapshot on the debug address writes snapshots of the stored samples to.").Default("snapshots").String()
+	recordLines        = kingpin.Flag("debug.record-lines", "Append every received line, prefixed with its receive time, to this file. Disabled if empty.").Default("").String()
+	recordMaxBytes     = kingpin.Flag("debug.record-lines-max-bytes", "Stop recording lines once the recording reaches this size. 0 means no limit.").Default("1GB").Bytes()
+
+	_ = kingpin.Command("serve", "Accept graphite samples and expose them to Prometheus.").Default()
+
+	replayCmd    = kingpin.Command("replay", "Send lines recorded with --debug.record-lines to an exporter over TCP.")
+	replayFile   = replayCmd.Arg("file", "Recording to replay.").Required().String()
+	replayTarget = replayCmd.Flag("target", "TCP address to send the lines to.").Default("localhost:9109").String()
+	replayRate   = replayCmd.Flag("rate", "Lines per second to send. 0 keeps the recorded pacing.").Default("0").Float64()
+
+	cardinalityCmd           = kingpin.Command("cardinality-report", "Map a file of graphite metric paths, each optionally followed by a sample count, and report the resulting series, collisions and unmatched paths.")
+	cardinalityPaths         = cardinalityCmd.Arg("paths-file", "File with one metric path per line.").Required().String()
+	cardinalityMaxSeries     = cardinalityCmd.Flag("max-series-per-name", "Fail if a metric name has more series than this. -1 disables the check.").Default("-1").Int()
+	cardinalityMaxCollisions = cardinalityCmd.Flag("max-collisions", "Fail if more series than this receive more than one path. -1 disables the check.").Default("0").Int()
+	cardinalityMaxUnmatched  = cardinalityCmd.Flag("max-unmatched", "Fail if more paths than this match no mapping. -1 disables the check.").Default("-1").Int()
+
+	benchMappingCmd        = kingpin.Command("bench-mapping", "Measure how fast the mapping configuration matches a file of graphite metric paths, overall and per rule.")
+	benchMappingPaths      = benchMappingCmd.Arg("paths-file", "File with one metric path per line.").Required().String()
+	benchMappingIterations = benchMappingCmd.Flag("iterations", "Number of times each path is matched.").Default("100").Int()
+	benchMappingTop        = benchMappingCmd.Flag("top", "Number of slowest rules to show. 0 shows all.").Default("10").Int()
+
+	testMappingCmd = kingpin.Command("test-mapping", "Read graphite metric paths from stdin, one per line, and print how the mapping configuration maps each of them as JSON lines.")
+
+	createBlocksCmd           = kingpin.Command("create-blocks", "Convert whisper files into Prometheus TSDB blocks, using the mapping configuration.")
+	createBlocksWhisperDir    = createBlocksCmd.Arg("whisper-dir", "Directory containing the whisper files.").Required().ExistingDir()
+	createBlocksOutputDir     = createBlocksCmd.Arg("output-dir", "Directory to write the blocks to.").Required().String()
+	createBlocksMinTime       = createBlocksCmd.Flag("min-time", "Only convert points at or after this time, as RFC 3339 or Unix seconds.").Default("").String()
+	createBlocksMaxTime       = createBlocksCmd.Flag("max-time", "Only convert points at or before this time, as RFC 3339 or Unix seconds.").Default("").String()
+	createBlocksBlockDuration = createBlocksCmd.Flag("block-duration", "Time range covered by each block.").Default("2h").Duration()
+	createBlocksBatchSize     = createBlocksCmd.Flag("batch-size", "Number of whisper files held in memory at once.").Default("1000").Int()
 )
 
-type graphiteSample struct {
-	OriginalName string
-	Name         string
-	Labels       map[string]string
-	Help         string
-	Value        float64
-	Type         prometheus.ValueType
-	Timestamp    time.Time
-}
+// shutdownTimeout bounds how long in-flight web requests may take to complete
+// during a graceful shutdown.
+const shutdownTimeout = 10 * time.Second
 
-func (s graphiteSample) String() string {
-	return fmt.Sprintf("%#v", s)
+// valueCoercionsFromFlags returns the numbers that values given with
+// --graphite.value-coercion are replaced by.
+func valueCoercionsFromFlags() (map[string]float64, error) {
+	coercions := make(map[string]float64, len(*valueCoercions))
+	for value, number := range *valueCoercions {
+		f, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --graphite.value-coercion %s=%s, the replacement must be a number", value, number)
+		}
+		coercions[value] = f
+	}
+	return coercions, nil
 }
 
-type metricMapper interface {
-	GetMapping(string, mapper.MetricType) (*mapper.MetricMapping, prometheus.Labels, bool)
-	InitFromFile(string) error
+// pullConfigFromFlags returns the configuration of the render API poller.
+func pullConfigFromFlags() pullConfig {
+	cfg := pullConfig{
+		URL:          *pullURL,
+		Targets:      *pullTargets,
+		From:         *pullFrom,
+		Interval:     *pullInterval,
+		Timeout:      *pullTimeout,
+		MaxStaleness: *pullMaxStaleness,
+		HTTPClient: promconfig.HTTPClientConfig{
+			BearerTokenFile: *pullBearerFile,
+			TLSConfig: promconfig.TLSConfig{
+				CAFile:             *pullCAFile,
+				CertFile:           *pullCertFile,
+				KeyFile:            *pullKeyFile,
+				ServerName:         *pullServerName,
+				InsecureSkipVerify: *pullSkipVerify,
+			},
+		},
+	}
+	if *pullUsername != "" {
+		cfg.HTTPClient.BasicAuth = &promconfig.BasicAuth{Username: *pullUsername, PasswordFile: *pullPasswordFile}
+	}
+	return cfg
 }
 
-type graphiteCollector struct {
-	samples     map[string]*graphiteSample
-	mu          *sync.Mutex
-	mapper      metricMapper
-	sampleCh    chan *graphiteSample
-	lineCh      chan string
-	strictMatch bool
-	logger      log.Logger
+// memorySoftLimitFromFlags returns the soft memory limit, defaulting to 90%
+// of the runtime's memory limit set by GOMEMLIMIT, so that samples are shed
+// before the garbage collector runs ever more often to stay under it.
+func memorySoftLimitFromFlags() uint64 {
+	return memorySoftLimitOrDefault(uint64(*memorySoftLimit))
 }
 
-func newGraphiteCollector(logger log.Logger) *graphiteCollector {
-	c := &graphiteCollector{
-		sampleCh:    make(chan *graphiteSample),
-		lineCh:      make(chan string),
-		mu:          &sync.Mutex{},
-		samples:     map[string]*graphiteSample{},
-		strictMatch: *strictMatch,
-		logger:      logger,
-	}
-	go c.processSamples()
-	go c.processLines()
-	return c
+// memorySoftLimitOrDefault returns limit, or 90% of the runtime's memory
+// limit if limit is 0.
+func memorySoftLimitOrDefault(limit uint64) uint64 {
+	if limit > 0 {
+		return limit
+	}
+	return goMemLimit() / 10 * 9
 }
 
-func (c *graphiteCollector) processReader(reader io.Reader) {
-	lineScanner := bufio.NewScanner(reader)
-	for {
-		if ok := lineScanner.Scan(); !ok {
+// goMemLimit returns the memory limit of the Go runtime set by the GOMEMLIMIT
+// environment variable, or 0 if it is unset, off or invalid.
+func goMemLimit() uint64 {
+	value := os.Getenv("GOMEMLIMIT")
+	multiplier := uint64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier uint64
+	}{
+		{"KiB", 1 << 10},
+		{"MiB", 1 << 20},
+		{"GiB", 1 << 30},
+		{"TiB", 1 << 40},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value, multiplier = strings.TrimSuffix(value, unit.suffix), unit.multiplier
 			break
 		}
-		c.lineCh <- lineScanner.Text()
 	}
-}
-
-func (c *graphiteCollector) processLines() {
-	for line := range c.lineCh {
-		c.processLine(line)
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || n > math.MaxUint64/multiplier {
+		return 0
 	}
+	return n * multiplier
 }
 
-func (c *graphiteCollector) processLine(line string) {
-	line = strings.TrimSpace(line)
-	level.Debug(c.logger).Log("msg", "Incoming line", "line", line)
-	parts := strings.Split(line, " ")
-	if len(parts) != 3 {
-		level.Info(c.logger).Log("msg", "Invalid part count", "parts", len(parts), "line", line)
-		return
+// valueSuffixesFromFlags returns the multipliers of the unit suffixes
+// accepted after values, or nil if none are.
+func valueSuffixesFromFlags() (map[string]float64, error) {
+	if !*defaultSuffixes && len(*valueSuffixes) == 0 {
+		return nil, nil
 	}
-	originalName := parts[0]
-	var name string
-	mapping, labels, present := c.mapper.GetMapping(originalName, mapper.MetricTypeGauge)
-
-	if (present && mapping.Action == mapper.ActionTypeDrop) || (!present && c.strictMatch) {
-		return
-	}
-
-	if present {
-		name = invalidMetricChars.ReplaceAllString(mapping.Name, "_")
-	} else {
-		name = invalidMetricChars.ReplaceAllString(originalName, "_")
+	suffixes := map[string]float64{}
+	if *defaultSuffixes {
+		for suffix, multiplier := range graphitecollector.DefaultValueSuffixes {
+			suffixes[suffix] = multiplier
+		}
 	}
-
-	value, err := strconv.ParseFloat(parts[1], 64)
-	if err != nil {
-		level.Info(c.logger).Log("msg", "Invalid value", "line", line)
-		return
+	for suffix, multiplier := range *valueSuffixes {
+		f, err := strconv.ParseFloat(multiplier, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --graphite.value-suffix %s=%s, the multiplier must be a number", suffix, multiplier)
+		}
+		if suffix == "" || strings.IndexFunc(suffix, func(r rune) bool { return unicode.IsDigit(r) || r == '.' }) >= 0 {
+			return nil, fmt.Errorf("invalid --graphite.value-suffix %s=%s, the suffix must be non-empty and contain no digits or dots", suffix, multiplier)
+		}
+		suffixes[suffix] = f
 	}
-	timestamp, err := strconv.ParseFloat(parts[2], 64)
-	if err != nil {
-		level.Info(c.logger).Log("msg", "Invalid timestamp", "line", line)
-		return
-	}
-	sample := graphiteSample{
-		OriginalName: originalName,
-		Name:         name,
-		Value:        value,
-		Labels:       labels,
-		Type:         prometheus.GaugeValue,
-		Help:         fmt.Sprintf("Graphite metric %s", name),
-		Timestamp:    time.Unix(int64(timestamp), int64(math.Mod(timestamp, 1.0)*1e9)),
-	}
-	level.Debug(c.logger).Log("msg", "Processing sample", "sample", sample)
-	lastProcessed.Set(float64(time.Now().UnixNano()) / 1e9)
-	c.sampleCh <- &sample
+	return suffixes, nil
 }
 
-func (c *graphiteCollector) processSamples() {
-	ticker := time.NewTicker(time.Minute).C
+// maxBindRetryInterval bounds the backoff between retries of a failed bind.
+const maxBindRetryInterval = 30 * time.Second
 
-	for {
+// bindWithRetry calls bind until it succeeds, retrying a failure up to
+// retries times. It waits interval before the first retry and twice as long
+// before each further one, up to maxBindRetryInterval, and returns the error
+// of the last attempt. It stops retrying once done is closed.
+func bindWithRetry(name string, retries int, interval time.Duration, done <-chan struct{}, logger log.Logger, bind func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := bind()
+		if err == nil || attempt > retries {
+			return err
+		}
+		level.Warn(logger).Log("msg", "Error binding "+name+" listener, retrying", "attempt", attempt, "retry_in", interval, "err", err)
 		select {
-		case sample, ok := <-c.sampleCh:
-			if sample == nil || !ok {
-				return
-			}
-			c.mu.Lock()
-			c.samples[sample.OriginalName] = sample
-			c.mu.Unlock()
-		case <-ticker:
-			// Garbage collect expired samples.
-			ageLimit := time.Now().Add(-*sampleExpiry)
-			c.mu.Lock()
-			for k, sample := range c.samples {
-				if ageLimit.After(sample.Timestamp) {
-					delete(c.samples, k)
-				}
-			}
-			c.mu.Unlock()
+		case <-time.After(interval):
+		case <-done:
+			return err
+		}
+		interval *= 2
+		if interval > maxBindRetryInterval {
+			interval = maxBindRetryInterval
 		}
 	}
 }
 
-// Collect implements prometheus.Collector.
-func (c graphiteCollector) Collect(ch chan<- prometheus.Metric) {
-	ch <- lastProcessed
-
-	c.mu.Lock()
-	samples := make([]*graphiteSample, 0, len(c.samples))
-	for _, sample := range c.samples {
-		samples = append(samples, sample)
+// mapSettingsFromFlags returns the mapping settings given on the command
+// line.
+func mapSettingsFromFlags() graphitecollector.MapSettings {
+	s := graphitecollector.MapSettings{
+		StrictMatch:        *strictMatch,
+		StrictMappedNames:  *strictMappedNames,
+		NormalizeNames:     *normalizeNames,
+		MetricPrefix:       *metricPrefix,
+		DefaultType:        graphitecollector.MetricType(*defaultMetricType),
+		Aggregate:          graphitecollector.Aggregation(*aggregation),
+		UnmappedSplitDepth: *splitDepth,
+		UnmappedSplitLabel: *splitLabel,
+		InstanceComponent:  *instanceComponent,
+		InvalidNamePrefix:  *invalidNamePrefix,
 	}
-	c.mu.Unlock()
-
-	ageLimit := time.Now().Add(-*sampleExpiry)
-	for _, sample := range samples {
-		if ageLimit.After(sample.Timestamp) {
-			continue
-		}
-		ch <- prometheus.MustNewConstMetric(
-			prometheus.NewDesc(sample.Name, sample.Help, []string{}, sample.Labels),
-			sample.Type,
-			sample.Value,
-		)
+	if *dropInvalidNames {
+		s.InvalidNamePrefix = ""
 	}
-}
-
-// Describe implements prometheus.Collector.
-func (c graphiteCollector) Describe(ch chan<- *prometheus.Desc) {
-	ch <- lastProcessed.Desc()
+	if *decimalPlaces >= 0 {
+		s.DecimalPlaces = decimalPlaces
+	}
+	return s
 }
 
 func init() {
 	prometheus.MustRegister(version.NewCollector("graphite_exporter"))
 }
 
-func dumpFSM(mapper *mapper.MetricMapper, dumpFilename string, logger log.Logger) error {
-	f, err := os.Create(dumpFilename)
-	if err != nil {
+// dumpFSM writes the FSM used for glob matching to dumpFilename, or to
+// stdout if it is "-". The format is either "dot" or "svg"; SVG is rendered
+// by the Graphviz dot command, which must be in the PATH.
+func dumpFSM(mapper *mapper.MetricMapper, dumpFilename, format string, logger log.Logger) error {
+	if mapper.FSM == nil {
+		return fmt.Errorf("the mapping config has no glob mappings")
+	}
+	w := io.Writer(os.Stdout)
+	if dumpFilename != "-" {
+		f, err := os.Create(dumpFilename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	level.Info(logger).Log("msg", "Start dumping FSM", "to", dumpFilename, "format", format)
+	if err := writeFSM(mapper, format, w); err != nil {
 		return err
 	}
-	level.Info(logger).Log("msg", "Start dumping FSM", "to", dumpFilename)
-	w := bufio.NewWriter(f)
-	mapper.FSM.DumpFSM(w)
-	w.Flush()
-	f.Close()
 	level.Info(logger).Log("msg", "Finish dumping FSM")
 	return nil
 }
 
+func writeFSM(mapper *mapper.MetricMapper, format string, w io.Writer) error {
+	switch format {
+	case "dot":
+		bw := bufio.NewWriter(w)
+		mapper.FSM.DumpFSM(bw)
+		return bw.Flush()
+	case "svg":
+		var dot, stderr bytes.Buffer
+		mapper.FSM.DumpFSM(&dot)
+		cmd := exec.Command("dot", "-Tsvg")
+		cmd.Stdin = &dot
+		cmd.Stdout = w
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) > 0 {
+				return fmt.Errorf("rendering SVG with dot: %v: %s", err, msg)
+			}
+			return fmt.Errorf("rendering SVG with dot: %v", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown FSM dump format %q", format)
+	}
+}
+
 func main() {
 	promlogConfig := &promlog.Config{}
 	flag.AddFlags(kingpin.CommandLine, promlogConfig)
 	kingpin.Version(version.Print("graphite_exporter"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
+
+	var (
+		config    *configFile
+		configErr error
+	)
+	if *configFilePath != "" {
+		config, configErr = newConfigFile(kingpin.CommandLine, *configFilePath, os.Args[1:])
+		if configErr == nil {
+			configErr = config.load()
+		}
+	}
 	logger := promlog.New(promlogConfig)
+	if configErr != nil {
+		level.Error(logger).Log("msg", "Error loading configuration file", "file", *configFilePath, "err", configErr)
+		os.Exit(1)
+	}
+	if errs := validateFlags(); len(errs) > 0 {
+		for _, err := range errs {
+			level.Error(logger).Log("msg", "Invalid flags", "err", err)
+		}
+		os.Exit(1)
+	}
+	var tenantConfigs []tenantConfig
+	if config != nil {
+		tenantConfigs, configErr = config.tenants()
+		if configErr == nil {
+			configErr = validateTenants(tenantConfigs, *graphiteAddress)
+		}
+		if configErr != nil {
+			level.Error(logger).Log("msg", "Error loading tenants from configuration file", "file", *configFilePath, "err", configErr)
+			os.Exit(1)
+		}
+	}
+
+	switch command {
+	case createBlocksCmd.FullCommand():
+		os.Exit(runCreateBlocks(logger))
+	case testMappingCmd.FullCommand():
+		os.Exit(runTestMapping(logger))
+	case replayCmd.FullCommand():
+		os.Exit(runReplay(logger))
+	case cardinalityCmd.FullCommand():
+		os.Exit(runCardinalityReport(logger))
+	case benchMappingCmd.FullCommand():
+		os.Exit(runBenchMapping(logger))
+	}
 
-	prometheus.MustRegister(sampleExpiryMetric)
-	sampleExpiryMetric.Set(sampleExpiry.Seconds())
+	if *dumpFSMAndExit {
+		m, err := graphitecollector.LoadMapping(*mappingConfig)
+		if err == nil {
+			err = dumpFSM(&m.MetricMapper, *dumpFSMPath, *dumpFSMFormat, logger)
+		}
+		if err != nil {
+			level.Error(logger).Log("msg", "Error dumping FSM", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	prometheus.MustRegister(httpRequestDuration, httpRequestsTotal, scrapeResponseSize, recordedLines, replicaMode)
+	if *readOnlyReplica {
+		replicaMode.WithLabelValues("read_only").Set(1)
+	} else {
+		replicaMode.WithLabelValues("normal").Set(1)
+	}
+	if *otlpEndpoint != "" {
+		prometheus.MustRegister(otlpSentPoints, otlpDroppedPoints, otlpFailedRequests, otlpConnectionState, otlpConnFailures)
+	}
+	if *pullURL != "" {
+		prometheus.MustRegister(pullPolls, pullDatapoints, pullLastSuccess)
+	}
+
+	service, err := startService(logger)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error connecting to the service manager", "err", err)
+		os.Exit(1)
+	}
 
 	level.Info(logger).Log("msg", "Starting graphite_exporter", "version_info", version.Info())
 	level.Info(logger).Log("build_context", version.BuildContext())
 
-	http.Handle(*metricsPath, promhttp.Handler())
-	c := newGraphiteCollector(logger)
-	prometheus.MustRegister(c)
+	if err := web.Validate(*webConfig); err != nil {
+		level.Error(logger).Log("msg", "Error loading web configuration", "err", err)
+		os.Exit(1)
+	}
+
+	status := &exporterStatus{readOnly: *readOnlyReplica}
+	if err := status.setWebConfig(*webConfig); err != nil {
+		level.Error(logger).Log("msg", "Error loading web configuration", "err", err)
+		os.Exit(1)
+	}
 
-	c.mapper = &mapper.MetricMapper{}
+	m := &graphitecollector.Mapper{}
 	if *mappingConfig != "" {
-		err := c.mapper.InitFromFile(*mappingConfig)
+		contents, err := graphitecollector.LoadMappingConfig(m, *mappingConfig, "", "startup", logger)
 		if err != nil {
-			level.Error(logger).Log("msg", "Error loading metric mapping config", "err", err)
 			os.Exit(1)
 		}
+		status.setMappingConfig(*mappingConfig, contents)
 	}
 
 	if *dumpFSMPath != "" {
-		err := dumpFSM(c.mapper.(*mapper.MetricMapper), *dumpFSMPath, logger)
+		err := dumpFSM(&m.MetricMapper, *dumpFSMPath, *dumpFSMFormat, logger)
 		if err != nil {
 			level.Error(logger).Log("msg", "Error dumping FSM", "err", err)
 			os.Exit(1)
 		}
 	}
 
-	tcpSock, err := net.Listen("tcp", *graphiteAddress)
-	if err != nil {
-		level.Error(logger).Log("msg", "Error binding to TCP socket", "err", err)
-		os.Exit(1)
+	opts := graphitecollector.Options{
+		Logger:          logger,
+		Mapper:          m,
+		MapSettings:     mapSettingsFromFlags(),
+		SampleExpiry:    *sampleExpiry,
+		Carbon2:         *carbon2Lines,
+		CollectTimeout:  *collectTimeout,
+		TrackSources:    *trackSources,
+		ExportSources:   *exportSources,
+		LogDroppedPaths: *logDroppedPaths,
+		ObserveValues:   *observeValues,
+
+		MaxPendingUDPPackets: *udpMaxPending,
+		ParseRateLimit:       *parseRateLimit,
+		MinUpdates:           *minUpdates,
+		ProbationExpiry:      *probationExpiry,
+		MemorySoftLimit:      memorySoftLimitFromFlags(),
+		RejectMalformedPaths: *rejectMalformed,
+		LenientFieldOrder:    *lenientFieldOrder,
+		MultiDatapointLines:  *multiDatapoints,
+		AcceptCommaDecimal:   *commaDecimal,
+		MaxSamplesPerScrape:  *maxScrapeSamples,
+		StartupGracePeriod:   *startupGrace,
+		GraceReadinessOnly:   *startupGraceMode == "ready",
+		ReplayMode:           *replayMode,
+		TrackSanitizedNames:  *trackSanitized,
+		TrackUpdateIntervals: *trackIntervals,
+		ReadOnly:             *readOnlyReplica || *backfillNoMetrics,
+		Backfill:             *backfillMode,
+
+		ExpirySweepInitialJitter: *sweepInitialJitter,
+		ExpirySweepJitter:        *sweepJitter,
+		Tombstones:               *expiredTombstones,
+		TombstoneValue:           *tombstoneValue,
+		TombstoneLabel:           *tombstoneLabel,
+		PipelineStallThreshold:   *stallThreshold,
+		ExpireOnCollect:          *expireOnCollect,
+		LengthLimits: graphitecollector.LengthLimits{
+			MaxNameLength:       *maxNameLength,
+			MaxLabelValueLength: *maxLabelValueLen,
+			Truncate:            *lengthLimitAction == "truncate",
+		},
 	}
-	go func() {
-		for {
-			conn, err := tcpSock.Accept()
+	// The flag was validated before.
+	opts.ValueCoercions, _ = valueCoercionsFromFlags()
+	opts.ValueSuffixes, _ = valueSuffixesFromFlags()
+	if *storageSchemas != "" {
+		schemas, err := graphitecollector.LoadStorageSchemas(*storageSchemas, *schemaFactor)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error loading storage schemas", "file", *storageSchemas, "err", err)
+			os.Exit(1)
+		}
+		opts.MapSettings.StorageSchemas = schemas
+	}
+	if *identityFile != "" {
+		identity, err := graphitecollector.LoadIdentityLabels(*identityFile)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error loading identity labels", "file", *identityFile, "err", err)
+			os.Exit(1)
+		}
+		opts.IdentityLabels = identity
+	}
+	var recorder *lineRecorder
+	if *recordLines != "" {
+		var err error
+		recorder, err = newLineRecorder(*recordLines, int64(*recordMaxBytes), logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error opening line recording", "err", err)
+			os.Exit(1)
+		}
+		opts.RecordLine = recorder.record
+	}
+	if *dedupWindow > 0 {
+		opts.DedupWindow = *dedupWindow
+		opts.DedupMaxLines = *dedupMaxLines
+	}
+	switch {
+	case *deadLetterFile != "":
+		f, err := graphitecollector.NewRotatingFile(*deadLetterFile, int64(*deadLetterMaxBytes), *deadLetterMaxFiles)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error opening dead letter file", "err", err)
+			os.Exit(1)
+		}
+		opts.DeadLetter = graphitecollector.NewDeadLetter(f, *deadLetterRate, logger)
+	case *deadLetterAddress != "":
+		forwarderOpts := graphitecollector.TCPForwarderOptions{Compression: *deadLetterCompress}
+		if *deadLetterTLS {
+			tlsConfig, err := promconfig.NewTLSConfig(&promconfig.TLSConfig{
+				CAFile:             *deadLetterCAFile,
+				CertFile:           *deadLetterCertFile,
+				KeyFile:            *deadLetterKeyFile,
+				ServerName:         *deadLetterSrvName,
+				InsecureSkipVerify: *deadLetterNoVerify,
+			})
 			if err != nil {
-				level.Error(logger).Log("msg", "Error accepting TCP connection", "err", err)
-				continue
+				level.Error(logger).Log("msg", "Error setting up TLS for the dead letter address", "err", err)
+				os.Exit(1)
 			}
-			go func() {
-				defer conn.Close()
-				c.processReader(conn)
-			}()
+			forwarderOpts.TLS = tlsConfig
 		}
-	}()
+		opts.DeadLetter = graphitecollector.NewDeadLetter(graphitecollector.NewTCPForwarder(*deadLetterAddress, forwarderOpts), *deadLetterRate, logger)
+	}
 
-	udpAddress, err := net.ResolveUDPAddr("udp", *graphiteAddress)
-	if err != nil {
-		level.Error(logger).Log("msg", "Error resolving UDP address", "err", err)
-		os.Exit(1)
+	handlerOpts := promhttp.HandlerOpts{
+		DisableCompression:  *disableCompression,
+		MaxRequestsInFlight: *maxRequests,
+		Timeout:             *metricsTimeout,
 	}
-	udpSock, err := net.ListenUDP("udp", udpAddress)
-	if err != nil {
-		level.Error(logger).Log("msg", "Error listening to UDP address", "err", err)
-		os.Exit(1)
+	mux := newInstrumentedMux(logger)
+	mux.Handle(*metricsPath, metricsHandler(handlerOpts))
+	c := graphitecollector.NewCollector(opts)
+	prometheus.MustRegister(c)
+	c.Run(context.Background())
+
+	tenants := make([]*tenant, 0, len(tenantConfigs))
+	for _, tc := range tenantConfigs {
+		t, err := newTenant(tc, opts, *tenantMetrics == "label")
+		if err != nil {
+			level.Error(logger).Log("msg", "Error setting up tenant", "err", err)
+			os.Exit(1)
+		}
+		// Only the samples are served per tenant, as the exporter's own
+		// metrics are shared by all tenants.
+		if t.labelled {
+			prometheus.MustRegister(t.c.SampleCollector())
+		} else {
+			reg := prometheus.NewRegistry()
+			reg.MustRegister(t.c.SampleCollector())
+			mux.Handle(strings.TrimSuffix(*metricsPath, "/")+"/"+t.Name, promhttp.HandlerFor(reg, handlerOpts))
+		}
+		t.c.Run(context.Background())
+		tenants = append(tenants, t)
 	}
-	go func() {
-		defer udpSock.Close()
-		for {
-			buf := make([]byte, 65536)
-			chars, srcAddress, err := udpSock.ReadFromUDP(buf)
+	if len(tenants) > 0 {
+		prometheus.MustRegister(tenantStats(tenants))
+	}
+
+	var otlp *otlpExporter
+	if *otlpEndpoint != "" {
+		var err error
+		currentSamples := func(time.Time) []*graphitecollector.Sample {
+			return c.CurrentSamples(c.Now())
+		}
+		otlp, err = newOTLPExporter(currentSamples, otlpConfig{
+			Endpoint: *otlpEndpoint,
+			Headers:  *otlpHeaders,
+			Insecure: *otlpInsecure,
+			TLSConfig: promconfig.TLSConfig{
+				CAFile:             *otlpCAFile,
+				CertFile:           *otlpCertFile,
+				KeyFile:            *otlpKeyFile,
+				ServerName:         *otlpServerName,
+				InsecureSkipVerify: *otlpSkipVerify,
+			},
+			Auth: otlpAuth{
+				BearerTokenFile: *otlpBearerFile,
+				Username:        *otlpUsername,
+				PasswordFile:    *otlpPasswordFile,
+			},
+			Interval:    *otlpInterval,
+			Timeout:     *otlpTimeout,
+			BatchSize:   *otlpBatchSize,
+			Compression: *otlpCompression,
+		}, logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error setting up OTLP export", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	var poller *renderPoller
+	if *pullURL != "" {
+		var err error
+		poller, err = newRenderPoller(c, pullConfigFromFlags(), logger)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error setting up the Graphite render API poller", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	// graphiteBound counts the bound Graphite listeners, which may take
+	// several attempts after the web listeners are bound.
+	var graphiteBound int32
+	mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
+		if !c.PipelineHealthy() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "The sample pipeline is stalled.\n")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Graphite Exporter is Healthy.\n")
+	})
+	mux.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&graphiteBound) < int32(2*(1+len(tenants))) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "The Graphite listeners are not bound yet.\n")
+			return
+		}
+		if *startupGraceMode == "ready" && c.InStartupGrace(time.Now()) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "In the startup grace period of %s.\n", *startupGrace)
+			return
+		}
+		if *readyWithin > 0 && !c.ProcessedWithin(*readyWithin, time.Now()) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "No samples processed in the last %s.\n", *readyWithin)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Graphite Exporter is Ready.\n")
+	})
+
+	// reload applies the reloadable settings on a POST to /-/reload or on
+	// SIGHUP, named by trigger. A reload failing part way keeps the
+	// remaining settings. Concurrent reloads are serialized.
+	var reloadMu sync.Mutex
+	reloadable := func() bool {
+		return config != nil || *mappingConfig != "" || *identityFile != ""
+	}
+	reload := func(trigger string) error {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+		if config != nil {
+			if err := config.reload(reloadableFlags(c, tenants), logger); err != nil {
+				level.Error(logger).Log("msg", "Error reloading configuration file", "file", config.path, "trigger", trigger, "err", err)
+				return fmt.Errorf("failed to reload config: %s", err)
+			}
+			level.Info(logger).Log("msg", "Reloaded configuration file", "file", config.path, "trigger", trigger)
+		}
+		if *mappingConfig != "" {
+			// A configuration that fails to load keeps the previous mapper
+			// in use. Lines received before SetMapper are still mapped
+			// with it.
+			m := &graphitecollector.Mapper{}
+			contents, err := graphitecollector.LoadMappingConfig(m, *mappingConfig, "", trigger, logger)
 			if err != nil {
-				level.Error(logger).Log("msg", "Error reading UDP packet", "from", srcAddress, "err", err)
-				continue
+				return fmt.Errorf("failed to reload mapping config: %s", err)
 			}
-			go c.processReader(bytes.NewReader(buf[0:chars]))
+			c.SetMapper(m)
+			status.setMappingConfig(*mappingConfig, contents)
+			level.Info(logger).Log("msg", "Reloaded metric mapping config", "file", *mappingConfig, "trigger", trigger)
 		}
-	}()
-
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/" {
-			http.NotFound(w, r)
+		if *identityFile != "" {
+			// A file that fails to load keeps the previous labels in use.
+			identity, err := graphitecollector.LoadIdentityLabels(*identityFile)
+			if err != nil {
+				level.Error(logger).Log("msg", "Error reloading identity labels", "file", *identityFile, "trigger", trigger, "err", err)
+				return fmt.Errorf("failed to reload identity labels: %s", err)
+			}
+			c.SetIdentityLabels(identity)
+			for _, t := range tenants {
+				t.c.SetIdentityLabels(t.identityLabels(identity))
+			}
+			level.Info(logger).Log("msg", "Reloaded identity labels", "file", *identityFile, "sha256", identity.Hash, "trigger", trigger)
+		}
+		if len(tenants) > 0 {
+			// The tenants fall back to the settings of the flags reloaded
+			// above.
+			base := opts
+			base.SampleExpiry = c.SampleExpiry()
+			base.MaxSamplesPerScrape = c.MaxSamplesPerScrape()
+			base.ParseRateLimit = c.ParseRateLimit()
+			configs, err := config.tenants()
+			if err == nil {
+				err = reloadTenants(tenants, configs, base, trigger, logger)
+			}
+			if err != nil {
+				level.Error(logger).Log("msg", "Error reloading tenants", "file", config.path, "trigger", trigger, "err", err)
+				return fmt.Errorf("failed to reload tenants: %s", err)
+			}
+		}
+		return nil
+	}
+	mux.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "This endpoint requires a POST or PUT request.\n")
+			return
+		}
+		if !reloadable() {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "No configuration file given with --config.file, --graphite.mapping-config or --graphite.identity-labels.\n")
 			return
 		}
-		w.Write([]byte(`<html>
-      <head><title>Graphite Exporter</title></head>
-      <body>
-      <h1>Graphite Exporter</h1>
-      <p>Accepting plaintext Graphite samples over TCP and UDP on ` + *graphiteAddress + `</p>
-      <p><a href="` + *metricsPath + `">Metrics</a></p>
-      </body>
-      </html>`))
+		if err := reload("http"); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	quit := make(chan struct{})
+	var quitOnce sync.Once
+	mux.HandleFunc("/-/quit", func(w http.ResponseWriter, r *http.Request) {
+		if !*enableLifecycle {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "Lifecycle API is not enabled.\n")
+			return
+		}
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "This endpoint requires a POST or PUT request.\n")
+			return
+		}
+		fmt.Fprintf(w, "Requesting termination... Goodbye!\n")
+		quitOnce.Do(func() { close(quit) })
+	})
+	if *enableBatchIngest {
+		mux.HandleFunc("/api/v1/ingest/batch", graphitecollector.IngestBatchHandler(c, int64(*batchMaxBytes), *batchTimeout))
+	}
+	mux.HandleFunc("/api/v1/status/buildinfo", buildInfo)
+	mux.HandleFunc("/api/v1/status/config", configStatus(kingpin.CommandLine, status, *exposeMapping))
+	mux.HandleFunc("/", landingPage(status, c, *metricsPath, *debugAddress))
+
+	// The web listeners are bound before the components start, so that a
+	// bind failure exits before any sample is accepted. The Graphite
+	// listeners are bound by their components, which may retry while the
+	// web servers already serve.
+	g := &runGroup{logger: logger}
+	serve := func(name, address string, handler http.Handler) {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error binding "+name+" listener", "address", address, "err", err)
+			os.Exit(exitFailure)
+		}
+		level.Info(logger).Log("msg", "Listening on "+address, "listener", name)
+		stats := status.listeners.Add(name, "http", listener.Addr().String(), status.tlsEnabled)
+
+		server := &http.Server{
+			Handler:      handler,
+			ReadTimeout:  *webReadTimeout,
+			WriteTimeout: *webWriteTimeout,
+		}
+		g.add(name+" server", exitFailure, func() error {
+			err := web.Serve(stats.Wrap(listener), server, *webConfig, logger)
+			if err == http.ErrServerClosed {
+				return nil
+			}
+			stats.RecordError(err)
+			return err
+		}, func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			return server.Shutdown(ctx)
+		})
+	}
+
+	serve("http", *listenAddress, mux)
+	if *debugAddress != "" {
+		debugMux := newInstrumentedMux(logger)
+		debugMux.HandleFunc("/debug/pprof/", pprof.Index)
+		debugMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		debugMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		debugMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		debugMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		debugMux.HandleFunc("/debug/snapshot", graphitecollector.SnapshotHandler(c, *snapshotDir, logger))
+		debugMux.HandleFunc("/debug/selftest", graphitecollector.SelftestHandler(c, logger))
+		debugMux.HandleFunc("/debug/mappings", graphitecollector.MappingsHandler(c))
+		debugMux.HandleFunc("/debug/connections", graphitecollector.ConnectionsHandler(c))
+		debugMux.HandleFunc("/debug/summary", graphitecollector.SummaryHandler(c, logger))
+		debugMux.HandleFunc("/debug/outcomes", graphitecollector.OutcomesHandler(c))
+		debugMux.HandleFunc("/debug/ingest-dry", graphitecollector.IngestDryRunHandler(c))
+		debugMux.HandleFunc("/debug/listeners", graphitecollector.ListenersHandler(&status.listeners))
+		debugMux.HandleFunc("/debug/samples", graphitecollector.SamplesHandler(c))
+		if *trackSources > 0 {
+			debugMux.HandleFunc("/debug/sources", graphitecollector.SourcesHandler(c))
+		}
+		if *trackSanitized > 0 {
+			debugMux.HandleFunc("/debug/sanitized", graphitecollector.SanitizedNamesHandler(c))
+		}
+		if *trackIntervals > 0 {
+			debugMux.HandleFunc("/debug/update-intervals", graphitecollector.UpdateIntervalsHandler(c))
+		}
+		serve("debug", *debugAddress, debugMux)
+	}
+
+	// The components are stopped in the reverse order of being added: the
+	// Graphite listeners first, then the pipeline, so that it processes
+	// what they received, then the outputs fed by it, and the web servers
+	// last.
+	if otlp != nil {
+		g.add("OTLP exporter", exitFailure, func() error {
+			otlp.run()
+			return nil
+		}, func() error {
+			otlp.stop()
+			return nil
+		})
+	}
+	// stopPipeline stops the pipeline of c once its Graphite listeners
+	// no longer accept connections, so that the senders of the open ones
+	// can fail over and finish sending.
+	stopPipeline := func(c *graphitecollector.Collector, logger log.Logger) {
+		if drained, forced := c.DrainConnections(*drainTimeout); drained+forced > 0 {
+			level.Info(logger).Log("msg", "Closed TCP connections", "drained", drained, "forced", forced)
+		}
+		c.Stop()
+		<-c.Stopped()
+		c.LogSummary(logger)
+	}
+	g.add("sample pipeline", exitPipeline, func() error {
+		<-c.Stopped()
+		return errors.New("the sample pipeline stopped")
+	}, func() error {
+		stopPipeline(c, logger)
+		if recorder != nil {
+			recorder.close()
+		}
+		// The tenants' pipelines, which share the dead letter output, are
+		// stopped before.
+		if opts.DeadLetter != nil {
+			opts.DeadLetter.Close()
+		}
+		return nil
+	})
+	for _, t := range tenants {
+		t := t
+		g.add("sample pipeline of tenant "+t.Name, exitPipeline, func() error {
+			<-t.c.Stopped()
+			return fmt.Errorf("the sample pipeline of tenant %s stopped", t.Name)
+		}, func() error {
+			stopPipeline(t.c, log.With(logger, "tenant", t.Name))
+			return nil
+		})
+	}
+
+	// Closed on shutdown so that the Graphite listener loops can tell a
+	// closed socket from a transient error, and binds stop retrying.
+	done := make(chan struct{})
+	var doneOnce sync.Once
+	stopListeners := func() error {
+		doneOnce.Do(func() { close(done) })
+		return nil
+	}
+	// serveGraphite adds the Graphite TCP and UDP listeners on address, or
+	// on the addresses of the network interface iface if set, feeding c,
+	// named name in the listener statistics.
+	serveGraphite := func(name, address, iface string, c *graphitecollector.Collector) {
+		g.add(name+" TCP listener", exitGraphiteTCP, func() error {
+			var tcpSocks []net.Listener
+			err := bindWithRetry("tcp", *bindRetries, *bindRetryInterval, done, logger, func() error {
+				addresses, err := listenAddresses(address, iface)
+				if err != nil {
+					return err
+				}
+				tcpSocks = nil
+				for _, a := range addresses {
+					tcpSock, err := net.Listen("tcp", a)
+					if err != nil {
+						for _, sock := range tcpSocks {
+							sock.Close()
+						}
+						return err
+					}
+					tcpSocks = append(tcpSocks, tcpSock)
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("binding to TCP socket: %v", err)
+			}
+			var wg sync.WaitGroup
+			for _, tcpSock := range tcpSocks {
+				tcpSock := tcpSock
+				tcpStats := status.listeners.Add(name, "tcp", tcpSock.Addr().String(), false)
+				if iface != "" {
+					level.Info(logger).Log("msg", "Bound TCP listener to interface address", "interface", iface, "address", tcpSock.Addr())
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					c.ServeTCP(tcpSock.(*net.TCPListener), tcpStats, done)
+				}()
+				go func() {
+					<-done
+					tcpSock.Close()
+				}()
+			}
+			atomic.AddInt32(&graphiteBound, 1)
+			wg.Wait()
+			return nil
+		}, stopListeners)
+		g.add(name+" UDP listener", exitGraphiteUDP, func() error {
+			var udpSocks []*net.UDPConn
+			err := bindWithRetry("udp", *bindRetries, *bindRetryInterval, done, logger, func() error {
+				addresses, err := listenAddresses(address, iface)
+				if err != nil {
+					return err
+				}
+				udpSocks = nil
+				for _, a := range addresses {
+					udpAddress, err := net.ResolveUDPAddr("udp", a)
+					if err != nil {
+						return fmt.Errorf("resolving UDP address: %v", err)
+					}
+					udpSock, err := net.ListenUDP("udp", udpAddress)
+					if err != nil {
+						for _, sock := range udpSocks {
+							sock.Close()
+						}
+						return err
+					}
+					udpSocks = append(udpSocks, udpSock)
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("listening to UDP address: %v", err)
+			}
+			var wg sync.WaitGroup
+			for _, udpSock := range udpSocks {
+				udpSock := udpSock
+				udpStats := status.listeners.Add(name, "udp", udpSock.LocalAddr().String(), false)
+				if iface != "" {
+					level.Info(logger).Log("msg", "Bound UDP listener to interface address", "interface", iface, "address", udpSock.LocalAddr())
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					c.ServeUDP(udpSock, udpStats, done)
+				}()
+				go func() {
+					<-done
+					udpSock.Close()
+				}()
+			}
+			atomic.AddInt32(&graphiteBound, 1)
+			wg.Wait()
+			return nil
+		}, stopListeners)
+	}
+	if poller != nil {
+		g.add("graphite render API poller", exitFailure, func() error {
+			poller.run()
+			return nil
+		}, func() error {
+			poller.stop()
+			return nil
+		})
+	}
+	serveGraphite("graphite", *graphiteAddress, *bindInterface, c)
+	for _, t := range tenants {
+		serveGraphite("graphite tenant "+t.Name, t.ListenAddress, "", t.c)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	stopReloads := make(chan struct{})
+	g.add("reload signals", exitFailure, func() error {
+		for {
+			select {
+			case <-hup:
+				if !reloadable() {
+					level.Warn(logger).Log("msg", "Received SIGHUP, but there is nothing to reload")
+					continue
+				}
+				// Errors are logged by reload.
+				_ = reload("sighup")
+			case <-stopReloads:
+				return nil
+			}
+		}
+	}, func() error {
+		signal.Stop(hup)
+		close(stopReloads)
+		return nil
+	})
+
+	// On Windows, closing the console window, logging off and shutting down
+	// are delivered as SIGTERM too.
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+	interrupted := make(chan struct{})
+	g.add("shutdown requests", exitFailure, func() error {
+		select {
+		case sig := <-term:
+			level.Info(logger).Log("msg", "Received signal, shutting down", "signal", sig)
+		case <-quit:
+			level.Info(logger).Log("msg", "Received termination request via web service, shutting down")
+		case <-service.stopRequests():
+			level.Info(logger).Log("msg", "Received stop request from the service manager, shutting down")
+		case <-interrupted:
+		}
+		return nil
+	}, func() error {
+		close(interrupted)
+		return nil
 	})
 
-	level.Info(logger).Log("msg", "Listening on "+*listenAddress)
-	level.Error(logger).Log("err", http.ListenAndServe(*listenAddress, nil))
-	os.Exit(1)
+	exitCode := g.run()
+	service.exited(exitCode)
+	os.Exit(exitCode)
 }
@@ -14,139 +14,110 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-kit/kit/log"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/statsd_exporter/pkg/mapper"
 	"github.com/stretchr/testify/assert"
-)
 
-type mockMapper struct {
-	labels  prometheus.Labels
-	present bool
-	name    string
-	action  mapper.ActionType
-}
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
 
-func (m *mockMapper) GetMapping(metricName string, metricType mapper.MetricType) (*mapper.MetricMapping, prometheus.Labels, bool) {
+func TestWriteFSM(t *testing.T) {
+	m := &graphitecollector.Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: servers.*.requests
+  name: requests
+`))
 
-	mapping := mapper.MetricMapping{Name: m.name, Action: m.action}
+	var out bytes.Buffer
+	assert.NoError(t, writeFSM(&m.MetricMapper, "dot", &out))
+	assert.True(t, strings.HasPrefix(out.String(), "digraph g {\n"))
+	assert.EqualError(t, writeFSM(&m.MetricMapper, "png", &out), `unknown FSM dump format "png"`)
 
-	return &mapping, m.labels, m.present
+	empty := &graphitecollector.Mapper{}
+	assert.EqualError(t, dumpFSM(&empty.MetricMapper, "-", "dot", log.NewNopLogger()), "the mapping config has no glob mappings")
 
+	if _, err := exec.LookPath("dot"); err != nil {
+		t.Skip("Graphviz dot is not installed")
+	}
+	out.Reset()
+	assert.NoError(t, writeFSM(&m.MetricMapper, "svg", &out))
+	assert.Contains(t, out.String(), "<svg")
 }
 
-func (m *mockMapper) InitFromFile(string) error {
-	return nil
-}
-
-func TestProcessLine(t *testing.T) {
-
-	type testCase struct {
-		line     string
-		name     string
-		labels   map[string]string
-		value    float64
-		present  bool
-		willFail bool
-		action   mapper.ActionType
-		strict   bool
+func TestBindWithRetry(t *testing.T) {
+	// The port is held by a previous instance, which releases it shortly.
+	held, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	testCases := []testCase{
-		{
-			line: "my.simple.metric 9001 1534620625",
-			name: "my_simple_metric",
-			labels: map[string]string{
-				"foo":  "bar",
-				"zip":  "zot",
-				"name": "alabel",
-			},
-			present: true,
-			value:   float64(9001),
-		},
-		{
-			line: "my.simple.metric.baz 9002 1534620625",
-			name: "my_simple_metric",
-			labels: map[string]string{
-				"baz": "bat",
-			},
-			present: true,
-			value:   float64(9002),
-		},
-		{
-			line:    "my.nomap.metric 9001 1534620625",
-			name:    "my_nomap_metric",
-			value:   float64(9001),
-			present: false,
-		},
-		{
-			line:     "my.nomap.metric.novalue 9001 ",
-			name:     "my_nomap_metric_novalue",
-			labels:   nil,
-			value:    float64(9001),
-			willFail: true,
-		},
-		{
-			line:     "my.mapped.metric.drop 55 1534620625",
-			name:     "my_mapped_metric_drop",
-			present:  true,
-			willFail: true,
-			action:   mapper.ActionTypeDrop,
-		},
-		{
-			line:     "my.mapped.strict.metric 55 1534620625",
-			name:     "my_mapped_strict_metric",
-			value:    float64(55),
-			present:  true,
-			willFail: false,
-			strict:   true,
-		},
-		{
-			line:     "my.mapped.strict.metric.drop 55 1534620625",
-			name:     "my_mapped_strict_metric_drop",
-			present:  false,
-			willFail: true,
-			strict:   true,
-		},
+	address := held.Addr().String()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		held.Close()
+	}()
+	var l net.Listener
+	err = bindWithRetry("tcp", 10, 10*time.Millisecond, nil, log.NewNopLogger(), func() (err error) {
+		l, err = net.Listen("tcp", address)
+		return err
+	})
+	if assert.NoError(t, err) {
+		l.Close()
 	}
 
-	c := newGraphiteCollector(log.NewNopLogger())
-
-	for _, testCase := range testCases {
-
-		if testCase.present {
-			c.mapper = &mockMapper{
-				name:    testCase.name,
-				labels:  testCase.labels,
-				action:  testCase.action,
-				present: testCase.present,
-			}
-		} else {
-			c.mapper = &mockMapper{
-				present: testCase.present,
-			}
-		}
-
-		c.strictMatch = testCase.strict
-		c.processLine(testCase.line)
+	attempts := 0
+	err = bindWithRetry("udp", 2, time.Millisecond, nil, log.NewNopLogger(), func() error {
+		attempts++
+		return errors.New("address already in use")
+	})
+	assert.EqualError(t, err, "address already in use")
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	assert.Error(t, bindWithRetry("udp", 0, time.Second, nil, log.NewNopLogger(), func() error {
+		attempts++
+		return errors.New("address already in use")
+	}))
+	assert.Equal(t, 1, attempts, "no retries by default")
+
+	// Retries end on shutdown.
+	done := make(chan struct{})
+	close(done)
+	attempts = 0
+	assert.Error(t, bindWithRetry("udp", 5, time.Hour, done, log.NewNopLogger(), func() error {
+		attempts++
+		return errors.New("address already in use")
+	}))
+	assert.Equal(t, 1, attempts)
+}
 
+func TestGoMemLimit(t *testing.T) {
+	defer os.Setenv("GOMEMLIMIT", os.Getenv("GOMEMLIMIT"))
+	for value, want := range map[string]uint64{
+		"":        0,
+		"off":     0,
+		"1000":    1000,
+		"512B":    512,
+		"2KiB":    2 << 10,
+		"100MiB":  100 << 20,
+		"4GiB":    4 << 30,
+		"1TiB":    1 << 40,
+		"1.5GiB":  0,
+		"-1MiB":   0,
+		"9999TiB": 9999 << 40,
+	} {
+		os.Setenv("GOMEMLIMIT", value)
+		assert.Equal(t, want, goMemLimit(), value)
 	}
 
-	c.sampleCh <- nil
-	for _, k := range testCases {
-		originalName := strings.Split(k.line, " ")[0]
-		sample := c.samples[originalName]
-		if k.willFail {
-			assert.Nil(t, sample, "Found %s", k.name)
-		} else {
-			if assert.NotNil(t, sample, "Missing %s", k.name) {
-				assert.Equal(t, k.name, sample.Name)
-				assert.Equal(t, k.labels, sample.Labels)
-				assert.Equal(t, k.value, sample.Value)
-			}
-		}
-	}
+	os.Setenv("GOMEMLIMIT", "1000MiB")
+	assert.Equal(t, uint64(900<<20), memorySoftLimitFromFlags())
 }
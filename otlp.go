@@ -0,0 +1,390 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	promconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/common/version"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+func init() {
+	graphitecollector.RegisterFeature("otlp")
+}
+
+var (
+	otlpSentPoints = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "graphite_otlp_sent_points_total",
+			Help: "Number of data points accepted by the OTLP receiver.",
+		},
+	)
+	otlpDroppedPoints = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "graphite_otlp_dropped_points_total",
+			Help: "Number of data points given up on after failed OTLP exports.",
+		},
+	)
+	otlpFailedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "graphite_otlp_failed_requests_total",
+			Help: "Number of failed OTLP export requests, by gRPC status code.",
+		},
+		[]string{"code"},
+	)
+	otlpConnectionState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "graphite_otlp_connection_state",
+			Help: "State of the connection to the OTLP receiver, 1 for the current state.",
+		},
+		[]string{"state"},
+	)
+	otlpConnFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "graphite_otlp_connection_failures_total",
+			Help: "Number of failed connections to the OTLP receiver, by the stage that failed.",
+		},
+		[]string{"stage"},
+	)
+)
+
+const (
+	otlpInitialBackoff = 100 * time.Millisecond
+	otlpMaxBackoff     = 5 * time.Second
+)
+
+// otlpConfig configures the OTLP exporter.
+type otlpConfig struct {
+	Endpoint  string
+	Headers   map[string]string
+	Insecure  bool
+	TLSConfig promconfig.TLSConfig
+	Auth      otlpAuth
+	Interval  time.Duration
+	Timeout   time.Duration
+	BatchSize int
+	// Compression is "none" or "gzip".
+	Compression string
+}
+
+// otlpAuth sends basic auth or bearer token credentials with every request.
+// The files are read for each request, so that rotated credentials are picked
+// up without a restart.
+type otlpAuth struct {
+	BearerTokenFile string
+	Username        string
+	PasswordFile    string
+}
+
+func (a otlpAuth) enabled() bool {
+	return a.BearerTokenFile != "" || a.Username != ""
+}
+
+// GetRequestMetadata implements credentials.PerRPCCredentials.
+func (a otlpAuth) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	if a.BearerTokenFile != "" {
+		token, err := ioutil.ReadFile(a.BearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading bearer token: %v", err)
+		}
+		return map[string]string{"authorization": "Bearer " + strings.TrimSpace(string(token))}, nil
+	}
+	var password []byte
+	if a.PasswordFile != "" {
+		var err error
+		if password, err = ioutil.ReadFile(a.PasswordFile); err != nil {
+			return nil, fmt.Errorf("reading basic auth password: %v", err)
+		}
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(a.Username + ":" + strings.TrimSpace(string(password))))
+	return map[string]string{"authorization": "Basic " + encoded}, nil
+}
+
+// RequireTransportSecurity implements credentials.PerRPCCredentials. The
+// credentials may be sent without TLS to a receiver on a trusted network.
+func (a otlpAuth) RequireTransportSecurity() bool {
+	return false
+}
+
+// otlpCredentials counts the failed TLS handshakes with the OTLP receiver.
+type otlpCredentials struct {
+	credentials.TransportCredentials
+}
+
+func (c otlpCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, info, err := c.TransportCredentials.ClientHandshake(ctx, authority, conn)
+	if err != nil {
+		otlpConnFailures.WithLabelValues("tls_handshake").Inc()
+	}
+	return conn, info, err
+}
+
+func (c otlpCredentials) Clone() credentials.TransportCredentials {
+	return otlpCredentials{c.TransportCredentials.Clone()}
+}
+
+// otlpDial connects to the OTLP receiver, counting failures.
+func otlpDial(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	if err != nil {
+		otlpConnFailures.WithLabelValues("dial").Inc()
+	}
+	return conn, err
+}
+
+// otlpExporter periodically pushes the stored samples to an OTLP/gRPC
+// receiver, each as a gauge data point. It only reads the sample store, so a
+// slow or unavailable receiver never delays scrapes.
+type otlpExporter struct {
+	cfg     otlpConfig
+	conn    *grpc.ClientConn
+	client  collectorpb.MetricsServiceClient
+	samples func(now time.Time) []*graphitecollector.Sample
+	logger  log.Logger
+	done    chan struct{}
+	stopped chan struct{}
+	// stopWatch stops watching the connection state.
+	stopWatch context.CancelFunc
+}
+
+// newOTLPExporter returns an exporter pushing the samples returned by samples,
+// such as a collector's CurrentSamples.
+func newOTLPExporter(samples func(now time.Time) []*graphitecollector.Sample, cfg otlpConfig, logger log.Logger) (*otlpExporter, error) {
+	opts := []grpc.DialOption{grpc.WithInsecure(), grpc.WithContextDialer(otlpDial)}
+	if !cfg.Insecure {
+		tlsConfig, err := promconfig.NewTLSConfig(&cfg.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		opts[0] = grpc.WithTransportCredentials(otlpCredentials{credentials.NewTLS(tlsConfig)})
+	}
+	if cfg.Auth.enabled() {
+		opts = append(opts, grpc.WithPerRPCCredentials(cfg.Auth))
+	}
+	if cfg.Compression == "gzip" {
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)))
+	}
+	conn, err := grpc.Dial(cfg.Endpoint, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &otlpExporter{
+		cfg:       cfg,
+		conn:      conn,
+		client:    collectorpb.NewMetricsServiceClient(conn),
+		samples:   samples,
+		logger:    logger,
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+		stopWatch: cancel,
+	}
+	go e.watchState(ctx)
+	return e, nil
+}
+
+// watchState tracks the state of the connection in otlpConnectionState until
+// ctx is done or the connection is closed.
+func (e *otlpExporter) watchState(ctx context.Context) {
+	for {
+		state := e.conn.GetState()
+		for _, s := range []connectivity.State{connectivity.Idle, connectivity.Connecting, connectivity.Ready, connectivity.TransientFailure, connectivity.Shutdown} {
+			v := 0.0
+			if s == state {
+				v = 1
+			}
+			otlpConnectionState.WithLabelValues(s.String()).Set(v)
+		}
+		if state == connectivity.Shutdown || !e.conn.WaitForStateChange(ctx, state) {
+			return
+		}
+	}
+}
+
+// run exports the stored samples every interval until stop is called.
+func (e *otlpExporter) run() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(e.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.export(time.Now())
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// stop ends the export loop and closes the connection.
+func (e *otlpExporter) stop() {
+	close(e.done)
+	<-e.stopped
+	e.stopWatch()
+	e.conn.Close()
+}
+
+// export sends every current sample in batches. A failed batch is retried
+// with backoff until the next export is due.
+func (e *otlpExporter) export(now time.Time) {
+	deadline := now.Add(e.cfg.Interval)
+	for _, req := range otlpRequests(e.samples(now), e.cfg.BatchSize) {
+		points := otlpPointCount(req)
+		if err := e.send(req, deadline); err != nil {
+			level.Warn(e.logger).Log("msg", "Dropping OTLP export", "points", points, "err", err)
+			otlpDroppedPoints.Add(float64(points))
+			continue
+		}
+		otlpSentPoints.Add(float64(points))
+	}
+}
+
+func (e *otlpExporter) send(req *collectorpb.ExportMetricsServiceRequest, deadline time.Time) error {
+	backoff := otlpInitialBackoff
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), e.cfg.Timeout)
+		if len(e.cfg.Headers) > 0 {
+			ctx = metadata.NewOutgoingContext(ctx, metadata.New(e.cfg.Headers))
+		}
+		_, err := e.client.Export(ctx, req)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		code := status.Code(err)
+		otlpFailedRequests.WithLabelValues(code.String()).Inc()
+		if !otlpRetryable(code) || time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		level.Debug(e.logger).Log("msg", "Retrying OTLP export", "backoff", backoff, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-e.done:
+			return err
+		}
+		if backoff *= 2; backoff > otlpMaxBackoff {
+			backoff = otlpMaxBackoff
+		}
+	}
+}
+
+// otlpRetryable reports whether an export failing with code may succeed when
+// retried, following the OTLP specification.
+func otlpRetryable(code codes.Code) bool {
+	switch code {
+	case codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted,
+		codes.Aborted, codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+		return true
+	}
+	return false
+}
+
+// otlpRequests converts samples into export requests of at most batchSize
+// data points each. Samples of the same name in a request share a metric.
+func otlpRequests(samples []*graphitecollector.Sample, batchSize int) []*collectorpb.ExportMetricsServiceRequest {
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].Name != samples[j].Name {
+			return samples[i].Name < samples[j].Name
+		}
+		return samples[i].OriginalName < samples[j].OriginalName
+	})
+
+	var reqs []*collectorpb.ExportMetricsServiceRequest
+	for start := 0; start < len(samples); start += batchSize {
+		end := start + batchSize
+		if end > len(samples) {
+			end = len(samples)
+		}
+		var metrics []*metricspb.Metric
+		var gauge *metricspb.Gauge
+		for i, s := range samples[start:end] {
+			if i == 0 || s.Name != samples[start+i-1].Name {
+				gauge = &metricspb.Gauge{}
+				metrics = append(metrics, &metricspb.Metric{
+					Name:        s.Name,
+					Description: s.HelpText(),
+					Data:        &metricspb.Metric_Gauge{Gauge: gauge},
+				})
+			}
+			gauge.DataPoints = append(gauge.DataPoints, &metricspb.NumberDataPoint{
+				Attributes:   otlpAttributes(s.Labels),
+				TimeUnixNano: uint64(s.Timestamp.UnixNano()),
+				Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: s.Value},
+			})
+		}
+		reqs = append(reqs, &collectorpb.ExportMetricsServiceRequest{
+			ResourceMetrics: []*metricspb.ResourceMetrics{{
+				Resource: &resourcepb.Resource{
+					Attributes: otlpAttributes(map[string]string{"service.name": "graphite_exporter"}),
+				},
+				InstrumentationLibraryMetrics: []*metricspb.InstrumentationLibraryMetrics{{
+					InstrumentationLibrary: &commonpb.InstrumentationLibrary{
+						Name:    "graphite_exporter",
+						Version: version.Version,
+					},
+					Metrics: metrics,
+				}},
+			}},
+		})
+	}
+	return reqs
+}
+
+func otlpAttributes(labels map[string]string) []*commonpb.KeyValue {
+	attrs := make([]*commonpb.KeyValue, 0, len(labels))
+	for k, v := range labels {
+		attrs = append(attrs, &commonpb.KeyValue{
+			Key:   k,
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}},
+		})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+	return attrs
+}
+
+func otlpPointCount(req *collectorpb.ExportMetricsServiceRequest) int {
+	n := 0
+	for _, rm := range req.ResourceMetrics {
+		for _, ilm := range rm.InstrumentationLibraryMetrics {
+			for _, m := range ilm.Metrics {
+				n += len(m.GetGauge().GetDataPoints())
+			}
+		}
+	}
+	return n
+}
@@ -0,0 +1,223 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+// otlpReceiver fails the first failures requests and records the others.
+type otlpReceiver struct {
+	collectorpb.UnimplementedMetricsServiceServer
+
+	mu       sync.Mutex
+	failures int
+	headers  []string
+	auth     []string
+	requests []*collectorpb.ExportMetricsServiceRequest
+}
+
+func (r *otlpReceiver) Export(ctx context.Context, req *collectorpb.ExportMetricsServiceRequest) (*collectorpb.ExportMetricsServiceResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failures > 0 {
+		r.failures--
+		return nil, status.Error(codes.Unavailable, "try again")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	r.headers = append(r.headers, md.Get("x-scope-orgid")...)
+	r.auth = append(r.auth, md.Get("authorization")...)
+	r.requests = append(r.requests, req)
+	return &collectorpb.ExportMetricsServiceResponse{}, nil
+}
+
+func TestOTLPExport(t *testing.T) {
+	defer func(d time.Duration) { *sampleExpiry = d }(*sampleExpiry)
+	*sampleExpiry = 5 * time.Minute
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := &otlpReceiver{failures: 1}
+	server := grpc.NewServer()
+	collectorpb.RegisterMetricsServiceServer(server, receiver)
+	go server.Serve(l)
+	defer server.Stop()
+
+	now := time.Now()
+	samples := func(time.Time) []*graphitecollector.Sample {
+		return []*graphitecollector.Sample{
+			{OriginalName: "b", Name: "b", Value: 3, Type: prometheus.CounterValue, Timestamp: now},
+			{OriginalName: "a.web2", Name: "a", Labels: map[string]string{"host": "web2"}, Value: 2, Type: prometheus.GaugeValue, Timestamp: now},
+			{OriginalName: "a.web1", Name: "a", Labels: map[string]string{"host": "web1"}, Value: 1, Type: prometheus.GaugeValue, Timestamp: now},
+		}
+	}
+
+	e, err := newOTLPExporter(samples, otlpConfig{
+		Endpoint:  l.Addr().String(),
+		Headers:   map[string]string{"X-Scope-OrgID": "tenant"},
+		Insecure:  true,
+		Interval:  time.Minute,
+		Timeout:   time.Second,
+		BatchSize: 2,
+	}, log.NewNopLogger())
+	assert.NoError(t, err)
+	defer e.conn.Close()
+
+	sentBefore := testutil.ToFloat64(otlpSentPoints)
+	failedBefore := testutil.ToFloat64(otlpFailedRequests.WithLabelValues("Unavailable"))
+	e.export(now)
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(otlpSentPoints)-sentBefore)
+	assert.Equal(t, 1.0, testutil.ToFloat64(otlpFailedRequests.WithLabelValues("Unavailable"))-failedBefore)
+	assert.Equal(t, []string{"tenant", "tenant"}, receiver.headers)
+	assert.Len(t, receiver.requests, 2, "three points in batches of two")
+
+	metrics := receiver.requests[0].ResourceMetrics[0].InstrumentationLibraryMetrics[0].Metrics
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, "a", metrics[0].Name)
+	points := metrics[0].GetGauge().DataPoints
+	assert.Len(t, points, 2)
+	assert.Equal(t, "host", points[0].Attributes[0].Key)
+	assert.Equal(t, "web1", points[0].Attributes[0].Value.GetStringValue())
+	assert.Equal(t, 1.0, points[0].GetAsDouble())
+	assert.Equal(t, uint64(now.UnixNano()), points[0].TimeUnixNano)
+}
+
+// compressionRecorder records the compression of the requests received by a
+// gRPC server.
+type compressionRecorder struct {
+	mu          sync.Mutex
+	compression []string
+}
+
+func (r *compressionRecorder) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (r *compressionRecorder) HandleRPC(_ context.Context, s stats.RPCStats) {
+	if h, ok := s.(*stats.InHeader); ok {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.compression = append(r.compression, h.Compression)
+	}
+}
+
+func (r *compressionRecorder) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (r *compressionRecorder) HandleConn(context.Context, stats.ConnStats) {}
+
+func TestOTLPAuthCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graphite_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := &otlpReceiver{}
+	recorder := &compressionRecorder{}
+	server := grpc.NewServer(grpc.StatsHandler(recorder))
+	collectorpb.RegisterMetricsServiceServer(server, receiver)
+	go server.Serve(l)
+	defer server.Stop()
+
+	now := time.Now()
+	samples := func(time.Time) []*graphitecollector.Sample {
+		return []*graphitecollector.Sample{{OriginalName: "a", Name: "a", Value: 1, Type: prometheus.GaugeValue, Timestamp: now}}
+	}
+	cfg := otlpConfig{
+		Endpoint:    l.Addr().String(),
+		Insecure:    true,
+		Auth:        otlpAuth{BearerTokenFile: tokenFile},
+		Interval:    time.Minute,
+		Timeout:     time.Second,
+		BatchSize:   10,
+		Compression: "gzip",
+	}
+	e, err := newOTLPExporter(samples, cfg, log.NewNopLogger())
+	assert.NoError(t, err)
+	e.export(now)
+	e.conn.Close()
+
+	cfg.Auth = otlpAuth{Username: "user"}
+	cfg.Compression = "none"
+	e, err = newOTLPExporter(samples, cfg, log.NewNopLogger())
+	assert.NoError(t, err)
+	e.export(now)
+	e.conn.Close()
+
+	assert.Equal(t, []string{"Bearer secret", "Basic dXNlcjo="}, receiver.auth)
+	assert.Equal(t, []string{"gzip", ""}, recorder.compression)
+}
+
+func TestOTLPConnectionFailures(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	collectorpb.RegisterMetricsServiceServer(server, &otlpReceiver{})
+	go server.Serve(l)
+	defer server.Stop()
+
+	// The receiver does not use TLS, so the handshake fails.
+	now := time.Now()
+	samples := func(time.Time) []*graphitecollector.Sample {
+		return []*graphitecollector.Sample{{OriginalName: "a", Name: "a", Value: 1, Type: prometheus.GaugeValue, Timestamp: now}}
+	}
+	handshakeFailures := testutil.ToFloat64(otlpConnFailures.WithLabelValues("tls_handshake"))
+	e, err := newOTLPExporter(samples, otlpConfig{
+		Endpoint:  l.Addr().String(),
+		Interval:  100 * time.Millisecond,
+		Timeout:   100 * time.Millisecond,
+		BatchSize: 10,
+	}, log.NewNopLogger())
+	assert.NoError(t, err)
+	defer e.conn.Close()
+	e.export(now)
+
+	assert.Less(t, handshakeFailures, testutil.ToFloat64(otlpConnFailures.WithLabelValues("tls_handshake")))
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(otlpConnectionState.WithLabelValues("TRANSIENT_FAILURE")) == 1
+	}, 5*time.Second, time.Millisecond)
+}
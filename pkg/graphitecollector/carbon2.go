@@ -0,0 +1,137 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+func init() {
+	RegisterFeature("carbon2")
+}
+
+var invalidLabelChars = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// carbon2Line is a line in the carbon2 format of metrics 2.0:
+//
+//	metric=cpu_idle host=web-1 mtype=gauge  team=ops 97.5 1534620625
+//
+// The intrinsic tags identify the series. They are separated from the
+// optional meta tags by two spaces.
+type carbon2Line struct {
+	Intrinsic map[string]string
+	Meta      map[string]string
+	Value     string
+	Timestamp string
+}
+
+// isCarbon2 reports whether line looks like a carbon2 line rather than a
+// plaintext one, whose first field is a metric path without "=".
+func isCarbon2(line string) bool {
+	i := strings.IndexByte(line, ' ')
+	return i > 0 && strings.Contains(line[:i], "=")
+}
+
+func parseCarbon2(line string) (carbon2Line, error) {
+	l := carbon2Line{}
+	i := strings.LastIndexByte(line, ' ')
+	if i < 0 {
+		return l, fmt.Errorf("missing value and timestamp")
+	}
+	rest, timestamp := strings.TrimRight(line[:i], " "), line[i+1:]
+	i = strings.LastIndexByte(rest, ' ')
+	if i < 0 {
+		return l, fmt.Errorf("missing value")
+	}
+	tags, value := strings.TrimRight(rest[:i], " "), rest[i+1:]
+	l.Value, l.Timestamp = value, timestamp
+
+	intrinsic, meta := tags, ""
+	if i := strings.Index(tags, "  "); i >= 0 {
+		intrinsic, meta = tags[:i], tags[i+2:]
+	}
+	var err error
+	if l.Intrinsic, err = parseCarbon2Tags(intrinsic); err != nil {
+		return l, err
+	}
+	if l.Meta, err = parseCarbon2Tags(meta); err != nil {
+		return l, err
+	}
+	if l.name() == "" {
+		return l, fmt.Errorf("missing metric tag")
+	}
+	return l, nil
+}
+
+func parseCarbon2Tags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, tag := range strings.Fields(s) {
+		i := strings.IndexByte(tag, '=')
+		if i <= 0 || i == len(tag)-1 {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		tags[tag[:i]] = tag[i+1:]
+	}
+	return tags, nil
+}
+
+// name returns the metric name, given by the metric tag, or by the what tag
+// of the original metrics 2.0 specification.
+func (l carbon2Line) name() string {
+	if name := l.Intrinsic["metric"]; name != "" {
+		return name
+	}
+	return l.Intrinsic["what"]
+}
+
+// originalName identifies the series of the line in the sample store. It has
+// the form of a tagged graphite path, with the tags sorted.
+func (l carbon2Line) originalName() string {
+	tags := make([]string, 0, len(l.Intrinsic))
+	for k, v := range l.Intrinsic {
+		tags = append(tags, k+"="+v)
+	}
+	sort.Strings(tags)
+	return l.name() + ";" + strings.Join(tags, ";")
+}
+
+// hints returns the type and unit given by the mtype and unit tags. Only
+// mtype=counter is a Prometheus counter; count, rate and the other types are
+// exported as gauges.
+func (l carbon2Line) hints() metricHints {
+	h := metricHints{Unit: l.Intrinsic["unit"]}
+	if l.Intrinsic["mtype"] == "counter" {
+		h.Type = MetricTypeCounter
+	}
+	return h
+}
+
+// mapCarbon2 maps the metric name of a carbon2 line like a plaintext path,
+// and adds the other intrinsic tags as labels. Labels set by the mapping take
+// precedence.
+func mapCarbon2(m MetricMapper, l carbon2Line, s MapSettings) (MappedMetric, bool) {
+	h := l.hints()
+	h.Tags = make(map[string]string, len(l.Intrinsic))
+	for k, v := range l.Intrinsic {
+		switch k {
+		case "metric", "what", "mtype", "unit":
+			continue
+		}
+		h.Tags[invalidLabelChars.ReplaceAllString(k, "_")] = v
+	}
+	return mapMetricWithHints(m, l.name(), h, s)
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCarbon2(t *testing.T) {
+	for _, tc := range []struct {
+		line    string
+		want    carbon2Line
+		wantErr bool
+	}{
+		{
+			line: "metric=cpu_idle host=web-1  team=ops 97.5 1534620625",
+			want: carbon2Line{
+				Intrinsic: map[string]string{"metric": "cpu_idle", "host": "web-1"},
+				Meta:      map[string]string{"team": "ops"},
+				Value:     "97.5",
+				Timestamp: "1534620625",
+			},
+		},
+		{
+			line: "what=cpu_idle host=web-1 97.5 1534620625",
+			want: carbon2Line{
+				Intrinsic: map[string]string{"what": "cpu_idle", "host": "web-1"},
+				Meta:      map[string]string{},
+				Value:     "97.5",
+				Timestamp: "1534620625",
+			},
+		},
+		{line: "host=web-1 97.5 1534620625", wantErr: true},
+		{line: "metric=cpu_idle host= 97.5 1534620625", wantErr: true},
+		{line: "metric=cpu_idle 97.5", wantErr: true},
+		{line: "my.path;tag=value 97.5 1534620625", wantErr: true},
+	} {
+		got, err := parseCarbon2(tc.line)
+		if tc.wantErr {
+			assert.Error(t, err, tc.line)
+			continue
+		}
+		assert.NoError(t, err, tc.line)
+		assert.Equal(t, tc.want, got, tc.line)
+	}
+}
+
+func TestMapCarbon2(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+unit_suffixes:
+- suffix: ms
+  unit: seconds
+  scale: 0.001
+mappings:
+- match: app.*.latency
+  name: app_latency
+  normalize_name: true
+  labels:
+    app: $1
+`))
+
+	l, err := parseCarbon2("metric=app.web.latency app=other host=web-1 unit=ms mtype=counter 250 1534620625")
+	assert.NoError(t, err)
+	got, ok := mapCarbon2(m, l, MapSettings{})
+	assert.True(t, ok)
+	assert.Equal(t, "app_latency_seconds_total", got.Name)
+	assert.Equal(t, prometheus.CounterValue, got.Type)
+	assert.Equal(t, 0.001, got.Scale)
+	assert.Equal(t, map[string]string{"app": "web", "host": "web-1"}, got.Labels, "mapping labels take precedence over tags")
+
+	l, err = parseCarbon2("metric=disk.free host-name=web-1 unit=B 100 1534620625")
+	assert.NoError(t, err)
+	got, ok = mapCarbon2(m, l, MapSettings{})
+	assert.True(t, ok)
+	assert.Equal(t, "disk_free", got.Name)
+	assert.Equal(t, prometheus.GaugeValue, got.Type)
+	assert.Equal(t, map[string]string{"host_name": "web-1", "unit": "B"}, got.Labels)
+
+	_, ok = mapCarbon2(m, l, MapSettings{StrictMatch: true})
+	assert.False(t, ok)
+}
+
+func TestProcessCarbon2Line(t *testing.T) {
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.SetMapper(&mockMapper{})
+	c.carbon2 = true
+	c.Run(context.Background())
+	defer c.Stop()
+
+	c.processLine("metric=cpu_idle host=web-1  team=ops 97.5 1534620625", LineSource{})
+	c.processLine("metric=cpu_idle host=web-2 95 1534620625", LineSource{})
+	// Lines that are not carbon2 are parsed as plaintext.
+	c.processLine("my.path;tag=value 1 1534620625", LineSource{})
+	// The sample store handles one request at a time, so the samples have
+	// been stored once a removal is accepted.
+	c.removeCh <- ""
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if assert.Contains(t, c.samples, "cpu_idle;host=web-1;metric=cpu_idle") {
+		s := c.samples["cpu_idle;host=web-1;metric=cpu_idle"]
+		assert.Equal(t, "cpu_idle", s.Name)
+		assert.Equal(t, map[string]string{"host": "web-1"}, s.Labels)
+		assert.Equal(t, 97.5, s.Value)
+	}
+	assert.Contains(t, c.samples, "cpu_idle;host=web-2;metric=cpu_idle")
+	assert.Contains(t, c.samples, "my.path;tag=value")
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Clock tells the current time, by which samples expire.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// replayClock is the newest timestamp observed, so that samples of a
+// replayed capture expire relative to each other rather than to the wall
+// clock. It is the zero time until a timestamp is observed.
+type replayClock struct {
+	// newest is in Unix nanoseconds. It must be accessed atomically.
+	newest int64
+}
+
+func (c *replayClock) Now() time.Time {
+	newest := atomic.LoadInt64(&c.newest)
+	if newest == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, newest)
+}
+
+func (c *replayClock) observe(t time.Time) {
+	ts := t.UnixNano()
+	for {
+		newest := atomic.LoadInt64(&c.newest)
+		if ts <= newest || atomic.CompareAndSwapInt64(&c.newest, newest, ts) {
+			return
+		}
+	}
+}
+
+// Now returns the current time of the collector's clock.
+func (c *Collector) Now() time.Time {
+	return c.clock.Now()
+}
@@ -0,0 +1,172 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// manualClock is a clock that only moves when advanced.
+type manualClock struct {
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	return c.now
+}
+
+func currentPaths(c *Collector) []string {
+	var paths []string
+	for _, s := range c.CurrentSamples(c.Now()) {
+		paths = append(paths, s.OriginalName)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// exportedSamples returns the names of the ingested metrics that c exports.
+func exportedSamples(t *testing.T, c *Collector) []string {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	assert.NoError(t, err)
+	var names []string
+	for _, f := range families {
+		if strings.HasPrefix(f.GetHelp(), "Graphite metric ") {
+			names = append(names, f.GetName())
+		}
+	}
+	return names
+}
+
+func TestClock(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	c := NewCollector(Options{Logger: log.NewNopLogger(), Clock: clock, SampleExpiry: time.Minute})
+	c.Run(context.Background())
+	defer c.Stop()
+	c.processLine("a.metric 1 990", LineSource{})
+	c.processLine("b.metric 1 1030", LineSource{})
+	c.removeCh <- ""
+
+	assert.Equal(t, []string{"a.metric", "b.metric"}, currentPaths(c))
+	assert.Equal(t, []string{"a_metric", "b_metric"}, exportedSamples(t, c))
+
+	clock.now = time.Unix(1060, 0)
+	assert.Equal(t, []string{"b.metric"}, currentPaths(c))
+	assert.Equal(t, []string{"b_metric"}, exportedSamples(t, c))
+	c.expireSamples(c.Now())
+	assert.Equal(t, 1, c.SampleCount())
+}
+
+func TestExpireOnCollect(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	c := NewCollector(Options{Logger: log.NewNopLogger(), Clock: clock, SampleExpiry: time.Minute, ExpireOnCollect: true})
+	c.Run(context.Background())
+	defer c.Stop()
+	c.processLine("a.metric 1 990", LineSource{})
+	c.processLine("b.metric 1 1030", LineSource{})
+	c.removeCh <- ""
+
+	clock.now = time.Unix(1060, 0)
+	expirations := testutil.ToFloat64(collectExpirations)
+	assert.Equal(t, []string{"b_metric"}, exportedSamples(t, c))
+	assert.Eventually(t, func() bool {
+		return c.SampleCount() == 1
+	}, 5*time.Second, time.Millisecond, "the scrape removes the expired sample before any sweep")
+	assert.Equal(t, expirations+1, testutil.ToFloat64(collectExpirations))
+}
+
+func TestExpireOnCollectReinserted(t *testing.T) {
+	// The collector is not running, so the test stores samples and handles
+	// the expired names as the goroutine owning the sample store would.
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	c := NewCollector(Options{Logger: log.NewNopLogger(), Clock: clock, SampleExpiry: time.Minute, ExpireOnCollect: true})
+	store := func(line string) {
+		assert.NoError(t, c.storeSample(c.ingestLine(line, LineSource{}, c.Mapper()).sample))
+	}
+	store("a.metric 1 990")
+	store("b.metric 1 990")
+	clock.now = time.Unix(1060, 0)
+	assert.Empty(t, exportedSamples(t, c))
+
+	// A new sample for a.metric is stored before the names found expired
+	// by the scrape are handled, and is kept.
+	store("a.metric 2 1055")
+	c.expireNamed(<-c.expireCh, clock.Now())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	assert.Len(t, c.samples, 1)
+	if assert.Contains(t, c.samples, "a.metric") {
+		assert.Equal(t, 2.0, c.samples["a.metric"].Value)
+	}
+}
+
+func TestReplayMode(t *testing.T) {
+	c := NewCollector(Options{Logger: log.NewNopLogger(), ReplayMode: true, SampleExpiry: time.Minute})
+	assert.True(t, c.Now().IsZero())
+	c.Run(context.Background())
+	defer c.Stop()
+
+	// Samples from long ago are current while they are the newest ones.
+	c.processLine("a.metric 1 1000", LineSource{})
+	c.processLine("b.metric 1 1050", LineSource{})
+	c.removeCh <- ""
+	assert.Equal(t, time.Unix(1050, 0), c.Now())
+	assert.Equal(t, []string{"a.metric", "b.metric"}, currentPaths(c))
+
+	// An older sample does not move the clock back.
+	c.processLine("c.metric 1 1010", LineSource{})
+	c.processLine("d.metric 1 1065", LineSource{})
+	c.removeCh <- ""
+	assert.Equal(t, time.Unix(1065, 0), c.Now())
+	assert.Equal(t, []string{"b.metric", "c.metric", "d.metric"}, currentPaths(c))
+}
+
+func TestBackfill(t *testing.T) {
+	c := NewCollector(Options{Logger: log.NewNopLogger(), Backfill: true, ReplayMode: true, Tombstones: true, SampleExpiry: time.Minute})
+	assert.Nil(t, c.replay)
+	assert.Nil(t, c.tombstones)
+	c.Run(context.Background())
+	defer c.Stop()
+
+	// Samples from long ago are neither expired nor swept.
+	c.processLine("a.metric 1 1000", LineSource{})
+	c.processLine("b.metric 2 1050", LineSource{})
+	c.removeCh <- ""
+	assert.Equal(t, []string{"a.metric", "b.metric"}, currentPaths(c))
+	c.expireSamples(c.Now())
+	assert.Equal(t, 2, c.SampleCount())
+
+	// They are exported with their own timestamps.
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	assert.NoError(t, err)
+	timestamps := map[string]int64{}
+	for _, f := range families {
+		if strings.HasPrefix(f.GetHelp(), "Graphite metric ") {
+			timestamps[f.GetName()] = f.GetMetric()[0].GetTimestampMs()
+		}
+	}
+	assert.Equal(t, map[string]int64{"a_metric": 1000000, "b_metric": 1050000}, timestamps)
+}
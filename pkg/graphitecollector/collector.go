@@ -0,0 +1,2450 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package graphitecollector implements the collector of the graphite
+// exporter: it accepts lines in the graphite plaintext protocol, maps their
+// paths to Prometheus metrics, and exports the most recent sample of each
+// metric. It can be embedded in other programs to accept graphite input
+// without running the exporter binary.
+package graphitecollector
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+var (
+	lastProcessed = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "graphite_last_processed_timestamp_seconds",
+			Help: "Unix timestamp of the last processed graphite metric.",
+		},
+	)
+	sampleExpiryDesc = prometheus.NewDesc(
+		"graphite_sample_expiry_seconds",
+		"How long in seconds a metric sample is valid for.",
+		nil, nil,
+	)
+	storedSamplesDesc = prometheus.NewDesc(
+		"graphite_stored_samples",
+		"Number of samples in the store, one per graphite path.",
+		nil, nil,
+	)
+	collectExpirations = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "graphite_collect_expired_samples_total",
+			Help: "Total number of expired samples removed from the store after a scrape found them, before the next expiry sweep.",
+		},
+	)
+	seriesCreated = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "graphite_series_created_total",
+			Help: "Total count of samples stored for a graphite path without a stored sample, including paths whose sample expired before.",
+		},
+	)
+	sampleUpdates = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "graphite_sample_updates_total",
+			Help: "Total count of samples replacing the stored sample of their graphite path.",
+		},
+	)
+	expiryOverridesDesc = prometheus.NewDesc(
+		"graphite_sample_expiry_overrides",
+		"Number of stored samples whose expiry is set by their mapping, an expiry override or the storage schemas instead of the sample expiry.",
+		nil, nil,
+	)
+	invalidSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "graphite_invalid_samples_total",
+			Help: "Total count of samples that were not stored because they were invalid.",
+		},
+		[]string{"reason"},
+	)
+	collectSkippedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "graphite_collect_skipped_samples_total",
+			Help: "Total count of stored samples left out of scrapes because they conflicted with another sample or could not be exported, by reason. Each sample is counted once, however many scrapes leave it out.",
+		},
+		[]string{"reason"},
+	)
+	invalidLines = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "graphite_invalid_lines_total",
+			Help: "Total count of lines that could not be parsed, by reason and the protocol they were received over.",
+		},
+		[]string{"reason", "protocol"},
+	)
+	lineProcessingDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "graphite_line_processing_duration_seconds",
+			Help:    "Time spent parsing and mapping a single graphite line.",
+			Buckets: []float64{1e-6, 5e-6, 1e-5, 5e-5, 1e-4, 5e-4, 1e-3, 5e-3, 1e-2},
+		},
+	)
+	prefixedNames = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "graphite_prefixed_names_total",
+			Help: "Total count of samples whose sanitized name was not a valid metric name and was prefixed.",
+		},
+	)
+	sanitizedNames = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "graphite_names_sanitized_total",
+			Help: "Total count of samples whose metric name had invalid characters replaced.",
+		},
+	)
+	valueCoercions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "graphite_value_coercions_total",
+			Help: "Total count of values that were not numbers and were replaced by the number configured for them.",
+		},
+		[]string{"value"},
+	)
+	valueSuffixConversions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "graphite_value_suffix_conversions_total",
+			Help: "Total count of values with a unit suffix that were converted with the multiplier configured for the suffix.",
+		},
+		[]string{"suffix"},
+	)
+	commaDecimalValues = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "graphite_comma_decimal_values_total",
+			Help: "Total count of values that were parsed with a comma as the decimal separator.",
+		},
+	)
+	fieldOrderCorrections = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "graphite_field_order_corrections_total",
+			Help: "Total count of lines whose value and timestamp were swapped because they appeared to be in the wrong order.",
+		},
+	)
+	normalizedPaths = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "graphite_normalized_paths_total",
+			Help: "Total count of lines whose metric path had empty components removed.",
+		},
+	)
+	internalPanics = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "graphite_internal_panics_total",
+			Help: "Total count of panics recovered from while processing lines.",
+		},
+	)
+	collectDuration = prometheus.NewSummary(
+		prometheus.SummaryOpts{
+			Name:       "graphite_collect_duration_seconds",
+			Help:       "Time spent collecting the stored samples for a scrape.",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		},
+	)
+	collectSamples = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "graphite_collect_samples",
+			Help: "Number of samples emitted by the last collection.",
+		},
+	)
+	collectTruncations = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "graphite_collect_truncated_total",
+			Help: "Total count of collections that stopped emitting samples because they reached the collect timeout.",
+		},
+	)
+	collectOmitted = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "graphite_collect_omitted_samples_total",
+			Help: "Total count of samples left out of collections because there were more than the maximum samples per scrape.",
+		},
+	)
+	blockedSends = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "graphite_channel_blocked_sends_total",
+			Help: "Total count of sends to an internal channel that had to wait for the receiver.",
+		},
+		[]string{"channel"},
+	)
+	blockedSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "graphite_channel_blocked_seconds_total",
+			Help: "Total time spent waiting on sends to an internal channel.",
+		},
+		[]string{"channel"},
+	)
+	channelLengthDesc = prometheus.NewDesc(
+		"graphite_channel_length",
+		"Number of items queued in an internal channel.",
+		[]string{"channel"}, nil,
+	)
+	channelCapacityDesc = prometheus.NewDesc(
+		"graphite_channel_capacity",
+		"Capacity of an internal channel.",
+		[]string{"channel"}, nil,
+	)
+	pipelineGoroutines = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "graphite_pipeline_goroutines",
+			Help: "Number of running goroutines in each stage of the ingestion pipeline.",
+		},
+		[]string{"stage"},
+	)
+	loopHeartbeat = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "graphite_loop_heartbeat_timestamp_seconds",
+			Help: "Unix timestamp of the last heartbeat of each long-running loop. A loop that stops updating it is stuck or has died.",
+		},
+		[]string{"loop"},
+	)
+	invalidMetricChars = regexp.MustCompile("[^a-zA-Z0-9_:]")
+)
+
+// heartbeatInterval is how often the long-running loops wake up, if idle, to
+// update their heartbeat.
+const heartbeatInterval = 5 * time.Second
+
+// defaultSampleExpiry is the sample expiry if Options leave it unset.
+const defaultSampleExpiry = 5 * time.Minute
+
+// defaultPendingUDPPacketsPerCPU is the bound on pending UDP packets per
+// GOMAXPROCS if Options leave it unset. Each pending packet is processed by a
+// goroutine of its own.
+const defaultPendingUDPPacketsPerCPU = 256
+
+// Sample is a stored graphite sample, mapped to a Prometheus metric. Stored
+// samples are never modified: a new sample replaces the stored one, so that
+// readers can use a sample without holding the store's lock.
+type Sample struct {
+	OriginalName string
+	Name         string
+	Labels       map[string]string
+	Value        float64
+	Type         prometheus.ValueType
+	Timestamp    time.Time
+	// Accumulate marks samples of counters whose Value is accumulated across
+	// resets; Raw then holds the value as received.
+	Accumulate bool
+	Raw        float64
+	// Delta marks samples of delta counters, whose Value is the running
+	// total of the increments received for the series; Raw then holds the
+	// increment at the sample's timestamp.
+	Delta bool
+	// Aggregate is how the sample is combined with the stored sample of its
+	// series if both have the same timestamp.
+	Aggregate Aggregation
+	// Expiry overrides the sample expiry of the collector if non-zero.
+	Expiry time.Duration
+	// Help is the help text of the metric. Ingested samples leave it empty
+	// rather than storing a copy each, see HelpText.
+	Help string
+	// expirySource is what set Expiry, see effectiveExpiry.
+	expirySource string
+	// updates is the number of samples the series received, including
+	// this one, see inProbation.
+	updates int
+	// conflicted is set atomically once a scrape skipped the sample for
+	// conflicting with another one, see skipConflicting.
+	conflicted uint32
+}
+
+func (s Sample) String() string {
+	return fmt.Sprintf("%#v", s)
+}
+
+// HelpText returns the help text of the sample's metric, which is derived
+// from its name unless Help is set. Deriving it keeps the help text of a
+// metric consistent across its series.
+func (s *Sample) HelpText() string {
+	if s.Help != "" {
+		return s.Help
+	}
+	return "Graphite metric " + s.Name
+}
+
+// MetricMapper maps graphite metric paths to Prometheus metrics. Mapper is
+// the implementation used by the exporter.
+type MetricMapper interface {
+	GetMapping(string, mapper.MetricType) (*mapper.MetricMapping, prometheus.Labels, bool)
+	InitFromFile(string) error
+}
+
+// Options configures a Collector. The zero value is a collector without
+// mappings that keeps samples for five minutes.
+type Options struct {
+	Logger log.Logger
+	// Mapper maps the received paths. If nil, paths are not mapped.
+	Mapper      MetricMapper
+	MapSettings MapSettings
+	// SampleExpiry is how long a sample is exported after it was received.
+	SampleExpiry time.Duration
+	// Carbon2 enables the detection of lines in the carbon2 format.
+	Carbon2 bool
+	// CollectTimeout bounds the time Collect spends emitting samples. Zero
+	// means no timeout.
+	CollectTimeout time.Duration
+	// MaxSamplesPerScrape bounds the number of samples Collect emits,
+	// leaving out those updated least recently. Zero means no limit.
+	MaxSamplesPerScrape int
+	// TrackSources is the number of source IPs to count lines for. Zero
+	// disables tracking. The ExportSources sources sending the most lines
+	// are exported as metrics.
+	TrackSources  int
+	ExportSources int
+	// TrackUpdateIntervals is the number of metric names to track the
+	// update intervals of. Zero disables tracking.
+	TrackUpdateIntervals int
+	// TrackSanitizedNames is the number of names changed by sanitization
+	// to count samples for, keeping the most frequent. Zero disables
+	// tracking.
+	TrackSanitizedNames int
+	// DedupWindow enables dropping lines identical to one received within
+	// the window, remembering up to DedupMaxLines lines.
+	DedupWindow   time.Duration
+	DedupMaxLines int
+	// MaxPendingUDPPackets bounds the number of received UDP packets waiting
+	// to be processed. Packets arriving while as many are pending are
+	// dropped. Zero means 256 per GOMAXPROCS.
+	MaxPendingUDPPackets int
+	// ParseRateLimit bounds the number of lines processed per second.
+	// Further lines wait, which slows down TCP senders. Zero means no
+	// limit.
+	ParseRateLimit float64
+	// MinUpdates is the number of samples a series has to receive before
+	// it is exported. Series with fewer samples are stored, but expire
+	// after ProbationExpiry. Zero and one export every series.
+	MinUpdates      int
+	ProbationExpiry time.Duration
+	// MaxSeries bounds the number of stored series. Samples of further
+	// series are rejected until stored ones expire. Zero means no limit.
+	MaxSeries int
+	// MemorySoftLimit is the live heap size in bytes above which the
+	// oldest samples are removed and samples of new series are rejected.
+	// Zero disables the limit.
+	MemorySoftLimit uint64
+	// LogDroppedPaths logs the first drop of each path per hour by a drop
+	// mapping or strict matching.
+	LogDroppedPaths bool
+	// ObserveValues observes the absolute value of every ingested sample in
+	// the graphite_ingested_values histogram, to notice senders emitting
+	// values of an unexpected magnitude.
+	ObserveValues bool
+	// RejectMalformedPaths rejects lines whose metric path has empty
+	// components, e.g. "apps..requests.", instead of removing them.
+	RejectMalformedPaths bool
+	// StartupGracePeriod is how long after its creation the collector is in
+	// its startup grace period, see InStartupGrace. Collect exports no
+	// stored samples during the period, only the exporter's own metrics,
+	// unless GraceReadinessOnly is set.
+	StartupGracePeriod time.Duration
+	GraceReadinessOnly bool
+	// DeadLetter receives the lines that are dropped, if set.
+	DeadLetter *DeadLetter
+	// RecordLine, if set, is called with every received line before it is
+	// parsed.
+	RecordLine func(line string)
+	// Clock is the time samples expire by. If nil, the system clock is
+	// used, or with ReplayMode the newest ingested timestamp.
+	Clock Clock
+	// ReplayMode drives the clock from the newest timestamp ingested, so
+	// that historical data is not expired as soon as it is received.
+	ReplayMode bool
+	// Backfill accepts historical data: samples never expire, and Collect
+	// exports them with their own timestamps instead of as current values.
+	// It takes precedence over ReplayMode and Tombstones.
+	Backfill bool
+	// ValueCoercions are the numbers that values which are not numbers,
+	// such as "true" or "off", are replaced by. They are matched ignoring
+	// case. Lines with other values that are not numbers are invalid.
+	ValueCoercions map[string]float64
+	// ValueSuffixes are the multipliers of the unit suffixes accepted after
+	// a value, e.g. 0.001 for "ms" in "42ms". Suffixes are matched exactly.
+	// Values with other suffixes are invalid. See DefaultValueSuffixes.
+	ValueSuffixes map[string]float64
+	// MultiDatapointLines accepts plaintext lines with several value and
+	// timestamp pairs, "<path> <v1> <t1> <v2> <t2> ...", ingesting each
+	// datapoint like a line of its own.
+	MultiDatapointLines bool
+	// AcceptCommaDecimal accepts values with a single comma as the decimal
+	// separator, e.g. "3,14", unless they also contain a dot.
+	AcceptCommaDecimal bool
+	// LenientFieldOrder accepts plaintext lines with the value and the
+	// timestamp swapped, if the value looks like a Unix timestamp and the
+	// timestamp does not.
+	LenientFieldOrder bool
+	// ReadOnly processes lines as usual but makes Collect export none of
+	// the stored samples, only the exporter's own metrics, e.g. for a
+	// replica validating a mapping configuration on mirrored traffic.
+	ReadOnly bool
+	// ExpirySweepInitialJitter makes the first sweep for expired samples
+	// wait a random duration up to it instead of a full sweep interval, so
+	// that replicas started together do not sweep at the same time.
+	ExpirySweepInitialJitter time.Duration
+	// ExpirySweepJitter moves each later sweep randomly by up to this
+	// fraction of the sweep interval in either direction, e.g. 0.1 for
+	// ±10%. It must be less than 1.
+	ExpirySweepJitter float64
+	// Tombstones emits a final sample of TombstoneValue for each expired
+	// series in the next Collect, labelled graphite_expired="true" if
+	// TombstoneLabel is set.
+	Tombstones     bool
+	TombstoneValue float64
+	TombstoneLabel bool
+	// LengthLimits bounds the length of metric names and label values.
+	LengthLimits LengthLimits
+	// ExpireOnCollect makes Collect hand the expired samples it finds back
+	// for removal, so that they do not occupy memory until the next expiry
+	// sweep.
+	ExpireOnCollect bool
+	// PipelineStallThreshold is how long a processing loop may go without
+	// a heartbeat while lines are waiting for it before the pipeline is
+	// reported as unhealthy, see PipelineHealthy. Zero disables the check.
+	PipelineStallThreshold time.Duration
+	// IdentityLabels are added to every exported sample, see
+	// SetIdentityLabels.
+	IdentityLabels *IdentityLabels
+}
+
+// Collector receives graphite lines, maps them to Prometheus metrics and
+// exports the most recent sample of each as a prometheus.Collector.
+type Collector struct {
+	samples  map[string]*Sample
+	mu       *sync.Mutex
+	mapper   *atomic.Value
+	mapperMu *sync.Mutex
+	// identity holds the *IdentityLabels added to exported samples.
+	identity *atomic.Value
+	sampleCh chan *Sample
+	lineCh   chan graphiteLine
+	removeCh chan string
+	batchCh  chan *sampleBatch
+	// expireCh receives the original names of expired samples found by
+	// Collect, if enabled.
+	expireCh chan []string
+	settings MapSettings
+	// carbon2 enables the detection of lines in the carbon2 format.
+	carbon2 bool
+	// strictPaths rejects paths with empty components instead of
+	// normalizing them.
+	strictPaths bool
+	// collectTimeout bounds the time Collect spends emitting samples.
+	collectTimeout time.Duration
+	logger         log.Logger
+	invalidLogger  *sampledLogger
+	strings        *stringTable
+	recordLine     func(line string)
+	deadLetter     *DeadLetter
+	sources        *sourceTracker
+	dropLogger     *dropLogger
+	dedup          *lineDeduper
+	// stringsStale is set once samples were removed since the intern table
+	// was last rebuilt. It is only accessed by the goroutine that owns the
+	// sample store.
+	stringsStale bool
+	// udpPending holds a token for each UDP packet waiting to be processed.
+	udpPending chan struct{}
+	// ingestedValues observes the ingested values, if enabled.
+	ingestedValues prometheus.Histogram
+	// maxSamples bounds the number of samples Collect emits, if positive.
+	// It may change at runtime and must be accessed atomically.
+	maxSamples *int64
+	// sanitized counts the samples of the names changed by sanitization,
+	// if enabled.
+	sanitized *topKeys
+	// intervals tracks how often the samples of each metric name are
+	// updated, if enabled.
+	intervals *intervalTracker
+
+	// sampleExpiry is the sample expiry in nanoseconds, which may change at
+	// runtime. It must be accessed atomically.
+	sampleExpiry *int64
+	// lastProcessedAt is the time of the last processed sample in Unix
+	// nanoseconds, or zero if there was none. It must be accessed atomically.
+	lastProcessedAt *int64
+	createdAt       time.Time
+	clock           Clock
+	// replay is the clock of the replay mode, which observes the ingested
+	// timestamps.
+	replay *replayClock
+	// backfill disables expiry and exports samples with their timestamps.
+	backfill bool
+	// graceUntil is the end of the startup grace period, during which
+	// Collect exports no samples if withholdInGrace is set.
+	graceUntil      time.Time
+	withholdInGrace bool
+	// readOnly withholds all samples from Collect.
+	readOnly bool
+	// values configures how values that are not numbers are parsed.
+	values valueOptions
+	// lenientOrder swaps the value and timestamp of plaintext lines that
+	// appear to have them in the wrong order.
+	lenientOrder bool
+	// limits bounds the length of metric names and label values.
+	limits LengthLimits
+	// multiDatapoints splits plaintext lines with several datapoints, see
+	// splitDatapoints.
+	multiDatapoints bool
+	// expireOnCollect sends the expired samples found by Collect to
+	// expireCh.
+	expireOnCollect bool
+	// watchdog tracks the heartbeats of the processing loops.
+	watchdog *watchdog
+	// parseLimiter holds the *rateLimiter delaying lines beyond the parse
+	// rate limit.
+	parseLimiter *atomic.Value
+	// maxSeries bounds the number of stored series, if positive. It may
+	// change at runtime and must be accessed atomically.
+	maxSeries *int64
+	// minUpdates and probationExpiry withhold series with few samples,
+	// see inProbation.
+	minUpdates      int
+	probationExpiry time.Duration
+	// memory enforces the soft memory limit, if one is set, by sending to
+	// evictCh.
+	memory  *memoryGuard
+	evictCh chan struct{}
+	// conns holds the open TCP connections, whose contexts derive from
+	// connCtx. Stop cancels connCtx and closes them.
+	conns       *connRegistry
+	connCtx     context.Context
+	cancelConns context.CancelFunc
+	// The expiry sweeps are scheduled by nextSweep with timers of newTimer.
+	// random is only used by the goroutine owning the sample store.
+	sweepInitialJitter time.Duration
+	sweepJitter        float64
+	random             func() float64
+	newTimer           func(time.Duration) sweepTimer
+	// tombstones holds the expired samples pending a final sample, if
+	// enabled.
+	tombstones *tombstones
+	// totals counts the outcome of the processed lines for Summary.
+	totals *totals
+
+	// done is closed by Stop, and stopped once the processing goroutines
+	// have exited.
+	done     chan struct{}
+	stopped  chan struct{}
+	runOnce  *sync.Once
+	stopOnce *sync.Once
+}
+
+// NewCollector returns a Collector. Lines are only processed once Run was
+// called.
+func NewCollector(opts Options) *Collector {
+	if opts.Logger == nil {
+		opts.Logger = log.NewNopLogger()
+	}
+	if opts.Mapper == nil {
+		opts.Mapper = &Mapper{}
+	}
+	if opts.SampleExpiry == 0 {
+		opts.SampleExpiry = defaultSampleExpiry
+	}
+	if opts.MaxPendingUDPPackets <= 0 {
+		opts.MaxPendingUDPPackets = defaultPendingUDPPacketsPerCPU * runtime.GOMAXPROCS(0)
+	}
+	var replay *replayClock
+	if opts.Clock == nil && opts.ReplayMode && !opts.Backfill {
+		replay = &replayClock{}
+		opts.Clock = replay
+	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+	c := &Collector{
+		sampleCh:       make(chan *Sample),
+		lineCh:         make(chan graphiteLine),
+		removeCh:       make(chan string),
+		batchCh:        make(chan *sampleBatch),
+		expireCh:       make(chan []string, 1),
+		evictCh:        make(chan struct{}, 1),
+		mu:             &sync.Mutex{},
+		samples:        map[string]*Sample{},
+		mapper:         &atomic.Value{},
+		mapperMu:       &sync.Mutex{},
+		identity:       &atomic.Value{},
+		settings:       opts.MapSettings,
+		carbon2:        opts.Carbon2,
+		strictPaths:    opts.RejectMalformedPaths,
+		collectTimeout: opts.CollectTimeout,
+		logger:         opts.Logger,
+		invalidLogger:  newSampledLogger(opts.Logger, time.Minute),
+		strings:        newStringTable(),
+		recordLine:     opts.RecordLine,
+		deadLetter:     opts.DeadLetter,
+		udpPending:     make(chan struct{}, opts.MaxPendingUDPPackets),
+
+		sampleExpiry:    new(int64),
+		maxSamples:      new(int64),
+		maxSeries:       new(int64),
+		parseLimiter:    &atomic.Value{},
+		lastProcessedAt: new(int64),
+		createdAt:       time.Now(),
+		clock:           opts.Clock,
+		replay:          replay,
+
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		runOnce:  &sync.Once{},
+		stopOnce: &sync.Once{},
+	}
+	c.SetMapper(opts.Mapper)
+	c.SetSampleExpiry(opts.SampleExpiry)
+	c.SetIdentityLabels(opts.IdentityLabels)
+	c.graceUntil = c.createdAt.Add(opts.StartupGracePeriod)
+	c.SetMaxSamplesPerScrape(opts.MaxSamplesPerScrape)
+	c.withholdInGrace = !opts.GraceReadinessOnly
+	c.readOnly = opts.ReadOnly
+	c.backfill = opts.Backfill
+	c.lenientOrder = opts.LenientFieldOrder
+	c.multiDatapoints = opts.MultiDatapointLines
+	c.limits = opts.LengthLimits
+	c.expireOnCollect = opts.ExpireOnCollect
+	c.watchdog = &watchdog{threshold: opts.PipelineStallThreshold}
+	c.SetParseRateLimit(opts.ParseRateLimit)
+	c.SetMaxSeries(opts.MaxSeries)
+	c.minUpdates = opts.MinUpdates
+	c.probationExpiry = opts.ProbationExpiry
+	c.memory = newMemoryGuard(opts.MemorySoftLimit, c.SampleCount)
+	c.values.commaDecimal = opts.AcceptCommaDecimal
+	c.conns = newConnRegistry()
+	c.totals = newTotals()
+	c.connCtx, c.cancelConns = context.WithCancel(context.Background())
+	c.sweepInitialJitter = opts.ExpirySweepInitialJitter
+	c.sweepJitter = opts.ExpirySweepJitter
+	// Each collector has its own source, so that replicas do not draw the
+	// same jitter.
+	c.random = rand.New(rand.NewSource(time.Now().UnixNano())).Float64
+	c.newTimer = newSystemTimer
+	// In backfill mode nothing expires, so there is nothing to tombstone.
+	if opts.Tombstones && !opts.Backfill {
+		c.tombstones = newTombstones(opts.TombstoneValue, opts.TombstoneLabel)
+	}
+	c.values.suffixes = opts.ValueSuffixes
+	if len(opts.ValueCoercions) > 0 {
+		c.values.coercions = make(map[string]float64, len(opts.ValueCoercions))
+		for value, number := range opts.ValueCoercions {
+			c.values.coercions[strings.ToLower(value)] = number
+		}
+	}
+	if opts.ObserveValues {
+		c.ingestedValues = prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "graphite_ingested_values",
+			Help: "Absolute values of the ingested samples, by order of magnitude.",
+			// One bucket per power of ten from 1e-9 to 1e15.
+			Buckets: prometheus.ExponentialBuckets(1e-9, 10, 25),
+		})
+	}
+	if opts.TrackSources > 0 {
+		c.sources = newSourceTracker(opts.TrackSources, opts.ExportSources)
+	}
+	if opts.TrackSanitizedNames > 0 {
+		c.sanitized = newTopKeys(opts.TrackSanitizedNames)
+	}
+	if opts.TrackUpdateIntervals > 0 {
+		c.intervals = newIntervalTracker(opts.TrackUpdateIntervals)
+	}
+	if opts.DedupWindow > 0 && opts.DedupMaxLines > 0 {
+		c.dedup = newLineDeduper(opts.DedupWindow, opts.DedupMaxLines)
+	}
+	if opts.LogDroppedPaths {
+		c.dropLogger = newDropLogger(opts.Logger, time.Hour)
+	}
+	return c
+}
+
+// Run starts the processing goroutines, which run until ctx is cancelled or
+// Stop is called. Calls after the first have no effect.
+func (c *Collector) Run(ctx context.Context) {
+	c.runOnce.Do(func() {
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c.processSamples()
+		}()
+		go func() {
+			defer wg.Done()
+			c.processLines()
+		}()
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.Stop()
+			case <-c.done:
+			}
+		}()
+		go func() {
+			wg.Wait()
+			close(c.stopped)
+		}()
+		if c.watchdog.threshold > 0 {
+			go c.watchPipeline()
+		}
+		go c.watchMemory()
+	})
+}
+
+// Stop stops the processing goroutines and closes the open TCP connections.
+// Lines received afterwards are discarded. It does not wait for the
+// goroutines to exit, see Stopped.
+func (c *Collector) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.done)
+		c.cancelConns()
+		c.conns.drop(func(*trackedConn) bool { return true })
+	})
+}
+
+// Stopped returns a channel that is closed once the processing goroutines
+// started by Run have exited.
+func (c *Collector) Stopped() <-chan struct{} {
+	return c.stopped
+}
+
+// mapperHolder wraps the mapper stored in an atomic.Value, which requires all
+// stored values to have the same concrete type. generation counts the
+// mappers set, starting at 1, so that the zero holder is no mapper at all.
+type mapperHolder struct {
+	m          MetricMapper
+	generation uint64
+}
+
+// Mapper returns the mapper currently in use.
+func (c *Collector) Mapper() MetricMapper {
+	return c.currentMapper().m
+}
+
+func (c *Collector) currentMapper() mapperHolder {
+	return c.mapper.Load().(mapperHolder)
+}
+
+// SetMapper replaces the mapper, for example after reloading the mapping
+// configuration. Lines received once SetMapper returned are mapped with m,
+// while lines received before are still mapped with the mapper in use when
+// they were received, even if they are processed afterwards. m must not be
+// modified once set; a reload loads the configuration into a new Mapper.
+func (c *Collector) SetMapper(m MetricMapper) {
+	// Concurrent calls are serialized, so that the generations are stored
+	// in order.
+	c.mapperMu.Lock()
+	defer c.mapperMu.Unlock()
+	generation := uint64(1)
+	if current, ok := c.mapper.Load().(mapperHolder); ok {
+		generation = current.generation + 1
+	}
+	c.mapper.Store(mapperHolder{m: m, generation: generation})
+}
+
+// SampleExpiry returns how long samples are exported after they were
+// received.
+func (c *Collector) SampleExpiry() time.Duration {
+	return time.Duration(atomic.LoadInt64(c.sampleExpiry))
+}
+
+// SetSampleExpiry changes the sample expiry at runtime.
+func (c *Collector) SetSampleExpiry(d time.Duration) {
+	atomic.StoreInt64(c.sampleExpiry, int64(d))
+}
+
+// maxLoggedLineLength is the number of bytes of an invalid line that is
+// logged, so that garbage sent to the listener cannot flood the log.
+const maxLoggedLineLength = 256
+
+// LineSource identifies where a line was received from.
+type LineSource struct {
+	// Protocol is "tcp", "udp", "http" for lines of batch requests, or
+	// "selftest" for lines injected by the self-test.
+	Protocol string
+	Address  string
+}
+
+// protocolLabel is the value of the protocol label of the source, "other"
+// for lines passed in directly.
+func (s LineSource) protocolLabel() string {
+	if s.Protocol == "" {
+		return "other"
+	}
+	return s.Protocol
+}
+
+// graphiteLine is a received line together with its source.
+type graphiteLine struct {
+	text   string
+	source LineSource
+	// mapper is the mapper in use when the line was received, which it is
+	// mapped with. The lines of a UDP packet share the same mapper. Every
+	// line sent to lineCh has one, set by receiveLine or the self-test.
+	mapper mapperHolder
+}
+
+// ProcessReader processes the lines read from reader until it is exhausted.
+func (c *Collector) ProcessReader(reader io.Reader) {
+	c.processReader(reader, LineSource{}, mapperHolder{})
+}
+
+// ProcessLine processes a single line.
+func (c *Collector) ProcessLine(line string) {
+	c.receiveLine(graphiteLine{text: line})
+}
+
+// processReader processes the lines read from reader until it is exhausted.
+// They are mapped with mapper, or if it is the zero holder, with the mapper
+// in use when each line is read.
+func (c *Collector) processReader(reader io.Reader, source LineSource, mapper mapperHolder) {
+	lineScanner := bufio.NewScanner(reader)
+	for {
+		if ok := lineScanner.Scan(); !ok {
+			break
+		}
+		c.receiveLine(graphiteLine{text: lineScanner.Text(), source: source, mapper: mapper})
+	}
+}
+
+// receiveLine queues a received line for processing, with the mapper in use
+// unless it already has one.
+func (c *Collector) receiveLine(line graphiteLine) {
+	if line.mapper.generation == 0 {
+		line.mapper = c.currentMapper()
+	}
+	if c.recordLine != nil {
+		c.recordLine(line.text)
+	}
+	c.sendLine(line)
+}
+
+// sendLine queues a line for processing. Sends that have to wait are counted,
+// so that a pipeline falling behind shows up in the exporter's own metrics;
+// the fast path costs a single non-blocking send.
+func (c *Collector) sendLine(line graphiteLine) {
+	c.watchdog.lines.enqueued(time.Now())
+	select {
+	case c.lineCh <- line:
+		return
+	case <-c.done:
+		return
+	default:
+	}
+	start := time.Now()
+	select {
+	case c.lineCh <- line:
+	case <-c.done:
+		return
+	}
+	blockedSends.WithLabelValues("line").Inc()
+	blockedSeconds.WithLabelValues("line").Add(time.Since(start).Seconds())
+}
+
+func (c *Collector) sendSample(sample *Sample) {
+	c.watchdog.samples.enqueued(time.Now())
+	select {
+	case c.sampleCh <- sample:
+		return
+	case <-c.done:
+		return
+	default:
+	}
+	start := time.Now()
+	select {
+	case c.sampleCh <- sample:
+	case <-c.done:
+		return
+	}
+	blockedSends.WithLabelValues("sample").Inc()
+	blockedSeconds.WithLabelValues("sample").Add(time.Since(start).Seconds())
+}
+
+// processLines processes queued lines until the collector is stopped. The
+// loop is restarted after a panic, so that a single line triggering a bug
+// cannot stop ingestion.
+func (c *Collector) processLines() {
+	for !c.lineLoop() {
+	}
+}
+
+// lineLoop reports whether it returned because the collector was stopped,
+// rather than because of a panic, which it logs and counts.
+func (c *Collector) lineLoop() (stopped bool) {
+	pipelineGoroutines.WithLabelValues("line").Inc()
+	defer pipelineGoroutines.WithLabelValues("line").Dec()
+	heartbeat := loopHeartbeat.WithLabelValues("line")
+	heartbeat.SetToCurrentTime()
+	c.watchdog.lines.alive(time.Now())
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	var current graphiteLine
+	defer func() {
+		if r := recover(); r != nil {
+			internalPanics.Inc()
+			level.Error(c.logger).Log("msg", "Recovered from panic while processing a line, restarting the line processing loop",
+				"line", truncateLine(current.text, maxLoggedLineLength), "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+
+	for {
+		select {
+		case line := <-c.lineCh:
+			current = line
+			if !c.admitLine(line) {
+				break
+			}
+			if !c.throttleParse(c.done) {
+				return true
+			}
+			start := time.Now()
+			datapoints := []string{line.text}
+			if split := c.splitDatapoints(line.text); split != nil {
+				multiDatapointLines.Inc()
+				datapoints = split
+			}
+			for _, text := range datapoints {
+				if r := c.ingestLine(text, line.source, line.mapper.m); r.sample != nil {
+					c.sendSample(r.sample)
+				}
+			}
+			lineProcessingDuration.Observe(time.Since(start).Seconds())
+		case <-ticker.C:
+			heartbeat.SetToCurrentTime()
+		case <-c.done:
+			return true
+		}
+		c.watchdog.lines.alive(time.Now())
+	}
+}
+
+// admitLine counts the line for its source and reports whether it is to be
+// processed, i.e. is not a duplicate of a recent line.
+func (c *Collector) admitLine(line graphiteLine) bool {
+	if c.sources != nil && line.source.Address != "" {
+		c.sources.add(line.source.Address)
+	}
+	if c.dedup != nil && c.dedup.duplicate(line.text, time.Now()) {
+		duplicateLines.Inc()
+		return false
+	}
+	return true
+}
+
+// MappedMetric is the Prometheus identity of a graphite metric path.
+type MappedMetric struct {
+	Name   string
+	Labels map[string]string
+	Type   prometheus.ValueType
+	// Scale is applied to every value, to convert it to the base unit of a
+	// normalized name.
+	Scale float64
+	// Accumulate is set for counters that accumulate across resets.
+	Accumulate bool
+	// Delta is set for counters that receive increments, see
+	// CounterModeDelta.
+	Delta bool
+	// Aggregate is how samples with the same timestamp are combined.
+	Aggregate Aggregation
+	// Expiry is how long the samples are exported, if not the sample expiry
+	// of the collector.
+	Expiry time.Duration
+	// expirySource is what set Expiry, see effectiveExpiry.
+	expirySource string
+	// DecimalPlaces is the number of decimal places values are rounded to
+	// after scaling. Values are not rounded if it is nil.
+	DecimalPlaces *int
+	// relabeled are the relabeling rules that changed a label value.
+	relabeled []*relabelRule
+	// labelConflicts are the labels set by more than one source.
+	labelConflicts []labelConflict
+	// prefixed is set if the name was prefixed to make it valid.
+	prefixed bool
+	// sanitized is the name before invalid characters were replaced, if
+	// any were.
+	sanitized string
+	// sanitizedMapping is the match of the mapping whose name had invalid
+	// characters replaced, if the name was mapped.
+	sanitizedMapping string
+	// DropReason is why the metric is dropped, if it is.
+	DropReason string
+}
+
+// MapSettings are the settings that apply to the mapping of every metric.
+type MapSettings struct {
+	StrictMatch    bool
+	NormalizeNames bool
+	// StrictMappedNames drops metrics whose name given by a mapping holds
+	// characters that are invalid in metric names instead of replacing
+	// them. Mapping names are validated when loading, so such characters
+	// can only come from captures.
+	StrictMappedNames bool
+	// MetricPrefix is prepended to every name after mapping.
+	MetricPrefix string
+	// DefaultType is the type of unmapped metrics and of mapped metrics
+	// whose mapping sets none.
+	DefaultType MetricType
+	// Aggregate is how samples of a series with the same timestamp are
+	// combined, for unmapped metrics and mappings that set no aggregation.
+	// The zero value keeps the last sample.
+	Aggregate Aggregation
+	// UnmappedSplitDepth is the number of leading components of an unmapped
+	// path that are moved into the UnmappedSplitLabel label instead of the
+	// name. Zero keeps the whole path in the name.
+	UnmappedSplitDepth int
+	UnmappedSplitLabel string
+	// InstanceComponent is the position, starting at 1, of the component of
+	// unmapped paths that names the instance, e.g. 2 for
+	// servers.<host>.cpu. It is moved into the instance label before the
+	// path is split. Zero keeps it in the name.
+	InstanceComponent int
+	// InvalidNamePrefix is prepended to sanitized names that are not valid
+	// metric names, i.e. are empty or start with a digit. If empty, such
+	// metrics are dropped. It is not needed with a MetricPrefix.
+	InvalidNamePrefix string
+	// StorageSchemas sets the expiry of the paths they match, if set.
+	StorageSchemas *StorageSchemas
+	// DecimalPlaces rounds every value to that many decimal places, if set,
+	// unless its mapping sets its own.
+	DecimalPlaces *int
+}
+
+// DefaultInvalidNamePrefix is the flag default of MapSettings.InvalidNamePrefix.
+const DefaultInvalidNamePrefix = "graphite_"
+
+// DefaultUnmappedSplitLabel is the label that the leading components of
+// unmapped paths are moved into if MapSettings sets none.
+const DefaultUnmappedSplitLabel = "graphite_hierarchy"
+
+// instanceLabel is the label that the instance component of unmapped paths
+// is moved into, see MapSettings.InstanceComponent.
+const instanceLabel = "instance"
+
+// splitUnmapped splits an unmapped path into the name of its metric and the
+// labels holding its instance component and its leading components, as
+// configured by s. Paths that would be left without a name are not split.
+func splitUnmapped(path string, s MapSettings) (string, map[string]string) {
+	var labels map[string]string
+	if n := s.InstanceComponent; n > 0 {
+		parts := strings.Split(path, ".")
+		if len(parts) > 1 && len(parts) >= n && parts[n-1] != "" {
+			labels = map[string]string{instanceLabel: parts[n-1]}
+			path = strings.Join(append(parts[:n-1:n-1], parts[n:]...), ".")
+		}
+	}
+	if s.UnmappedSplitDepth <= 0 {
+		return path, labels
+	}
+	parts := strings.SplitN(path, ".", s.UnmappedSplitDepth+1)
+	if len(parts) <= s.UnmappedSplitDepth || parts[s.UnmappedSplitDepth] == "" {
+		return path, labels
+	}
+	label := s.UnmappedSplitLabel
+	if label == "" {
+		label = DefaultUnmappedSplitLabel
+	}
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[label] = strings.Join(parts[:s.UnmappedSplitDepth], ".")
+	return parts[s.UnmappedSplitDepth], labels
+}
+
+// ValidMetricPrefix matches the prefixes that cannot make a valid metric name
+// invalid.
+var ValidMetricPrefix = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+
+// metricHints carry the type, unit and tags that some line formats send
+// along with the metric path.
+type metricHints struct {
+	Type MetricType
+	Unit string
+	// Tags are exported as labels, unless the mapping sets the same ones.
+	Tags map[string]string
+}
+
+// MapMetric maps a graphite metric path to a Prometheus name and labels. It
+// returns false if the metric is dropped by the mapping configuration, with
+// the reason in DropReason.
+func MapMetric(m MetricMapper, originalName string, s MapSettings) (MappedMetric, bool) {
+	return mapMetricWithHints(m, originalName, metricHints{}, s)
+}
+
+// mapMetricWithHints is MapMetric for a path sent with hints. The hinted type
+// applies unless the mapping sets one. The hinted unit is appended to the name
+// before it is normalized, and exported as a unit label otherwise. The labels
+// of all sources are assembled in the precedence of labelSource.
+func mapMetricWithHints(m MetricMapper, originalName string, h metricHints, s MapSettings) (MappedMetric, bool) {
+	var (
+		mapping *mapper.MetricMapping
+		labels  prometheus.Labels
+		present bool
+		sources labelSources
+	)
+	// A nil mapper has no mappings.
+	if m != nil {
+		mapping, labels, present = m.GetMapping(originalName, mapper.MetricTypeGauge)
+	}
+	if h.Type == "" {
+		h.Type = s.DefaultType
+	}
+
+	if present && mapping.Action == mapper.ActionTypeDrop {
+		return MappedMetric{DropReason: dropReasonMapping}, false
+	}
+	if !present && s.StrictMatch {
+		return MappedMetric{DropReason: dropReasonStrictMatch}, false
+	}
+
+	result := MappedMetric{Type: h.Type.valueType(), Scale: 1, Aggregate: s.Aggregate, DecimalPlaces: s.DecimalPlaces}
+	unitInName := false
+	if present {
+		sources[labelSourceMapping] = labels
+		result.Name = invalidMetricChars.ReplaceAllString(mapping.Name, "_")
+		if result.Name != mapping.Name {
+			if s.StrictMappedNames {
+				return MappedMetric{DropReason: dropReasonInvalidMappedName}, false
+			}
+			result.sanitized, result.sanitizedMapping = mapping.Name, mapping.Match
+		}
+
+		if p, ok := m.(mappingOptionsProvider); ok {
+			opts := p.mappingOptions(mapping)
+			if opts.Type == "" {
+				opts.Type = h.Type
+			}
+			result.Type = opts.Type.valueType()
+			result.Accumulate = opts.Accumulate
+			result.Delta = opts.CounterMode == CounterModeDelta
+			if opts.Aggregate != "" {
+				result.Aggregate = opts.Aggregate
+			}
+			// An accumulated total is always based on the last sample.
+			if opts.Accumulate {
+				result.Aggregate = ""
+			}
+			if opts.Expiry > 0 {
+				result.Expiry, result.expirySource = opts.Expiry, expirySourceMapping
+			}
+			if opts.DecimalPlaces != nil {
+				result.DecimalPlaces = opts.DecimalPlaces
+			}
+			if len(opts.DropLabels) > 0 {
+				// The labels may be shared with the mapper's cache.
+				labels = copyLabels(labels)
+				for _, label := range opts.DropLabels {
+					delete(labels, label)
+				}
+				sources[labelSourceMapping] = labels
+			}
+			if opts.NormalizeName || s.NormalizeNames {
+				if h.Unit != "" && !strings.HasSuffix(result.Name, "_"+h.Unit) {
+					result.Name += "_" + invalidMetricChars.ReplaceAllString(h.Unit, "_")
+				}
+				unitInName = true
+				result.Name, result.Scale = normalizeName(result.Name, opts.Type, p.unitSuffixes())
+			}
+		}
+	} else {
+		var name string
+		name, sources[labelSourcePath] = splitUnmapped(originalName, s)
+		result.Name = invalidMetricChars.ReplaceAllString(name, "_")
+		if result.Name != name {
+			result.sanitized = name
+		}
+	}
+	// Sanitized names only consist of valid characters, but may be empty
+	// or start with a digit.
+	if s.MetricPrefix == "" && !model.IsValidMetricName(model.LabelValue(result.Name)) {
+		if s.InvalidNamePrefix == "" {
+			return MappedMetric{DropReason: dropReasonInvalidName}, false
+		}
+		result.Name = s.InvalidNamePrefix + result.Name
+		result.prefixed = true
+	}
+	sources[labelSourceTags] = h.Tags
+	if h.Unit != "" && !unitInName {
+		sources[labelSourceTags] = copyLabels(h.Tags)
+		sources[labelSourceTags]["unit"] = h.Unit
+	}
+	result.Labels, result.labelConflicts = sources.assemble()
+	if p, ok := m.(mappingOptionsProvider); ok {
+		result.Labels, result.relabeled = relabel(p.relabelRules(), result.Labels)
+	}
+	// The expiry of a mapping takes precedence over the expiry overrides,
+	// which take precedence over the storage schemas.
+	if p, ok := m.(mappingOptionsProvider); ok && result.Expiry == 0 {
+		result.Expiry = overrideExpiry(p.expiryOverrides(), originalName)
+		if result.Expiry > 0 {
+			result.expirySource = expirySourceOverride
+		}
+	}
+	if s.StorageSchemas != nil && result.Expiry == 0 {
+		result.Expiry = s.StorageSchemas.Expiry(originalName)
+		if result.Expiry > 0 {
+			result.expirySource = expirySourceStorageSchema
+		}
+	}
+	result.Name = s.MetricPrefix + result.Name
+	return result, true
+}
+
+// ingestLine parses and maps a line with m, counting and logging the
+// outcome. The sample of the returned line, if any, is to be stored by the
+// caller.
+func (c *Collector) ingestLine(line string, source LineSource, m MetricMapper) parsedLine {
+	line = strings.TrimSpace(line)
+	c.totals.line()
+	level.Debug(c.logger).Log("msg", "Incoming line", "line", line, "source", source.Address, "protocol", source.Protocol)
+	r := c.parseLine(line, m)
+	if r.normalized {
+		normalizedPaths.Inc()
+	}
+	switch {
+	case r.invalid != "":
+		c.invalidLine(line, source, r.invalid, r.keyvals...)
+		return r
+	case r.dropReason != "":
+		c.dropSample(line, r.originalName, r.dropReason)
+		return r
+	}
+
+	if r.prefixed {
+		prefixedNames.Inc()
+	}
+	if r.swapped {
+		fieldOrderCorrections.Inc()
+	}
+	if r.commaDecimal {
+		commaDecimalValues.Inc()
+	}
+	if r.sanitizedLabels > 0 {
+		sanitizedLabelValues.Add(float64(r.sanitizedLabels))
+	}
+	for _, field := range r.truncated {
+		lengthTruncations.WithLabelValues(field).Inc()
+	}
+	if r.coerced != "" {
+		valueCoercions.WithLabelValues(r.coerced).Inc()
+	}
+	if r.suffix != "" {
+		valueSuffixConversions.WithLabelValues(r.suffix).Inc()
+	}
+	if r.sanitized != nil {
+		sanitizedNames.Inc()
+		if c.sanitized != nil {
+			c.sanitized.add(r.sanitized.original, r.sanitized.name)
+		}
+		if r.sanitized.mapping != "" {
+			c.recordSanitizedMapping(m, r.sanitized)
+		}
+	}
+	for _, rule := range r.relabeled {
+		relabelApplications.WithLabelValues(rule.Label, string(rule.Action)).Inc()
+	}
+	for _, conflict := range r.labelConflicts {
+		labelConflicts.WithLabelValues(conflict.overridden.String(), conflict.kept.String()).Inc()
+		level.Debug(c.logger).Log("msg", "Label set by more than one source", "path", r.originalName, "label", conflict.label,
+			"overridden", conflict.overridden, "kept", conflict.kept)
+	}
+	level.Debug(c.logger).Log("msg", "Processing sample", "sample", r.sample)
+	if c.ingestedValues != nil && !math.IsNaN(r.sample.Value) {
+		c.ingestedValues.Observe(math.Abs(r.sample.Value))
+	}
+	if c.replay != nil {
+		c.replay.observe(r.sample.Timestamp)
+	}
+	if !isSelftest(r.originalName) {
+		now := time.Now()
+		lastProcessed.Set(float64(now.UnixNano()) / 1e9)
+		atomic.StoreInt64(c.lastProcessedAt, now.UnixNano())
+	}
+	return r
+}
+
+// parsedLine is the outcome of parsing and mapping a line: either a sample,
+// or the reason the line is invalid or its metric dropped.
+type parsedLine struct {
+	originalName string
+	sample       *Sample
+	// invalid is the reason the line cannot be parsed, further described
+	// by keyvals.
+	invalid string
+	keyvals []interface{}
+	// dropReason is why the mapping drops the metric of the line.
+	dropReason string
+	// normalized is set if empty components were removed from the path.
+	normalized bool
+	// relabeled are the relabeling rules that changed a label value.
+	relabeled []*relabelRule
+	// labelConflicts are the labels set by more than one source.
+	labelConflicts []labelConflict
+	// prefixed is set if the name was prefixed to make it valid.
+	prefixed bool
+	// sanitized is set if invalid characters were replaced in the name.
+	sanitized *sanitizedName
+	// coerced is the value that was replaced by a number, if any.
+	coerced string
+	// suffix is the unit suffix the value was converted from, if any.
+	suffix string
+	// commaDecimal is set if the value had a comma as decimal separator.
+	commaDecimal bool
+	// swapped is set if the value and timestamp fields were swapped.
+	swapped bool
+	// truncated are the fields shortened to their length limit.
+	truncated []string
+	// sanitizedLabels is the number of label values that were sanitized.
+	sanitizedLabels int
+}
+
+// parseLine parses a trimmed line and maps it with mapper without any side
+// effects, so that lines can be tried without being ingested.
+func (c *Collector) parseLine(line string, mapper MetricMapper) parsedLine {
+	if c.carbon2 && isCarbon2(line) {
+		l, err := parseCarbon2(line)
+		if err == nil {
+			m, ok := mapCarbon2(mapper, l, c.settings)
+			if !ok {
+				return parsedLine{originalName: l.originalName(), dropReason: m.DropReason}
+			}
+			return c.limits.limitLengths(sanitizeLabelValues(parseValues(l.originalName(), m, l.Value, l.Timestamp, c.values)))
+		}
+		level.Debug(c.logger).Log("msg", "Parsing line as plaintext after carbon2 failed", "line", line, "err", err)
+	}
+
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 {
+		return parsedLine{invalid: "part_count", keyvals: []interface{}{"parts", len(parts)}}
+	}
+	originalName, normalized := normalizePath(parts[0])
+	if normalized && (c.strictPaths || originalName == "") {
+		return parsedLine{originalName: parts[0], invalid: "malformed_path"}
+	}
+	m, ok := MapMetric(mapper, originalName, c.settings)
+	if !ok {
+		return parsedLine{originalName: originalName, dropReason: m.DropReason, normalized: normalized}
+	}
+	value, timestamp, swapped := parts[1], parts[2], false
+	if c.lenientOrder {
+		value, timestamp, swapped = fixFieldOrder(value, timestamp)
+	}
+	r := parseValues(originalName, m, value, timestamp, c.values)
+	r.normalized = normalized
+	r.swapped = swapped
+	return c.limits.limitLengths(sanitizeLabelValues(r))
+}
+
+// The range of timestamps fixFieldOrder takes for an epoch timestamp, from
+// 2000 to 2100.
+const (
+	minPlausibleEpoch = 946684800
+	maxPlausibleEpoch = 4102444800
+)
+
+// fixFieldOrder swaps the value and timestamp fields of a plaintext line if
+// the value looks like a Unix timestamp and the timestamp does not, as sent
+// by agents writing "<path> <timestamp> <value>". Lines whose fields both
+// look like timestamps, such as the time of an event sent as the value, are
+// left as they are. It returns true if the fields were swapped.
+func fixFieldOrder(value, timestamp string) (string, string, bool) {
+	if looksLikeEpoch(value) && !looksLikeEpoch(timestamp) {
+		return timestamp, value, true
+	}
+	return value, timestamp, false
+}
+
+func looksLikeEpoch(s string) bool {
+	f, err := strconv.ParseFloat(s, 64)
+	return err == nil && f >= minPlausibleEpoch && f < maxPlausibleEpoch
+}
+
+// normalizePath removes the empty components of a metric path, as left by
+// consecutive, leading or trailing dots. It returns false if there were none.
+func normalizePath(path string) (string, bool) {
+	if !strings.Contains(path, "..") && !strings.HasPrefix(path, ".") && !strings.HasSuffix(path, ".") {
+		return path, false
+	}
+	components := strings.Split(path, ".")
+	kept := components[:0]
+	for _, c := range components {
+		if c != "" {
+			kept = append(kept, c)
+		}
+	}
+	return strings.Join(kept, "."), true
+}
+
+// valueOptions configures how values that are not numbers are parsed.
+type valueOptions struct {
+	// coercions maps lower case values that are not numbers to numbers.
+	coercions map[string]float64
+	// commaDecimal accepts a comma as the decimal separator.
+	commaDecimal bool
+	// suffixes maps the unit suffixes accepted after a number to their
+	// multipliers.
+	suffixes map[string]float64
+}
+
+// DefaultValueSuffixes are common unit suffixes of values, such as those
+// written by Telegraf, with the multipliers converting them to the base unit.
+// "m" is left out, as it is ambiguous between milli and minutes.
+var DefaultValueSuffixes = map[string]float64{
+	"ns": 1e-9,
+	"us": 1e-6,
+	"µs": 1e-6,
+	"ms": 1e-3,
+	"s":  1,
+	"k":  1e3,
+	"K":  1e3,
+	"M":  1e6,
+	"G":  1e9,
+	"T":  1e12,
+}
+
+// parseSuffixed parses a number followed by one of the unit suffixes, e.g.
+// "42ms", into the number times the suffix's multiplier. It returns the
+// suffix, or false if s is not a number with a known suffix.
+func parseSuffixed(s string, suffixes map[string]float64) (float64, string, bool) {
+	number := strings.TrimRightFunc(s, func(r rune) bool {
+		return !unicode.IsDigit(r) && r != '.'
+	})
+	suffix := s[len(number):]
+	multiplier, ok := suffixes[suffix]
+	if !ok || number == "" {
+		return 0, "", false
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, "", false
+	}
+	return value * multiplier, suffix, true
+}
+
+// parseCommaDecimal parses a number written with a single comma as the
+// decimal separator, e.g. "3,14". Values that also contain a dot are
+// rejected, as the comma may then be a thousands separator.
+func parseCommaDecimal(s string) (float64, bool) {
+	if strings.Count(s, ",") != 1 || strings.Contains(s, ".") {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(strings.Replace(s, ",", ".", 1), 64)
+	return value, err == nil
+}
+
+// parseValues parses the value and timestamp of a line whose metric has been
+// mapped into the resulting sample. A value that is not a number is parsed
+// with a comma as the decimal separator, converted from its unit suffix, or
+// replaced by its number in the coercions, as configured by opts, and then
+// scaled like any other.
+func parseValues(originalName string, m MappedMetric, rawValue, rawTimestamp string, opts valueOptions) parsedLine {
+	r := parsedLine{originalName: originalName, relabeled: m.relabeled, labelConflicts: m.labelConflicts, prefixed: m.prefixed}
+	if m.sanitized != "" {
+		r.sanitized = &sanitizedName{original: m.sanitized, name: m.Name, mapping: m.sanitizedMapping}
+	}
+	value, err := strconv.ParseFloat(rawValue, 64)
+	if err != nil && opts.commaDecimal {
+		var ok bool
+		if value, ok = parseCommaDecimal(rawValue); ok {
+			err, r.commaDecimal = nil, true
+		}
+	}
+	if err != nil && len(opts.suffixes) > 0 {
+		var ok bool
+		if value, r.suffix, ok = parseSuffixed(rawValue, opts.suffixes); ok {
+			err = nil
+		}
+	}
+	if err != nil {
+		coerced, ok := opts.coercions[strings.ToLower(rawValue)]
+		if !ok {
+			r.invalid, r.keyvals = "value", []interface{}{"err", err}
+			return r
+		}
+		value, r.coerced = coerced, strings.ToLower(rawValue)
+	}
+	value *= m.Scale
+	if m.DecimalPlaces != nil {
+		value = roundValue(value, *m.DecimalPlaces)
+	}
+	timestamp, err := strconv.ParseFloat(rawTimestamp, 64)
+	if err != nil {
+		r.invalid, r.keyvals = "timestamp", []interface{}{"err", err}
+		return r
+	}
+	r.sample = &Sample{
+		OriginalName: originalName,
+		Name:         m.Name,
+		Value:        value,
+		Labels:       m.Labels,
+		Type:         m.Type,
+		Accumulate:   m.Accumulate,
+		Delta:        m.Delta,
+		Aggregate:    m.Aggregate,
+		Expiry:       m.Expiry,
+		expirySource: m.expirySource,
+		Timestamp:    time.Unix(int64(timestamp), int64(math.Mod(timestamp, 1.0)*1e9)),
+	}
+	return r
+}
+
+// roundValue rounds v to places decimal places. It rounds the decimal
+// representation, so that e.g. 0.30000000000000004 becomes exactly the float
+// closest to 0.3, and values too large to have a fractional part are kept.
+// Exact halves are rounded to even.
+func roundValue(v float64, places int) float64 {
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return v
+	}
+	rounded, err := strconv.ParseFloat(strconv.FormatFloat(v, 'f', places, 64), 64)
+	if err != nil {
+		return v
+	}
+	// A negative value rounded to zero is exported as 0, not -0.
+	if rounded == 0 {
+		return 0
+	}
+	return rounded
+}
+
+// invalidLine logs and drops a line that cannot be parsed. The log entry
+// always has the same fields, so that failures can be searched by reason and
+// source; extra key-value pairs describe the failure further.
+func (c *Collector) invalidLine(line string, source LineSource, reason string, keyvals ...interface{}) {
+	keyvals = append([]interface{}{
+		"msg", "Invalid line",
+		"reason", reason,
+		"line", truncateLine(line, maxLoggedLineLength),
+		"source", source.Address,
+		"protocol", source.Protocol,
+	}, keyvals...)
+	level.Info(c.logger).Log(keyvals...)
+	invalidLines.WithLabelValues(reason, source.protocolLabel()).Inc()
+	c.totals.count(c.totals.invalidLines, reason)
+	c.totals.outcome(outcomeInvalid)
+	c.dropLine(line)
+}
+
+// truncateLine shortens line to at most n bytes without splitting a UTF-8
+// sequence, marking the cut with "...".
+func truncateLine(line string, n int) string {
+	if len(line) <= n {
+		return line
+	}
+	for n > 0 && !utf8.RuneStart(line[n]) {
+		n--
+	}
+	return line[:n] + "..."
+}
+
+// dropLine passes a line that is not stored to the dead letter output, if
+// one is configured.
+func (c *Collector) dropLine(line string) {
+	if c.deadLetter != nil {
+		c.deadLetter.send(line)
+	}
+}
+
+// ProcessedWithin reports whether a sample was processed within the given
+// window before now. The collector's creation counts as processing so that a
+// freshly started exporter is given the window to receive its first sample.
+func (c *Collector) ProcessedWithin(window time.Duration, now time.Time) bool {
+	last := c.LastProcessedTime()
+	if last.IsZero() {
+		last = c.createdAt
+	}
+	return now.Sub(last) <= window
+}
+
+// InStartupGrace reports whether now is within the startup grace period,
+// giving senders time to send their data again after a restart.
+func (c *Collector) InStartupGrace(now time.Time) bool {
+	return now.Before(c.graceUntil)
+}
+
+// expired reports whether the sample has expired at now, by its own expiry
+// or that of the collector. In backfill mode samples never expire.
+func (c *Collector) expired(s *Sample, now time.Time) bool {
+	if c.backfill {
+		return false
+	}
+	expiry, _ := c.effectiveExpiry(s)
+	if c.inProbation(s) && c.probationExpiry > 0 && c.probationExpiry < expiry {
+		expiry = c.probationExpiry
+	}
+	return now.Sub(s.Timestamp) > expiry
+}
+
+// The sources of the expiry of a sample.
+const (
+	expirySourceDefault       = "default"
+	expirySourceMapping       = "mapping"
+	expirySourceOverride      = "expiry_override"
+	expirySourceStorageSchema = "storage_schema"
+	// expirySourceSample is the source of an Expiry set by a library user.
+	expirySourceSample = "sample"
+)
+
+// effectiveExpiry returns how long s is exported, and whether that is set by
+// its mapping, an expiry override, the storage schemas or the sample expiry
+// of the collector.
+func (c *Collector) effectiveExpiry(s *Sample) (time.Duration, string) {
+	if s.Expiry == 0 {
+		return c.SampleExpiry(), expirySourceDefault
+	}
+	if s.expirySource == "" {
+		return s.Expiry, expirySourceSample
+	}
+	return s.Expiry, s.expirySource
+}
+
+// expiryOverrides returns the number of stored samples whose expiry is not
+// the sample expiry of the collector.
+func (c *Collector) expiryOverrides() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, s := range c.samples {
+		if s.Expiry != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// CurrentSamples returns the stored samples that have not expired at now,
+// leaving out those of self-tests, with the identity labels added.
+func (c *Collector) CurrentSamples(now time.Time) []*Sample {
+	samples := c.snapshot()
+	identity := c.IdentityLabels()
+	current := samples[:0]
+	for _, s := range samples {
+		if c.expired(s, now) || c.inProbation(s) {
+			continue
+		}
+		if identity != nil {
+			// Stored samples are never modified.
+			labeled := *s
+			labeled.Labels = identity.apply(s.Labels)
+			s = &labeled
+		}
+		current = append(current, s)
+	}
+	return current
+}
+
+// snapshot returns the stored samples, leaving out those of self-tests. As
+// stored samples are never modified, the result is a consistent view of the
+// store at a single point in time, however long the caller takes to use it
+// while ingestion continues.
+func (c *Collector) snapshot() []*Sample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	samples := make([]*Sample, 0, len(c.samples))
+	for _, s := range c.samples {
+		if !isSelftest(s.OriginalName) {
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
+
+// LastProcessedTime returns the time of the last processed sample, or the zero
+// time if there was none.
+func (c *Collector) LastProcessedTime() time.Time {
+	last := atomic.LoadInt64(c.lastProcessedAt)
+	if last == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, last)
+}
+
+// SampleCount returns the number of samples in the store.
+func (c *Collector) SampleCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.samples)
+}
+
+func (c *Collector) processSamples() {
+	pipelineGoroutines.WithLabelValues("sample").Inc()
+	defer pipelineGoroutines.WithLabelValues("sample").Dec()
+	heartbeat := loopHeartbeat.WithLabelValues("sample")
+	heartbeat.SetToCurrentTime()
+	c.watchdog.samples.alive(time.Now())
+	heartbeatTicker := time.NewTicker(heartbeatInterval)
+	defer heartbeatTicker.Stop()
+	sweep := c.newTimer(c.nextSweep(true))
+	defer sweep.Stop()
+
+	for {
+		select {
+		case sample := <-c.sampleCh:
+			c.storeSample(sample)
+		case batch := <-c.batchCh:
+			rejections := make([]error, len(batch.samples))
+			for i, sample := range batch.samples {
+				rejections[i] = c.storeSample(sample)
+			}
+			batch.done <- rejections
+		case name := <-c.removeCh:
+			c.mu.Lock()
+			if _, ok := c.samples[name]; ok {
+				delete(c.samples, name)
+				c.stringsStale = true
+			}
+			c.mu.Unlock()
+		case names := <-c.expireCh:
+			c.expireNamed(names, c.clock.Now())
+		case <-sweep.C():
+			c.expireSamples(c.clock.Now())
+			sweep.Reset(c.nextSweep(false))
+		case <-c.evictCh:
+			c.evictOldest(memoryEvictFraction)
+		case <-heartbeatTicker.C:
+			heartbeat.SetToCurrentTime()
+		case <-c.done:
+			return
+		}
+		c.watchdog.samples.alive(time.Now())
+	}
+}
+
+// storeSample inserts or replaces the stored sample for the sample's original
+// name. Label maps and names are deduplicated against the existing sample and
+// the intern table so that repeated strings share backing storage. It must
+// only be called from the goroutine that owns the sample store. It returns
+// the rejection if the sample is not stored.
+func (c *Collector) storeSample(sample *Sample) error {
+	if reason, err := validateSample(sample); err != nil {
+		return c.rejectSample(sample, reason, err)
+	}
+
+	existing := c.samples[sample.OriginalName]
+	if existing == nil {
+		if err := c.rejectNewSeries(sample); err != nil {
+			return err
+		}
+	}
+	if sample.Delta {
+		if sample.Value < 0 {
+			return c.rejectSample(sample, "negative_delta", fmt.Errorf("negative increment %v of delta counter %s", sample.Value, sample.Name))
+		}
+		if !accumulateDelta(sample, existing) {
+			return c.rejectSample(sample, "out_of_order", fmt.Errorf("sample at %s is older than the last sample of delta counter %s", sample.Timestamp, sample.Name))
+		}
+	} else if existing != nil && existing.Timestamp.Equal(sample.Timestamp) {
+		if v, ok := sample.Aggregate.combine(existing.Value, sample.Value); ok {
+			sample.Value = v
+		}
+	}
+	if sample.Accumulate && !accumulate(sample, existing) {
+		return c.rejectSample(sample, "out_of_order", fmt.Errorf("sample at %s is older than the last sample of accumulating counter %s", sample.Timestamp, sample.Name))
+	}
+	if existing != nil && labelsEqual(existing.Labels, sample.Labels) {
+		sample.Labels = existing.Labels
+	} else {
+		sample.Labels = c.strings.internLabels(sample.Labels)
+	}
+	sample.Name = c.strings.intern(sample.Name)
+	sample.updates = 1
+	if existing != nil {
+		sample.updates = existing.updates + 1
+	}
+
+	c.mu.Lock()
+	c.samples[sample.OriginalName] = sample
+	c.totals.series(len(c.samples))
+	if c.tombstones != nil {
+		// The series is current again.
+		delete(c.tombstones.pending, sample.OriginalName)
+	}
+	c.mu.Unlock()
+	if !isSelftest(sample.OriginalName) {
+		// A path is new if it was never seen or its sample expired, so
+		// that churn shows up as created series.
+		if existing == nil {
+			seriesCreated.Inc()
+		} else {
+			sampleUpdates.Inc()
+		}
+		c.totals.outcome(outcomeAccepted)
+		if c.intervals != nil {
+			c.intervals.observe(sample.Name, sample, existing, c.clock.Now())
+		}
+	}
+	return nil
+}
+
+// accumulate replaces the received value of a sample of an accumulating
+// counter with a total that keeps increasing across counter resets, based on
+// the previous sample of the series. Any decrease of the received value is
+// taken as a reset to zero, including a wrap-around of the sender's counter.
+// It returns false if the sample is older than the previous one, as the total
+// cannot be corrected retroactively. The state lives in the stored sample, so
+// it expires with the series.
+func accumulate(sample, existing *Sample) bool {
+	sample.Raw = sample.Value
+	if existing == nil || !existing.Accumulate {
+		return true
+	}
+	if sample.Timestamp.Before(existing.Timestamp) {
+		return false
+	}
+	increase := sample.Raw - existing.Raw
+	if increase < 0 {
+		increase = sample.Raw
+	}
+	sample.Value = existing.Value + increase
+	return true
+}
+
+// accumulateDelta replaces the increment received in a sample of a delta
+// counter with the running total of the increments of its series. An
+// increment with the same timestamp as the previous one is combined with it
+// by the sample's aggregation, and replaces it by default, so that a line
+// sent twice is not counted twice. It returns false if the sample is older
+// than the previous one, as a late increment cannot be told from a resent
+// one. The state lives in the stored sample, so it expires with the series.
+func accumulateDelta(sample, existing *Sample) bool {
+	sample.Raw = sample.Value
+	if existing == nil || !existing.Delta {
+		return true
+	}
+	if sample.Timestamp.Before(existing.Timestamp) {
+		return false
+	}
+	total := existing.Value
+	if sample.Timestamp.Equal(existing.Timestamp) {
+		total -= existing.Raw
+		if v, ok := sample.Aggregate.combine(existing.Raw, sample.Raw); ok {
+			sample.Raw = v
+		}
+	}
+	sample.Value = total + sample.Raw
+	return true
+}
+
+// expireSamples garbage collects samples that have expired at now and, if
+// any samples were removed since the last rebuild, rebuilds the intern table
+// from the strings still referenced by the remaining samples.
+func (c *Collector) expireSamples(now time.Time) {
+	c.mu.Lock()
+	for k, sample := range c.samples {
+		if c.expired(sample, now) {
+			delete(c.samples, k)
+			c.expiredSample(sample)
+			c.stringsStale = true
+		}
+	}
+	c.mu.Unlock()
+	if c.stringsStale {
+		c.rebuildStrings()
+	}
+}
+
+// rebuildStrings replaces the intern table by one holding only the strings of
+// the stored samples, releasing those of removed samples. It must only be
+// called from the goroutine that owns the sample store, which is the only
+// user of the intern table.
+func (c *Collector) rebuildStrings() {
+	strings := newStringTable()
+	c.mu.Lock()
+	for _, sample := range c.samples {
+		strings.intern(sample.Name)
+		strings.addLabels(sample.Labels)
+	}
+	c.mu.Unlock()
+	c.strings = strings
+	c.stringsStale = false
+}
+
+// expireNamed removes the samples of the given original names that have
+// expired at now. Collect found them expired, but they are checked again, as
+// a new sample may have been stored for the name since then.
+func (c *Collector) expireNamed(names []string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range names {
+		sample, ok := c.samples[name]
+		if !ok || !c.expired(sample, now) {
+			continue
+		}
+		delete(c.samples, name)
+		c.expiredSample(sample)
+		c.stringsStale = true
+		collectExpirations.Inc()
+	}
+}
+
+// stringTable interns metric names and label sets so that the many samples
+// sharing them reference a single copy instead of one per sample.
+type stringTable struct {
+	strings   map[string]string
+	labelSets map[uint64][]map[string]string
+}
+
+func newStringTable() *stringTable {
+	return &stringTable{
+		strings:   map[string]string{},
+		labelSets: map[uint64][]map[string]string{},
+	}
+}
+
+func (t *stringTable) intern(s string) string {
+	if interned, ok := t.strings[s]; ok {
+		return interned
+	}
+	t.strings[s] = s
+	return s
+}
+
+// internLabels returns a label map equal to labels that is shared with all
+// other samples carrying the same label set. The returned map must not be
+// modified.
+func (t *stringTable) internLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return labels
+	}
+	h := hashLabels(labels)
+	for _, existing := range t.labelSets[h] {
+		if labelsEqual(existing, labels) {
+			return existing
+		}
+	}
+	interned := make(map[string]string, len(labels))
+	for k, v := range labels {
+		interned[t.intern(k)] = t.intern(v)
+	}
+	t.labelSets[h] = append(t.labelSets[h], interned)
+	return interned
+}
+
+// addLabels registers an already interned label set with the table.
+func (t *stringTable) addLabels(labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	h := hashLabels(labels)
+	for _, existing := range t.labelSets[h] {
+		if labelsEqual(existing, labels) {
+			return
+		}
+	}
+	for k, v := range labels {
+		t.intern(k)
+		t.intern(v)
+	}
+	t.labelSets[h] = append(t.labelSets[h], labels)
+}
+
+// hashLabels returns an order-independent hash of a label set.
+func hashLabels(labels map[string]string) uint64 {
+	var sum uint64
+	h := fnv.New64a()
+	for k, v := range labels {
+		h.Reset()
+		h.Write([]byte(k))
+		h.Write([]byte{0xff})
+		h.Write([]byte(v))
+		sum += h.Sum64()
+	}
+	return sum
+}
+
+func labelsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) || (a == nil) != (b == nil) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// Collect implements prometheus.Collector.
+func (c Collector) Collect(ch chan<- prometheus.Metric) {
+	start := time.Now()
+	ch <- lastProcessed
+	ch <- prometheus.MustNewConstMetric(sampleExpiryDesc, prometheus.GaugeValue, c.SampleExpiry().Seconds())
+	ch <- prometheus.MustNewConstMetric(expiryOverridesDesc, prometheus.GaugeValue, float64(c.expiryOverrides()))
+	ch <- prometheus.MustNewConstMetric(storedSamplesDesc, prometheus.GaugeValue, float64(c.SampleCount()))
+	c.collectPipelineHealth(ch)
+	c.collectIdentity(ch)
+	c.collectSelfLimits(ch)
+
+	emitted := c.emitSamples(ch, start)
+	collectSamples.Set(float64(emitted))
+	collectDuration.Observe(time.Since(start).Seconds())
+
+	invalidSamples.Collect(ch)
+	collectSkippedSamples.Collect(ch)
+	droppedSamples.Collect(ch)
+	duplicateLines.Collect(ch)
+	collectDuration.Collect(ch)
+	collectSamples.Collect(ch)
+	collectTruncations.Collect(ch)
+	collectOmitted.Collect(ch)
+	tombstonesEmitted.Collect(ch)
+	collectExpirations.Collect(ch)
+	seriesCreated.Collect(ch)
+	sampleUpdates.Collect(ch)
+	c.collectPipeline(ch)
+	mappingLoadFailures.Collect(ch)
+	mappingLastLoadSuccessful.Collect(ch)
+	deadLetterLines.Collect(ch)
+	deadLetterConnected.Collect(ch)
+	deadLetterConnFailures.Collect(ch)
+	if c.sources != nil {
+		c.sources.collect(ch)
+	}
+	if c.ingestedValues != nil {
+		c.ingestedValues.Collect(ch)
+	}
+}
+
+// emitSamples emits the stored samples, and returns how many it emitted.
+func (c Collector) emitSamples(ch chan<- prometheus.Metric, start time.Time) int {
+	var samples []*Sample
+	// Right after a restart only a few senders have sent data again, so the
+	// samples are withheld rather than exported as a partial set.
+	exporting := !c.readOnly && (!c.withholdInGrace || !c.InStartupGrace(start))
+	if exporting {
+		samples = c.snapshot()
+	}
+
+	// Samples that would make the registry fail the whole scrape are
+	// skipped here: several graphite paths mapping to the same series, and
+	// the same metric name being used with different types. In both cases
+	// the most recent sample wins, so that the choice is stable across
+	// scrapes.
+	now := c.clock.Now()
+	identity := c.IdentityLabels()
+	series := make(seriesSet, len(samples))
+	var expired []*Sample
+	for _, sample := range samples {
+		if c.expired(sample, now) {
+			// Series in probation were never exported, so there is
+			// nothing to tombstone. The sweep removes them.
+			if !c.inProbation(sample) {
+				expired = append(expired, sample)
+			}
+			continue
+		}
+		if c.inProbation(sample) {
+			continue
+		}
+		labels := identity.apply(sample.Labels)
+		if existing := series.get(sample.Name, labels); existing != nil {
+			if !preferSample(sample, existing) {
+				c.skipConflicting(sample, "duplicate", fmt.Errorf("metric %s was already collected with the same labels", sample.Name))
+				continue
+			}
+			c.skipConflicting(existing, "duplicate", fmt.Errorf("metric %s was already collected with the same labels", sample.Name))
+		}
+		series.set(sample, labels)
+	}
+	if maxSamples := c.MaxSamplesPerScrape(); maxSamples > 0 && series.len() > maxSamples {
+		collectOmitted.Add(float64(series.len() - maxSamples))
+		series = newestSamples(series, maxSamples)
+	}
+
+	exported := series.entries()
+	types := map[string]*Sample{}
+	for _, e := range exported {
+		if existing, ok := types[e.sample.Name]; !ok || preferSample(e.sample, existing) {
+			types[e.sample.Name] = e.sample
+		}
+	}
+
+	// Samples are emitted until the collect timeout, so that a slow scrape
+	// returns what it has rather than exceeding the scrape timeout.
+	emitted, checked := 0, 0
+	for _, e := range exported {
+		sample := e.sample
+		if c.collectTimeout > 0 && time.Since(start) > c.collectTimeout {
+			level.Warn(c.logger).Log("msg", "Collect timeout reached, skipping the remaining samples", "timeout", c.collectTimeout, "emitted", emitted, "skipped", len(exported)-checked)
+			collectTruncations.Inc()
+			break
+		}
+		checked++
+		if sample.Type != types[sample.Name].Type {
+			c.skipConflicting(sample, "type_conflict", fmt.Errorf("metric %s was already collected with a different type", sample.Name))
+			continue
+		}
+		m, err := prometheus.NewConstMetric(
+			prometheus.NewDesc(sample.Name, sample.HelpText(), []string{}, e.labels),
+			sample.Type,
+			sample.Value,
+		)
+		if err != nil {
+			c.skipConflicting(sample, "invalid_metric", err)
+			continue
+		}
+		// Backfilled samples are historical, so they must not be mistaken
+		// for current values by the scraper.
+		if c.backfill {
+			m = prometheus.NewMetricWithTimestamp(sample.Timestamp, m)
+		}
+		ch <- m
+		emitted++
+	}
+	if c.tombstones != nil && exporting {
+		c.collectTombstones(ch, expired, series, types)
+	}
+	if c.expireOnCollect && len(expired) > 0 {
+		names := make([]string, len(expired))
+		for i, sample := range expired {
+			names[i] = sample.OriginalName
+		}
+		// If the names of an earlier scrape are still pending, these are
+		// left to a later scrape or the next sweep.
+		select {
+		case c.expireCh <- names:
+		default:
+		}
+	}
+	return emitted
+}
+
+// SampleCollector returns a prometheus.Collector exporting only the stored
+// samples of c, without the exporter's own metrics, so that the samples of
+// several collectors can be served side by side. It is unchecked, as the
+// samples are not known in advance.
+func (c *Collector) SampleCollector() prometheus.Collector {
+	return sampleCollector{c}
+}
+
+type sampleCollector struct {
+	c *Collector
+}
+
+func (s sampleCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (s sampleCollector) Collect(ch chan<- prometheus.Metric) {
+	s.c.emitSamples(ch, time.Now())
+}
+
+// Describe implements prometheus.Collector.
+func (c Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lastProcessed.Desc()
+	ch <- sampleExpiryDesc
+	ch <- expiryOverridesDesc
+	ch <- storedSamplesDesc
+	mappingLoadFailures.Describe(ch)
+	mappingLastLoadSuccessful.Describe(ch)
+	deadLetterLines.Describe(ch)
+	deadLetterConnected.Describe(ch)
+	deadLetterConnFailures.Describe(ch)
+	invalidSamples.Describe(ch)
+	collectSkippedSamples.Describe(ch)
+	droppedSamples.Describe(ch)
+	duplicateLines.Describe(ch)
+	collectDuration.Describe(ch)
+	collectSamples.Describe(ch)
+	collectTruncations.Describe(ch)
+	collectOmitted.Describe(ch)
+	tombstonesEmitted.Describe(ch)
+	collectExpirations.Describe(ch)
+	seriesCreated.Describe(ch)
+	sampleUpdates.Describe(ch)
+	lineProcessingDuration.Describe(ch)
+	normalizedPaths.Describe(ch)
+	fieldOrderCorrections.Describe(ch)
+	commaDecimalValues.Describe(ch)
+	invalidLines.Describe(ch)
+	prefixedNames.Describe(ch)
+	sanitizedNames.Describe(ch)
+	mappedNamesSanitized.Describe(ch)
+	valueCoercions.Describe(ch)
+	valueSuffixConversions.Describe(ch)
+	relabelApplications.Describe(ch)
+	labelConflicts.Describe(ch)
+	sanitizedLabelValues.Describe(ch)
+	lengthTruncations.Describe(ch)
+	multiDatapointLines.Describe(ch)
+	probationDrops.Describe(ch)
+	parseThrottledLines.Describe(ch)
+	parseThrottledSeconds.Describe(ch)
+	memoryLimitChecks.Describe(ch)
+	memoryLimitEvictions.Describe(ch)
+	internalPanics.Describe(ch)
+	blockedSends.Describe(ch)
+	blockedSeconds.Describe(ch)
+	pipelineGoroutines.Describe(ch)
+	udpDroppedPackets.Describe(ch)
+	ch <- subsystemLastErrorDesc
+	loopHeartbeat.Describe(ch)
+	ch <- pipelineHealthyDesc
+	ch <- identityLabelsDesc
+	ch <- parseRateLimitDesc
+	ch <- memorySoftLimitDesc
+	ch <- memoryLimitExceededDesc
+	ch <- seriesLimitDesc
+	ch <- udpMaxPendingDesc
+	ch <- channelLengthDesc
+	ch <- channelCapacityDesc
+	ch <- activeConnectionsDesc
+	shutdownConnections.Describe(ch)
+	if c.sources != nil {
+		ch <- topSourceLinesDesc
+	}
+	if c.ingestedValues != nil {
+		c.ingestedValues.Describe(ch)
+	}
+}
+
+// collectPipeline reports the state of the ingestion pipeline.
+func (c Collector) collectPipeline(ch chan<- prometheus.Metric) {
+	lineProcessingDuration.Collect(ch)
+	normalizedPaths.Collect(ch)
+	fieldOrderCorrections.Collect(ch)
+	commaDecimalValues.Collect(ch)
+	invalidLines.Collect(ch)
+	prefixedNames.Collect(ch)
+	sanitizedNames.Collect(ch)
+	mappedNamesSanitized.Collect(ch)
+	valueCoercions.Collect(ch)
+	valueSuffixConversions.Collect(ch)
+	relabelApplications.Collect(ch)
+	labelConflicts.Collect(ch)
+	sanitizedLabelValues.Collect(ch)
+	lengthTruncations.Collect(ch)
+	multiDatapointLines.Collect(ch)
+	probationDrops.Collect(ch)
+	parseThrottledLines.Collect(ch)
+	parseThrottledSeconds.Collect(ch)
+	memoryLimitChecks.Collect(ch)
+	memoryLimitEvictions.Collect(ch)
+	internalPanics.Collect(ch)
+	blockedSends.Collect(ch)
+	blockedSeconds.Collect(ch)
+	pipelineGoroutines.Collect(ch)
+	udpDroppedPackets.Collect(ch)
+	collectSubsystemErrors(ch)
+	loopHeartbeat.Collect(ch)
+	ch <- prometheus.MustNewConstMetric(activeConnectionsDesc, prometheus.GaugeValue, float64(c.conns.len()))
+	shutdownConnections.Collect(ch)
+	for _, p := range []struct {
+		channel          string
+		length, capacity int
+	}{
+		{"line", len(c.lineCh), cap(c.lineCh)},
+		{"sample", len(c.sampleCh), cap(c.sampleCh)},
+	} {
+		ch <- prometheus.MustNewConstMetric(channelLengthDesc, prometheus.GaugeValue, float64(p.length), p.channel)
+		ch <- prometheus.MustNewConstMetric(channelCapacityDesc, prometheus.GaugeValue, float64(p.capacity), p.channel)
+	}
+}
+
+// rejectSample counts a sample that cannot be exported and logs it, sampled
+// so that a flood of bad samples does not flood the log as well. It returns
+// the rejection as an error.
+func (c *Collector) rejectSample(sample *Sample, reason string, err error) error {
+	invalidSamples.WithLabelValues(reason).Inc()
+	c.totals.count(c.totals.rejected, reason)
+	c.totals.outcome(outcomeRejected)
+	c.invalidLogger.Log("msg", "Invalid sample", "reason", reason, "name", sample.OriginalName, "err", err)
+	return &sampleRejection{reason: reason, err: err}
+}
+
+// skipConflicting counts a stored sample that a scrape left out because it
+// conflicts with another sample or cannot be exported, and logs it, sampled
+// like rejectSample. Every scrape skips it again until it is replaced, so it
+// is only counted and logged by the first. Unlike rejected samples, skipped
+// ones were stored, so they are not a line outcome.
+func (c Collector) skipConflicting(sample *Sample, reason string, err error) {
+	if !atomic.CompareAndSwapUint32(&sample.conflicted, 0, 1) {
+		return
+	}
+	collectSkippedSamples.WithLabelValues(reason).Inc()
+	c.totals.count(c.totals.skipped, reason)
+	c.invalidLogger.Log("msg", "Sample left out of scrape", "reason", reason, "name", sample.OriginalName, "err", err)
+}
+
+// sampleRejection is the reason a sample was not stored or exported.
+type sampleRejection struct {
+	reason string
+	err    error
+}
+
+func (r *sampleRejection) Error() string {
+	return r.err.Error()
+}
+
+// validateSample checks that the sample can be turned into a valid Prometheus
+// metric, returning the reason it cannot.
+func validateSample(sample *Sample) (string, error) {
+	if !model.IsValidMetricName(model.LabelValue(sample.Name)) {
+		return "invalid_name", fmt.Errorf("invalid metric name %q", sample.Name)
+	}
+	for k, v := range sample.Labels {
+		if !model.LabelName(k).IsValid() || strings.HasPrefix(k, model.ReservedLabelPrefix) {
+			return "invalid_label_name", fmt.Errorf("invalid label name %q", k)
+		}
+		if !utf8.ValidString(v) {
+			return "invalid_label_value", fmt.Errorf("invalid label value %q for label %q", v, k)
+		}
+	}
+	return "", nil
+}
+
+// newestSamples returns the n most recently updated of the series. Samples
+// with the same timestamp are ordered by name and path, so that the same
+// samples are chosen in every scrape.
+func newestSamples(series seriesSet, n int) seriesSet {
+	entries := series.entries()
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i].sample, entries[j].sample
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.After(b.Timestamp)
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.OriginalName < b.OriginalName
+	})
+	newest := make(seriesSet, n)
+	for _, e := range entries[:n] {
+		newest.set(e.sample, e.labels)
+	}
+	return newest
+}
+
+// preferSample reports whether a should be exported instead of b when both
+// cannot be exported together.
+func preferSample(a, b *Sample) bool {
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return a.Timestamp.After(b.Timestamp)
+	}
+	return a.OriginalName < b.OriginalName
+}
+
+// hashSeries returns a hash of the series of a sample. Different series may
+// share a hash.
+func hashSeries(name string, labels map[string]string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64() ^ hashLabels(labels)
+}
+
+// seriesEntry is a sample in a seriesSet, with the labels it is exported
+// with.
+type seriesEntry struct {
+	sample *Sample
+	labels map[string]string
+}
+
+// seriesSet holds at most one sample per series, keyed by the name and the
+// exported labels. The series are grouped by hashSeries and compared in
+// full, as in stringTable.internLabels, so that series sharing a hash are
+// kept apart.
+type seriesSet map[uint64][]seriesEntry
+
+// get returns the sample of the series, or nil if there is none.
+func (s seriesSet) get(name string, labels map[string]string) *Sample {
+	for _, e := range s[hashSeries(name, labels)] {
+		if e.sample.Name == name && sameLabels(e.labels, labels) {
+			return e.sample
+		}
+	}
+	return nil
+}
+
+// set makes sample the sample of its series, exported with labels.
+func (s seriesSet) set(sample *Sample, labels map[string]string) {
+	h := hashSeries(sample.Name, labels)
+	for i, e := range s[h] {
+		if e.sample.Name == sample.Name && sameLabels(e.labels, labels) {
+			s[h][i] = seriesEntry{sample: sample, labels: labels}
+			return
+		}
+	}
+	s[h] = append(s[h], seriesEntry{sample: sample, labels: labels})
+}
+
+func (s seriesSet) len() int {
+	n := 0
+	for _, entries := range s {
+		n += len(entries)
+	}
+	return n
+}
+
+func (s seriesSet) entries() []seriesEntry {
+	entries := make([]seriesEntry, 0, len(s))
+	for _, group := range s {
+		entries = append(entries, group...)
+	}
+	return entries
+}
+
+// sameLabels reports whether a and b are the same label set, a nil set
+// being the same as an empty one.
+func sameLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// sampledLogger logs at most one message per interval, reporting how many
+// messages were suppressed in between.
+type sampledLogger struct {
+	mu         sync.Mutex
+	logger     log.Logger
+	interval   time.Duration
+	last       time.Time
+	suppressed int
+}
+
+func newSampledLogger(logger log.Logger, interval time.Duration) *sampledLogger {
+	return &sampledLogger{logger: logger, interval: interval}
+}
+
+func (l *sampledLogger) Log(keyvals ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.last) < l.interval {
+		l.suppressed++
+		return
+	}
+	if l.suppressed > 0 {
+		keyvals = append(keyvals, "suppressed", l.suppressed)
+	}
+	level.Warn(l.logger).Log(keyvals...)
+	l.last = now
+	l.suppressed = 0
+}
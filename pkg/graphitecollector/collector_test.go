@@ -0,0 +1,1338 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockMapper struct {
+	labels  prometheus.Labels
+	present bool
+	name    string
+	action  mapper.ActionType
+}
+
+func (m *mockMapper) GetMapping(metricName string, metricType mapper.MetricType) (*mapper.MetricMapping, prometheus.Labels, bool) {
+
+	mapping := mapper.MetricMapping{Name: m.name, Action: m.action}
+
+	return &mapping, m.labels, m.present
+
+}
+
+func (m *mockMapper) InitFromFile(string) error {
+	return nil
+}
+
+// processLine ingests a line with the current mapper and queues its sample
+// for storage, bypassing the line queue. Sending "" to removeCh afterwards
+// waits until the sample is stored.
+func (c *Collector) processLine(line string, source LineSource) {
+	if r := c.ingestLine(line, source, c.Mapper()); r.sample != nil {
+		c.sendSample(r.sample)
+	}
+}
+
+func TestProcessLine(t *testing.T) {
+
+	type testCase struct {
+		line     string
+		name     string
+		labels   map[string]string
+		value    float64
+		present  bool
+		willFail bool
+		action   mapper.ActionType
+		strict   bool
+	}
+
+	testCases := []testCase{
+		{
+			line: "my.simple.metric 9001 1534620625",
+			name: "my_simple_metric",
+			labels: map[string]string{
+				"foo":  "bar",
+				"zip":  "zot",
+				"name": "alabel",
+			},
+			present: true,
+			value:   float64(9001),
+		},
+		{
+			line: "my.simple.metric.baz 9002 1534620625",
+			name: "my_simple_metric",
+			labels: map[string]string{
+				"baz": "bat",
+			},
+			present: true,
+			value:   float64(9002),
+		},
+		{
+			line:    "my.nomap.metric 9001 1534620625",
+			name:    "my_nomap_metric",
+			value:   float64(9001),
+			present: false,
+		},
+		{
+			line:     "my.nomap.metric.novalue 9001 ",
+			name:     "my_nomap_metric_novalue",
+			labels:   nil,
+			value:    float64(9001),
+			willFail: true,
+		},
+		{
+			line:     "my.mapped.metric.drop 55 1534620625",
+			name:     "my_mapped_metric_drop",
+			present:  true,
+			willFail: true,
+			action:   mapper.ActionTypeDrop,
+		},
+		{
+			line:     "my.mapped.strict.metric 55 1534620625",
+			name:     "my_mapped_strict_metric",
+			value:    float64(55),
+			present:  true,
+			willFail: false,
+			strict:   true,
+		},
+		{
+			line:     "my.mapped.strict.metric.drop 55 1534620625",
+			name:     "my_mapped_strict_metric_drop",
+			present:  false,
+			willFail: true,
+			strict:   true,
+		},
+	}
+
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.Run(context.Background())
+	defer c.Stop()
+
+	for _, testCase := range testCases {
+
+		if testCase.present {
+			c.SetMapper(&mockMapper{
+				name:    testCase.name,
+				labels:  testCase.labels,
+				action:  testCase.action,
+				present: testCase.present,
+			})
+		} else {
+			c.SetMapper(&mockMapper{
+				present: testCase.present,
+			})
+		}
+
+		c.settings.StrictMatch = testCase.strict
+		c.processLine(testCase.line, LineSource{})
+
+	}
+
+	c.Stop()
+	<-c.Stopped()
+	for _, k := range testCases {
+		originalName := strings.Split(k.line, " ")[0]
+		sample := c.samples[originalName]
+		if k.willFail {
+			assert.Nil(t, sample, "Found %s", k.name)
+		} else {
+			if assert.NotNil(t, sample, "Missing %s", k.name) {
+				assert.Equal(t, k.name, sample.Name)
+				assert.Equal(t, k.labels, sample.Labels)
+				assert.Equal(t, k.value, sample.Value)
+			}
+		}
+	}
+}
+
+func BenchmarkStoreSampleMemory(b *testing.B) {
+	const series = 1000000
+
+	for _, tc := range []struct {
+		interned bool
+		// storedHelp stores a help text per sample, as ingested samples
+		// did before it was derived from the name.
+		storedHelp bool
+	}{
+		{interned: false, storedHelp: true},
+		{interned: true, storedHelp: true},
+		{interned: true, storedHelp: false},
+	} {
+		b.Run(fmt.Sprintf("interned=%t/stored_help=%t", tc.interned, tc.storedHelp), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				c := &Collector{
+					mu:      &sync.Mutex{},
+					samples: map[string]*Sample{},
+					strings: newStringTable(),
+					totals:  newTotals(),
+				}
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				for j := 0; j < series; j++ {
+					sample := &Sample{
+						OriginalName: fmt.Sprintf("dc%d.host%d.app%d.metric%d", j%4, j%1000, j%10, j/1000),
+						Name:         fmt.Sprintf("app_metric%d", j/1000),
+						Labels: map[string]string{
+							"datacenter": fmt.Sprintf("dc%d", j%4),
+							"host":       fmt.Sprintf("host%d", j%1000),
+							"app":        "app" + strconv.Itoa(j%10),
+						},
+						Timestamp: time.Now(),
+					}
+					if tc.storedHelp {
+						sample.Help = fmt.Sprintf("Graphite metric %s", sample.Name)
+					}
+					if tc.interned {
+						c.storeSample(sample)
+					} else {
+						c.samples[sample.OriginalName] = sample
+					}
+				}
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/series, "heap-bytes/series")
+				runtime.KeepAlive(c)
+			}
+		})
+	}
+}
+
+func BenchmarkProcessLine(b *testing.B) {
+	for _, observe := range []bool{false, true} {
+		b.Run(fmt.Sprintf("observe_values=%t", observe), func(b *testing.B) {
+			c := NewCollector(Options{Logger: log.NewNopLogger(), ObserveValues: observe})
+			c.Run(context.Background())
+			defer c.Stop()
+			lines := make([]string, 1000)
+			for i := range lines {
+				lines[i] = fmt.Sprintf("app%d.requests %d 1534620625", i%10, i*i)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.processLine(lines[i%len(lines)], LineSource{})
+			}
+		})
+	}
+}
+
+func TestObserveValues(t *testing.T) {
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	assert.Equal(t, 0, testutil.CollectAndCount(c, "graphite_ingested_values"), "disabled by default")
+
+	c = NewCollector(Options{Logger: log.NewNopLogger(), ObserveValues: true})
+	c.Run(context.Background())
+	defer c.Stop()
+	for _, line := range []string{"a.b 0.5 100", "a.b -2000 100", "a.b 1e15 100", "a.b NaN 100"} {
+		c.processLine(line, LineSource{})
+	}
+
+	m := &dto.Metric{}
+	assert.NoError(t, c.ingestedValues.Write(m))
+	h := m.GetHistogram()
+	assert.Equal(t, uint64(3), h.GetSampleCount(), "NaN is not observed")
+	// cumulative returns the count of the bucket with the given upper bound,
+	// which is only approximately a power of ten.
+	cumulative := func(bound float64) uint64 {
+		for _, b := range h.GetBucket() {
+			if math.Abs(b.GetUpperBound()-bound) <= bound*1e-9 {
+				return b.GetCumulativeCount()
+			}
+		}
+		t.Fatalf("no bucket with upper bound %g", bound)
+		return 0
+	}
+	assert.Equal(t, uint64(0), cumulative(0.1))
+	assert.Equal(t, uint64(1), cumulative(1))
+	assert.Equal(t, uint64(2), cumulative(10000))
+	assert.Equal(t, uint64(2), cumulative(1e14))
+}
+
+func TestCollectSkipsInvalidSamples(t *testing.T) {
+	invalidLabels := testutil.ToFloat64(invalidSamples.WithLabelValues("invalid_label_name"))
+	duplicates := testutil.ToFloat64(collectSkippedSamples.WithLabelValues("duplicate"))
+	typeConflicts := testutil.ToFloat64(collectSkippedSamples.WithLabelValues("type_conflict"))
+
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.Run(context.Background())
+	defer c.Stop()
+
+	c.SetMapper(&mockMapper{
+		name:    "bad_label_metric",
+		labels:  map[string]string{"bad-label": "x"},
+		present: true,
+	})
+	c.processLine("my.bad.label.metric 1 "+strconv.FormatInt(time.Now().Unix(), 10), LineSource{})
+	c.SetMapper(&mockMapper{
+		name:    "good_metric",
+		labels:  map[string]string{"foo": "bar"},
+		present: true,
+	})
+	c.processLine("my.good.metric 2 "+strconv.FormatInt(time.Now().Unix(), 10), LineSource{})
+	c.processLine("my.duplicate.good.metric 3 "+strconv.FormatInt(time.Now().Unix(), 10), LineSource{})
+	c.Stop()
+	<-c.Stopped()
+
+	assert.Nil(t, c.samples["my.bad.label.metric"], "invalid sample was stored")
+
+	// Samples that are only invalid together must be caught at collect time.
+	c.samples["my.conflicting.type"] = &Sample{
+		OriginalName: "my.conflicting.type",
+		Name:         "good_metric",
+		Labels:       map[string]string{"foo": "baz"},
+		Type:         prometheus.CounterValue,
+		Timestamp:    time.Now().Add(-time.Minute),
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	// Conflicts are counted once per sample, not once per scrape.
+	exportedSamples(t, c)
+
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), "\ngood_metric{foo=\"bar\"} 3\n")
+	assert.NotContains(t, rec.Body.String(), "bad_label_metric")
+	assert.NotContains(t, rec.Body.String(), `good_metric{foo="baz"}`)
+	assert.Equal(t, invalidLabels+1, testutil.ToFloat64(invalidSamples.WithLabelValues("invalid_label_name")))
+	assert.Equal(t, duplicates+1, testutil.ToFloat64(collectSkippedSamples.WithLabelValues("duplicate")))
+	assert.Equal(t, typeConflicts+1, testutil.ToFloat64(collectSkippedSamples.WithLabelValues("type_conflict")))
+}
+
+func TestSeriesSetHashCollision(t *testing.T) {
+	a := &Sample{Name: "load", Labels: map[string]string{"app": "web"}}
+	b := &Sample{Name: "load", Labels: map[string]string{"app": "db"}}
+	// b is filed under the hash of a, as if their hashes collided.
+	series := seriesSet{hashSeries(a.Name, a.Labels): {{sample: b, labels: b.Labels}}}
+	assert.Nil(t, series.get(a.Name, a.Labels), "a series sharing a hash is a different series")
+	series.set(a, a.Labels)
+	assert.Equal(t, 2, series.len())
+	assert.Equal(t, a, series.get(a.Name, a.Labels))
+
+	newer := &Sample{Name: "load", Labels: map[string]string{"app": "web"}}
+	series.set(newer, newer.Labels)
+	assert.Equal(t, 2, series.len())
+	assert.Equal(t, newer, series.get(a.Name, a.Labels))
+
+	empty := &Sample{Name: "up"}
+	series.set(empty, nil)
+	assert.Equal(t, empty, series.get("up", map[string]string{}), "no labels are the same as empty labels")
+}
+
+func TestCollectTimeout(t *testing.T) {
+
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.SetMapper(&mockMapper{})
+	c.Run(context.Background())
+	defer c.Stop()
+	for i := 0; i < 3; i++ {
+		c.processLine(fmt.Sprintf("my.metric.%d 1 %d", i, time.Now().Unix()), LineSource{})
+	}
+	c.Stop()
+	<-c.Stopped()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Body.String()
+	}
+
+	body := scrape()
+	assert.Contains(t, body, "my_metric_2 1")
+	assert.Contains(t, body, "graphite_collect_samples 3")
+	assert.Contains(t, body, "graphite_collect_duration_seconds_count")
+
+	truncations := testutil.ToFloat64(collectTruncations)
+	c.collectTimeout = time.Nanosecond
+	reg = prometheus.NewRegistry()
+	reg.MustRegister(c)
+	body = scrape()
+	assert.NotContains(t, body, "my_metric_")
+	assert.Contains(t, body, "graphite_collect_samples 0")
+	assert.Equal(t, truncations+1, testutil.ToFloat64(collectTruncations))
+}
+
+func TestDefaultMetricType(t *testing.T) {
+
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: app.*.requests
+  name: requests_total
+  type: counter
+- match: app.*.sessions
+  name: sessions
+`))
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.SetMapper(m)
+	c.settings.DefaultType = MetricTypeUntyped
+	c.Run(context.Background())
+	defer c.Stop()
+	now := time.Now().Unix()
+	c.processLine(fmt.Sprintf("app.web.requests 1 %d", now), LineSource{})
+	c.processLine(fmt.Sprintf("app.web.sessions 2 %d", now), LineSource{})
+	c.processLine(fmt.Sprintf("my.unmapped 3 %d", now), LineSource{})
+	c.Stop()
+	<-c.Stopped()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := rec.Body.String()
+	assert.Contains(t, body, "# TYPE requests_total counter\n")
+	assert.Contains(t, body, "# TYPE sessions untyped\n")
+	assert.Contains(t, body, "# TYPE my_unmapped untyped\n")
+}
+
+func TestProcessedWithin(t *testing.T) {
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.SetMapper(&mockMapper{})
+	c.Run(context.Background())
+	defer c.Stop()
+
+	start := time.Now()
+	assert.True(t, c.ProcessedWithin(time.Minute, start), "a new collector should be within the window")
+	assert.False(t, c.ProcessedWithin(time.Minute, start.Add(2*time.Minute)), "no sample was processed")
+
+	c.processLine("my.metric 1 1534620625", LineSource{})
+	assert.True(t, c.ProcessedWithin(time.Minute, time.Now().Add(30*time.Second)))
+	assert.False(t, c.ProcessedWithin(time.Minute, time.Now().Add(2*time.Minute)))
+
+	// Lines that fail to parse do not count as processed.
+	processed := atomic.LoadInt64(c.lastProcessedAt)
+	c.processLine("my.metric invalid 1534620625", LineSource{})
+	assert.Equal(t, processed, atomic.LoadInt64(c.lastProcessedAt))
+}
+
+func TestCurrentSamples(t *testing.T) {
+	c := NewCollector(Options{Mapper: &mockMapper{}, SampleExpiry: time.Minute})
+	c.Run(context.Background())
+	defer c.Stop()
+
+	now := time.Now()
+	c.ProcessLine(fmt.Sprintf("new.metric 1 %d", now.Unix()))
+	c.ProcessLine(fmt.Sprintf("old.metric 2 %d", now.Add(-time.Hour).Unix()))
+	c.ProcessLine(fmt.Sprintf("%s1 3 %d", selftestPrefix, now.Unix()))
+	c.ProcessReader(strings.NewReader(fmt.Sprintf("other.metric 4 %d\n", now.Unix())))
+	assert.Eventually(t, func() bool { return c.SampleCount() == 4 }, time.Second, time.Millisecond)
+
+	var names []string
+	for _, s := range c.CurrentSamples(now) {
+		names = append(names, s.OriginalName)
+	}
+	assert.ElementsMatch(t, []string{"new.metric", "other.metric"}, names, "expired and self-test samples are left out")
+}
+
+func TestSeriesChurn(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	c := NewCollector(Options{Logger: log.NewNopLogger(), Mapper: &mockMapper{}, Clock: clock, SampleExpiry: time.Minute})
+	c.Run(context.Background())
+	defer c.Stop()
+	created, updates := testutil.ToFloat64(seriesCreated), testutil.ToFloat64(sampleUpdates)
+
+	c.processLine("a.metric 1 1000", LineSource{})
+	c.processLine("b.metric 1 1000", LineSource{})
+	c.processLine("a.metric 2 1010", LineSource{})
+	// Self-test samples are not counted.
+	c.processLine(selftestPrefix+"1 1 1010", LineSource{})
+	c.removeCh <- selftestPrefix + "1"
+	assert.Equal(t, created+2, testutil.ToFloat64(seriesCreated))
+	assert.Equal(t, updates+1, testutil.ToFloat64(sampleUpdates))
+
+	// A path whose sample expired is created again.
+	clock.now = time.Unix(1065, 0)
+	c.expireSamples(clock.now)
+	c.processLine("b.metric 2 1065", LineSource{})
+	c.removeCh <- ""
+	assert.Equal(t, created+3, testutil.ToFloat64(seriesCreated))
+	assert.Equal(t, updates+1, testutil.ToFloat64(sampleUpdates))
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP graphite_stored_samples Number of samples in the store, one per graphite path.
+# TYPE graphite_stored_samples gauge
+graphite_stored_samples 2
+`), "graphite_stored_samples"))
+}
+
+func TestSampleCollector(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	for _, tenant := range []string{"a", "b"} {
+		c := NewCollector(Options{Logger: log.NewNopLogger()})
+		c.SetIdentityLabels(&IdentityLabels{Labels: map[string]string{"tenant": tenant}})
+		c.Run(context.Background())
+		defer c.Stop()
+		c.processLine(fmt.Sprintf("app.load 1 %d", time.Now().Unix()), LineSource{})
+		c.removeCh <- ""
+		// The exporter's own metrics of several collectors would clash.
+		reg.MustRegister(c.SampleCollector())
+	}
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP app_load Graphite metric app_load
+# TYPE app_load gauge
+app_load{tenant="a"} 1
+app_load{tenant="b"} 1
+`)))
+}
+
+// panickingMapper panics on paths starting with "poison".
+type panickingMapper struct {
+	mockMapper
+}
+
+func (m *panickingMapper) GetMapping(metricName string, metricType mapper.MetricType) (*mapper.MetricMapping, prometheus.Labels, bool) {
+	if strings.HasPrefix(metricName, "poison") {
+		panic("poisoned path " + metricName)
+	}
+	return m.mockMapper.GetMapping(metricName, metricType)
+}
+
+func TestLinePanicRecovery(t *testing.T) {
+	var buf bytes.Buffer
+	c := NewCollector(Options{Logger: log.NewJSONLogger(&buf), Mapper: &panickingMapper{}})
+	c.Run(context.Background())
+	defer c.Stop()
+
+	panics := testutil.ToFloat64(internalPanics)
+	c.ProcessLine("poison.metric 1 1534620625")
+	c.ProcessLine("poison.metric 2 1534620625")
+	c.ProcessLine("my.metric 3 1534620625")
+	assert.Eventually(t, func() bool { return c.SampleCount() == 1 }, time.Second, time.Millisecond, "lines after a panic are processed")
+	assert.Equal(t, panics+2, testutil.ToFloat64(internalPanics))
+	assert.Contains(t, buf.String(), "poisoned path poison.metric")
+	assert.Contains(t, buf.String(), `"line":"poison.metric 1 1534620625"`)
+}
+
+func TestNilMapper(t *testing.T) {
+	c := NewCollector(Options{})
+	c.SetMapper(nil)
+	c.Run(context.Background())
+	defer c.Stop()
+
+	c.processLine("my.metric 1 1534620625", LineSource{})
+	c.removeCh <- ""
+	assert.Equal(t, 1, c.SampleCount(), "paths are stored unmapped")
+
+	c.settings.StrictMatch = true
+	c.processLine("my.other.metric 1 1534620625", LineSource{})
+	c.removeCh <- ""
+	assert.Equal(t, 1, c.SampleCount(), "strict matching drops all paths")
+}
+
+func TestRunStop(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		c := NewCollector(Options{Mapper: &mockMapper{}})
+		ctx, cancel := context.WithCancel(context.Background())
+		c.Run(ctx)
+
+		// Senders must return once the collector is stopped, whether or not
+		// their lines were processed.
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				for k := 0; k < 100; k++ {
+					c.ProcessLine(fmt.Sprintf("my.metric.%d.%d %d %d", j, k, k, time.Now().Unix()))
+				}
+			}(j)
+		}
+		if i%2 == 0 {
+			c.Stop()
+		} else {
+			cancel()
+		}
+
+		select {
+		case <-c.Stopped():
+		case <-time.After(5 * time.Second):
+			t.Fatal("collector did not stop")
+		}
+		wg.Wait()
+		cancel()
+		c.Stop()
+	}
+}
+
+func TestSetMapperDuringTraffic(t *testing.T) {
+	c := NewCollector(Options{Mapper: &mockMapper{name: "first", present: true}})
+	c.Run(context.Background())
+	defer c.Stop()
+
+	// Lines arrive while the collector starts up and while the mapper is
+	// replaced; the race detector flags any unsynchronized access.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.ProcessLine(fmt.Sprintf("my.metric.%d.%d %d %d", i, j, j, time.Now().Unix()))
+			}
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		c.SetMapper(&mockMapper{name: fmt.Sprintf("metric_%d", i), present: true})
+	}
+	wg.Wait()
+
+	c.SetMapper(&mockMapper{name: "last", present: true})
+	c.ProcessLine(fmt.Sprintf("my.last.metric 1 %d", time.Now().Unix()))
+	assert.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		s := c.samples["my.last.metric"]
+		return s != nil && s.Name == "last"
+	}, time.Second, time.Millisecond)
+}
+
+func TestSetMapperBarrier(t *testing.T) {
+	// Each generation of the mapping configuration encodes its number in
+	// both the name and, by a relabeling rule, the gen label, so that a
+	// sample mapped with a mix of two rulesets has different numbers.
+	generation := func(n int) *Mapper {
+		m := &Mapper{}
+		assert.NoError(t, m.InitFromYAMLString(fmt.Sprintf(`
+relabel:
+- label: gen
+  regex: .*
+  replacement: "%[1]d"
+mappings:
+- match: reload.*.*
+  name: gen_%[1]d
+  labels:
+    gen: unset
+    sender: $1
+`, n)))
+		return m
+	}
+	// A line waiting to be processed while the mapper is replaced is mapped
+	// with the mapper in use when it was received.
+	received := make(chan struct{}, 1)
+	c := NewCollector(Options{
+		Logger: log.NewNopLogger(),
+		Mapper: generation(0),
+		RecordLine: func(string) {
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+		},
+	})
+	go c.ProcessLine(fmt.Sprintf("reload.main.waiting 1 %d", time.Now().Unix()))
+	<-received
+	c.SetMapper(generation(1))
+	c.Run(context.Background())
+	defer c.Stop()
+	assert.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		s := c.samples["reload.main.waiting"]
+		return s != nil && s.Name == "gen_0"
+	}, 5*time.Second, time.Millisecond)
+
+	// Other senders keep the pipeline busy while the mapper is replaced.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				c.ProcessLine(fmt.Sprintf("reload.noise%d.n%d %d %d", i, j%50, j, time.Now().Unix()))
+			}
+		}(i)
+	}
+	mappers := make([]*Mapper, 200)
+	for n := range mappers {
+		mappers[n] = generation(n + 1)
+	}
+	for n, m := range mappers {
+		c.SetMapper(m)
+		for j := 0; j < 5; j++ {
+			c.ProcessLine(fmt.Sprintf("reload.main.g%d_%d %d %d", n+1, j, j, time.Now().Unix()))
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	// Lines are processed in order, so all lines are stored once the last
+	// one is.
+	c.ProcessLine(fmt.Sprintf("reload.main.last 1 %d", time.Now().Unix()))
+	assert.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.samples["reload.main.last"] != nil
+	}, 5*time.Second, time.Millisecond)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path, s := range c.samples {
+		// No sample is mapped with a mix of rulesets.
+		assert.Equal(t, "gen_"+s.Labels["gen"], s.Name, path)
+		// Lines received after SetMapper returned are mapped with its
+		// mapper, and lines received before are not.
+		var n, j int
+		if _, err := fmt.Sscanf(path, "reload.main.g%d_%d", &n, &j); err == nil {
+			assert.Equal(t, fmt.Sprintf("gen_%d", n), s.Name, path)
+		}
+	}
+}
+
+func TestStoppedBeforeRun(t *testing.T) {
+	c := NewCollector(Options{})
+	c.Stop()
+	c.ProcessLine("my.metric 1 1534620625")
+	c.Run(context.Background())
+	select {
+	case <-c.Stopped():
+	case <-time.After(5 * time.Second):
+		t.Fatal("collector did not stop")
+	}
+	assert.Equal(t, 0, c.SampleCount())
+}
+
+func TestPipelineMetrics(t *testing.T) {
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.SetMapper(&mockMapper{})
+	c.Run(context.Background())
+	defer c.Stop()
+	c.processReader(strings.NewReader("my.first.metric 1 1534620625\nmy.second.metric 2 1534620625\n"), LineSource{}, mapperHolder{})
+	c.removeCh <- ""
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := rec.Body.String()
+	assert.Contains(t, body, `graphite_channel_length{channel="line"} 0`)
+	assert.Contains(t, body, `graphite_channel_capacity{channel="sample"} 0`)
+	assert.Contains(t, body, "graphite_line_processing_duration_seconds_count")
+	assert.Regexp(t, `graphite_pipeline_goroutines\{stage="line"\} [1-9]`, body)
+	assert.Regexp(t, `graphite_pipeline_goroutines\{stage="sample"\} [1-9]`, body)
+	assert.Contains(t, body, `graphite_loop_heartbeat_timestamp_seconds{loop="line"}`)
+	assert.Contains(t, body, `graphite_loop_heartbeat_timestamp_seconds{loop="sample"}`)
+}
+
+func TestIsTimeout(t *testing.T) {
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer l.Close()
+	l.SetReadDeadline(time.Now())
+	_, _, err = l.ReadFromUDP(make([]byte, 1))
+	assert.True(t, isTimeout(err))
+	assert.False(t, isTimeout(errors.New("not a network error")))
+}
+
+func TestInvalidLineLogging(t *testing.T) {
+	var buf bytes.Buffer
+	c := NewCollector(Options{Logger: level.NewFilter(log.NewJSONLogger(&buf), level.AllowInfo())})
+	c.SetMapper(&mockMapper{})
+	c.Run(context.Background())
+	defer c.Stop()
+	source := LineSource{Protocol: "udp", Address: "192.0.2.1:4242"}
+
+	c.processLine("my.metric invalid 1534620625", source)
+	var entry map[string]string
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, map[string]string{
+		"level":    "info",
+		"msg":      "Invalid line",
+		"reason":   "value",
+		"line":     "my.metric invalid 1534620625",
+		"source":   "192.0.2.1:4242",
+		"protocol": "udp",
+		"err":      `strconv.ParseFloat: parsing "invalid": invalid syntax`,
+	}, entry)
+
+	buf.Reset()
+	c.processLine(strings.Repeat("x", 300), source)
+	var truncated map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &truncated))
+	assert.Equal(t, "part_count", truncated["reason"])
+	assert.Equal(t, strings.Repeat("x", maxLoggedLineLength)+"...", truncated["line"])
+
+	assert.Equal(t, "a...", truncateLine("aé", 2), "multi-byte characters are not split")
+}
+
+func TestMetricPrefix(t *testing.T) {
+	settings := MapSettings{MetricPrefix: "legacy_"}
+
+	m, ok := MapMetric(&mockMapper{name: "requests", present: true}, "my.requests", settings)
+	assert.True(t, ok)
+	assert.Equal(t, "legacy_requests", m.Name)
+
+	m, ok = MapMetric(&mockMapper{}, "my.unmapped-metric", settings)
+	assert.True(t, ok)
+	assert.Equal(t, "legacy_my_unmapped_metric", m.Name, "unmapped metrics are prefixed after sanitization")
+
+	assert.True(t, ValidMetricPrefix.MatchString("vendorx_"))
+	assert.False(t, ValidMetricPrefix.MatchString("1x_"))
+	assert.False(t, ValidMetricPrefix.MatchString("vendor-x_"))
+}
+
+func TestUnmappedSplitDepth(t *testing.T) {
+	for _, tc := range []struct {
+		settings   MapSettings
+		path       string
+		wantName   string
+		wantLabels map[string]string
+	}{
+		{path: "servers.web01.cpu.user", wantName: "servers_web01_cpu_user"},
+		{
+			settings: MapSettings{UnmappedSplitDepth: 2},
+			path:     "servers.web01.cpu.user",
+			wantName: "cpu_user", wantLabels: map[string]string{"graphite_hierarchy": "servers.web01"},
+		},
+		{
+			settings: MapSettings{UnmappedSplitDepth: 1, UnmappedSplitLabel: "prefix"},
+			path:     "servers.web01.cpu.user",
+			wantName: "web01_cpu_user", wantLabels: map[string]string{"prefix": "servers"},
+		},
+		// Paths that would be left without a name are not split.
+		{settings: MapSettings{UnmappedSplitDepth: 2}, path: "servers.web01", wantName: "servers_web01"},
+		{settings: MapSettings{UnmappedSplitDepth: 2}, path: "servers.web01.", wantName: "servers_web01_"},
+	} {
+		m, ok := MapMetric(&mockMapper{}, tc.path, tc.settings)
+		assert.True(t, ok)
+		assert.Equal(t, tc.wantName, m.Name, "name of %s at depth %d", tc.path, tc.settings.UnmappedSplitDepth)
+		assert.Equal(t, tc.wantLabels, m.Labels, "labels of %s at depth %d", tc.path, tc.settings.UnmappedSplitDepth)
+	}
+
+	m, ok := MapMetric(&mockMapper{name: "cpu", present: true}, "servers.web01.cpu", MapSettings{UnmappedSplitDepth: 2})
+	assert.True(t, ok)
+	assert.Equal(t, "cpu", m.Name, "mapped metrics are not split")
+	assert.Empty(t, m.Labels)
+}
+
+func TestInstanceComponent(t *testing.T) {
+	for _, tc := range []struct {
+		settings   MapSettings
+		path       string
+		wantName   string
+		wantLabels map[string]string
+	}{
+		{
+			settings: MapSettings{InstanceComponent: 2},
+			path:     "servers.web01.cpu.user",
+			wantName: "servers_cpu_user", wantLabels: map[string]string{"instance": "web01"},
+		},
+		{
+			settings: MapSettings{InstanceComponent: 1},
+			path:     "web01.cpu",
+			wantName: "cpu", wantLabels: map[string]string{"instance": "web01"},
+		},
+		{
+			settings: MapSettings{InstanceComponent: 2},
+			path:     "collectd.web01",
+			wantName: "collectd", wantLabels: map[string]string{"instance": "web01"},
+		},
+		// The instance is removed before the path is split.
+		{
+			settings: MapSettings{InstanceComponent: 2, UnmappedSplitDepth: 1},
+			path:     "servers.web01.cpu.user",
+			wantName: "cpu_user", wantLabels: map[string]string{"instance": "web01", "graphite_hierarchy": "servers"},
+		},
+		// Paths without the component, or only consisting of it, are kept.
+		{settings: MapSettings{InstanceComponent: 3}, path: "servers.web01", wantName: "servers_web01"},
+		{settings: MapSettings{InstanceComponent: 1}, path: "web01", wantName: "web01"},
+	} {
+		m, ok := MapMetric(&mockMapper{}, tc.path, tc.settings)
+		assert.True(t, ok)
+		assert.Equal(t, tc.wantName, m.Name, "name of %s", tc.path)
+		assert.Equal(t, tc.wantLabels, m.Labels, "labels of %s", tc.path)
+	}
+
+	m, ok := MapMetric(&mockMapper{name: "cpu", present: true}, "servers.web01.cpu", MapSettings{InstanceComponent: 2})
+	assert.True(t, ok)
+	assert.Equal(t, "cpu", m.Name, "explicit mappings take precedence")
+	assert.Empty(t, m.Labels)
+}
+
+func TestMalformedPaths(t *testing.T) {
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{"apps.web.requests", "apps.web.requests"},
+		{"apps..requests.", "apps.requests"},
+		{".apps...web..requests", "apps.web.requests"},
+	} {
+		got, _ := normalizePath(tc.path)
+		assert.Equal(t, tc.want, got, "path %q", tc.path)
+	}
+
+	for _, reject := range []bool{false, true} {
+		c := NewCollector(Options{Logger: log.NewNopLogger(), RejectMalformedPaths: reject})
+		c.Run(context.Background())
+		normalized := testutil.ToFloat64(normalizedPaths)
+		c.processLine("apps..requests. 1 100", LineSource{})
+		c.processLine("... 1 100", LineSource{})
+		c.processLine("apps.errors 1 100", LineSource{})
+		// The sample store handles one request at a time, so the samples
+		// have been stored once a removal is accepted.
+		c.removeCh <- ""
+		c.mu.Lock()
+		paths := []string{}
+		for path := range c.samples {
+			paths = append(paths, path)
+		}
+		c.mu.Unlock()
+		c.Stop()
+
+		sort.Strings(paths)
+		if reject {
+			assert.Equal(t, []string{"apps.errors"}, paths)
+			assert.Equal(t, normalized, testutil.ToFloat64(normalizedPaths))
+		} else {
+			assert.Equal(t, []string{"apps.errors", "apps.requests"}, paths, "the mapper sees the normalized path")
+			assert.Equal(t, normalized+1, testutil.ToFloat64(normalizedPaths))
+		}
+	}
+}
+
+func TestInvalidNames(t *testing.T) {
+	prefix := MapSettings{InvalidNamePrefix: DefaultInvalidNamePrefix}
+	for _, tc := range []struct {
+		mapper   MetricMapper
+		path     string
+		settings MapSettings
+		want     string
+	}{
+		{mapper: &mockMapper{}, path: "123.456.count", settings: prefix, want: "graphite_123_456_count"},
+		{mapper: &mockMapper{name: "1xx_responses", present: true}, path: "http.1xx", settings: prefix, want: "graphite_1xx_responses"},
+		{mapper: &mockMapper{}, path: "a123.count", settings: prefix, want: "a123_count"},
+		{mapper: &mockMapper{}, path: "123.count", settings: MapSettings{MetricPrefix: "legacy_"}, want: "legacy_123_count"},
+		{mapper: &mockMapper{}, path: "123.count"},
+	} {
+		m, ok := MapMetric(tc.mapper, tc.path, tc.settings)
+		if tc.want == "" {
+			assert.False(t, ok, "%s is dropped", tc.path)
+			assert.Equal(t, dropReasonInvalidName, m.DropReason)
+			continue
+		}
+		assert.True(t, ok)
+		assert.Equal(t, tc.want, m.Name, "name of %s", tc.path)
+	}
+
+	c := NewCollector(Options{Logger: log.NewNopLogger(), MapSettings: prefix})
+	c.Run(context.Background())
+	defer c.Stop()
+	prefixed := testutil.ToFloat64(prefixedNames)
+	c.processLine("123.456.count 1 100", LineSource{})
+	assert.Equal(t, prefixed+1, testutil.ToFloat64(prefixedNames))
+}
+
+func TestInvalidLinesByProtocol(t *testing.T) {
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	tcp := testutil.ToFloat64(invalidLines.WithLabelValues("part_count", "tcp"))
+	udp := testutil.ToFloat64(invalidLines.WithLabelValues("value", "udp"))
+	other := testutil.ToFloat64(invalidLines.WithLabelValues("timestamp", "other"))
+
+	c.processLine("my.metric 1", LineSource{Protocol: "tcp", Address: "127.0.0.1:5000"})
+	c.processLine("my.metric x 1", LineSource{Protocol: "udp", Address: "127.0.0.1:5001"})
+	c.processLine("my.metric 1 x", LineSource{})
+
+	assert.Equal(t, tcp+1, testutil.ToFloat64(invalidLines.WithLabelValues("part_count", "tcp")))
+	assert.Equal(t, udp+1, testutil.ToFloat64(invalidLines.WithLabelValues("value", "udp")))
+	assert.Equal(t, other+1, testutil.ToFloat64(invalidLines.WithLabelValues("timestamp", "other")))
+}
+
+func TestStartupGracePeriod(t *testing.T) {
+	for _, tc := range []struct {
+		opts Options
+		want bool
+	}{
+		{opts: Options{}, want: true},
+		{opts: Options{StartupGracePeriod: time.Hour}, want: false},
+		{opts: Options{StartupGracePeriod: time.Hour, GraceReadinessOnly: true}, want: true},
+	} {
+		tc.opts.Logger = log.NewNopLogger()
+		c := NewCollector(tc.opts)
+		c.Run(context.Background())
+		c.processLine(fmt.Sprintf("my.metric 1 %d", time.Now().Unix()), LineSource{})
+		c.removeCh <- ""
+		assert.Equal(t, tc.opts.StartupGracePeriod > 0, c.InStartupGrace(time.Now()))
+		assert.False(t, c.InStartupGrace(time.Now().Add(2*time.Hour)))
+		assert.Equal(t, tc.want, len(exportedSamples(t, c)) == 1, "options %+v", tc.opts)
+		c.Stop()
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	c := NewCollector(Options{Logger: log.NewNopLogger(), ReadOnly: true})
+	c.Run(context.Background())
+	defer c.Stop()
+	c.processLine(fmt.Sprintf("my.metric 1 %d", time.Now().Unix()), LineSource{})
+	c.removeCh <- ""
+
+	// The sample is stored, but not exported.
+	assert.Equal(t, 1, c.SampleCount())
+	assert.Len(t, c.CurrentSamples(time.Now()), 1)
+	assert.Empty(t, exportedSamples(t, c))
+}
+
+func TestMaxSamplesPerScrape(t *testing.T) {
+	now := time.Now().Unix()
+	for _, tc := range []struct {
+		max  int
+		want []string
+	}{
+		{max: 0, want: []string{"a_metric", "b_metric", "c_metric", "d_metric"}},
+		{max: 4, want: []string{"a_metric", "b_metric", "c_metric", "d_metric"}},
+		// c and d are the newest; a and b tie and are chosen by name.
+		{max: 3, want: []string{"a_metric", "c_metric", "d_metric"}},
+		{max: 1, want: []string{"d_metric"}},
+	} {
+		c := NewCollector(Options{Logger: log.NewNopLogger(), MaxSamplesPerScrape: tc.max})
+		c.Run(context.Background())
+		c.processLine(fmt.Sprintf("b.metric 1 %d", now-20), LineSource{})
+		c.processLine(fmt.Sprintf("a.metric 1 %d", now-20), LineSource{})
+		c.processLine(fmt.Sprintf("c.metric 1 %d", now-10), LineSource{})
+		c.processLine(fmt.Sprintf("d.metric 1 %d", now), LineSource{})
+		c.removeCh <- ""
+
+		omitted := testutil.ToFloat64(collectOmitted)
+		for i := 0; i < 2; i++ {
+			assert.Equal(t, tc.want, exportedSamples(t, c), "max %d, scrape %d", tc.max, i)
+		}
+		assert.Equal(t, omitted+2*float64(4-len(tc.want)), testutil.ToFloat64(collectOmitted), "max %d", tc.max)
+		c.Stop()
+	}
+}
+
+func TestRoundValue(t *testing.T) {
+	for _, tc := range []struct {
+		value  float64
+		places int
+		want   float64
+	}{
+		{value: 0.30000000000000004, places: 2, want: 0.3},
+		{value: 0.30000000000000004, places: 15, want: 0.3},
+		{value: -1.23456, places: 3, want: -1.235},
+		{value: -0.0004, places: 3, want: 0},
+		// Exact halves round to even.
+		{value: 2.5, places: 0, want: 2},
+		{value: -3.5, places: 0, want: -4},
+		{value: 1.7976931348623157e308, places: 2, want: 1.7976931348623157e308},
+		{value: -1e20 / 3, places: 2, want: -1e20 / 3},
+		{value: 1e-12, places: 6, want: 0},
+		{value: math.Inf(-1), places: 2, want: math.Inf(-1)},
+	} {
+		got := roundValue(tc.value, tc.places)
+		assert.Equal(t, tc.want, got, "%v rounded to %d places", tc.value, tc.places)
+		assert.False(t, math.Signbit(got) && got == 0, "%v rounds to -0", tc.value)
+	}
+	assert.True(t, math.IsNaN(roundValue(math.NaN(), 2)))
+}
+
+func TestDecimalPlaces(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: exact.*
+  name: exact
+  decimal_places: 0
+- match: load.*
+  name: load
+`))
+	two := 2
+	for _, tc := range []struct {
+		path     string
+		value    string
+		settings MapSettings
+		want     float64
+	}{
+		// Without rounding, values are stored exactly as parsed.
+		{path: "load.web", value: "0.30000000000000004", want: 0.30000000000000004},
+		{path: "load.web", value: "-123456789.123456789", want: -123456789.123456789},
+		{path: "unmapped", value: "0.30000000000000004", want: 0.30000000000000004},
+		{path: "load.web", value: "0.30000000000000004", settings: MapSettings{DecimalPlaces: &two}, want: 0.3},
+		{path: "unmapped", value: "-0.30000000000000004", settings: MapSettings{DecimalPlaces: &two}, want: -0.3},
+		{path: "load.web", value: "1e300", settings: MapSettings{DecimalPlaces: &two}, want: 1e300},
+		// The mapping overrides the global setting.
+		{path: "exact.web", value: "41.6", settings: MapSettings{DecimalPlaces: &two}, want: 42},
+		{path: "exact.web", value: "-41.6", want: -42},
+	} {
+		mapped, ok := MapMetric(m, tc.path, tc.settings)
+		assert.True(t, ok)
+		p := parseValues(tc.path, mapped, tc.value, "100", valueOptions{})
+		if assert.NotNil(t, p.sample, "%s %s", tc.path, tc.value) {
+			assert.Equal(t, math.Float64bits(tc.want), math.Float64bits(p.sample.Value), "%s %s: got %v, want %v", tc.path, tc.value, p.sample.Value, tc.want)
+		}
+	}
+	assert.Equal(t, 0, *m.effectiveRules(MapSettings{DecimalPlaces: &two})[0].DecimalPlaces)
+	assert.Equal(t, 2, *m.effectiveRules(MapSettings{DecimalPlaces: &two})[1].DecimalPlaces)
+
+	assert.Error(t, (&Mapper{}).InitFromYAMLString("mappings:\n- match: a.*\n  name: a\n  decimal_places: -1\n"))
+}
+
+func TestValueCoercions(t *testing.T) {
+	c := NewCollector(Options{
+		Logger:         log.NewNopLogger(),
+		ValueCoercions: map[string]float64{"true": 1, "false": 0, "ON": 1, "off": 0},
+	})
+	c.Run(context.Background())
+	defer c.Stop()
+
+	coerced := testutil.ToFloat64(valueCoercions.WithLabelValues("on"))
+	invalid := testutil.ToFloat64(invalidLines.WithLabelValues("value", "other"))
+	for _, line := range []string{
+		"appliance.power On 100",
+		"appliance.alarm false 100",
+		"appliance.fan 0.5 100",
+		"appliance.mode auto 100",
+	} {
+		c.processLine(line, LineSource{})
+	}
+	c.removeCh <- ""
+
+	values := map[string]float64{}
+	for _, s := range c.snapshot() {
+		values[s.OriginalName] = s.Value
+	}
+	assert.Equal(t, map[string]float64{"appliance.power": 1, "appliance.alarm": 0, "appliance.fan": 0.5}, values)
+	assert.Equal(t, coerced+1, testutil.ToFloat64(valueCoercions.WithLabelValues("on")))
+	assert.Equal(t, invalid+1, testutil.ToFloat64(invalidLines.WithLabelValues("value", "other")), "values without a coercion are invalid")
+
+	// Without coercions, only numbers are accepted.
+	p := parseValues("appliance.power", MappedMetric{Scale: 1}, "true", "100", valueOptions{})
+	assert.Equal(t, "value", p.invalid)
+}
+
+func TestValueSuffixes(t *testing.T) {
+	c := NewCollector(Options{
+		Logger:        log.NewNopLogger(),
+		ValueSuffixes: DefaultValueSuffixes,
+	})
+	c.Run(context.Background())
+	defer c.Stop()
+
+	converted := testutil.ToFloat64(valueSuffixConversions.WithLabelValues("ms"))
+	invalid := testutil.ToFloat64(invalidLines.WithLabelValues("value", "other"))
+	for _, line := range []string{
+		"app.latency 42ms 100",
+		"app.bytes 1.5k 100",
+		"app.plain 7 100",
+		"app.unknown 5xyz 100",
+		"app.minutes 3m 100",
+	} {
+		c.processLine(line, LineSource{})
+	}
+	c.removeCh <- ""
+
+	values := map[string]float64{}
+	for _, s := range c.snapshot() {
+		values[s.OriginalName] = s.Value
+	}
+	assert.Equal(t, map[string]float64{"app.latency": 0.042, "app.bytes": 1500, "app.plain": 7}, values)
+	assert.Equal(t, converted+1, testutil.ToFloat64(valueSuffixConversions.WithLabelValues("ms")))
+	assert.Equal(t, invalid+2, testutil.ToFloat64(invalidLines.WithLabelValues("value", "other")), "values with unknown suffixes are invalid")
+
+	// The multiplier is applied before the mapping's scale.
+	p := parseValues("app.latency", MappedMetric{Scale: 1000}, "42ms", "100", valueOptions{suffixes: DefaultValueSuffixes})
+	assert.Equal(t, "", p.invalid)
+	assert.InDelta(t, 42, p.sample.Value, 1e-9)
+	assert.Equal(t, "ms", p.suffix)
+
+	// Without suffixes, only numbers are accepted.
+	p = parseValues("app.latency", MappedMetric{Scale: 1}, "42ms", "100", valueOptions{})
+	assert.Equal(t, "value", p.invalid)
+}
+
+func TestHelpText(t *testing.T) {
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.Run(context.Background())
+	defer c.Stop()
+	c.processLine("app.requests 1 100", LineSource{})
+	c.removeCh <- ""
+
+	s := c.snapshot()[0]
+	assert.Empty(t, s.Help, "ingested samples store no help text")
+	assert.Equal(t, "Graphite metric app_requests", s.HelpText())
+	assert.Equal(t, "Requests.", (&Sample{Name: "app_requests", Help: "Requests."}).HelpText())
+}
+
+func TestFixFieldOrder(t *testing.T) {
+	for _, tc := range []struct {
+		value, timestamp string
+		swapped          bool
+	}{
+		{value: "42", timestamp: "1600000000"},
+		{value: "1600000000", timestamp: "42", swapped: true},
+		{value: "1600000000.5", timestamp: "-3.2", swapped: true},
+		{value: "1600000000", timestamp: "NaN", swapped: true},
+		// A value that is itself a time, e.g. of the last successful run,
+		// sent in the right order.
+		{value: "1599999000", timestamp: "1600000000"},
+		// Both fields are out of the plausible range of timestamps.
+		{value: "99999999999", timestamp: "42"},
+		{value: "900000000", timestamp: "42"},
+		{value: "4102444800", timestamp: "42"},
+		{value: "4102444799", timestamp: "42", swapped: true},
+		{value: "946684800", timestamp: "42", swapped: true},
+		{value: "abc", timestamp: "def"},
+	} {
+		value, timestamp, swapped := fixFieldOrder(tc.value, tc.timestamp)
+		assert.Equal(t, tc.swapped, swapped, "%s %s", tc.value, tc.timestamp)
+		if tc.swapped {
+			assert.Equal(t, []string{tc.timestamp, tc.value}, []string{value, timestamp})
+		} else {
+			assert.Equal(t, []string{tc.value, tc.timestamp}, []string{value, timestamp})
+		}
+	}
+}
+
+func TestLenientFieldOrder(t *testing.T) {
+	for _, lenient := range []bool{false, true} {
+		c := NewCollector(Options{Logger: log.NewNopLogger(), LenientFieldOrder: lenient})
+		c.Run(context.Background())
+
+		corrections := testutil.ToFloat64(fieldOrderCorrections)
+		c.processLine("legacy.agent 1600000000 7", LineSource{})
+		c.processLine("modern.agent 8 1600000000", LineSource{})
+		c.removeCh <- ""
+
+		samples := map[string]*Sample{}
+		for _, s := range c.snapshot() {
+			samples[s.OriginalName] = s
+		}
+		if !lenient {
+			assert.Equal(t, 1600000000.0, samples["legacy.agent"].Value, "the fields are kept by default")
+			assert.Equal(t, corrections, testutil.ToFloat64(fieldOrderCorrections))
+		} else {
+			assert.Equal(t, 7.0, samples["legacy.agent"].Value)
+			assert.Equal(t, time.Unix(1600000000, 0), samples["legacy.agent"].Timestamp)
+			assert.Equal(t, corrections+1, testutil.ToFloat64(fieldOrderCorrections))
+		}
+		assert.Equal(t, 8.0, samples["modern.agent"].Value)
+		c.Stop()
+	}
+}
+
+func TestParseCommaDecimal(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  float64
+		ok    bool
+	}{
+		{value: "3,14", want: 3.14, ok: true},
+		{value: "-0,5", want: -0.5, ok: true},
+		{value: ",5", want: 0.5, ok: true},
+		{value: "1,5e3", want: 1500, ok: true},
+		{value: "1.000,5"},
+		{value: "1,000.5"},
+		{value: "1,000,5"},
+		{value: "3,14abc"},
+		{value: "3;14"},
+		{value: ","},
+	} {
+		got, ok := parseCommaDecimal(tc.value)
+		assert.Equal(t, tc.ok, ok, tc.value)
+		assert.Equal(t, tc.want, got, tc.value)
+	}
+}
+
+func TestAcceptCommaDecimal(t *testing.T) {
+	for _, accept := range []bool{false, true} {
+		c := NewCollector(Options{Logger: log.NewNopLogger(), AcceptCommaDecimal: accept})
+		c.Run(context.Background())
+
+		converted := testutil.ToFloat64(commaDecimalValues)
+		c.processLine("locale.value 3,14 100", LineSource{})
+		c.processLine("locale.thousands 1.000,5 100", LineSource{})
+		c.processLine("plain.value 2.5 100", LineSource{})
+		c.removeCh <- ""
+
+		values := map[string]float64{}
+		for _, s := range c.snapshot() {
+			values[s.OriginalName] = s.Value
+		}
+		if accept {
+			assert.Equal(t, map[string]float64{"locale.value": 3.14, "plain.value": 2.5}, values)
+			assert.Equal(t, converted+1, testutil.ToFloat64(commaDecimalValues))
+		} else {
+			assert.Equal(t, map[string]float64{"plain.value": 2.5}, values)
+			assert.Equal(t, converted, testutil.ToFloat64(commaDecimalValues))
+		}
+		c.Stop()
+	}
+}
+
+func TestRebuildStrings(t *testing.T) {
+	// The collector is not running, so the test stores and expires samples
+	// as the goroutine owning the sample store would.
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	c := NewCollector(Options{Logger: log.NewNopLogger(), Clock: clock, SampleExpiry: time.Minute, ExpireOnCollect: true})
+	store := func(line string) {
+		assert.NoError(t, c.storeSample(c.ingestLine(line, LineSource{}, c.Mapper()).sample))
+	}
+	store("a.metric 1 990")
+	store("b.metric 1 1030")
+
+	// A sweep that removes nothing keeps the intern table.
+	table := c.strings
+	c.expireSamples(clock.now)
+	assert.True(t, table == c.strings, "the intern table was rebuilt without any removed sample")
+
+	clock.now = time.Unix(1060, 0)
+	c.expireSamples(clock.now)
+	assert.False(t, table == c.strings, "the intern table was not rebuilt after a removal")
+	assert.NotContains(t, c.strings.strings, "a_metric")
+	assert.Contains(t, c.strings.strings, "b_metric")
+
+	// Samples removed by a scrape are released by the next sweep.
+	clock.now = time.Unix(1100, 0)
+	assert.Empty(t, exportedSamples(t, c))
+	c.expireNamed(<-c.expireCh, clock.now)
+	c.expireSamples(clock.now)
+	assert.NotContains(t, c.strings.strings, "b_metric")
+}
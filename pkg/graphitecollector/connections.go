@@ -0,0 +1,237 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	RegisterFeature("connection_management")
+}
+
+var (
+	activeConnectionsDesc = prometheus.NewDesc(
+		"graphite_tcp_connections_active",
+		"Number of open TCP connections sending lines.",
+		nil, nil,
+	)
+	shutdownConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "graphite_tcp_shutdown_connections",
+			Help: "Number of TCP connections open when the last shutdown began, by whether the sender closed them within the drain timeout (drained) or the exporter closed them (forced).",
+		},
+		[]string{"outcome"},
+	)
+)
+
+// trackedConn is an open TCP connection. Its context is cancelled, and the
+// connection closed, when it is dropped.
+type trackedConn struct {
+	id       uint64
+	conn     net.Conn
+	remote   string
+	openedAt time.Time
+	cancel   context.CancelFunc
+}
+
+// drop cancels the context of the connection and closes it, which makes its
+// reader return.
+func (t *trackedConn) drop() {
+	t.cancel()
+	t.conn.Close()
+}
+
+// connRegistry holds the open TCP connections, so that they can be closed
+// on shutdown or on request.
+type connRegistry struct {
+	mu     sync.Mutex
+	nextID uint64
+	conns  map[uint64]*trackedConn
+	// drained is closed once the last connection is removed while
+	// draining.
+	drained chan struct{}
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{conns: map[uint64]*trackedConn{}}
+}
+
+// add registers conn with a context derived from parent, and returns the
+// context and a function that removes and closes the connection once it is
+// done with.
+func (r *connRegistry) add(parent context.Context, conn net.Conn) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	r.mu.Lock()
+	r.nextID++
+	t := &trackedConn{
+		id:       r.nextID,
+		conn:     conn,
+		remote:   conn.RemoteAddr().String(),
+		openedAt: time.Now(),
+		cancel:   cancel,
+	}
+	r.conns[t.id] = t
+	r.mu.Unlock()
+	return ctx, func() {
+		r.mu.Lock()
+		delete(r.conns, t.id)
+		if r.drained != nil && len(r.conns) == 0 {
+			close(r.drained)
+			r.drained = nil
+		}
+		r.mu.Unlock()
+		t.drop()
+	}
+}
+
+// drop closes the connections for which match returns true, and returns
+// how many it closed.
+func (r *connRegistry) drop(match func(*trackedConn) bool) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, t := range r.conns {
+		if match(t) {
+			t.drop()
+			n++
+		}
+	}
+	return n
+}
+
+// drain announces the shutdown to the senders of the open connections by
+// closing the sending side of each, and waits up to timeout for the senders
+// to close them, while their lines are still read. The connections closed by
+// their senders have been read to the end, so they close cleanly. Those still
+// open after timeout are closed, discarding what their senders sent since.
+// It returns the number of connections of each kind.
+func (r *connRegistry) drain(timeout time.Duration) (drained, forced int) {
+	r.mu.Lock()
+	open := len(r.conns)
+	if open == 0 {
+		r.mu.Unlock()
+		return 0, 0
+	}
+	done := make(chan struct{})
+	r.drained = done
+	for _, t := range r.conns {
+		if tcp, ok := t.conn.(interface{ CloseWrite() error }); ok {
+			tcp.CloseWrite()
+		}
+	}
+	r.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+	forced = r.drop(func(*trackedConn) bool { return true })
+	r.mu.Lock()
+	r.drained = nil
+	r.mu.Unlock()
+	return open - forced, forced
+}
+
+func (r *connRegistry) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+// processConn processes the lines received on a registered connection until
+// it is closed or ctx is cancelled.
+func (c *Collector) processConn(ctx context.Context, conn net.Conn, source LineSource) {
+	lineScanner := bufio.NewScanner(conn)
+	for ctx.Err() == nil && lineScanner.Scan() {
+		c.receiveLine(graphiteLine{text: lineScanner.Text(), source: source})
+	}
+}
+
+// DrainConnections announces the shutdown to the senders of the open TCP
+// connections and keeps processing their lines until they close the
+// connections or timeout passes, after which the remaining connections are
+// closed. The listener must no longer accept connections. It records and
+// returns the number of connections closed by their senders and by the
+// exporter.
+func (c *Collector) DrainConnections(timeout time.Duration) (drained, forced int) {
+	drained, forced = c.conns.drain(timeout)
+	shutdownConnections.WithLabelValues("drained").Set(float64(drained))
+	shutdownConnections.WithLabelValues("forced").Set(float64(forced))
+	return drained, forced
+}
+
+// connectionInfo describes an open TCP connection.
+type connectionInfo struct {
+	ID       uint64    `json:"id"`
+	Remote   string    `json:"remote"`
+	OpenedAt time.Time `json:"opened_at"`
+}
+
+// ConnectionsHandler responds with the open TCP connections of c. A POST
+// request closes the connections of the peer given by the peer parameter,
+// either an IP address or an IP address and port, and responds with the
+// number of connections closed.
+func ConnectionsHandler(c *Collector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodPost {
+			peer := r.FormValue("peer")
+			if peer == "" {
+				http.Error(w, "the peer parameter is required", http.StatusBadRequest)
+				return
+			}
+			closed := c.conns.drop(func(t *trackedConn) bool {
+				if t.remote == peer {
+					return true
+				}
+				host, _, err := net.SplitHostPort(t.remote)
+				return err == nil && host == peer
+			})
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status": "success",
+				"data":   map[string]int{"closed": closed},
+			})
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+
+		c.conns.mu.Lock()
+		conns := make([]connectionInfo, 0, len(c.conns.conns))
+		for _, t := range c.conns.conns {
+			conns = append(conns, connectionInfo{ID: t.id, Remote: t.remote, OpenedAt: t.openedAt})
+		}
+		c.conns.mu.Unlock()
+		sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   conns,
+		})
+	}
+}
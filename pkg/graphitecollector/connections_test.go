@@ -0,0 +1,139 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnections(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.Run(context.Background())
+	done := make(chan struct{})
+	go c.ServeTCP(l, nil, done)
+	defer func() {
+		close(done)
+		l.Close()
+	}()
+
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		clients = append(clients, conn)
+	}
+	assert.Eventually(t, func() bool { return c.conns.len() == 2 }, 5*time.Second, time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	ConnectionsHandler(c)(rec, httptest.NewRequest("GET", "/debug/connections", nil))
+	var list struct {
+		Data []connectionInfo
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list), rec.Body.String())
+	assert.Len(t, list.Data, 2)
+
+	// A peer is dropped by its address and port.
+	rec = httptest.NewRecorder()
+	form := url.Values{"peer": {clients[0].LocalAddr().String()}}
+	req := httptest.NewRequest("POST", "/debug/connections", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ConnectionsHandler(c)(rec, req)
+	assert.JSONEq(t, `{"status":"success","data":{"closed":1}}`, rec.Body.String())
+	assertClosed(t, clients[0])
+	assert.Eventually(t, func() bool { return c.conns.len() == 1 }, 5*time.Second, time.Millisecond)
+
+	rec = httptest.NewRecorder()
+	ConnectionsHandler(c)(rec, httptest.NewRequest("POST", "/debug/connections", nil))
+	assert.Equal(t, 400, rec.Code)
+
+	// Stopping the collector closes the remaining connections.
+	c.Stop()
+	assertClosed(t, clients[1])
+	assert.Eventually(t, func() bool { return c.conns.len() == 0 }, 5*time.Second, time.Millisecond)
+}
+
+func TestDrainConnections(t *testing.T) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.Run(context.Background())
+	defer c.Stop()
+	done := make(chan struct{})
+	go c.ServeTCP(l, nil, done)
+
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		clients = append(clients, conn)
+	}
+	assert.Eventually(t, func() bool { return c.conns.len() == 2 }, 5*time.Second, time.Millisecond)
+	close(done)
+	l.Close()
+
+	// The first sender sees the announcement, sends its last line and
+	// closes the connection, while the second one never does.
+	go func() {
+		assertClosed(t, clients[0])
+		io.WriteString(clients[0], "drained.metric 1 1534620625\n")
+		clients[0].Close()
+	}()
+	drained, forced := c.DrainConnections(500 * time.Millisecond)
+	assert.Equal(t, 1, drained)
+	assert.Equal(t, 1, forced)
+	assertClosed(t, clients[1])
+	assert.Eventually(t, func() bool { return c.conns.len() == 0 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, 1.0, testutil.ToFloat64(shutdownConnections.WithLabelValues("drained")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(shutdownConnections.WithLabelValues("forced")))
+
+	// The line sent after the announcement was processed.
+	c.removeCh <- ""
+	c.mu.Lock()
+	assert.Contains(t, c.samples, "drained.metric")
+	c.mu.Unlock()
+
+	drained, forced = c.DrainConnections(time.Second)
+	assert.Equal(t, 0, drained+forced, "no connections are left")
+}
+
+// assertClosed asserts that the peer of conn closes it.
+func assertClosed(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
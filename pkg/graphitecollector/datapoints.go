@@ -0,0 +1,58 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	RegisterFeature("multi_datapoint_lines")
+}
+
+var multiDatapointLines = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "graphite_multi_datapoint_lines_total",
+		Help: "Total count of plaintext lines with several datapoints that were split into one line per datapoint.",
+	},
+)
+
+// splitDatapoints returns one line per datapoint of a plaintext line that
+// batches several value and timestamp pairs,
+//
+//	<path> <value1> <timestamp1> <value2> <timestamp2> ...
+//
+// or nil if the line is to be ingested as is: if the extension is disabled,
+// the line is a carbon2 line, or its part count is not odd and greater than
+// three. It has no side effects.
+func (c *Collector) splitDatapoints(line string) []string {
+	if !c.multiDatapoints {
+		return nil
+	}
+	line = strings.TrimSpace(line)
+	if strings.Count(line, " ") < 4 || (c.carbon2 && isCarbon2(line)) {
+		return nil
+	}
+	parts := strings.Split(line, " ")
+	if len(parts)%2 == 0 {
+		return nil
+	}
+	lines := make([]string, 0, len(parts)/2)
+	for i := 1; i < len(parts); i += 2 {
+		lines = append(lines, parts[0]+" "+parts[i]+" "+parts[i+1])
+	}
+	return lines
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitDatapoints(t *testing.T) {
+	c := NewCollector(Options{Logger: log.NewNopLogger(), Carbon2: true, MultiDatapointLines: true})
+	for line, want := range map[string][]string{
+		"app.load 1 100 2 110 3 120":                {"app.load 1 100", "app.load 2 110", "app.load 3 120"},
+		" app.load 1 100 2 110 ":                    {"app.load 1 100", "app.load 2 110"},
+		"app.load 1 100":                            nil,
+		"app.load 1 100 2":                          nil,
+		"app.load 1 100 2 110 3":                    nil,
+		"metric=app.load host=a dc=b  team=c 1 100": nil,
+	} {
+		assert.Equal(t, want, c.splitDatapoints(line), "%q", line)
+	}
+
+	c = NewCollector(Options{Logger: log.NewNopLogger()})
+	assert.Nil(t, c.splitDatapoints("app.load 1 100 2 110"), "disabled by default")
+}
+
+func TestMultiDatapointLines(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: app.*.hits
+  name: hits
+  aggregate: sum
+  labels:
+    app: $1
+`))
+	c := NewCollector(Options{
+		Logger:              log.NewNopLogger(),
+		Mapper:              m,
+		MultiDatapointLines: true,
+		DedupWindow:         time.Minute,
+		DedupMaxLines:       10,
+	})
+	c.Run(context.Background())
+	defer c.Stop()
+
+	split := testutil.ToFloat64(multiDatapointLines)
+	created := testutil.ToFloat64(seriesCreated)
+	updates := testutil.ToFloat64(sampleUpdates)
+	duplicates := testutil.ToFloat64(duplicateLines)
+	results, err := c.ingestBatch(context.Background(), strings.NewReader(strings.Join([]string{
+		// Datapoints with the same timestamp replace each other, unless the
+		// mapping aggregates them.
+		"other.load 1 100 2 100 5 110",
+		"app.web.hits 1 100 2 100 4 110",
+		"app.web.hits 1 100 2 100 4 110",
+		"app.web.errors 1 100 x 110",
+		"app.web.errors 1 100 2",
+	}, "\n")), LineSource{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []batchResult{
+		{Line: "other.load 1 100", Accepted: true, Series: "other_load"},
+		{Line: "other.load 2 100", Accepted: true, Series: "other_load"},
+		{Line: "other.load 5 110", Accepted: true, Series: "other_load"},
+		{Line: "app.web.hits 1 100", Accepted: true, Series: `hits{app="web"}`},
+		{Line: "app.web.hits 2 100", Accepted: true, Series: `hits{app="web"}`},
+		{Line: "app.web.hits 4 110", Accepted: true, Series: `hits{app="web"}`},
+		// A resent line is dropped as a whole.
+		{Line: "app.web.hits 1 100 2 100 4 110", Reason: "duplicate"},
+		// Each datapoint is validated on its own.
+		{Line: "app.web.errors 1 100", Accepted: true, Series: "app_web_errors"},
+		{Line: "app.web.errors x 110", Reason: "value", Error: `err=strconv.ParseFloat: parsing "x": invalid syntax`},
+		{Line: "app.web.errors 1 100 2", Reason: "part_count", Error: "parts=4"},
+	}, results)
+	assert.Equal(t, split+3, testutil.ToFloat64(multiDatapointLines))
+	assert.Equal(t, duplicates+1, testutil.ToFloat64(duplicateLines))
+	// Every stored datapoint after the first of a path is an update.
+	assert.Equal(t, created+3, testutil.ToFloat64(seriesCreated))
+	assert.Equal(t, updates+4, testutil.ToFloat64(sampleUpdates))
+
+	c.mu.Lock()
+	assert.Equal(t, 5.0, c.samples["other.load"].Value)
+	c.mu.Unlock()
+
+	// Lines received by the listeners are split too.
+	c.ProcessLine("app.web.hits 3 120 3 120")
+	assert.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		s := c.samples["app.web.hits"]
+		return s.Value == 6 && s.Timestamp.Equal(time.Unix(120, 0))
+	}, 5*time.Second, time.Millisecond)
+}
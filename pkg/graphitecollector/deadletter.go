@@ -0,0 +1,415 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	RegisterFeature("dead_letter")
+}
+
+var (
+	deadLetterLines = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "graphite_dead_letter_lines_total",
+			Help: "Total count of dropped lines handled by the dead letter output, by outcome.",
+		},
+		[]string{"outcome"},
+	)
+	deadLetterConnected = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "graphite_dead_letter_connected",
+			Help: "Whether the dead letter output is connected to its TCP address.",
+		},
+	)
+	deadLetterConnFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "graphite_dead_letter_connection_failures_total",
+			Help: "Total count of failed connections of the dead letter output, by the stage that failed.",
+		},
+		[]string{"stage"},
+	)
+)
+
+// DeadLetterSink is where the dead letter output writes lines to.
+type DeadLetterSink interface {
+	write(line string) error
+	flush() error
+	close() error
+}
+
+// DeadLetter retains the lines that the exporter drops, so that they can be
+// recovered later. Like the line recorder, it writes asynchronously and drops
+// lines rather than slowing down ingestion. A global rate limit keeps a flood
+// of bad input from filling the disk or the network.
+type DeadLetter struct {
+	// mu guards closing ch, as lines may still be dropped while the
+	// exporter shuts down.
+	mu      sync.Mutex
+	closed  bool
+	ch      chan string
+	done    chan struct{}
+	limiter *rateLimiter
+	sink    DeadLetterSink
+	// errLogger logs write errors, which repeat for every line while the
+	// sink is unavailable.
+	errLogger *sampledLogger
+}
+
+// NewDeadLetter starts writing to sink. A rate of zero means no limit.
+func NewDeadLetter(sink DeadLetterSink, rate float64, logger log.Logger) *DeadLetter {
+	d := &DeadLetter{
+		ch:        make(chan string, 10000),
+		done:      make(chan struct{}),
+		limiter:   newRateLimiter(rate),
+		sink:      sink,
+		errLogger: newSampledLogger(logger, time.Minute),
+	}
+	go d.run()
+	return d
+}
+
+// send queues a dropped line for writing without blocking.
+func (d *DeadLetter) send(line string) {
+	if !d.limiter.allow(time.Now()) {
+		deadLetterLines.WithLabelValues("dropped_rate_limit").Inc()
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	select {
+	case d.ch <- line:
+	default:
+		deadLetterLines.WithLabelValues("dropped_queue_full").Inc()
+	}
+}
+
+// Close writes the queued lines and closes the sink.
+func (d *DeadLetter) Close() {
+	d.mu.Lock()
+	d.closed = true
+	close(d.ch)
+	d.mu.Unlock()
+	<-d.done
+}
+
+func (d *DeadLetter) run() {
+	defer close(d.done)
+
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+	for {
+		select {
+		case line, ok := <-d.ch:
+			if !ok {
+				if err := d.sink.close(); err != nil {
+					d.errLogger.Log("msg", "Error writing dead letter lines", "err", err)
+				}
+				return
+			}
+			if err := d.sink.write(line); err != nil {
+				d.errLogger.Log("msg", "Error writing dead letter lines", "err", err)
+				deadLetterLines.WithLabelValues("dropped_write_error").Inc()
+				continue
+			}
+			deadLetterLines.WithLabelValues("written").Inc()
+		case <-flush.C:
+			if err := d.sink.flush(); err != nil {
+				d.errLogger.Log("msg", "Error writing dead letter lines", "err", err)
+			}
+		}
+	}
+}
+
+// rateLimiter is a token bucket allowing rate events per second, with bursts
+// of up to one second's worth.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: rate}
+}
+
+func (l *rateLimiter) allow(now time.Time) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(now)
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// reserve takes a token even if there is none, going into debt, and returns
+// how long the caller has to wait for its token, so that waiting callers are
+// spread at the limiter's rate.
+func (l *rateLimiter) reserve(now time.Time) time.Duration {
+	if l.rate <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(now)
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// refill adds the tokens accrued since the last call. l.mu must be held.
+func (l *rateLimiter) refill(now time.Time) {
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+}
+
+// RotatingFile appends lines to a file. Once the file would exceed maxBytes
+// it is renamed to path.1, shifting older files up to path.maxFiles, and a
+// new file is started.
+type RotatingFile struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+	f        *os.File
+	w        *bufio.Writer
+	size     int64
+}
+
+func NewRotatingFile(path string, maxBytes int64, maxFiles int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxBytes: maxBytes, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.w, r.size = f, bufio.NewWriter(f), info.Size()
+	return nil
+}
+
+func (r *RotatingFile) rotate() error {
+	if err := r.close(); err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxFiles))
+	for i := r.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if r.maxFiles > 0 {
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *RotatingFile) write(line string) error {
+	if r.f == nil {
+		// A failed rotation left no file open; try again.
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+	n := int64(len(line) + 1)
+	if r.maxBytes > 0 && r.size > 0 && r.size+n > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := r.w.WriteString(line + "\n"); err != nil {
+		return err
+	}
+	r.size += n
+	return nil
+}
+
+func (r *RotatingFile) flush() error {
+	if r.w == nil {
+		return nil
+	}
+	return r.w.Flush()
+}
+
+func (r *RotatingFile) close() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.w.Flush()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	r.f, r.w = nil, nil
+	return err
+}
+
+// TCPForwarderOptions configures a TCPForwarder.
+type TCPForwarderOptions struct {
+	// TLS encrypts the connection if not nil.
+	TLS *tls.Config
+	// Compression is the stream compression of the connection, "none",
+	// "gzip" or "snappy".
+	Compression string
+}
+
+// TCPForwarder sends lines to a TCP address in the plaintext protocol. The
+// connection is reestablished after errors, at most once per retryInterval;
+// lines written in between are lost.
+type TCPForwarder struct {
+	address       string
+	opts          TCPForwarderOptions
+	retryInterval time.Duration
+	conn          net.Conn
+	compressor    streamCompressor
+	w             *bufio.Writer
+	lastDial      time.Time
+}
+
+// streamCompressor is implemented by the gzip and snappy writers.
+type streamCompressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+func NewTCPForwarder(address string, opts TCPForwarderOptions) *TCPForwarder {
+	return &TCPForwarder{address: address, opts: opts, retryInterval: time.Second}
+}
+
+// dial connects to the address, counting the failures of each stage.
+func (t *TCPForwarder) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", t.address, 5*time.Second)
+	if err != nil {
+		deadLetterConnFailures.WithLabelValues("dial").Inc()
+		return nil, err
+	}
+	if t.opts.TLS == nil {
+		return conn, nil
+	}
+	cfg := t.opts.TLS.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(t.address)
+	}
+	tlsConn := tls.Client(conn, cfg)
+	tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		deadLetterConnFailures.WithLabelValues("tls_handshake").Inc()
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func (t *TCPForwarder) write(line string) error {
+	if t.conn == nil {
+		if time.Since(t.lastDial) < t.retryInterval {
+			return fmt.Errorf("not connected to %s", t.address)
+		}
+		t.lastDial = time.Now()
+		conn, err := t.dial()
+		if err != nil {
+			return err
+		}
+		var w io.Writer = conn
+		switch t.opts.Compression {
+		case "gzip":
+			t.compressor = gzip.NewWriter(conn)
+		case "snappy":
+			t.compressor = snappy.NewBufferedWriter(conn)
+		}
+		if t.compressor != nil {
+			w = t.compressor
+		}
+		t.conn, t.w = conn, bufio.NewWriter(w)
+		deadLetterConnected.Set(1)
+	}
+	if _, err := t.w.WriteString(line + "\n"); err != nil {
+		deadLetterConnFailures.WithLabelValues("write").Inc()
+		t.close()
+		return err
+	}
+	return nil
+}
+
+func (t *TCPForwarder) flush() error {
+	if t.conn == nil {
+		return nil
+	}
+	err := t.w.Flush()
+	if err == nil && t.compressor != nil {
+		err = t.compressor.Flush()
+	}
+	if err != nil {
+		deadLetterConnFailures.WithLabelValues("write").Inc()
+		t.close()
+		return err
+	}
+	return nil
+}
+
+func (t *TCPForwarder) close() error {
+	if t.conn == nil {
+		return nil
+	}
+	t.w.Flush()
+	if t.compressor != nil {
+		t.compressor.Close()
+	}
+	err := t.conn.Close()
+	t.conn, t.compressor, t.w = nil, nil, nil
+	deadLetterConnected.Set(0)
+	return err
+}
@@ -0,0 +1,189 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graphite_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dead.txt")
+
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: servers.*.debug
+  name: dropped
+  action: drop
+- match: servers.*.requests
+  name: requests
+`))
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.SetMapper(m)
+	c.settings.StrictMatch = true
+	c.Run(context.Background())
+	defer c.Stop()
+	// The dropped lines below are 30 bytes with their newline, so every file
+	// holds two of them and the first file is rotated away.
+	f, err := NewRotatingFile(path, 60, 1)
+	assert.NoError(t, err)
+	c.deadLetter = NewDeadLetter(f, 0, log.NewNopLogger())
+
+	for _, line := range []string{
+		"servers.web1.requests 1 1000",
+		"servers.web1.debug 1 10000000",
+		"servers.web1.unknown 1 100000",
+		"servers.web1.requests x 10000",
+		"servers.web1.requests 1 x0000",
+		"servers.web1.requests 1",
+	} {
+		c.processLine(line, LineSource{})
+	}
+	c.deadLetter.Close()
+
+	rotated, err := ioutil.ReadFile(path + ".1")
+	assert.NoError(t, err)
+	current, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "servers.web1.requests x 10000\nservers.web1.requests 1 x0000\n", string(rotated))
+	assert.Equal(t, "servers.web1.requests 1\n", string(current))
+	_, err = os.Stat(path + ".2")
+	assert.True(t, os.IsNotExist(err), "only one rotated file is kept")
+
+	// Lines dropped after closing are ignored.
+	c.processLine("servers.web1.debug 1 1", LineSource{})
+}
+
+func TestDeadLetterForward(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan string)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			received <- scanner.Text()
+		}
+	}()
+
+	d := NewDeadLetter(NewTCPForwarder(l.Addr().String(), TCPForwarderOptions{}), 0, log.NewNopLogger())
+	d.send("my.metric 1 1534620625")
+	d.Close()
+	select {
+	case line := <-received:
+		assert.Equal(t, "my.metric 1 1534620625", line)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the forwarded line")
+	}
+}
+
+func TestDeadLetterForwardTLS(t *testing.T) {
+	// The test server's certificate is valid for 127.0.0.1.
+	ts := httptest.NewTLSServer(nil)
+	ts.Close()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: ts.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan string)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r, err := gzip.NewReader(conn)
+				if err != nil {
+					return
+				}
+				scanner := bufio.NewScanner(r)
+				for scanner.Scan() {
+					received <- scanner.Text()
+				}
+			}()
+		}
+	}()
+
+	handshakeFailures := testutil.ToFloat64(deadLetterConnFailures.WithLabelValues("tls_handshake"))
+	untrusted := NewTCPForwarder(l.Addr().String(), TCPForwarderOptions{TLS: &tls.Config{}})
+	assert.Error(t, untrusted.write("my.metric 1 1534620625"))
+	assert.Equal(t, handshakeFailures+1, testutil.ToFloat64(deadLetterConnFailures.WithLabelValues("tls_handshake")))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	f := NewTCPForwarder(l.Addr().String(), TCPForwarderOptions{TLS: &tls.Config{RootCAs: roots}, Compression: "gzip"})
+	assert.NoError(t, f.write("my.metric 1 1534620625"))
+	assert.Equal(t, 1.0, testutil.ToFloat64(deadLetterConnected))
+	assert.NoError(t, f.flush())
+	select {
+	case line := <-received:
+		assert.Equal(t, "my.metric 1 1534620625", line)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the forwarded line")
+	}
+	assert.NoError(t, f.close())
+	assert.Equal(t, 0.0, testutil.ToFloat64(deadLetterConnected))
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1534620625, 0)
+	l := newRateLimiter(2)
+	assert.True(t, l.allow(now))
+	assert.True(t, l.allow(now))
+	assert.False(t, l.allow(now), "the burst is one second's worth")
+	assert.True(t, l.allow(now.Add(500*time.Millisecond)))
+	assert.False(t, l.allow(now.Add(500*time.Millisecond)))
+	assert.True(t, newRateLimiter(0).allow(now), "zero means no limit")
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	now := time.Unix(1534620625, 0)
+	l := newRateLimiter(2)
+	assert.Equal(t, time.Duration(0), l.reserve(now))
+	assert.Equal(t, time.Duration(0), l.reserve(now))
+	assert.Equal(t, 500*time.Millisecond, l.reserve(now))
+	assert.Equal(t, time.Second, l.reserve(now), "waiting callers are spread at the rate")
+	assert.Equal(t, time.Second, l.reserve(now.Add(500*time.Millisecond)))
+	assert.Equal(t, time.Duration(0), newRateLimiter(0).reserve(now), "zero means no limit")
+}
@@ -0,0 +1,90 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	RegisterFeature("dedup")
+}
+
+var duplicateLines = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "graphite_duplicate_lines_total",
+		Help: "Total count of lines dropped because an identical line was received within the deduplication window.",
+	},
+)
+
+type dedupEntry struct {
+	hash uint64
+	at   time.Time
+}
+
+// lineDeduper detects lines identical to one received within a window. It
+// remembers the hashes of at most a fixed number of lines in a ring, oldest
+// first, so that a burst of distinct lines shortens the effective window
+// rather than growing memory.
+type lineDeduper struct {
+	mu     sync.Mutex
+	window time.Duration
+	ring   []dedupEntry
+	head   int
+	n      int
+	seen   map[uint64]struct{}
+}
+
+func newLineDeduper(window time.Duration, maxLines int) *lineDeduper {
+	return &lineDeduper{
+		window: window,
+		ring:   make([]dedupEntry, maxLines),
+		seen:   make(map[uint64]struct{}, maxLines),
+	}
+}
+
+// duplicate reports whether line was already received within the window
+// before now, and remembers it otherwise. Surrounding whitespace is ignored.
+func (d *lineDeduper) duplicate(line string, now time.Time) bool {
+	h := fnv.New64a()
+	h.Write([]byte(strings.TrimSpace(line)))
+	hash := h.Sum64()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for d.n > 0 && now.Sub(d.ring[d.head].at) >= d.window {
+		d.evict()
+	}
+	if _, ok := d.seen[hash]; ok {
+		return true
+	}
+	if d.n == len(d.ring) {
+		d.evict()
+	}
+	d.ring[(d.head+d.n)%len(d.ring)] = dedupEntry{hash: hash, at: now}
+	d.n++
+	d.seen[hash] = struct{}{}
+	return false
+}
+
+func (d *lineDeduper) evict() {
+	delete(d.seen, d.ring[d.head].hash)
+	d.head = (d.head + 1) % len(d.ring)
+	d.n--
+}
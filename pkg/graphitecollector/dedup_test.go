@@ -0,0 +1,55 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLineDeduper(t *testing.T) {
+	d := newLineDeduper(2*time.Second, 2)
+	now := time.Unix(1534620625, 0)
+
+	assert.False(t, d.duplicate("my.metric 1 1534620625", now))
+	assert.True(t, d.duplicate("my.metric 1 1534620625\n", now.Add(time.Second)), "surrounding whitespace is ignored")
+	assert.False(t, d.duplicate("my.metric 2 1534620625", now.Add(time.Second)), "a different value is not a duplicate")
+	assert.False(t, d.duplicate("my.metric 1 1534620625", now.Add(2*time.Second)), "the window has passed")
+
+	// The ring holds two lines, so a third evicts the oldest early.
+	assert.False(t, d.duplicate("other.metric 1 1534620625", now.Add(2*time.Second)))
+	assert.False(t, d.duplicate("my.metric 2 1534620625", now.Add(2*time.Second)))
+	assert.Len(t, d.seen, 2)
+}
+
+func TestDuplicateLines(t *testing.T) {
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.SetMapper(&mockMapper{})
+	c.dedup = newLineDeduper(time.Minute, 100)
+	c.Run(context.Background())
+	defer c.Stop()
+
+	duplicates := testutil.ToFloat64(duplicateLines)
+	c.processReader(strings.NewReader("my.metric 1 1534620625\nmy.metric 1 1534620625\nmy.metric 2 1534620626\n"), LineSource{}, mapperHolder{})
+	// The line goroutine has handled all lines once the sample store
+	// received the last sample.
+	c.removeCh <- ""
+	assert.Equal(t, duplicates+1, testutil.ToFloat64(duplicateLines))
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The reasons for which the mapping configuration drops a sample.
+const (
+	dropReasonMapping     = "mapping_drop"
+	dropReasonStrictMatch = "strict_match"
+	dropReasonInvalidName = "invalid_name"
+	// dropReasonInvalidMappedName drops samples whose mapped name had
+	// invalid characters replaced, with MapSettings.StrictMappedNames.
+	dropReasonInvalidMappedName = "invalid_mapped_name"
+)
+
+var droppedSamples = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "graphite_samples_dropped_total",
+		Help: "Total count of samples dropped by the mapping configuration, by reason.",
+	},
+	[]string{"reason"},
+)
+
+func init() {
+	droppedSamples.WithLabelValues(dropReasonMapping)
+	droppedSamples.WithLabelValues(dropReasonStrictMatch)
+	droppedSamples.WithLabelValues(dropReasonInvalidName)
+	droppedSamples.WithLabelValues(dropReasonInvalidMappedName)
+}
+
+// maxLoggedDropPaths bounds the number of paths a dropLogger remembers per
+// interval. Further paths are not logged until the next interval.
+const maxLoggedDropPaths = 10000
+
+// dropLogger logs the first drop of each path per interval, so that drop
+// rules can be verified without logging every line they discard.
+type dropLogger struct {
+	mu       sync.Mutex
+	logger   log.Logger
+	interval time.Duration
+	seen     map[string]struct{}
+	reset    time.Time
+}
+
+func newDropLogger(logger log.Logger, interval time.Duration) *dropLogger {
+	return &dropLogger{
+		logger:   logger,
+		interval: interval,
+		seen:     map[string]struct{}{},
+	}
+}
+
+func (l *dropLogger) log(now time.Time, path, reason string) {
+	l.mu.Lock()
+	if now.Sub(l.reset) >= l.interval {
+		l.seen = map[string]struct{}{}
+		l.reset = now
+	}
+	_, seen := l.seen[path]
+	if !seen && len(l.seen) < maxLoggedDropPaths {
+		l.seen[path] = struct{}{}
+	} else {
+		seen = true
+	}
+	l.mu.Unlock()
+
+	if !seen {
+		level.Info(l.logger).Log("msg", "Dropped metric path", "path", path, "reason", reason)
+	}
+}
+
+// dropSample counts a line whose metric is dropped by the mapping
+// configuration and passes it on to the dead letter output.
+func (c *Collector) dropSample(line, path, reason string) {
+	droppedSamples.WithLabelValues(reason).Inc()
+	c.totals.count(c.totals.dropped, reason)
+	c.totals.outcome(outcomeDropped)
+	if c.dropLogger != nil {
+		c.dropLogger.log(time.Now(), path, reason)
+	}
+	c.dropLine(line)
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDroppedSamples(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: noisy.*.metric
+  name: dropped
+  action: drop
+- match: app.*.requests
+  name: requests
+`))
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.SetMapper(m)
+	c.Run(context.Background())
+	defer c.Stop()
+
+	mappingDrops := testutil.ToFloat64(droppedSamples.WithLabelValues(dropReasonMapping))
+	strictDrops := testutil.ToFloat64(droppedSamples.WithLabelValues(dropReasonStrictMatch))
+
+	c.processLine("noisy.host.metric 1 1534620625", LineSource{})
+	c.processLine("noisy.other.metric 1 1534620625", LineSource{})
+	assert.Equal(t, mappingDrops+2, testutil.ToFloat64(droppedSamples.WithLabelValues(dropReasonMapping)))
+	assert.Equal(t, strictDrops, testutil.ToFloat64(droppedSamples.WithLabelValues(dropReasonStrictMatch)))
+
+	c.settings.StrictMatch = true
+	c.processLine("unmatched.metric 1 1534620625", LineSource{})
+	c.processLine("app.web.requests 1 1534620625", LineSource{})
+	assert.Equal(t, mappingDrops+2, testutil.ToFloat64(droppedSamples.WithLabelValues(dropReasonMapping)))
+	assert.Equal(t, strictDrops+1, testutil.ToFloat64(droppedSamples.WithLabelValues(dropReasonStrictMatch)))
+}
+
+func TestDropLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := newDropLogger(log.NewLogfmtLogger(&buf), time.Hour)
+
+	now := time.Unix(1534620625, 0)
+	l.log(now, "noisy.host.metric", dropReasonMapping)
+	l.log(now.Add(time.Minute), "noisy.host.metric", dropReasonMapping)
+	l.log(now.Add(time.Minute), "unmatched.metric", dropReasonStrictMatch)
+	assert.Equal(t, 1, strings.Count(buf.String(), "path=noisy.host.metric"))
+	assert.Contains(t, buf.String(), "path=unmatched.metric reason=strict_match")
+
+	l.log(now.Add(time.Hour), "noisy.host.metric", dropReasonMapping)
+	assert.Equal(t, 2, strings.Count(buf.String(), "path=noisy.host.metric"), "paths are logged again after the interval")
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterFeature("expiry_overrides")
+}
+
+// expiryOverride sets the expiry of the samples whose Graphite path starts
+// with Prefix or matches the glob Match, whether or not a mapping matches
+// the path. In Match, * matches any part of a path component.
+type expiryOverride struct {
+	Prefix string        `yaml:"prefix"`
+	Match  string        `yaml:"match"`
+	Expiry time.Duration `yaml:"expiry"`
+
+	glob *regexp.Regexp
+}
+
+// init validates the override and compiles its glob.
+func (o *expiryOverride) init() error {
+	if (o.Prefix == "") == (o.Match == "") {
+		return fmt.Errorf("expiry override must set exactly one of prefix and match")
+	}
+	if o.Expiry <= 0 {
+		return fmt.Errorf("expiry override %q must set a positive expiry", o.pattern())
+	}
+	if o.Match != "" {
+		parts := strings.Split(o.Match, "*")
+		for i := range parts {
+			parts[i] = regexp.QuoteMeta(parts[i])
+		}
+		o.glob = regexp.MustCompile("^" + strings.Join(parts, `[^.]*`) + "$")
+	}
+	return nil
+}
+
+// pattern is the prefix or glob of the override.
+func (o *expiryOverride) pattern() string {
+	if o.Prefix != "" {
+		return o.Prefix
+	}
+	return o.Match
+}
+
+func (o *expiryOverride) matches(path string) bool {
+	if o.glob != nil {
+		return o.glob.MatchString(path)
+	}
+	return strings.HasPrefix(path, o.Prefix)
+}
+
+// overrideExpiry returns the expiry of the first of overrides matching the
+// Graphite path, or zero if none does.
+func overrideExpiry(overrides []expiryOverride, path string) time.Duration {
+	for i := range overrides {
+		if overrides[i].matches(path) {
+			return overrides[i].Expiry
+		}
+	}
+	return 0
+}
@@ -0,0 +1,56 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOverrideExpiry(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+expiry_overrides:
+- match: billing.*.invoices
+  expiry: 1h
+- prefix: billing.
+  expiry: 30m
+- match: app.web-*.requests
+  expiry: 20s
+`))
+	for path, want := range map[string]time.Duration{
+		"billing.acme.invoices":    time.Hour,
+		"billing.acme.eu.invoices": 30 * time.Minute,
+		"billing.acme.payments":    30 * time.Minute,
+		"app.web-1.requests":       20 * time.Second,
+		"app.web-1.requests.count": 0,
+		"app.api-1.requests":       0,
+		"billingx.acme.invoices":   0,
+		// The dots of a glob are not regexp wildcards.
+		"app.web-1Xrequests": 0,
+	} {
+		assert.Equal(t, want, overrideExpiry(m.expiryOverrides(), path), path)
+	}
+
+	for _, config := range []string{
+		"expiry_overrides:\n- expiry: 1m\n",
+		"expiry_overrides:\n- prefix: a.\n  match: a.*\n  expiry: 1m\n",
+		"expiry_overrides:\n- prefix: a.\n",
+		"expiry_overrides:\n- match: a.*\n  expiry: -1m\n",
+	} {
+		assert.Error(t, (&Mapper{}).InitFromYAMLString(config), config)
+	}
+}
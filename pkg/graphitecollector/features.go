@@ -0,0 +1,49 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"sort"
+	"sync"
+)
+
+// features is the set of capabilities of the build. Each feature is
+// registered by the init function of the file implementing it, so that the
+// set follows the code compiled into the binary.
+var features = struct {
+	sync.Mutex
+	names map[string]struct{}
+}{names: map[string]struct{}{}}
+
+// RegisterFeature records that the build supports the named feature, such
+// as "carbon2". It is meant to be called from the init function of the file
+// implementing the feature.
+func RegisterFeature(name string) {
+	features.Lock()
+	defer features.Unlock()
+	features.names[name] = struct{}{}
+}
+
+// Features returns the sorted names of the features registered with
+// RegisterFeature.
+func Features() []string {
+	features.Lock()
+	defer features.Unlock()
+	names := make([]string, 0, len(features.names))
+	for name := range features.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
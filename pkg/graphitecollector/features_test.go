@@ -0,0 +1,38 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeatures(t *testing.T) {
+	got := Features()
+	assert.True(t, sort.StringsAreSorted(got), "%v", got)
+	assert.Contains(t, got, "carbon2")
+	assert.Contains(t, got, "tombstones")
+
+	RegisterFeature("test_feature")
+	RegisterFeature("test_feature")
+	defer func() {
+		features.Lock()
+		delete(features.names, "test_feature")
+		features.Unlock()
+	}()
+	assert.Len(t, Features(), len(got)+1)
+	assert.Contains(t, Features(), "test_feature")
+}
@@ -0,0 +1,131 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+func init() {
+	RegisterFeature("identity_labels")
+}
+
+var identityLabelsDesc = prometheus.NewDesc(
+	"graphite_identity_labels_info",
+	"Identity labels file whose labels are added to every exported sample, with the SHA-256 of its contents.",
+	[]string{"file", "sha256"}, nil,
+)
+
+// IdentityLabels are labels identifying the exporter, such as the team
+// owning it, that are added to every exported sample. They are read from a
+// file maintained outside of the exporter, see LoadIdentityLabels.
+type IdentityLabels struct {
+	// File is the file the labels were read from.
+	File   string
+	Labels map[string]string
+	// Hash is the hex encoded SHA-256 of the contents of the file, so that
+	// the file in use can be audited.
+	Hash string
+}
+
+// LoadIdentityLabels reads identity labels from file, which holds one
+// name=value pair per line. Empty lines and lines starting with "#" are
+// ignored.
+func LoadIdentityLabels(file string) (*IdentityLabels, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := parseIdentityLabels(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	sum := sha256.Sum256(content)
+	return &IdentityLabels{File: file, Labels: labels, Hash: hex.EncodeToString(sum[:])}, nil
+}
+
+func parseIdentityLabels(content []byte) (map[string]string, error) {
+	labels := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected name=value", n)
+		}
+		name, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return nil, fmt.Errorf("line %d: invalid label name %q", n, name)
+		}
+		if !utf8.ValidString(value) {
+			return nil, fmt.Errorf("line %d: invalid label value %q", n, value)
+		}
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("line %d: duplicate label %q", n, name)
+		}
+		labels[name] = value
+	}
+	return labels, scanner.Err()
+}
+
+// apply returns labels with the identity labels added, overriding labels of
+// the same name. labels is returned as is if there are no identity labels.
+func (id *IdentityLabels) apply(labels map[string]string) map[string]string {
+	if id == nil || len(id.Labels) == 0 {
+		return labels
+	}
+	merged := make(map[string]string, len(labels)+len(id.Labels))
+	for k, v := range labels {
+		merged[k] = v
+	}
+	for k, v := range id.Labels {
+		merged[k] = v
+	}
+	return merged
+}
+
+// IdentityLabels returns the identity labels added to every exported
+// sample, or nil if there are none.
+func (c *Collector) IdentityLabels() *IdentityLabels {
+	id, _ := c.identity.Load().(*IdentityLabels)
+	return id
+}
+
+// SetIdentityLabels replaces the identity labels, for example after
+// reloading their file. Scrapes starting once SetIdentityLabels returned
+// export the samples with id, or without identity labels if id is nil. id
+// must not be modified once set.
+func (c *Collector) SetIdentityLabels(id *IdentityLabels) {
+	c.identity.Store(id)
+}
+
+// collectIdentity emits the info metric of the identity labels file, if any.
+func (c *Collector) collectIdentity(ch chan<- prometheus.Metric) {
+	if id := c.IdentityLabels(); id != nil {
+		ch <- prometheus.MustNewConstMetric(identityLabelsDesc, prometheus.GaugeValue, 1, id.File, id.Hash)
+	}
+}
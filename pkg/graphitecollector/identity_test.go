@@ -0,0 +1,117 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadIdentityLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graphite_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "identity")
+	content := "# Maintained by provisioning.\nteam=payments\n\n region = eu-west-1 \nnote=a=b\n"
+	assert.NoError(t, ioutil.WriteFile(file, []byte(content), 0644))
+	id, err := LoadIdentityLabels(file)
+	if assert.NoError(t, err) {
+		sum := sha256.Sum256([]byte(content))
+		assert.Equal(t, &IdentityLabels{
+			File:   file,
+			Labels: map[string]string{"team": "payments", "region": "eu-west-1", "note": "a=b"},
+			Hash:   hex.EncodeToString(sum[:]),
+		}, id)
+	}
+
+	for content, want := range map[string]string{
+		"team":                  "line 1: expected name=value",
+		"team=a\n__name__=x":    `line 2: invalid label name "__name__"`,
+		"team-name=a":           `line 1: invalid label name "team-name"`,
+		"team=a\nteam=b":        `line 2: duplicate label "team"`,
+		"team=\xff":             `line 1: invalid label value "\xff"`,
+		"# only comments\n\n  ": "",
+	} {
+		assert.NoError(t, ioutil.WriteFile(file, []byte(content), 0644))
+		_, err := LoadIdentityLabels(file)
+		if want == "" {
+			assert.NoError(t, err, "%q", content)
+			continue
+		}
+		assert.EqualError(t, err, fmt.Sprintf("%s: %s", file, want), "%q", content)
+	}
+
+	_, err = LoadIdentityLabels(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestIdentityLabels(t *testing.T) {
+	c := NewCollector(Options{
+		Logger:         log.NewNopLogger(),
+		Carbon2:        true,
+		IdentityLabels: &IdentityLabels{File: "identity", Labels: map[string]string{"team": "payments"}, Hash: "abc"},
+	})
+	c.Run(context.Background())
+	defer c.Stop()
+	now := time.Now().Unix()
+	c.processLine(fmt.Sprintf("metric=app.load host=web1 1 %d", now), LineSource{})
+	c.processLine(fmt.Sprintf("metric=app.spoofed team=other 2 %d", now), LineSource{})
+	c.removeCh <- ""
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP app_load Graphite metric app_load
+# TYPE app_load gauge
+app_load{host="web1",team="payments"} 1
+# HELP app_spoofed Graphite metric app_spoofed
+# TYPE app_spoofed gauge
+app_spoofed{team="payments"} 2
+# HELP graphite_identity_labels_info Identity labels file whose labels are added to every exported sample, with the SHA-256 of its contents.
+# TYPE graphite_identity_labels_info gauge
+graphite_identity_labels_info{file="identity",sha256="abc"} 1
+`), "app_load", "app_spoofed", "graphite_identity_labels_info"))
+
+	// OTLP exports the samples with the identity labels too, while the
+	// stored samples are unchanged.
+	for _, s := range c.CurrentSamples(time.Now()) {
+		assert.Equal(t, "payments", s.Labels["team"])
+	}
+	c.mu.Lock()
+	assert.Equal(t, map[string]string{"host": "web1"}, c.samples["app.load;host=web1;metric=app.load"].Labels)
+	c.mu.Unlock()
+
+	c.SetIdentityLabels(nil)
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP app_spoofed Graphite metric app_spoofed
+# TYPE app_spoofed gauge
+app_spoofed{team="other"} 2
+`), "app_spoofed", "graphite_identity_labels_info"))
+}
@@ -0,0 +1,196 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterFeature("batch_ingest")
+}
+
+// sampleBatch is a set of samples stored together by the goroutine owning
+// the sample store, which sends the rejection of each sample, or nil, on
+// done once they are stored.
+type sampleBatch struct {
+	samples []*Sample
+	done    chan []error
+}
+
+// batchResult reports the outcome of ingesting a line of a batch.
+type batchResult struct {
+	Line     string `json:"line"`
+	Accepted bool   `json:"accepted"`
+	// Series is the exported series of an accepted line.
+	Series string `json:"series,omitempty"`
+	// Reason is why the line was rejected, as in dryRunResult.
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ingestBatch ingests the lines read from r like lines received by the
+// listeners, and returns once the resulting samples are stored, with the
+// outcome of each line. Lines that are not stored before ctx is done may
+// still be stored later.
+func (c *Collector) ingestBatch(ctx context.Context, r io.Reader, source LineSource) ([]batchResult, error) {
+	// All lines of the batch are mapped with the same mapper.
+	mapper := c.Mapper()
+	results := []batchResult{}
+	var (
+		batch   sampleBatch
+		indices []int
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if c.recordLine != nil {
+			c.recordLine(line)
+		}
+		if !c.admitLine(graphiteLine{text: line, source: source}) {
+			results = append(results, batchResult{Line: line, Reason: "duplicate"})
+			continue
+		}
+		if !c.throttleParse(ctx.Done()) {
+			return nil, ctx.Err()
+		}
+		// The datapoints of a line are reported like lines of their own.
+		datapoints := []string{line}
+		if split := c.splitDatapoints(line); split != nil {
+			multiDatapointLines.Inc()
+			datapoints = split
+		}
+		for _, datapoint := range datapoints {
+			result := batchResult{Line: datapoint}
+			p := c.ingestLine(datapoint, source, mapper)
+			switch {
+			case p.invalid != "":
+				result.Reason = p.invalid
+				result.Error = formatKeyvals(p.keyvals)
+			case p.dropReason != "":
+				result.Reason = p.dropReason
+			default:
+				batch.samples = append(batch.samples, p.sample)
+				indices = append(indices, len(results))
+			}
+			results = append(results, result)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// done is buffered so that the store never waits for a request that
+	// timed out.
+	batch.done = make(chan []error, 1)
+	c.watchdog.samples.enqueued(time.Now())
+	select {
+	case c.batchCh <- &batch:
+	case <-c.done:
+		return nil, fmt.Errorf("collector stopped")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var rejections []error
+	select {
+	case rejections = <-batch.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for i, err := range rejections {
+		result := &results[indices[i]]
+		if err != nil {
+			result.Error = err.Error()
+			if rejection, ok := err.(*sampleRejection); ok {
+				result.Reason = rejection.reason
+			}
+			continue
+		}
+		s := batch.samples[i]
+		result.Accepted = true
+		result.Series = seriesString(s.Name, s.Labels)
+	}
+	return results, nil
+}
+
+// IngestLines ingests the lines read from r like lines received by the
+// listeners from source, and returns the number of accepted lines once the
+// resulting samples are stored. Lines that are not stored before ctx is done
+// may still be stored later.
+func (c *Collector) IngestLines(ctx context.Context, r io.Reader, source LineSource) (int, error) {
+	results, err := c.ingestBatch(ctx, r, source)
+	if err != nil {
+		return 0, err
+	}
+	accepted := 0
+	for _, result := range results {
+		if result.Accepted {
+			accepted++
+		}
+	}
+	return accepted, nil
+}
+
+// IngestBatchHandler ingests the plaintext lines in the request body and
+// responds with the outcome of each line once the accepted samples are
+// stored. Bodies larger than maxBytes are rejected, and requests taking
+// longer than timeout fail.
+func IngestBatchHandler(c *Collector, maxBytes int64, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "This endpoint requires a POST or PUT request.\n")
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read lines: %s", err), http.StatusBadRequest)
+			return
+		}
+		if int64(len(body)) > maxBytes {
+			http.Error(w, fmt.Sprintf("request body exceeds %d bytes", maxBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		results, err := c.ingestBatch(ctx, bytes.NewReader(body), LineSource{Protocol: "http", Address: r.RemoteAddr})
+		if err == context.DeadlineExceeded {
+			http.Error(w, fmt.Sprintf("lines were not stored within %s", timeout), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to ingest lines: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   results,
+		})
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIngestBatchHandler(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: app.*.requests
+  name: requests_total
+  type: counter
+  accumulate: true
+  labels:
+    app: $1
+- match: app.*.bad
+  name: bad
+  labels:
+    __app: $1
+- match: noisy.*
+  name: noisy
+  action: drop
+`))
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.SetMapper(m)
+	c.Run(context.Background())
+	defer c.Stop()
+
+	body := strings.Join([]string{
+		"app.web.requests 5 200",
+		"app.web.requests 3 100",
+		"app.web.bad 1 100",
+		"noisy.metric 1 100",
+		"app.web.requests",
+		"",
+	}, "\n")
+	rec := httptest.NewRecorder()
+	IngestBatchHandler(c, 1024, time.Second).ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/ingest/batch", strings.NewReader(body)))
+
+	var resp struct {
+		Status string
+		Data   []batchResult
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp), rec.Body.String())
+	assert.Equal(t, "success", resp.Status)
+	// The error of the out of order sample contains its time in the local
+	// time zone.
+	if assert.Len(t, resp.Data, 5) {
+		assert.Contains(t, resp.Data[1].Error, "is older than the last sample of accumulating counter requests_total")
+		resp.Data[1].Error = ""
+	}
+	assert.Equal(t, []batchResult{
+		{Line: "app.web.requests 5 200", Accepted: true, Series: `requests_total{app="web"}`},
+		{Line: "app.web.requests 3 100", Reason: "out_of_order"},
+		{Line: "app.web.bad 1 100", Reason: "invalid_label_name", Error: `invalid label name "__app"`},
+		{Line: "noisy.metric 1 100", Reason: dropReasonMapping},
+		{Line: "app.web.requests", Reason: "part_count", Error: "parts=1"},
+	}, resp.Data)
+
+	// The response is only sent once the samples are stored.
+	c.mu.Lock()
+	assert.Len(t, c.samples, 1)
+	assert.Equal(t, 5.0, c.samples["app.web.requests"].Value)
+	c.mu.Unlock()
+
+	rec = httptest.NewRecorder()
+	IngestBatchHandler(c, 8, time.Second).ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/ingest/batch", strings.NewReader(body)))
+	assert.Equal(t, 413, rec.Code)
+
+	rec = httptest.NewRecorder()
+	IngestBatchHandler(c, 1024, time.Second).ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/ingest/batch", nil))
+	assert.Equal(t, 405, rec.Code)
+}
+
+func TestIngestBatchTimeout(t *testing.T) {
+	// The collector is not running, so the samples are never stored.
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	rec := httptest.NewRecorder()
+	IngestBatchHandler(c, 1024, 10*time.Millisecond).ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/ingest/batch", strings.NewReader("my.metric 1 100\n")))
+	assert.Equal(t, 503, rec.Code)
+	assert.Equal(t, "lines were not stored within 10ms\n", rec.Body.String())
+}
+
+func TestIngestLines(t *testing.T) {
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.Run(context.Background())
+	defer c.Stop()
+	accepted, err := c.IngestLines(context.Background(), strings.NewReader("a.b 1 100\na.c\na.d 2 100\n"), LineSource{Protocol: "pull"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, accepted)
+	assert.Equal(t, 2, c.SampleCount(), "the samples are stored once IngestLines returns")
+}
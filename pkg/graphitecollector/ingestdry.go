@@ -0,0 +1,182 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+func init() {
+	RegisterFeature("ingest_dry_run")
+}
+
+// maxDryRunBytes bounds the request body of a dry run.
+const maxDryRunBytes = 1 << 20
+
+// dryRunResult reports what ingesting a line would result in.
+type dryRunResult struct {
+	Line     string `json:"line"`
+	Accepted bool   `json:"accepted"`
+	// Reason is why the line would be rejected: the reason logged for an
+	// invalid line, or the reason label of graphite_samples_dropped_total
+	// or graphite_invalid_samples_total.
+	Reason string            `json:"reason,omitempty"`
+	Error  string            `json:"error,omitempty"`
+	Path   string            `json:"path,omitempty"`
+	Name   string            `json:"name,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Type   string            `json:"type,omitempty"`
+	// Value is a string, as JSON cannot represent NaN and infinities.
+	Value     string  `json:"value,omitempty"`
+	Timestamp float64 `json:"timestamp,omitempty"`
+	// Series identifies the exported series. CollidesWith lists the other
+	// paths of the request and the stored paths exported as the same series.
+	Series        string   `json:"series,omitempty"`
+	CollidesWith  []string `json:"collides_with,omitempty"`
+	ExpirySeconds float64  `json:"expiry_seconds,omitempty"`
+	// ExpirySource is what sets the expiry: the mapping, the storage
+	// schemas or the default sample expiry.
+	ExpirySource string `json:"expiry_source,omitempty"`
+}
+
+// dryRun parses, maps and validates the lines read from r like the
+// ingestion pipeline does, without storing the resulting samples.
+func (c *Collector) dryRun(r io.Reader) ([]dryRunResult, error) {
+	// pathsBySeries starts with the stored series, so that collisions with
+	// the data already received are reported too.
+	pathsBySeries := map[string][]string{}
+	for _, s := range c.snapshot() {
+		series := seriesString(s.Name, s.Labels)
+		pathsBySeries[series] = append(pathsBySeries[series], s.OriginalName)
+	}
+
+	// All lines of the request are mapped with the same mapper.
+	mapper := c.Mapper()
+	results := []dryRunResult{}
+	scanner := bufio.NewScanner(r)
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if datapoints := c.splitDatapoints(line); datapoints != nil {
+			lines = append(lines, datapoints...)
+		} else {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		result := dryRunResult{Line: line}
+		p := c.parseLine(line, mapper)
+		result.Path = p.originalName
+		switch {
+		case p.invalid != "":
+			result.Reason = p.invalid
+			result.Error = formatKeyvals(p.keyvals)
+		case p.dropReason != "":
+			result.Reason = p.dropReason
+		default:
+			s := p.sample
+			result.Name = s.Name
+			result.Labels = s.Labels
+			result.Type = valueTypeName(s.Type)
+			result.Value = strconv.FormatFloat(s.Value, 'g', -1, 64)
+			result.Timestamp = float64(s.Timestamp.UnixNano()) / 1e9
+			if reason, err := validateSample(s); err != nil {
+				result.Reason, result.Error = reason, err.Error()
+				break
+			}
+			result.Accepted = true
+			result.Series = seriesString(s.Name, s.Labels)
+			for _, path := range pathsBySeries[result.Series] {
+				if path != s.OriginalName {
+					result.CollidesWith = append(result.CollidesWith, path)
+				}
+			}
+			pathsBySeries[result.Series] = appendUnique(pathsBySeries[result.Series], s.OriginalName)
+			expiry, source := c.effectiveExpiry(s)
+			result.ExpirySeconds, result.ExpirySource = expiry.Seconds(), source
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// seriesString formats a series in the Prometheus text notation.
+func seriesString(name string, labels map[string]string) string {
+	metric := model.Metric{model.MetricNameLabel: model.LabelValue(name)}
+	for k, v := range labels {
+		metric[model.LabelName(k)] = model.LabelValue(v)
+	}
+	return metric.String()
+}
+
+func valueTypeName(t prometheus.ValueType) string {
+	switch t {
+	case prometheus.CounterValue:
+		return string(MetricTypeCounter)
+	case prometheus.GaugeValue:
+		return string(MetricTypeGauge)
+	}
+	return string(MetricTypeUntyped)
+}
+
+func formatKeyvals(keyvals []interface{}) string {
+	parts := make([]string, 0, len(keyvals)/2)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		parts = append(parts, fmt.Sprintf("%v=%v", keyvals[i], keyvals[i+1]))
+	}
+	return strings.Join(parts, " ")
+}
+
+func appendUnique(s []string, v string) []string {
+	for _, e := range s {
+		if e == v {
+			return s
+		}
+	}
+	return append(s, v)
+}
+
+// IngestDryRunHandler responds with what ingesting the plaintext lines in the
+// request body would result in, line by line, without storing any sample.
+func IngestDryRunHandler(c *Collector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "This endpoint requires a POST or PUT request.\n")
+			return
+		}
+		results, err := c.dryRun(http.MaxBytesReader(w, r.Body, maxDryRunBytes))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to read lines: %s", err), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   results,
+		})
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIngestDryRunHandler(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+unit_suffixes:
+- suffix: ms
+  unit: seconds
+  scale: 0.001
+mappings:
+- match: app.*.latency_ms
+  name: latency_ms
+  normalize_name: true
+  labels:
+    app: $1
+- match: app.*.latency
+  name: latency_seconds
+  labels:
+    app: $1
+- match: noisy.*
+  name: noisy
+  action: drop
+`))
+	c := NewCollector(Options{Logger: log.NewNopLogger(), SampleExpiry: time.Minute})
+	c.SetMapper(m)
+	c.Run(context.Background())
+	defer c.Stop()
+	c.processLine("app.web.latency 1 100", LineSource{})
+	// The sample store handles one request at a time, so the sample has
+	// been stored once a removal is accepted.
+	c.removeCh <- ""
+
+	body := strings.Join([]string{
+		"app.web.latency_ms 1500 100",
+		"app.web.latency 2 100",
+		"noisy.metric 1 100",
+		"app.web.requests",
+		"app.web.requests x 100",
+		"",
+	}, "\n")
+	rec := httptest.NewRecorder()
+	IngestDryRunHandler(c).ServeHTTP(rec, httptest.NewRequest("POST", "/debug/ingest-dry", strings.NewReader(body)))
+
+	var resp struct {
+		Status string
+		Data   []dryRunResult
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp), rec.Body.String())
+	assert.Equal(t, "success", resp.Status)
+	assert.Equal(t, []dryRunResult{
+		{
+			Line: "app.web.latency_ms 1500 100", Accepted: true, Path: "app.web.latency_ms",
+			Name: "latency_seconds", Labels: map[string]string{"app": "web"}, Type: "gauge",
+			Value: "1.5", Timestamp: 100, Series: `latency_seconds{app="web"}`,
+			CollidesWith: []string{"app.web.latency"}, ExpirySeconds: 60, ExpirySource: "default",
+		},
+		{
+			Line: "app.web.latency 2 100", Accepted: true, Path: "app.web.latency",
+			Name: "latency_seconds", Labels: map[string]string{"app": "web"}, Type: "gauge",
+			Value: "2", Timestamp: 100, Series: `latency_seconds{app="web"}`,
+			CollidesWith: []string{"app.web.latency_ms"}, ExpirySeconds: 60, ExpirySource: "default",
+		},
+		{Line: "noisy.metric 1 100", Path: "noisy.metric", Reason: dropReasonMapping},
+		{Line: "app.web.requests", Reason: "part_count", Error: "parts=1"},
+		{Line: "app.web.requests x 100", Path: "app.web.requests", Reason: "value", Error: `err=strconv.ParseFloat: parsing "x": invalid syntax`},
+	}, resp.Data)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	assert.Len(t, c.samples, 1, "a dry run stores no samples")
+	assert.Equal(t, 1.0, c.samples["app.web.latency"].Value)
+
+	rec = httptest.NewRecorder()
+	IngestDryRunHandler(c).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/ingest-dry", nil))
+	assert.Equal(t, 405, rec.Code)
+}
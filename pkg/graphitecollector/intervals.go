@@ -0,0 +1,141 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterFeature("update_intervals")
+}
+
+// recentIntervals is how many of the latest update intervals of a metric
+// name its median is taken over.
+const recentIntervals = 16
+
+// intervalTracker tracks how often the samples of each metric name are
+// updated, for up to max names. Names seen once max names are tracked are
+// not tracked.
+type intervalTracker struct {
+	mu    sync.Mutex
+	max   int
+	names map[string]*nameIntervals
+}
+
+// nameIntervals is the update state of a metric name. intervals is a ring
+// of the latest intervals, the oldest at next once it is full.
+type nameIntervals struct {
+	lastUpdate time.Time
+	updates    uint64
+	intervals  [recentIntervals]time.Duration
+	n, next    int
+}
+
+func newIntervalTracker(max int) *intervalTracker {
+	return &intervalTracker{max: max, names: map[string]*nameIntervals{}}
+}
+
+// observe records an update of a series of name at now. If the series had a
+// sample before, the interval between the timestamps of that and the new
+// sample is recorded as well, as expiry is measured by timestamps too.
+func (t *intervalTracker) observe(name string, sample, previous *Sample, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n, ok := t.names[name]
+	if !ok {
+		if len(t.names) >= t.max {
+			return
+		}
+		n = &nameIntervals{}
+		t.names[name] = n
+	}
+	n.lastUpdate = now
+	n.updates++
+	if previous == nil || !sample.Timestamp.After(previous.Timestamp) {
+		return
+	}
+	n.intervals[n.next] = sample.Timestamp.Sub(previous.Timestamp)
+	n.next = (n.next + 1) % recentIntervals
+	if n.n < recentIntervals {
+		n.n++
+	}
+}
+
+// updateInterval is the update statistics of a metric name.
+type updateInterval struct {
+	Name       string    `json:"name"`
+	LastUpdate time.Time `json:"last_update"`
+	// AgeSeconds is the time since the last update.
+	AgeSeconds float64 `json:"age_seconds"`
+	Updates    uint64  `json:"updates"`
+	// MedianIntervalSeconds is the median of the latest intervals between
+	// the timestamps of consecutive samples of a series of the name, or
+	// zero if no series had more than one sample yet.
+	MedianIntervalSeconds float64 `json:"median_interval_seconds"`
+}
+
+// stats returns the update statistics of the tracked names, the least
+// recently updated first.
+func (t *intervalTracker) stats(now time.Time) []updateInterval {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := make([]updateInterval, 0, len(t.names))
+	for name, n := range t.names {
+		stats = append(stats, updateInterval{
+			Name:                  name,
+			LastUpdate:            n.lastUpdate,
+			AgeSeconds:            now.Sub(n.lastUpdate).Seconds(),
+			Updates:               n.updates,
+			MedianIntervalSeconds: n.median().Seconds(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if !stats[i].LastUpdate.Equal(stats[j].LastUpdate) {
+			return stats[i].LastUpdate.Before(stats[j].LastUpdate)
+		}
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+func (n *nameIntervals) median() time.Duration {
+	if n.n == 0 {
+		return 0
+	}
+	intervals := append([]time.Duration(nil), n.intervals[:n.n]...)
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+	if n.n%2 == 1 {
+		return intervals[n.n/2]
+	}
+	return (intervals[n.n/2-1] + intervals[n.n/2]) / 2
+}
+
+// UpdateIntervalsHandler responds with how often the samples of each metric
+// name were updated, the least recently updated names first, to tune the
+// sample expiry. It must only be used if c was created with
+// Options.TrackUpdateIntervals.
+func UpdateIntervalsHandler(c *Collector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   c.intervals.stats(c.clock.Now()),
+		})
+	}
+}
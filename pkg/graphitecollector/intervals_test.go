@@ -0,0 +1,81 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateIntervals(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	c := NewCollector(Options{Logger: log.NewNopLogger(), Clock: clock, TrackUpdateIntervals: 2})
+	c.Run(context.Background())
+	defer c.Stop()
+	ingest := func(lines ...string) {
+		for _, line := range lines {
+			c.processLine(line, LineSource{})
+		}
+		c.removeCh <- ""
+	}
+
+	ingest("slow.metric 1 900", "fast.metric 1 990", "fast.other 1 990")
+	clock.now = clock.now.Add(10 * time.Second)
+	ingest("fast.metric 1 1000")
+	clock.now = clock.now.Add(20 * time.Second)
+	// Samples that are not newer than the stored one add no interval.
+	ingest("fast.metric 1 1030", "fast.metric 1 1030", "ignored.metric 1 1030")
+
+	rec := httptest.NewRecorder()
+	UpdateIntervalsHandler(c)(rec, httptest.NewRequest("GET", "/debug/update-intervals", nil))
+	var resp struct {
+		Status string
+		Data   []updateInterval
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp), rec.Body.String())
+	assert.Equal(t, "success", resp.Status)
+	for i := range resp.Data {
+		resp.Data[i].LastUpdate = resp.Data[i].LastUpdate.Local()
+	}
+	assert.Equal(t, []updateInterval{
+		{Name: "slow_metric", LastUpdate: time.Unix(1000, 0), AgeSeconds: 30, Updates: 1},
+		{Name: "fast_metric", LastUpdate: time.Unix(1030, 0), AgeSeconds: 0, Updates: 4, MedianIntervalSeconds: 20},
+	}, resp.Data)
+}
+
+func TestIntervalMedian(t *testing.T) {
+	tracker := newIntervalTracker(1)
+	previous := &Sample{Timestamp: time.Unix(0, 0)}
+	for i, interval := range []int{5, 1, 3, 100} {
+		sample := &Sample{Timestamp: previous.Timestamp.Add(time.Duration(interval) * time.Second)}
+		tracker.observe("metric", sample, previous, sample.Timestamp)
+		previous = sample
+		want := map[int]time.Duration{0: 5 * time.Second, 1: 3 * time.Second, 2: 3 * time.Second, 3: 4 * time.Second}[i]
+		assert.Equal(t, want, tracker.names["metric"].median())
+	}
+
+	// Only the latest intervals count.
+	for i := 0; i < recentIntervals; i++ {
+		sample := &Sample{Timestamp: previous.Timestamp.Add(time.Minute)}
+		tracker.observe("metric", sample, previous, sample.Timestamp)
+		previous = sample
+	}
+	assert.Equal(t, time.Minute, tracker.names["metric"].median())
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// labelSource is where labels of a sample come from. The sources are listed
+// in increasing order of precedence: when several set the same label, the
+// value of the last one is kept.
+type labelSource int
+
+const (
+	// labelSourcePath are the components of unmapped paths moved into
+	// labels, see MapSettings.
+	labelSourcePath labelSource = iota
+	// labelSourceTags are the tags sent with the line, such as the
+	// intrinsic tags and the unit of a carbon2 line.
+	labelSourceTags
+	// labelSourceMapping are the labels set by the mapping of the path.
+	labelSourceMapping
+
+	labelSourceCount
+)
+
+var labelSourceNames = [labelSourceCount]string{"path", "tags", "mapping"}
+
+func (s labelSource) String() string {
+	return labelSourceNames[s]
+}
+
+var labelConflicts = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "graphite_label_conflicts_total",
+		Help: "Total count of labels set by more than one source, by the source whose value was overridden and the source whose value was kept.",
+	},
+	[]string{"overridden", "kept"},
+)
+
+var sanitizedLabelValues = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "graphite_sanitized_label_values_total",
+		Help: "Total count of label values whose control characters or invalid UTF-8 were removed or replaced.",
+	},
+)
+
+// labelConflict is a label set by more than one source.
+type labelConflict struct {
+	label      string
+	overridden labelSource
+	kept       labelSource
+}
+
+// labelSources are the labels of a sample, indexed by their source.
+type labelSources [labelSourceCount]map[string]string
+
+// assemble merges the labels of all sources in their order of precedence,
+// returning every label whose value was overridden. If a single source sets
+// labels, its map is returned as is, so it may be shared.
+func (ls labelSources) assemble() (map[string]string, []labelConflict) {
+	var (
+		labels    map[string]string
+		first     labelSource
+		owner     map[string]labelSource
+		conflicts []labelConflict
+	)
+	for i, set := range ls {
+		source := labelSource(i)
+		if len(set) == 0 {
+			continue
+		}
+		if labels == nil {
+			labels, first = set, source
+			continue
+		}
+		if owner == nil {
+			labels = copyLabels(labels)
+			owner = make(map[string]labelSource, len(labels)+len(set))
+			for k := range labels {
+				owner[k] = first
+			}
+		}
+		for k, v := range set {
+			if prev, ok := owner[k]; ok {
+				conflicts = append(conflicts, labelConflict{label: k, overridden: prev, kept: source})
+			}
+			labels[k] = v
+			owner[k] = source
+		}
+	}
+	sort.SliceStable(conflicts, func(i, j int) bool {
+		return conflicts[i].label < conflicts[j].label
+	})
+	return labels, conflicts
+}
+
+// sanitizeLabelValue returns v without control characters, which tags and
+// path components may carry but which have no place in a label value.
+// Whitespace such as newlines and tabs is replaced with a space, other control
+// characters are removed, and bytes that are not valid UTF-8 are replaced with
+// U+FFFD. Quotes and backslashes are kept, as the exposition formats escape
+// them.
+func sanitizeLabelValue(v string) string {
+	if utf8.ValidString(v) && strings.IndexFunc(v, unicode.IsControl) < 0 {
+		return v
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r) && unicode.IsSpace(r):
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, v)
+}
+
+// sanitizeLabelValues sanitizes the label values of the sample of a parsed
+// line, recording how many were changed.
+func sanitizeLabelValues(r parsedLine) parsedLine {
+	s := r.sample
+	if s == nil {
+		return r
+	}
+	copied := false
+	for name, value := range s.Labels {
+		sanitized := sanitizeLabelValue(value)
+		if sanitized == value {
+			continue
+		}
+		// The labels may be shared with the mapper's cache.
+		if !copied {
+			s.Labels = copyLabels(s.Labels)
+			copied = true
+		}
+		s.Labels[name] = sanitized
+		r.sanitizedLabels++
+	}
+	return r
+}
@@ -0,0 +1,220 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssembleLabels(t *testing.T) {
+	path := map[string]string{"instance": "path", "graphite_hierarchy": "servers"}
+	tags := map[string]string{"instance": "tags", "unit": "tags", "dc": "tags"}
+	mapping := map[string]string{"instance": "mapping", "unit": "mapping", "job": "mapping"}
+
+	for _, tc := range []struct {
+		name      string
+		sources   labelSources
+		want      map[string]string
+		conflicts []labelConflict
+	}{
+		{
+			name: "no labels",
+		},
+		{
+			name:    "path only",
+			sources: labelSources{labelSourcePath: path},
+			want:    path,
+		},
+		{
+			name:    "tags only",
+			sources: labelSources{labelSourceTags: tags},
+			want:    tags,
+		},
+		{
+			name:    "mapping only",
+			sources: labelSources{labelSourceMapping: mapping},
+			want:    mapping,
+		},
+		{
+			name:    "empty sources are skipped",
+			sources: labelSources{map[string]string{}, tags, nil},
+			want:    tags,
+		},
+		{
+			name:    "tags override the path",
+			sources: labelSources{labelSourcePath: path, labelSourceTags: tags},
+			want:    map[string]string{"instance": "tags", "graphite_hierarchy": "servers", "unit": "tags", "dc": "tags"},
+			conflicts: []labelConflict{
+				{label: "instance", overridden: labelSourcePath, kept: labelSourceTags},
+			},
+		},
+		{
+			name:    "the mapping overrides the path",
+			sources: labelSources{labelSourcePath: path, labelSourceMapping: mapping},
+			want:    map[string]string{"instance": "mapping", "graphite_hierarchy": "servers", "unit": "mapping", "job": "mapping"},
+			conflicts: []labelConflict{
+				{label: "instance", overridden: labelSourcePath, kept: labelSourceMapping},
+			},
+		},
+		{
+			name:    "the mapping overrides tags",
+			sources: labelSources{labelSourceTags: tags, labelSourceMapping: mapping},
+			want:    map[string]string{"instance": "mapping", "unit": "mapping", "dc": "tags", "job": "mapping"},
+			conflicts: []labelConflict{
+				{label: "instance", overridden: labelSourceTags, kept: labelSourceMapping},
+				{label: "unit", overridden: labelSourceTags, kept: labelSourceMapping},
+			},
+		},
+		{
+			name:    "all sources",
+			sources: labelSources{path, tags, mapping},
+			want:    map[string]string{"instance": "mapping", "graphite_hierarchy": "servers", "unit": "mapping", "dc": "tags", "job": "mapping"},
+			conflicts: []labelConflict{
+				{label: "instance", overridden: labelSourcePath, kept: labelSourceTags},
+				{label: "instance", overridden: labelSourceTags, kept: labelSourceMapping},
+				{label: "unit", overridden: labelSourceTags, kept: labelSourceMapping},
+			},
+		},
+		{
+			name:    "same values still conflict",
+			sources: labelSources{labelSourcePath: {"instance": "web1"}, labelSourceMapping: {"instance": "web1"}},
+			want:    map[string]string{"instance": "web1"},
+			conflicts: []labelConflict{
+				{label: "instance", overridden: labelSourcePath, kept: labelSourceMapping},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, conflicts := tc.sources.assemble()
+			assert.Equal(t, tc.want, got)
+			assert.Equal(t, tc.conflicts, conflicts)
+		})
+	}
+
+	// The sources are never modified.
+	assert.Equal(t, map[string]string{"instance": "path", "graphite_hierarchy": "servers"}, path)
+	assert.Equal(t, map[string]string{"instance": "tags", "unit": "tags", "dc": "tags"}, tags)
+	assert.Equal(t, map[string]string{"instance": "mapping", "unit": "mapping", "job": "mapping"}, mapping)
+}
+
+func TestLabelConflicts(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: app.*.requests
+  name: requests
+  labels:
+    app: $1
+`))
+	c := NewCollector(Options{
+		Logger:      log.NewNopLogger(),
+		Carbon2:     true,
+		MapSettings: MapSettings{InstanceComponent: 2},
+	})
+	c.SetMapper(m)
+	c.Run(context.Background())
+	defer c.Stop()
+
+	mappingOverTags := testutil.ToFloat64(labelConflicts.WithLabelValues("tags", "mapping"))
+	tagsOverPath := testutil.ToFloat64(labelConflicts.WithLabelValues("path", "tags"))
+	c.processLine("metric=app.web.requests app=other 1 1534620625", LineSource{})
+	c.processLine("metric=servers.web1.load instance=web2 1 1534620625", LineSource{})
+	c.removeCh <- ""
+
+	assert.Equal(t, mappingOverTags+1, testutil.ToFloat64(labelConflicts.WithLabelValues("tags", "mapping")))
+	assert.Equal(t, tagsOverPath+1, testutil.ToFloat64(labelConflicts.WithLabelValues("path", "tags")))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if assert.Contains(t, c.samples, "app.web.requests;app=other;metric=app.web.requests") {
+		assert.Equal(t, map[string]string{"app": "web"}, c.samples["app.web.requests;app=other;metric=app.web.requests"].Labels)
+	}
+	if assert.Contains(t, c.samples, "servers.web1.load;instance=web2;metric=servers.web1.load") {
+		assert.Equal(t, map[string]string{"instance": "web2"}, c.samples["servers.web1.load;instance=web2;metric=servers.web1.load"].Labels)
+	}
+}
+
+func TestSanitizeLabelValue(t *testing.T) {
+	for value, want := range map[string]string{
+		"web-1":         "web-1",
+		`say "hi"`:      `say "hi"`,
+		`C:\temp`:       `C:\temp`,
+		"two\nlines":    "two lines",
+		"a\tb\r":        "a b ",
+		"esc\x1b[0mape": "esc[0mape",
+		"nul\x00\x7f":   "nul",
+		"bad\xffbyte":   "bad\ufffdbyte",
+		"caf\u00e9":     "caf\u00e9",
+		"nb\u00a0sp":    "nb\u00a0sp",
+	} {
+		assert.Equal(t, want, sanitizeLabelValue(value), "%q", value)
+	}
+}
+
+func TestHostileLabelValuesScrape(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: app.*.requests
+  name: requests
+  labels:
+    app: $1
+`))
+	c := NewCollector(Options{Logger: log.NewNopLogger(), Carbon2: true})
+	c.SetMapper(m)
+	c.Run(context.Background())
+	defer c.Stop()
+
+	sanitized := testutil.ToFloat64(sanitizedLabelValues)
+	now := time.Now().Unix()
+	c.processLine(fmt.Sprintf("metric=hostile quote=a\"b back=c\\d ctl=x\x1by\x00z bad=\xffok 1 %d", now), LineSource{})
+	c.processLine(fmt.Sprintf("app.we\x07b\"\\.requests 1 %d", now), LineSource{})
+	c.removeCh <- ""
+	assert.Equal(t, sanitized+3, testutil.ToFloat64(sanitizedLabelValues))
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{ErrorHandling: promhttp.HTTPErrorOnError}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	// The exposition parses back into the sanitized values.
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := func(name string) map[string]string {
+		got := map[string]string{}
+		if assert.Contains(t, families, name) {
+			for _, l := range families[name].Metric[0].Label {
+				got[l.GetName()] = l.GetValue()
+			}
+		}
+		return got
+	}
+	assert.Equal(t, map[string]string{"quote": `a"b`, "back": `c\d`, "ctl": "xyz", "bad": "\ufffdok"}, labels("hostile"))
+	assert.Equal(t, map[string]string{"app": `web"\`}, labels("requests"))
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"fmt"
+	"hash/fnv"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var lengthTruncations = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "graphite_length_limit_truncations_total",
+		Help: "Total count of metric names and label values truncated to their maximum length, by field.",
+	},
+	[]string{"field"},
+)
+
+// LengthLimits bounds the length of the metric names and label values of the
+// ingested samples, so that paths made of e.g. stack traces are not stored.
+type LengthLimits struct {
+	// MaxNameLength is the maximum length in bytes of a metric name and of
+	// the path it was received as. Zero means no limit.
+	MaxNameLength int
+	// MaxLabelValueLength is the maximum length in bytes of each label
+	// value. Zero means no limit.
+	MaxLabelValueLength int
+	// Truncate shortens longer names and values to the maximum instead of
+	// rejecting the line, see truncateWithHash.
+	Truncate bool
+}
+
+// hashSuffixLength is the length of the suffix added by truncateWithHash.
+const hashSuffixLength = 17
+
+// truncateWithHash shortens s to at most max bytes, replacing its end with a
+// hash of the whole string, so that strings sharing a long prefix stay
+// distinct. UTF-8 sequences are not split. The result is longer than max if
+// max is less than the length of the suffix.
+func truncateWithHash(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	n := max - hashSuffixLength
+	if n < 0 {
+		n = 0
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return fmt.Sprintf("%s_%016x", s[:n], h.Sum64())
+}
+
+// limitLengths applies the length limits to the sample of a parsed line,
+// either truncating its name, path and label values, or marking the line as
+// invalid.
+func (l LengthLimits) limitLengths(r parsedLine) parsedLine {
+	s := r.sample
+	if s == nil {
+		return r
+	}
+	if max := l.MaxNameLength; max > 0 {
+		for _, name := range []string{s.Name, s.OriginalName} {
+			if len(name) > max && !l.Truncate {
+				r.sample, r.invalid, r.keyvals = nil, "name_too_long", []interface{}{"length", len(name), "max", max}
+				return r
+			}
+		}
+		if len(s.Name) > max || len(s.OriginalName) > max {
+			r.truncated = append(r.truncated, "name")
+			s.Name = truncateWithHash(s.Name, max)
+			s.OriginalName = truncateWithHash(s.OriginalName, max)
+			r.originalName = s.OriginalName
+		}
+	}
+	if max := l.MaxLabelValueLength; max > 0 {
+		copied := false
+		for name, value := range s.Labels {
+			if len(value) <= max {
+				continue
+			}
+			if !l.Truncate {
+				r.sample, r.invalid, r.keyvals = nil, "label_value_too_long", []interface{}{"label", name, "length", len(value), "max", max}
+				return r
+			}
+			// The labels may be shared with the mapper's cache.
+			if !copied {
+				s.Labels = copyLabels(s.Labels)
+				copied = true
+			}
+			s.Labels[name] = truncateWithHash(value, max)
+			r.truncated = append(r.truncated, "label_value")
+		}
+	}
+	return r
+}
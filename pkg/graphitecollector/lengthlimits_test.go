@@ -0,0 +1,94 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTruncateWithHash(t *testing.T) {
+	assert.Equal(t, "short", truncateWithHash("short", 32))
+
+	a := truncateWithHash(strings.Repeat("a", 100)+"1", 32)
+	b := truncateWithHash(strings.Repeat("a", 100)+"2", 32)
+	assert.Len(t, a, 32)
+	assert.Len(t, b, 32)
+	assert.NotEqual(t, a, b, "strings with the same prefix stay distinct")
+	assert.True(t, strings.HasPrefix(a, strings.Repeat("a", 15)+"_"))
+	assert.Equal(t, a, truncateWithHash(strings.Repeat("a", 100)+"1", 32), "the hash is stable")
+
+	// The cut falls in the middle of the two byte "é".
+	s := truncateWithHash(strings.Repeat("a", 14)+strings.Repeat("é", 20), 32)
+	assert.True(t, utf8.ValidString(s))
+	assert.Len(t, s, 31)
+}
+
+func TestLengthLimits(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: app.*.requests
+  name: requests
+  labels:
+    app: $1
+`))
+	longPath := "trace." + strings.Repeat("frame.", 20) + "main"
+	longApp := strings.Repeat("x", 40)
+
+	reject := NewCollector(Options{Logger: log.NewNopLogger(), LengthLimits: LengthLimits{MaxNameLength: 64, MaxLabelValueLength: 32}})
+	reject.SetMapper(m)
+	reject.Run(context.Background())
+	defer reject.Stop()
+	nameTooLong := testutil.ToFloat64(invalidLines.WithLabelValues("name_too_long", "other"))
+	valueTooLong := testutil.ToFloat64(invalidLines.WithLabelValues("label_value_too_long", "other"))
+	reject.processLine(longPath+" 1 1534620625", LineSource{})
+	reject.processLine("app."+longApp+".requests 1 1534620625", LineSource{})
+	reject.processLine("app.web.requests 1 1534620625", LineSource{})
+	reject.removeCh <- ""
+	assert.Equal(t, nameTooLong+1, testutil.ToFloat64(invalidLines.WithLabelValues("name_too_long", "other")))
+	assert.Equal(t, valueTooLong+1, testutil.ToFloat64(invalidLines.WithLabelValues("label_value_too_long", "other")))
+	reject.mu.Lock()
+	assert.Len(t, reject.samples, 1)
+	assert.Contains(t, reject.samples, "app.web.requests")
+	reject.mu.Unlock()
+
+	truncate := NewCollector(Options{Logger: log.NewNopLogger(), LengthLimits: LengthLimits{MaxNameLength: 64, MaxLabelValueLength: 32, Truncate: true}})
+	truncate.SetMapper(m)
+	truncate.Run(context.Background())
+	defer truncate.Stop()
+	names := testutil.ToFloat64(lengthTruncations.WithLabelValues("name"))
+	values := testutil.ToFloat64(lengthTruncations.WithLabelValues("label_value"))
+	truncate.processLine(longPath+" 1 1534620625", LineSource{})
+	truncate.processLine("app."+longApp+".requests 1 1534620625", LineSource{})
+	truncate.removeCh <- ""
+	assert.Equal(t, names+1, testutil.ToFloat64(lengthTruncations.WithLabelValues("name")))
+	assert.Equal(t, values+1, testutil.ToFloat64(lengthTruncations.WithLabelValues("label_value")))
+
+	truncate.mu.Lock()
+	defer truncate.mu.Unlock()
+	stored := truncateWithHash(longPath, 64)
+	if assert.Contains(t, truncate.samples, stored, "the path is truncated before it is stored") {
+		assert.Equal(t, truncateWithHash(strings.Replace(longPath, ".", "_", -1), 64), truncate.samples[stored].Name)
+	}
+	if assert.Contains(t, truncate.samples, "app."+longApp+".requests") {
+		assert.Equal(t, map[string]string{"app": truncateWithHash(longApp, 32)}, truncate.samples["app."+longApp+".requests"].Labels)
+	}
+}
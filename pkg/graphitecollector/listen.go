@@ -0,0 +1,139 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var udpDroppedPackets = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "graphite_udp_packets_dropped_total",
+		Help: "Total count of UDP packets dropped because too many were waiting to be processed.",
+	},
+)
+
+// ServeTCP accepts connections on l and processes the lines received on
+// them, recording its statistics in stats. It returns once done is closed
+// and l fails, which closing l after done ensures.
+func (c *Collector) ServeTCP(l *net.TCPListener, stats *Listener, done <-chan struct{}) {
+	pipelineGoroutines.WithLabelValues("tcp_accept").Inc()
+	defer pipelineGoroutines.WithLabelValues("tcp_accept").Dec()
+	heartbeat := loopHeartbeat.WithLabelValues("tcp_accept")
+	failing := false
+	for {
+		heartbeat.SetToCurrentTime()
+		// The deadline wakes the loop up to update its heartbeat.
+		l.SetDeadline(time.Now().Add(heartbeatInterval))
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if isTimeout(err) {
+				continue
+			}
+			level.Error(c.logger).Log("msg", "Error accepting TCP connection", "err", err)
+			RecordError(SubsystemTCPListener, "", err)
+			stats.RecordError(err)
+			failing = true
+			continue
+		}
+		if failing {
+			ClearError(SubsystemTCPListener, "")
+			failing = false
+		}
+		stats.connectionAccepted()
+		go func() {
+			pipelineGoroutines.WithLabelValues("tcp_connection").Inc()
+			defer pipelineGoroutines.WithLabelValues("tcp_connection").Dec()
+			ctx, remove := c.conns.add(c.connCtx, conn)
+			defer remove()
+			c.processConn(ctx, conn, LineSource{Protocol: "tcp", Address: conn.RemoteAddr().String()})
+		}()
+	}
+}
+
+// ServeUDP processes the lines of the packets received on conn, recording
+// its statistics in stats. It returns once done is closed and conn fails,
+// which closing conn after done ensures.
+//
+// Unlike a TCP sender, a UDP sender is not slowed down when processing falls
+// behind, so packets are dropped once Options.MaxPendingUDPPackets are
+// pending. This bounds the goroutines and memory held by pending packets.
+func (c *Collector) ServeUDP(conn *net.UDPConn, stats *Listener, done <-chan struct{}) {
+	pipelineGoroutines.WithLabelValues("udp_read").Inc()
+	defer pipelineGoroutines.WithLabelValues("udp_read").Dec()
+	heartbeat := loopHeartbeat.WithLabelValues("udp_read")
+	failing := false
+	var buf []byte
+	for {
+		heartbeat.SetToCurrentTime()
+		// The deadline wakes the loop up to update its heartbeat.
+		conn.SetReadDeadline(time.Now().Add(heartbeatInterval))
+		// The buffer of a dropped packet is reused for the next one.
+		if buf == nil {
+			buf = make([]byte, 65536)
+		}
+		chars, srcAddress, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if isTimeout(err) {
+				continue
+			}
+			level.Error(c.logger).Log("msg", "Error reading UDP packet", "from", srcAddress, "err", err)
+			RecordError(SubsystemUDPListener, "", err)
+			stats.RecordError(err)
+			failing = true
+			continue
+		}
+		if failing {
+			ClearError(SubsystemUDPListener, "")
+			failing = false
+		}
+		stats.datagramReceived()
+		select {
+		case c.udpPending <- struct{}{}:
+		default:
+			udpDroppedPackets.Inc()
+			continue
+		}
+		// The lines of a packet are mapped with the mapper in use when it
+		// was received, however long it waits to be processed.
+		go func(buf []byte, mapper mapperHolder) {
+			pipelineGoroutines.WithLabelValues("udp_packet").Inc()
+			defer pipelineGoroutines.WithLabelValues("udp_packet").Dec()
+			defer func() { <-c.udpPending }()
+			c.processReader(bytes.NewReader(buf), LineSource{Protocol: "udp", Address: srcAddress.String()}, mapper)
+		}(buf[:chars], c.currentMapper())
+		buf = nil
+	}
+}
+
+// isTimeout reports whether err is a network timeout.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
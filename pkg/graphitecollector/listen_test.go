@@ -0,0 +1,61 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeUDPBoundsPendingPackets(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The collector is not running, so no line is ever consumed.
+	c := NewCollector(Options{MaxPendingUDPPackets: 10})
+	done := make(chan struct{})
+	go c.ServeUDP(conn, nil, done)
+	defer func() {
+		close(done)
+		conn.Close()
+		c.Stop()
+	}()
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	goroutines := runtime.NumGoroutine()
+	dropped := testutil.ToFloat64(udpDroppedPackets)
+	pending := testutil.ToFloat64(pipelineGoroutines.WithLabelValues("udp_packet"))
+	for i := 0; i < 500; i++ {
+		fmt.Fprintf(client, "my.metric %d 1534620625\n", i)
+	}
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(udpDroppedPackets) > dropped
+	}, 5*time.Second, time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(pipelineGoroutines.WithLabelValues("udp_packet")) == pending+10
+	}, 5*time.Second, time.Millisecond)
+	assert.True(t, runtime.NumGoroutine() <= goroutines+10, "%d goroutines, %d before", runtime.NumGoroutine(), goroutines)
+}
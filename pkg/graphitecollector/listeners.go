@@ -0,0 +1,157 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Listener is a socket served by the exporter, with statistics of the
+// connections and datagrams it received. All methods may be called on a nil
+// Listener, which records nothing.
+type Listener struct {
+	name     string
+	protocol string
+	address  string
+	tls      bool
+
+	connections uint64
+	datagrams   uint64
+
+	mu          sync.Mutex
+	lastError   string
+	lastErrorAt time.Time
+}
+
+// ListenerStats is a snapshot of the statistics of a Listener.
+type ListenerStats struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	TLS      bool   `json:"tls"`
+	// Connections is the number of accepted connections of a stream
+	// listener.
+	Connections uint64 `json:"connections"`
+	// Datagrams is the number of packets received by a datagram listener.
+	Datagrams   uint64     `json:"datagrams"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+func (l *Listener) connectionAccepted() {
+	if l != nil {
+		atomic.AddUint64(&l.connections, 1)
+	}
+}
+
+func (l *Listener) datagramReceived() {
+	if l != nil {
+		atomic.AddUint64(&l.datagrams, 1)
+	}
+}
+
+// RecordError records err as the last error of the listener.
+func (l *Listener) RecordError(err error) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastError = err.Error()
+	l.lastErrorAt = time.Now()
+}
+
+// Stats returns the current statistics of the listener.
+func (l *Listener) Stats() ListenerStats {
+	s := ListenerStats{
+		Name:        l.name,
+		Protocol:    l.protocol,
+		Address:     l.address,
+		TLS:         l.tls,
+		Connections: atomic.LoadUint64(&l.connections),
+		Datagrams:   atomic.LoadUint64(&l.datagrams),
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.lastError != "" {
+		at := l.lastErrorAt
+		s.LastError, s.LastErrorAt = l.lastError, &at
+	}
+	return s
+}
+
+// Wrap returns a net.Listener counting the connections accepted on nl in
+// the statistics of l, for sockets served by other packages such as the web
+// servers.
+func (l *Listener) Wrap(nl net.Listener) net.Listener {
+	return &countingListener{Listener: nl, stats: l}
+}
+
+type countingListener struct {
+	net.Listener
+	stats *Listener
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.stats.connectionAccepted()
+	}
+	return conn, err
+}
+
+// Listeners is the set of listeners of the exporter, in the order in which
+// they were bound.
+type Listeners struct {
+	mu        sync.Mutex
+	listeners []*Listener
+}
+
+// Add adds a listener of protocol bound to address under name, such as
+// "graphite" or "debug", and returns it for recording its statistics.
+func (ls *Listeners) Add(name, protocol, address string, tls bool) *Listener {
+	l := &Listener{name: name, protocol: protocol, address: address, tls: tls}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.listeners = append(ls.listeners, l)
+	return l
+}
+
+// Stats returns the statistics of all listeners.
+func (ls *Listeners) Stats() []ListenerStats {
+	ls.mu.Lock()
+	listeners := append([]*Listener(nil), ls.listeners...)
+	ls.mu.Unlock()
+	stats := make([]ListenerStats, 0, len(listeners))
+	for _, l := range listeners {
+		stats = append(stats, l.Stats())
+	}
+	return stats
+}
+
+// ListenersHandler responds with the statistics of all listeners.
+func ListenersHandler(ls *Listeners) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   ls.Stats(),
+		})
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenerStats(t *testing.T) {
+	tcpSock, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpSock, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := &Listeners{}
+	tcp := ls.Add("graphite", "tcp", tcpSock.Addr().String(), false)
+	udp := ls.Add("graphite", "udp", udpSock.LocalAddr().String(), false)
+
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.Run(context.Background())
+	done := make(chan struct{})
+	go c.ServeTCP(tcpSock, tcp, done)
+	go c.ServeUDP(udpSock, udp, done)
+	defer func() {
+		close(done)
+		tcpSock.Close()
+		udpSock.Close()
+		c.Stop()
+	}()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", tcpSock.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "tcp.metric %d 1534620625\n", i)
+		conn.Close()
+	}
+	conn, err := net.Dial("udp", udpSock.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(conn, "udp.metric %d 1534620625\n", i)
+	}
+	conn.Close()
+	assert.Eventually(t, func() bool {
+		return tcp.Stats().Connections == 2 && udp.Stats().Datagrams == 3
+	}, 5*time.Second, time.Millisecond)
+
+	udp.RecordError(fmt.Errorf("read: connection refused"))
+	rec := httptest.NewRecorder()
+	ListenersHandler(ls)(rec, httptest.NewRequest("GET", "/debug/listeners", nil))
+	var resp struct {
+		Status string
+		Data   []ListenerStats
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp), rec.Body.String())
+	assert.Equal(t, "success", resp.Status)
+	if assert.Len(t, resp.Data, 2) {
+		assert.NotNil(t, resp.Data[1].LastErrorAt)
+		resp.Data[1].LastErrorAt = nil
+	}
+	assert.Equal(t, []ListenerStats{
+		{Name: "graphite", Protocol: "tcp", Address: tcpSock.Addr().String(), Connections: 2},
+		{Name: "graphite", Protocol: "udp", Address: udpSock.LocalAddr().String(), Datagrams: 3, LastError: "read: connection refused"},
+	}, resp.Data)
+}
+
+func TestListenerWrap(t *testing.T) {
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nl.Close()
+	l := (&Listeners{}).Add("http", "http", nl.Addr().String(), true)
+	wrapped := l.Wrap(nl)
+
+	go func() {
+		if conn, err := net.Dial("tcp", nl.Addr().String()); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := wrapped.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	assert.Equal(t, uint64(1), l.Stats().Connections)
+	assert.True(t, l.Stats().TLS)
+}
@@ -0,0 +1,385 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// MetricType is the Prometheus type a mapping exports its samples as.
+type MetricType string
+
+const (
+	MetricTypeGauge   MetricType = "gauge"
+	MetricTypeCounter MetricType = "counter"
+	// MetricTypeUntyped is only available as the default type of metrics
+	// whose mapping sets none.
+	MetricTypeUntyped MetricType = "untyped"
+)
+
+func (t *MetricType) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch MetricType(v) {
+	case MetricTypeGauge, MetricTypeCounter:
+		*t = MetricType(v)
+	default:
+		return fmt.Errorf("invalid metric type '%s'", v)
+	}
+	return nil
+}
+
+// CounterMode is how the values received for a counter are interpreted.
+type CounterMode string
+
+const (
+	// CounterModeAbsolute exports the received value as the value of the
+	// counter. It is the default.
+	CounterModeAbsolute CounterMode = "absolute"
+	// CounterModeDelta takes every received value as an increment, and
+	// exports the running total of the increments of each series.
+	CounterModeDelta CounterMode = "delta"
+)
+
+func (m *CounterMode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch CounterMode(v) {
+	case CounterModeAbsolute, CounterModeDelta:
+		*m = CounterMode(v)
+	default:
+		return fmt.Errorf("invalid counter mode '%s'", v)
+	}
+	return nil
+}
+
+// Aggregation is how a sample is combined with the stored sample of its series
+// if both have the same timestamp.
+type Aggregation string
+
+const (
+	// AggregationLast replaces the stored sample, as for any other
+	// timestamp. It is the default.
+	AggregationLast Aggregation = "last"
+	AggregationSum  Aggregation = "sum"
+	AggregationMax  Aggregation = "max"
+)
+
+func (a *Aggregation) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch Aggregation(v) {
+	case AggregationLast, AggregationSum, AggregationMax:
+		*a = Aggregation(v)
+	default:
+		return fmt.Errorf("invalid aggregation '%s'", v)
+	}
+	return nil
+}
+
+// combine returns the value of a sample with the same timestamp as the stored
+// sample of its series, or false if the sample replaces the stored one.
+func (a Aggregation) combine(stored, value float64) (float64, bool) {
+	switch a {
+	case AggregationSum:
+		return stored + value, true
+	case AggregationMax:
+		return math.Max(stored, value), true
+	}
+	return 0, false
+}
+
+func (t MetricType) valueType() prometheus.ValueType {
+	switch t {
+	case MetricTypeCounter:
+		return prometheus.CounterValue
+	case MetricTypeUntyped:
+		return prometheus.UntypedValue
+	}
+	return prometheus.GaugeValue
+}
+
+// mappingOptions holds the graphite_exporter specific settings of a mapping.
+// They live in the same mapping configuration file as the statsd_exporter
+// mapping rules, which ignore them.
+type mappingOptions struct {
+	Type          MetricType `yaml:"type"`
+	NormalizeName bool       `yaml:"normalize_name"`
+	// Accumulate makes a counter export a total that keeps increasing when
+	// the received value drops, e.g. because the sender restarted.
+	Accumulate bool `yaml:"accumulate"`
+	// CounterMode delta makes a counter export the running total of the
+	// increments it receives, e.g. from statsd bridges.
+	CounterMode CounterMode `yaml:"counter_mode"`
+	// Aggregate combines samples of a series with the same timestamp
+	// instead of keeping the last one.
+	Aggregate Aggregation `yaml:"aggregate"`
+	// DropLabels are removed from the labels of the mapped metric, e.g.
+	// captures only needed to position other captures.
+	DropLabels []string `yaml:"drop_labels"`
+	// DecimalPlaces rounds the values to that many decimal places, if set,
+	// overriding MapSettings.DecimalPlaces.
+	DecimalPlaces *int `yaml:"decimal_places"`
+	// Expiry overrides the sample expiry, the expiry overrides and the
+	// storage schemas for the samples of the mapping, if set.
+	Expiry time.Duration `yaml:"expiry"`
+}
+
+// unitSuffix translates a metric name ending in _<Suffix> into one ending in
+// _<Unit>, multiplying the value by Scale.
+type unitSuffix struct {
+	Suffix string  `yaml:"suffix" json:"suffix"`
+	Unit   string  `yaml:"unit" json:"unit"`
+	Scale  float64 `yaml:"scale" json:"scale"`
+}
+
+type graphiteMappingConfig struct {
+	UnitSuffixes    []unitSuffix     `yaml:"unit_suffixes"`
+	Relabel         []relabelRule    `yaml:"relabel"`
+	ExpiryOverrides []expiryOverride `yaml:"expiry_overrides"`
+	Mappings        []struct {
+		Match          string            `yaml:"match"`
+		Labels         map[string]string `yaml:"labels"`
+		mappingOptions `yaml:",inline"`
+	} `yaml:"mappings"`
+}
+
+// mappingOptionsProvider is implemented by mappers that know about the
+// graphite_exporter specific mapping options.
+type mappingOptionsProvider interface {
+	mappingOptions(*mapper.MetricMapping) mappingOptions
+	unitSuffixes() []unitSuffix
+	relabelRules() []relabelRule
+	expiryOverrides() []expiryOverride
+}
+
+// Mapper wraps the statsd_exporter mapper with the graphite_exporter
+// specific mapping options.
+type Mapper struct {
+	mapper.MetricMapper
+
+	options  map[string]mappingOptions
+	suffixes []unitSuffix
+	relabels []relabelRule
+	expiries []expiryOverride
+	// rules describes the loaded mappings and counts their matches.
+	rules *mappingRules
+}
+
+var (
+	mappingLoadFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "graphite_mapping_config_load_failures_total",
+			Help: "Total count of failed loads of the mapping configuration.",
+		},
+	)
+	mappingLastLoadSuccessful = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "graphite_mapping_config_last_reload_successful",
+			Help: "Whether the last load of every mapping configuration, that of the flags and those of the tenants, succeeded.",
+		},
+	)
+
+	// mappingLoadsFailedMu guards mappingLoadsFailed, the sources of
+	// LoadMappingConfig whose last load failed.
+	mappingLoadsFailedMu sync.Mutex
+	mappingLoadsFailed   = map[string]bool{}
+)
+
+func init() {
+	// Until a load fails, the configuration in use is fine.
+	mappingLastLoadSuccessful.Set(1)
+}
+
+// mappingLoadFailedMsg is the log message of every failed load of the
+// mapping configuration by the exporter, so that failures can be found
+// whatever triggered the load.
+const mappingLoadFailedMsg = "Error loading metric mapping config"
+
+// LoadMappingConfig loads the mapping configuration at path into m for the
+// running exporter, and records the outcome in the load metrics. source
+// names the pipeline the configuration is for, e.g. "tenant a", or is empty
+// for that of the flags. trigger names what caused the load, e.g. "startup"
+// or "sighup". It returns the file contents.
+func LoadMappingConfig(m *Mapper, path, source, trigger string, logger log.Logger) ([]byte, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = m.InitFromYAMLString(string(contents))
+	}
+	mappingLoadsFailedMu.Lock()
+	defer mappingLoadsFailedMu.Unlock()
+	if err != nil {
+		mappingLoadFailures.Inc()
+		mappingLoadsFailed[source] = true
+		mappingLastLoadSuccessful.Set(0)
+		level.Error(logger).Log("msg", mappingLoadFailedMsg, "file", path, "trigger", trigger, "err", err)
+		RecordError(SubsystemMapper, source, err)
+		return nil, err
+	}
+	// A configuration loading fine does not hide that of another source
+	// failing.
+	delete(mappingLoadsFailed, source)
+	if len(mappingLoadsFailed) == 0 {
+		mappingLastLoadSuccessful.Set(1)
+	}
+	ClearError(SubsystemMapper, source)
+	return contents, nil
+}
+
+// LoadMapping returns a mapper for the mapping configuration at path. An
+// empty path yields a mapper without any mappings.
+func LoadMapping(path string) (*Mapper, error) {
+	m := &Mapper{}
+	if path == "" {
+		return m, nil
+	}
+	if err := m.InitFromFile(path); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Mapper) InitFromFile(fileName string) error {
+	mappingStr, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	return m.InitFromYAMLString(string(mappingStr))
+}
+
+func (m *Mapper) InitFromYAMLString(fileContents string) error {
+	var n graphiteMappingConfig
+	if err := yaml.Unmarshal([]byte(fileContents), &n); err != nil {
+		return err
+	}
+
+	for _, s := range n.UnitSuffixes {
+		if s.Suffix == "" || s.Unit == "" {
+			return fmt.Errorf("unit suffix must set both suffix and unit")
+		}
+		if s.Scale == 0 {
+			return fmt.Errorf("unit suffix %q must set a non-zero scale", s.Suffix)
+		}
+	}
+
+	for i := range n.Relabel {
+		if err := n.Relabel[i].init(); err != nil {
+			return err
+		}
+	}
+
+	for i := range n.ExpiryOverrides {
+		if err := n.ExpiryOverrides[i].init(); err != nil {
+			return err
+		}
+	}
+
+	options := make(map[string]mappingOptions, len(n.Mappings))
+	for _, mapping := range n.Mappings {
+		if mapping.Accumulate && mapping.Type != MetricTypeCounter {
+			return fmt.Errorf("mapping %q sets accumulate, which requires type counter", mapping.Match)
+		}
+		if mapping.Accumulate && mapping.Aggregate != "" {
+			return fmt.Errorf("mapping %q sets both accumulate and aggregate", mapping.Match)
+		}
+		if mapping.CounterMode == CounterModeDelta && mapping.Type != MetricTypeCounter {
+			return fmt.Errorf("mapping %q sets counter_mode delta, which requires type counter", mapping.Match)
+		}
+		if mapping.CounterMode == CounterModeDelta && mapping.Accumulate {
+			return fmt.Errorf("mapping %q sets both accumulate and counter_mode delta", mapping.Match)
+		}
+		if mapping.Expiry < 0 {
+			return fmt.Errorf("mapping %q sets a negative expiry", mapping.Match)
+		}
+		if mapping.DecimalPlaces != nil && *mapping.DecimalPlaces < 0 {
+			return fmt.Errorf("mapping %q sets negative decimal_places", mapping.Match)
+		}
+		for _, label := range mapping.DropLabels {
+			if _, ok := mapping.Labels[label]; !ok {
+				return fmt.Errorf("mapping %q drops label %q, which it does not set", mapping.Match, label)
+			}
+		}
+		if _, ok := options[mapping.Match]; !ok {
+			options[mapping.Match] = mapping.mappingOptions
+		}
+	}
+
+	if err := m.MetricMapper.InitFromYAMLString(fileContents); err != nil {
+		return err
+	}
+	m.options = options
+	m.suffixes = n.UnitSuffixes
+	m.relabels = n.Relabel
+	m.expiries = n.ExpiryOverrides
+	m.rules = newMappingRules(m.Mappings)
+	return nil
+}
+
+func (m *Mapper) mappingOptions(mapping *mapper.MetricMapping) mappingOptions {
+	return m.options[mapping.Match]
+}
+
+func (m *Mapper) unitSuffixes() []unitSuffix {
+	return m.suffixes
+}
+
+func (m *Mapper) relabelRules() []relabelRule {
+	return m.relabels
+}
+
+func (m *Mapper) expiryOverrides() []expiryOverride {
+	return m.expiries
+}
+
+// normalizeName enforces the Prometheus naming conventions on a mapped metric
+// name. A unit suffix found in suffixes is replaced by its base unit, in which
+// case the returned scale must be applied to the value, and counters get a
+// _total suffix.
+func normalizeName(name string, t MetricType, suffixes []unitSuffix) (string, float64) {
+	scale := 1.0
+	if t == MetricTypeCounter {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	for _, s := range suffixes {
+		if strings.HasSuffix(name, "_"+s.Suffix) {
+			name = strings.TrimSuffix(name, s.Suffix) + s.Unit
+			scale = s.Scale
+			break
+		}
+	}
+	if t == MetricTypeCounter {
+		name += "_total"
+	}
+	return name, scale
+}
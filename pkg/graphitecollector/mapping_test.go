@@ -0,0 +1,459 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeName(t *testing.T) {
+	suffixes := []unitSuffix{
+		{Suffix: "ms", Unit: "seconds", Scale: 0.001},
+		{Suffix: "kb", Unit: "bytes", Scale: 1024},
+	}
+
+	testCases := []struct {
+		name      string
+		typ       MetricType
+		suffixes  []unitSuffix
+		wantName  string
+		wantScale float64
+	}{
+		{name: "requests", typ: MetricTypeCounter, wantName: "requests_total", wantScale: 1},
+		{name: "requests_total", typ: MetricTypeCounter, wantName: "requests_total", wantScale: 1},
+		{name: "queue_length", typ: MetricTypeGauge, wantName: "queue_length", wantScale: 1},
+		{name: "queue_total", typ: MetricTypeGauge, wantName: "queue_total", wantScale: 1},
+		{name: "latency_ms", typ: MetricTypeGauge, wantName: "latency_ms", wantScale: 1},
+		{name: "latency_ms", typ: MetricTypeGauge, suffixes: suffixes, wantName: "latency_seconds", wantScale: 0.001},
+		{name: "latency_ms", typ: MetricTypeCounter, suffixes: suffixes, wantName: "latency_seconds_total", wantScale: 0.001},
+		{name: "latency_ms_total", typ: MetricTypeCounter, suffixes: suffixes, wantName: "latency_seconds_total", wantScale: 0.001},
+		{name: "received_kb", typ: MetricTypeCounter, suffixes: suffixes, wantName: "received_bytes_total", wantScale: 1024},
+		{name: "items", typ: MetricTypeGauge, suffixes: suffixes, wantName: "items", wantScale: 1},
+	}
+
+	for _, tc := range testCases {
+		name, scale := normalizeName(tc.name, tc.typ, tc.suffixes)
+		assert.Equal(t, tc.wantName, name, "name for %s (%s)", tc.name, tc.typ)
+		assert.Equal(t, tc.wantScale, scale, "scale for %s (%s)", tc.name, tc.typ)
+	}
+}
+
+func TestMappingOptions(t *testing.T) {
+	config := `
+unit_suffixes:
+- suffix: ms
+  unit: seconds
+  scale: 0.001
+mappings:
+- match: app.*.requests
+  name: app_requests
+  type: counter
+  normalize_name: true
+  labels:
+    app: $1
+- match: app.*.latency_ms
+  name: app_latency_ms
+  normalize_name: true
+  labels:
+    app: $1
+- match: app.*.errors
+  name: app_errors
+  type: counter
+  labels:
+    app: $1
+- match: app.*.queue
+  name: app_queue
+  labels:
+    app: $1
+`
+	m := &Mapper{}
+	if err := m.InitFromYAMLString(config); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.SetMapper(m)
+	c.Run(context.Background())
+	defer c.Stop()
+
+	testCases := []struct {
+		line      string
+		name      string
+		value     float64
+		valueType prometheus.ValueType
+	}{
+		{line: "app.foo.requests 10 1534620625", name: "app_requests_total", value: 10, valueType: prometheus.CounterValue},
+		{line: "app.foo.latency_ms 250 1534620625", name: "app_latency_seconds", value: 0.25, valueType: prometheus.GaugeValue},
+		{line: "app.foo.errors 3 1534620625", name: "app_errors", value: 3, valueType: prometheus.CounterValue},
+		{line: "app.foo.queue 7 1534620625", name: "app_queue", value: 7, valueType: prometheus.GaugeValue},
+	}
+	for _, tc := range testCases {
+		c.processLine(tc.line, LineSource{})
+	}
+	c.Stop()
+	<-c.Stopped()
+
+	for _, tc := range testCases {
+		var found *Sample
+		for _, sample := range c.samples {
+			if sample.Name == tc.name {
+				found = sample
+			}
+		}
+		if assert.NotNil(t, found, "Missing %s", tc.name) {
+			assert.Equal(t, tc.value, found.Value, "value of %s", tc.name)
+			assert.Equal(t, tc.valueType, found.Type, "type of %s", tc.name)
+			assert.Equal(t, map[string]string{"app": "foo"}, found.Labels)
+		}
+	}
+}
+
+func TestMappingOptionsInvalid(t *testing.T) {
+	for _, config := range []string{
+		"mappings:\n- match: a.*\n  name: a\n  type: histogram\n",
+		"unit_suffixes:\n- suffix: ms\n  scale: 0.001\n",
+		"unit_suffixes:\n- suffix: ms\n  unit: seconds\n",
+		"mappings:\n- match: a.*\n  name: a\n  accumulate: true\n",
+		"mappings:\n- match: a.*\n  name: a\n  aggregate: avg\n",
+		"mappings:\n- match: a.*\n  name: a\n  type: counter\n  accumulate: true\n  aggregate: sum\n",
+		"mappings:\n- match: a.*\n  name: a\n  labels:\n    id: $1\n  drop_labels: [ib]\n",
+		"mappings:\n- match: a.*\n  name: a\n  expiry: -1m\n",
+		"mappings:\n- match: a.*\n  name: a\n  counter_mode: delta\n",
+		"mappings:\n- match: a.*\n  name: a\n  type: counter\n  counter_mode: deltas\n",
+		"mappings:\n- match: a.*\n  name: a\n  type: counter\n  counter_mode: delta\n  accumulate: true\n",
+	} {
+		m := &Mapper{}
+		assert.Error(t, m.InitFromYAMLString(config), "config %q", config)
+	}
+}
+
+func TestDropLabels(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: app.*.request.*.duration
+  name: request_duration
+  drop_labels: [request_id]
+  labels:
+    app: $1
+    request_id: $2
+`))
+	for i := 0; i < 2; i++ {
+		mapped, ok := MapMetric(m, "app.web.request.abc123.duration", MapSettings{})
+		assert.True(t, ok)
+		assert.Equal(t, "request_duration", mapped.Name)
+		assert.Equal(t, map[string]string{"app": "web"}, mapped.Labels, "attempt %d", i)
+	}
+	assert.Equal(t, []string{"request_id"}, m.effectiveRules(MapSettings{})[0].DropLabels)
+}
+
+func TestAccumulate(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: app.*.requests
+  name: requests_total
+  type: counter
+  accumulate: true
+  labels:
+    app: $1
+`))
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.SetMapper(m)
+	c.Run(context.Background())
+	defer c.Stop()
+
+	for _, tc := range []struct {
+		value     string
+		timestamp int
+		want      float64
+	}{
+		{value: "10", timestamp: 100, want: 10},
+		{value: "15", timestamp: 110, want: 15},
+		// The sender restarted and counted 3 since.
+		{value: "3", timestamp: 120, want: 18},
+		{value: "3", timestamp: 130, want: 18},
+		// An out-of-order sample is ignored.
+		{value: "1", timestamp: 125, want: 18},
+		{value: "4294967290", timestamp: 140, want: 4294967305},
+		// A wrap-around of a 32-bit counter is taken as a reset.
+		{value: "5", timestamp: 150, want: 4294967310},
+	} {
+		c.processLine(fmt.Sprintf("app.web.requests %s %d", tc.value, tc.timestamp), LineSource{})
+		// The sample store handles one request at a time, so the sample
+		// has been stored once a removal is accepted.
+		c.removeCh <- ""
+		c.mu.Lock()
+		got := c.samples["app.web.requests"].Value
+		c.mu.Unlock()
+		assert.Equal(t, tc.want, got, "after %s at %d", tc.value, tc.timestamp)
+	}
+}
+
+func TestDeltaCounter(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: app.*.requests
+  name: requests_total
+  type: counter
+  counter_mode: delta
+  labels:
+    app: $1
+- match: app.*.hits
+  name: hits_total
+  type: counter
+  counter_mode: delta
+  aggregate: sum
+  labels:
+    app: $1
+`))
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.SetMapper(m)
+	c.Run(context.Background())
+	defer c.Stop()
+
+	negative := testutil.ToFloat64(invalidSamples.WithLabelValues("negative_delta"))
+	outOfOrder := testutil.ToFloat64(invalidSamples.WithLabelValues("out_of_order"))
+	for _, tc := range []struct {
+		path      string
+		value     string
+		timestamp int
+		want      float64
+	}{
+		{path: "app.web.requests", value: "5", timestamp: 100, want: 5},
+		{path: "app.web.requests", value: "3", timestamp: 110, want: 8},
+		// A line sent twice is not counted twice.
+		{path: "app.web.requests", value: "3", timestamp: 110, want: 8},
+		// The last increment with the same timestamp wins.
+		{path: "app.web.requests", value: "4", timestamp: 110, want: 9},
+		{path: "app.web.requests", value: "0", timestamp: 120, want: 9},
+		// Negative and late increments are rejected.
+		{path: "app.web.requests", value: "-2", timestamp: 130, want: 9},
+		{path: "app.web.requests", value: "1", timestamp: 105, want: 9},
+		{path: "app.web.requests", value: "1", timestamp: 130, want: 10},
+		// With aggregate sum, increments with the same timestamp add up.
+		{path: "app.web.hits", value: "2", timestamp: 100, want: 2},
+		{path: "app.web.hits", value: "3", timestamp: 100, want: 5},
+		{path: "app.web.hits", value: "1", timestamp: 110, want: 6},
+	} {
+		c.processLine(fmt.Sprintf("%s %s %d", tc.path, tc.value, tc.timestamp), LineSource{})
+		// The sample store handles one request at a time, so the sample
+		// has been stored once a removal is accepted.
+		c.removeCh <- ""
+		c.mu.Lock()
+		got := c.samples[tc.path]
+		c.mu.Unlock()
+		assert.Equal(t, tc.want, got.Value, "after %s at %d", tc.value, tc.timestamp)
+		assert.Equal(t, prometheus.CounterValue, got.Type)
+	}
+	assert.Equal(t, negative+1, testutil.ToFloat64(invalidSamples.WithLabelValues("negative_delta")))
+	assert.Equal(t, outOfOrder+1, testutil.ToFloat64(invalidSamples.WithLabelValues("out_of_order")))
+
+	// The total starts again once the series expired.
+	c.removeCh <- "app.web.requests"
+	c.processLine("app.web.requests 2 140", LineSource{})
+	c.removeCh <- ""
+	c.mu.Lock()
+	assert.Equal(t, 2.0, c.samples["app.web.requests"].Value)
+	c.mu.Unlock()
+}
+
+func TestAggregate(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: app.*.requests
+  name: requests
+  aggregate: sum
+  labels:
+    app: $1
+- match: app.*.latency
+  name: latency
+  aggregate: max
+  labels:
+    app: $1
+- match: app.*.errors
+  name: errors
+  aggregate: last
+  labels:
+    app: $1
+`))
+
+	for _, tc := range []struct {
+		name     string
+		settings MapSettings
+		path     string
+		want     float64
+	}{
+		{name: "mapping sum", path: "app.web.requests", want: 12},
+		{name: "mapping max", path: "app.web.latency", want: 7},
+		{name: "default", path: "other.metric", want: 2},
+		{name: "global sum", settings: MapSettings{Aggregate: AggregationSum}, path: "other.metric", want: 12},
+		{name: "mapping overrides global", settings: MapSettings{Aggregate: AggregationSum}, path: "app.web.errors", want: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewCollector(Options{Logger: log.NewNopLogger()})
+			c.SetMapper(m)
+			c.settings = tc.settings
+			c.Run(context.Background())
+			defer c.Stop()
+
+			stored := func() float64 {
+				// The sample store handles one request at a time, so the
+				// samples have been stored once a removal is accepted.
+				c.removeCh <- ""
+				c.mu.Lock()
+				defer c.mu.Unlock()
+				return c.samples[tc.path].Value
+			}
+			for _, line := range []string{"3 100", "7 100", "2 100"} {
+				c.processLine(tc.path+" "+line, LineSource{})
+			}
+			assert.Equal(t, tc.want, stored())
+			// A sample with another timestamp replaces the stored one.
+			c.processLine(tc.path+" 1 110", LineSource{})
+			assert.Equal(t, 1.0, stored(), "after a new timestamp")
+		})
+	}
+}
+
+func TestCollectDuringIngest(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: app.*.requests
+  name: requests_total
+  type: counter
+  accumulate: true
+  labels:
+    app: $1
+`))
+	c := NewCollector(Options{Mapper: m})
+	c.Run(context.Background())
+	defer c.Stop()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+
+	// Each app's counter resets every ten lines, so its accumulated total is
+	// the number of lines received. Every scrape must see a whole number of
+	// lines per app, never fewer than the previous scrape.
+	const apps, lines = 4, 500
+	var wg sync.WaitGroup
+	for i := 0; i < apps; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < lines; j++ {
+				c.ProcessLine(fmt.Sprintf("app.app%d.requests %d %d", i, j%10+1, time.Now().Unix()))
+			}
+		}(i)
+	}
+	ingested := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(ingested)
+	}()
+
+	last := map[string]float64{}
+	scrape := func() {
+		mfs, err := reg.Gather()
+		if !assert.NoError(t, err) {
+			return
+		}
+		for _, mf := range mfs {
+			if mf.GetName() != "requests_total" {
+				continue
+			}
+			for _, metric := range mf.GetMetric() {
+				app := metric.GetLabel()[0].GetValue()
+				v := metric.GetCounter().GetValue()
+				assert.Equal(t, math.Trunc(v), v, "total of %s", app)
+				assert.True(t, v >= last[app] && v <= lines, "total of %s went from %g to %g", app, last[app], v)
+				last[app] = v
+			}
+		}
+	}
+	for done := false; !done; {
+		select {
+		case <-ingested:
+			done = true
+		default:
+		}
+		scrape()
+	}
+	assert.Eventually(t, func() bool {
+		scrape()
+		for i := 0; i < apps; i++ {
+			if last[fmt.Sprintf("app%d", i)] != lines {
+				return false
+			}
+		}
+		return true
+	}, time.Second, time.Millisecond)
+}
+
+func TestLoadMappingConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graphite_exporter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	good := filepath.Join(dir, "good.yml")
+	bad := filepath.Join(dir, "bad.yml")
+	assert.NoError(t, ioutil.WriteFile(good, []byte("mappings:\n- match: app.*.requests\n  name: requests\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(bad, []byte("mappings:\n- match: app.*.requests\n  type: histogram\n"), 0644))
+
+	var buf bytes.Buffer
+	logger := log.NewLogfmtLogger(&buf)
+	failures := testutil.ToFloat64(mappingLoadFailures)
+
+	contents, err := LoadMappingConfig(&Mapper{}, good, "", "startup", logger)
+	assert.NoError(t, err)
+	assert.Contains(t, string(contents), "app.*.requests")
+	assert.Equal(t, 1.0, testutil.ToFloat64(mappingLastLoadSuccessful))
+
+	for _, path := range []string{bad, filepath.Join(dir, "missing.yml")} {
+		_, err = LoadMappingConfig(&Mapper{}, path, "", "startup", logger)
+		assert.Error(t, err)
+		assert.Equal(t, 0.0, testutil.ToFloat64(mappingLastLoadSuccessful))
+	}
+	assert.Equal(t, failures+2, testutil.ToFloat64(mappingLoadFailures))
+	assert.Equal(t, 2, strings.Count(buf.String(), `msg="Error loading metric mapping config"`))
+
+	// The configuration of a tenant failing to load is not hidden by that
+	// of the flags loading fine.
+	_, err = LoadMappingConfig(&Mapper{}, bad, "tenant a", "sighup", logger)
+	assert.Error(t, err)
+	assert.Contains(t, buf.String(), "trigger=sighup")
+	_, err = LoadMappingConfig(&Mapper{}, good, "", "sighup", logger)
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, testutil.ToFloat64(mappingLastLoadSuccessful))
+	_, err = LoadMappingConfig(&Mapper{}, good, "tenant a", "sighup", logger)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, testutil.ToFloat64(mappingLastLoadSuccessful))
+}
@@ -0,0 +1,191 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+// mappingRule is a loaded mapping with its effective settings, as reported
+// by /debug/mappings.
+type mappingRule struct {
+	Index           int               `json:"index"`
+	Match           string            `json:"match"`
+	MatchType       string            `json:"match_type"`
+	MatchMetricType string            `json:"match_metric_type,omitempty"`
+	Action          string            `json:"action"`
+	Name            string            `json:"name"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Help            string            `json:"help,omitempty"`
+	Type            MetricType        `json:"type"`
+	NormalizeName   bool              `json:"normalize_name"`
+	Accumulate      bool              `json:"accumulate"`
+	CounterMode     CounterMode       `json:"counter_mode,omitempty"`
+	Aggregate       Aggregation       `json:"aggregate"`
+	DropLabels      []string          `json:"drop_labels,omitempty"`
+	DecimalPlaces   *int              `json:"decimal_places,omitempty"`
+	ExpirySeconds   float64           `json:"expiry_seconds,omitempty"`
+	Matches         uint64            `json:"matches"`
+	// SanitizedNames is the number of samples of the mapping whose name
+	// had invalid characters replaced.
+	SanitizedNames uint64 `json:"sanitized_names"`
+}
+
+// mappingRules keeps the mappings as they were loaded, as the statsd_exporter
+// mapper overwrites the name templates of glob mappings when matching, and
+// counts the matches of each.
+type mappingRules struct {
+	rules []mappingRule
+	// byMapping finds glob mappings, which are matched by reference, and
+	// byMatch regex mappings, which are matched as copies.
+	byMapping map[*mapper.MetricMapping]int
+	byMatch   map[string]int
+	matches   []uint64
+	sanitized []uint64
+}
+
+func newMappingRules(mappings []mapper.MetricMapping) *mappingRules {
+	r := &mappingRules{
+		rules:     make([]mappingRule, len(mappings)),
+		byMapping: make(map[*mapper.MetricMapping]int, len(mappings)),
+		byMatch:   make(map[string]int, len(mappings)),
+		matches:   make([]uint64, len(mappings)),
+		sanitized: make([]uint64, len(mappings)),
+	}
+	for i := range mappings {
+		mapping := &mappings[i]
+		r.rules[i] = mappingRule{
+			Index:           i,
+			Match:           mapping.Match,
+			MatchType:       string(mapping.MatchType),
+			MatchMetricType: string(mapping.MatchMetricType),
+			Action:          string(mapping.Action),
+			Name:            mapping.Name,
+			Labels:          mapping.Labels,
+			Help:            mapping.HelpText,
+		}
+		r.byMapping[mapping] = i
+		if _, ok := r.byMatch[mapping.Match]; !ok {
+			r.byMatch[mapping.Match] = i
+		}
+	}
+	return r
+}
+
+func (r *mappingRules) countMatch(mapping *mapper.MetricMapping) {
+	i, ok := r.byMapping[mapping]
+	if !ok {
+		if i, ok = r.byMatch[mapping.Match]; !ok {
+			return
+		}
+	}
+	atomic.AddUint64(&r.matches[i], 1)
+}
+
+// countSanitized counts a sample of the mapping with the given match whose
+// name was sanitized, and reports whether it is the first one.
+func (r *mappingRules) countSanitized(match string) bool {
+	i, ok := r.byMatch[match]
+	if !ok {
+		return false
+	}
+	return atomic.AddUint64(&r.sanitized[i], 1) == 1
+}
+
+// GetMapping implements MetricMapper, counting the matches of each mapping.
+func (m *Mapper) GetMapping(path string, t mapper.MetricType) (*mapper.MetricMapping, prometheus.Labels, bool) {
+	mapping, labels, present := m.MetricMapper.GetMapping(path, t)
+	if present && m.rules != nil {
+		m.rules.countMatch(mapping)
+	}
+	return mapping, labels, present
+}
+
+// effectiveRules returns the loaded mappings in order, with the settings
+// that apply to them.
+func (m *Mapper) effectiveRules(s MapSettings) []mappingRule {
+	if m.rules == nil {
+		return []mappingRule{}
+	}
+	rules := make([]mappingRule, len(m.rules.rules))
+	for i, rule := range m.rules.rules {
+		opts := m.options[rule.Match]
+		rule.Type = opts.Type
+		if rule.Type == "" {
+			rule.Type = s.DefaultType
+		}
+		if rule.Type == "" {
+			rule.Type = MetricTypeGauge
+		}
+		rule.NormalizeName = opts.NormalizeName || s.NormalizeNames
+		rule.Accumulate = opts.Accumulate
+		if rule.Type == MetricTypeCounter {
+			rule.CounterMode = opts.CounterMode
+			if rule.CounterMode == "" {
+				rule.CounterMode = CounterModeAbsolute
+			}
+		}
+		rule.Aggregate = opts.Aggregate
+		if rule.Aggregate == "" {
+			rule.Aggregate = s.Aggregate
+		}
+		if rule.Aggregate == "" || rule.Accumulate {
+			rule.Aggregate = AggregationLast
+		}
+		rule.DropLabels = opts.DropLabels
+		rule.DecimalPlaces = opts.DecimalPlaces
+		rule.ExpirySeconds = opts.Expiry.Seconds()
+		if rule.DecimalPlaces == nil {
+			rule.DecimalPlaces = s.DecimalPlaces
+		}
+		rule.Matches = atomic.LoadUint64(&m.rules.matches[i])
+		rule.SanitizedNames = atomic.LoadUint64(&m.rules.sanitized[i])
+		rules[i] = rule
+	}
+	return rules
+}
+
+// MappingsHandler responds with the loaded mappings, in the order in which
+// they are tried, and the settings that apply to all of them.
+func MappingsHandler(c *Collector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rules, suffixes, relabels := []mappingRule{}, []unitSuffix{}, []relabelRule{}
+		if m, ok := c.Mapper().(*Mapper); ok {
+			rules = m.effectiveRules(c.settings)
+			if m.suffixes != nil {
+				suffixes = m.suffixes
+			}
+			if m.relabels != nil {
+				relabels = m.relabels
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"strict_match":  c.settings.StrictMatch,
+				"strict_names":  c.settings.StrictMappedNames,
+				"metric_prefix": c.settings.MetricPrefix,
+				"unit_suffixes": suffixes,
+				"relabel":       relabels,
+				"mappings":      rules,
+			},
+		})
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMappingsHandler(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+unit_suffixes:
+- suffix: ms
+  unit: seconds
+  scale: 0.001
+mappings:
+- match: app.*.requests
+  name: requests_total
+  type: counter
+  accumulate: true
+  labels:
+    app: $1
+- match: noisy\..*
+  match_type: regex
+  name: noisy
+  action: drop
+- match: app.*.latency
+  name: app_latency_${1}
+  help: Request latency.
+  aggregate: max
+`))
+	for _, path := range []string{"app.web.requests", "app.api.requests", "noisy.metric", "app.web.latency", "unmatched"} {
+		m.GetMapping(path, mapper.MetricTypeGauge)
+	}
+
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.SetMapper(m)
+	c.settings = MapSettings{NormalizeNames: true, DefaultType: MetricTypeUntyped, Aggregate: AggregationSum}
+	c.Run(context.Background())
+	defer c.Stop()
+	rec := httptest.NewRecorder()
+	MappingsHandler(c).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/mappings", nil))
+
+	var resp struct {
+		Status string
+		Data   struct {
+			UnitSuffixes []unitSuffix  `json:"unit_suffixes"`
+			Mappings     []mappingRule `json:"mappings"`
+		}
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp), rec.Body.String())
+	assert.Equal(t, "success", resp.Status)
+	assert.Equal(t, []unitSuffix{{Suffix: "ms", Unit: "seconds", Scale: 0.001}}, resp.Data.UnitSuffixes)
+	assert.Equal(t, []mappingRule{
+		{
+			Index: 0, Match: "app.*.requests", MatchType: "glob", Action: "map",
+			Name: "requests_total", Labels: map[string]string{"app": "$1"},
+			Type: MetricTypeCounter, NormalizeName: true, Accumulate: true, CounterMode: CounterModeAbsolute,
+			Aggregate: AggregationLast, Matches: 2,
+		},
+		{
+			Index: 1, Match: `noisy\..*`, MatchType: "regex", Action: "drop",
+			Name: "noisy", Type: MetricTypeUntyped, NormalizeName: true, Aggregate: AggregationSum, Matches: 1,
+		},
+		{
+			Index: 2, Match: "app.*.latency", MatchType: "glob", Action: "map",
+			Name: "app_latency_${1}", Help: "Request latency.",
+			Type: MetricTypeUntyped, NormalizeName: true, Aggregate: AggregationMax, Matches: 1,
+		},
+	}, resp.Data.Mappings, "names are reported as templates, even after matching")
+}
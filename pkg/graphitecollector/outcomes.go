@@ -0,0 +1,116 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterFeature("outcome_history")
+}
+
+// outcomeHistoryMinutes is the number of minutes of line outcomes kept.
+const outcomeHistoryMinutes = 60
+
+// outcome is what became of a processed line, as counted by the totals.
+type outcome int
+
+const (
+	// outcomeAccepted is a stored sample.
+	outcomeAccepted outcome = iota
+	// outcomeInvalid is a line that could not be parsed.
+	outcomeInvalid
+	// outcomeRejected is a sample that was not stored or exported.
+	outcomeRejected
+	// outcomeDropped is a sample dropped by the mapping configuration.
+	outcomeDropped
+)
+
+// outcomeCounts counts the outcomes of the lines processed in the minute
+// starting at Start.
+type outcomeCounts struct {
+	Start    time.Time `json:"start"`
+	Accepted uint64    `json:"accepted"`
+	Invalid  uint64    `json:"invalid"`
+	Rejected uint64    `json:"rejected"`
+	Dropped  uint64    `json:"dropped"`
+}
+
+// outcomeHistory counts the outcomes of the processed lines per minute, for
+// the last outcomeHistoryMinutes minutes. The counts of a minute are reset
+// when its slot is reused an hour later.
+type outcomeHistory struct {
+	mu      sync.Mutex
+	minutes [outcomeHistoryMinutes]outcomeCounts
+}
+
+func (h *outcomeHistory) add(now time.Time, o outcome) {
+	start := now.Truncate(time.Minute)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	counts := &h.minutes[start.Unix()/60%outcomeHistoryMinutes]
+	if !counts.Start.Equal(start) {
+		*counts = outcomeCounts{Start: start}
+	}
+	switch o {
+	case outcomeAccepted:
+		counts.Accepted++
+	case outcomeInvalid:
+		counts.Invalid++
+	case outcomeRejected:
+		counts.Rejected++
+	case outcomeDropped:
+		counts.Dropped++
+	}
+}
+
+// snapshot returns the counts of every minute of the last hour at now,
+// oldest first, including the minutes without any processed line, so that
+// consecutive snapshots line up.
+func (h *outcomeHistory) snapshot(now time.Time) []outcomeCounts {
+	current := now.Truncate(time.Minute)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	minutes := make([]outcomeCounts, 0, outcomeHistoryMinutes)
+	for i := outcomeHistoryMinutes - 1; i >= 0; i-- {
+		start := current.Add(-time.Duration(i) * time.Minute)
+		counts := h.minutes[start.Unix()/60%outcomeHistoryMinutes]
+		if !counts.Start.Equal(start) {
+			counts = outcomeCounts{Start: start}
+		}
+		minutes = append(minutes, counts)
+	}
+	return minutes
+}
+
+// OutcomesHandler responds with the number of lines c accepted, found
+// invalid, rejected and dropped in each minute of the last hour. It repeats
+// the totals of the Prometheus counters, but keeps their history while the
+// Prometheus server scraping them is unavailable.
+func OutcomesHandler(c *Collector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"interval_seconds": 60,
+				"minutes":          c.totals.outcomes.snapshot(time.Now()),
+			},
+		})
+	}
+}
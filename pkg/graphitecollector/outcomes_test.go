@@ -0,0 +1,129 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutcomeHistory(t *testing.T) {
+	var h outcomeHistory
+	start := time.Unix(6000, 0)
+	h.add(start, outcomeAccepted)
+	h.add(start.Add(30*time.Second), outcomeAccepted)
+	h.add(start.Add(time.Minute), outcomeInvalid)
+	h.add(start.Add(2*time.Minute), outcomeRejected)
+	h.add(start.Add(2*time.Minute), outcomeDropped)
+
+	minutes := h.snapshot(start.Add(2*time.Minute + 10*time.Second))
+	if assert.Len(t, minutes, outcomeHistoryMinutes) {
+		assert.Equal(t, outcomeCounts{Start: start.Add(-57 * time.Minute)}, minutes[0])
+		assert.Equal(t, []outcomeCounts{
+			{Start: start, Accepted: 2},
+			{Start: start.Add(time.Minute), Invalid: 1},
+			{Start: start.Add(2 * time.Minute), Rejected: 1, Dropped: 1},
+		}, minutes[57:])
+	}
+
+	// An hour later, the slot of the first minute is reused.
+	h.add(start.Add(time.Hour), outcomeDropped)
+	minutes = h.snapshot(start.Add(time.Hour))
+	assert.Equal(t, outcomeCounts{Start: start.Add(time.Hour), Dropped: 1}, minutes[59])
+	assert.Equal(t, outcomeCounts{Start: start.Add(time.Minute), Invalid: 1}, minutes[0])
+}
+
+func TestOutcomesHandler(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: app.*.bad
+  name: bad
+  labels:
+    __app: $1
+- match: noisy.*
+  name: noisy
+  action: drop
+`))
+	c := NewCollector(Options{Logger: log.NewNopLogger(), Mapper: m})
+	c.Run(context.Background())
+	defer c.Stop()
+	for _, line := range []string{
+		"app.web.requests 1 1000",
+		"app.web.errors 1 1000",
+		"app.web.bad 1 1000",
+		"noisy.metric 1 1000",
+		"broken",
+	} {
+		c.processLine(line, LineSource{})
+	}
+	c.removeCh <- ""
+
+	rec := httptest.NewRecorder()
+	OutcomesHandler(c)(rec, httptest.NewRequest("GET", "/debug/outcomes", nil))
+	var resp struct {
+		Status string
+		Data   struct {
+			IntervalSeconds int             `json:"interval_seconds"`
+			Minutes         []outcomeCounts `json:"minutes"`
+		}
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp), rec.Body.String())
+	assert.Equal(t, "success", resp.Status)
+	assert.Equal(t, 60, resp.Data.IntervalSeconds)
+	assert.Len(t, resp.Data.Minutes, outcomeHistoryMinutes)
+	// The lines may have been processed in the minute before the request.
+	var total outcomeCounts
+	for _, counts := range resp.Data.Minutes {
+		total.Accepted += counts.Accepted
+		total.Invalid += counts.Invalid
+		total.Rejected += counts.Rejected
+		total.Dropped += counts.Dropped
+	}
+	assert.Equal(t, outcomeCounts{Accepted: 2, Invalid: 1, Rejected: 1, Dropped: 1}, total)
+}
+
+func TestOutcomesIgnoreScrapes(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: alpha.*.requests
+  name: requests
+- match: beta.*.requests
+  name: requests
+`))
+	c := NewCollector(Options{Logger: log.NewNopLogger(), Mapper: m})
+	c.Run(context.Background())
+	defer c.Stop()
+	now := time.Now().Unix()
+	c.processLine(fmt.Sprintf("alpha.x.requests 1 %d", now), LineSource{})
+	c.processLine(fmt.Sprintf("beta.x.requests 1 %d", now), LineSource{})
+	c.removeCh <- ""
+
+	// The colliding samples were both accepted when stored. Scrapes leave
+	// one of them out, which is not a line outcome.
+	at := time.Now()
+	before := c.totals.outcomes.snapshot(at)
+	exportedSamples(t, c)
+	exportedSamples(t, c)
+	assert.Equal(t, before, c.totals.outcomes.snapshot(at))
+	assert.Equal(t, map[string]uint64{"duplicate": 1}, c.Summary().SkippedSamples)
+}
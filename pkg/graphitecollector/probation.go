@@ -0,0 +1,49 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	RegisterFeature("min_updates")
+}
+
+var probationDrops = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "graphite_probation_dropped_series_total",
+		Help: "Total count of series removed without being exported because they received fewer samples than the minimum to be exported before the probation expiry.",
+	},
+)
+
+// inProbation reports whether the series of s received fewer samples than
+// needed to be exported. Senders creating series that never update, such as
+// ones with a random component in the path, would otherwise fill the exposed
+// series until they expire.
+func (c *Collector) inProbation(s *Sample) bool {
+	return c.minUpdates > 1 && s.updates < c.minUpdates
+}
+
+// expiredSample records the removal of an expired sample from the store. It
+// must be called with c.mu held.
+func (c *Collector) expiredSample(s *Sample) {
+	if c.inProbation(s) {
+		probationDrops.Inc()
+		return
+	}
+	if c.tombstones != nil {
+		c.tombstones.expire(s)
+	}
+}
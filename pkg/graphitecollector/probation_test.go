@@ -0,0 +1,57 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMinUpdates(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	c := NewCollector(Options{
+		Logger:          log.NewNopLogger(),
+		Clock:           clock,
+		SampleExpiry:    5 * time.Minute,
+		MinUpdates:      2,
+		ProbationExpiry: 30 * time.Second,
+	})
+	c.Run(context.Background())
+	defer c.Stop()
+	c.processLine("once.metric 1 1000", LineSource{})
+	c.processLine("twice.metric 1 1000", LineSource{})
+	c.removeCh <- ""
+
+	assert.Empty(t, currentPaths(c))
+	assert.Empty(t, exportedSamples(t, c), "series are withheld until their second sample")
+
+	c.processLine("twice.metric 2 1010", LineSource{})
+	c.removeCh <- ""
+	assert.Equal(t, []string{"twice.metric"}, currentPaths(c))
+	assert.Equal(t, []string{"twice_metric"}, exportedSamples(t, c))
+
+	// The single-shot series expires after the probation expiry, the updated
+	// one only after the sample expiry.
+	clock.now = time.Unix(1040, 0)
+	drops := testutil.ToFloat64(probationDrops)
+	c.expireSamples(c.Now())
+	assert.Equal(t, 1, c.SampleCount())
+	assert.Equal(t, drops+1, testutil.ToFloat64(probationDrops))
+	assert.Equal(t, []string{"twice_metric"}, exportedSamples(t, c))
+}
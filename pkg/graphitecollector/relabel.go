@@ -0,0 +1,135 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+func init() {
+	RegisterFeature("relabel")
+}
+
+// relabelAction is what a relabeling rule does to a label value.
+type relabelAction string
+
+const (
+	// relabelReplace replaces a value fully matching the regex with the
+	// expanded replacement.
+	relabelReplace     relabelAction = "replace"
+	relabelLowercase   relabelAction = "lowercase"
+	relabelStripDomain relabelAction = "strip_domain"
+)
+
+var relabelApplications = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "graphite_relabel_applications_total",
+		Help: "Total count of label values changed by a relabeling rule.",
+	},
+	[]string{"label", "action"},
+)
+
+// relabelRule rewrites the values of a label after mapping.
+type relabelRule struct {
+	Label       string        `yaml:"label" json:"label"`
+	Action      relabelAction `yaml:"action" json:"action"`
+	Regex       string        `yaml:"regex" json:"regex,omitempty"`
+	Replacement string        `yaml:"replacement" json:"replacement,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+// init validates the rule and compiles its regex.
+func (r *relabelRule) init() error {
+	if !model.LabelName(r.Label).IsValid() {
+		return fmt.Errorf("relabeling rule has invalid label name %q", r.Label)
+	}
+	if r.Action == "" {
+		r.Action = relabelReplace
+	}
+	switch r.Action {
+	case relabelReplace:
+		if r.Regex == "" {
+			return fmt.Errorf("relabeling rule for label %q must set a regex", r.Label)
+		}
+		regex, err := regexp.Compile("^(?:" + r.Regex + ")$")
+		if err != nil {
+			return fmt.Errorf("relabeling rule for label %q: %v", r.Label, err)
+		}
+		r.regex = regex
+	case relabelLowercase, relabelStripDomain:
+		if r.Regex != "" || r.Replacement != "" {
+			return fmt.Errorf("relabeling rule for label %q: action %s takes no regex or replacement", r.Label, r.Action)
+		}
+	default:
+		return fmt.Errorf("relabeling rule for label %q has invalid action %q", r.Label, r.Action)
+	}
+	return nil
+}
+
+func (r *relabelRule) apply(value string) string {
+	switch r.Action {
+	case relabelReplace:
+		match := r.regex.FindStringSubmatchIndex(value)
+		if match == nil {
+			return value
+		}
+		return string(r.regex.ExpandString(nil, r.Replacement, value, match))
+	case relabelLowercase:
+		return strings.ToLower(value)
+	case relabelStripDomain:
+		if i := strings.IndexByte(value, '.'); i > 0 {
+			return value[:i]
+		}
+	}
+	return value
+}
+
+// relabel applies the rules in order to labels, returning the resulting
+// labels and the rules that changed a value. labels is not modified.
+func relabel(rules []relabelRule, labels map[string]string) (map[string]string, []*relabelRule) {
+	var applied []*relabelRule
+	copied := false
+	for i := range rules {
+		rule := &rules[i]
+		value, ok := labels[rule.Label]
+		if !ok {
+			continue
+		}
+		relabeled := rule.apply(value)
+		if relabeled == value {
+			continue
+		}
+		if !copied {
+			labels = copyLabels(labels)
+			copied = true
+		}
+		labels[rule.Label] = relabeled
+		applied = append(applied, rule)
+	}
+	return labels, applied
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	c := make(map[string]string, len(labels))
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const relabelConfig = `
+relabel:
+- label: host
+  action: strip_domain
+- label: host
+  action: lowercase
+- label: host
+  regex: web-?(\d+)
+  replacement: web$1
+mappings:
+- match: servers.*.cpu
+  name: cpu
+  labels:
+    host: $1
+`
+
+func TestRelabel(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(relabelConfig))
+
+	for path, want := range map[string]string{
+		"servers.web01.cpu":  "web01",
+		"servers.WEB01.cpu":  "web01",
+		"servers.web-01.cpu": "web01",
+		"servers.db02.cpu":   "db02",
+	} {
+		mm, ok := MapMetric(m, path, MapSettings{})
+		assert.True(t, ok)
+		assert.Equal(t, map[string]string{"host": want}, mm.Labels, "labels of %s", path)
+	}
+
+	// Values with dots cannot be matched by a glob component, so strip
+	// the domain from a regex mapping.
+	assert.NoError(t, m.InitFromYAMLString(`
+relabel:
+- label: host
+  action: strip_domain
+- label: host
+  action: lowercase
+mappings:
+- match: servers\.(.*)\.cpu
+  match_type: regex
+  name: cpu
+  labels:
+    host: $1
+`))
+	mm, ok := MapMetric(m, "servers.WEB01.prod.example.com.cpu", MapSettings{})
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"host": "web01"}, mm.Labels)
+}
+
+func TestRelabelCounted(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(relabelConfig))
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.SetMapper(m)
+	c.Run(context.Background())
+	defer c.Stop()
+
+	lowercased := testutil.ToFloat64(relabelApplications.WithLabelValues("host", "lowercase"))
+	replaced := testutil.ToFloat64(relabelApplications.WithLabelValues("host", "replace"))
+	c.processLine("servers.WEB-01.cpu 1 100", LineSource{})
+	c.processLine("servers.web01.cpu 1 100", LineSource{})
+	c.processLine("servers.WEB01.cpu x 100", LineSource{})
+	assert.Equal(t, lowercased+1, testutil.ToFloat64(relabelApplications.WithLabelValues("host", "lowercase")), "only accepted lines are counted")
+	assert.Equal(t, replaced+1, testutil.ToFloat64(relabelApplications.WithLabelValues("host", "replace")))
+}
+
+func TestRelabelInvalid(t *testing.T) {
+	for _, config := range []string{
+		"relabel:\n- label: host.name\n  action: lowercase\n",
+		"relabel:\n- label: host\n  action: uppercase\n",
+		"relabel:\n- label: host\n",
+		"relabel:\n- label: host\n  regex: (\n",
+		"relabel:\n- label: host\n  action: lowercase\n  regex: x\n",
+	} {
+		m := &Mapper{}
+		assert.Error(t, m.InitFromYAMLString(config), "config %q", config)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// storedSample describes a stored sample and when it expires.
+type storedSample struct {
+	Path   string `json:"path"`
+	Series string `json:"series"`
+	// Value is a string, as JSON cannot represent NaN and infinities.
+	Value         string  `json:"value"`
+	Timestamp     float64 `json:"timestamp"`
+	ExpirySeconds float64 `json:"expiry_seconds"`
+	// ExpirySource is what sets the expiry: the mapping, an expiry
+	// override, the storage schemas or the default sample expiry.
+	ExpirySource string  `json:"expiry_source"`
+	ExpiresAt    float64 `json:"expires_at"`
+}
+
+// SamplesHandler responds with the stored samples whose path starts with the
+// prefix parameter, if given, ordered by path, with the expiry that applies
+// to each.
+func SamplesHandler(c *Collector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		prefix := r.URL.Query().Get("prefix")
+		samples := []storedSample{}
+		for _, s := range c.snapshot() {
+			if !strings.HasPrefix(s.OriginalName, prefix) {
+				continue
+			}
+			expiry, source := c.effectiveExpiry(s)
+			samples = append(samples, storedSample{
+				Path:          s.OriginalName,
+				Series:        seriesString(s.Name, s.Labels),
+				Value:         strconv.FormatFloat(s.Value, 'g', -1, 64),
+				Timestamp:     float64(s.Timestamp.UnixNano()) / 1e9,
+				ExpirySeconds: expiry.Seconds(),
+				ExpirySource:  source,
+				ExpiresAt:     float64(s.Timestamp.Add(expiry).UnixNano()) / 1e9,
+			})
+		}
+		sort.Slice(samples, func(i, j int) bool { return samples[i].Path < samples[j].Path })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   samples,
+		})
+	}
+}
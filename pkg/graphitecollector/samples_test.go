@@ -0,0 +1,111 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpiryOverrides(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: billing.*.invoices
+  name: invoices
+  expiry: 30m
+  labels:
+    customer: $1
+- match: collectd.*.load
+  name: load
+  labels:
+    host: $1
+expiry_overrides:
+- prefix: billing.
+  expiry: 2h
+- match: collectd.*.cpu*
+  expiry: 1m
+`))
+	schemas, err := ParseStorageSchemas(strings.NewReader("[all]\npattern = ^(billing|collectd)\\.\nretentions = 10s:1d\n"), 3)
+	assert.NoError(t, err)
+	clock := &manualClock{now: time.Unix(1600000000, 0)}
+	c := NewCollector(Options{
+		Logger:       log.NewNopLogger(),
+		Mapper:       m,
+		MapSettings:  MapSettings{StorageSchemas: schemas},
+		SampleExpiry: 5 * time.Minute,
+		Clock:        clock,
+	})
+	c.Run(context.Background())
+	defer c.Stop()
+
+	ts := clock.now.Unix()
+	for _, line := range []string{
+		"billing.acme.invoices 3 %d",
+		"collectd.web1.load 0.5 %d",
+		"collectd.web1.cpu0 12 %d",
+		"app.requests 7 %d",
+	} {
+		c.processLine(fmt.Sprintf(line, ts), LineSource{})
+	}
+	c.removeCh <- ""
+
+	rec := httptest.NewRecorder()
+	SamplesHandler(c)(rec, httptest.NewRequest("GET", "/debug/samples", nil))
+	var resp struct {
+		Data []storedSample
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp), rec.Body.String())
+	// The expiry of the mapping takes precedence over the expiry overrides,
+	// and those over the storage schemas.
+	assert.Equal(t, []storedSample{
+		{Path: "app.requests", Series: "app_requests", Value: "7", Timestamp: 1600000000, ExpirySeconds: 300, ExpirySource: "default", ExpiresAt: 1600000300},
+		{Path: "billing.acme.invoices", Series: `invoices{customer="acme"}`, Value: "3", Timestamp: 1600000000, ExpirySeconds: 1800, ExpirySource: "mapping", ExpiresAt: 1600001800},
+		{Path: "collectd.web1.cpu0", Series: "collectd_web1_cpu0", Value: "12", Timestamp: 1600000000, ExpirySeconds: 60, ExpirySource: "expiry_override", ExpiresAt: 1600000060},
+		{Path: "collectd.web1.load", Series: `load{host="web1"}`, Value: "0.5", Timestamp: 1600000000, ExpirySeconds: 30, ExpirySource: "storage_schema", ExpiresAt: 1600000030},
+	}, resp.Data)
+
+	rec = httptest.NewRecorder()
+	SamplesHandler(c)(rec, httptest.NewRequest("GET", "/debug/samples?prefix=billing.", nil))
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp), rec.Body.String())
+	assert.Len(t, resp.Data, 1)
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP graphite_sample_expiry_overrides Number of stored samples whose expiry is set by their mapping, an expiry override or the storage schemas instead of the sample expiry.
+# TYPE graphite_sample_expiry_overrides gauge
+graphite_sample_expiry_overrides 3
+`), "graphite_sample_expiry_overrides"))
+
+	// The sweep removes each sample once its own expiry has passed.
+	c.expireSamples(clock.now.Add(45 * time.Second))
+	assert.Equal(t, 3, c.SampleCount())
+	c.expireSamples(clock.now.Add(2 * time.Minute))
+	assert.Equal(t, 2, c.SampleCount())
+	c.expireSamples(clock.now.Add(10 * time.Minute))
+	assert.Equal(t, 1, c.SampleCount())
+	c.expireSamples(clock.now.Add(time.Hour))
+	assert.Equal(t, 0, c.SampleCount())
+}
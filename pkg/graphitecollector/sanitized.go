@@ -0,0 +1,87 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	RegisterFeature("sanitized_names")
+}
+
+// sanitizedName is a metric name that had invalid characters replaced.
+type sanitizedName struct {
+	// original is the name before sanitization: the unmapped path, or the
+	// name given by the mapping.
+	original string
+	// name is the exported metric name.
+	name string
+	// mapping is the match of the mapping that gave the name, if any.
+	mapping string
+}
+
+var mappedNamesSanitized = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "graphite_mapped_names_sanitized_total",
+		Help: "Total count of samples whose name given by a mapping had invalid characters replaced.",
+	},
+)
+
+// recordSanitizedMapping counts a sample whose mapped name was sanitized,
+// and logs the first one of each mapping of m. Names with invalid characters
+// are rejected when loading the mapping configuration, so they come from
+// captures of parts of the path, which the mapping most likely did not
+// expect to hold such characters.
+func (c *Collector) recordSanitizedMapping(m MetricMapper, s *sanitizedName) {
+	mappedNamesSanitized.Inc()
+	if mm, ok := m.(*Mapper); ok && mm.rules != nil && !mm.rules.countSanitized(s.mapping) {
+		return
+	}
+	level.Warn(c.logger).Log("msg", "Mapped metric name had invalid characters replaced", "mapping", s.mapping, "name", s.original, "exported_name", s.name)
+}
+
+// sanitizedNameCount is the estimated number of samples of a sanitized
+// name. The true count lies between Samples-Error and Samples.
+type sanitizedNameCount struct {
+	Original string `json:"original"`
+	Name     string `json:"name"`
+	Samples  uint64 `json:"samples"`
+	Error    uint64 `json:"error"`
+}
+
+// SanitizedNamesHandler responds with the names changed by sanitization
+// that c saw the most samples of, i.e. the best candidates for a mapping.
+// It must only be used if c was created with Options.TrackSanitizedNames.
+func SanitizedNamesHandler(c *Collector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		total, keys := c.sanitized.top(-1)
+		names := make([]sanitizedNameCount, 0, len(keys))
+		for _, k := range keys {
+			names = append(names, sanitizedNameCount{Original: k.Key, Name: k.Value, Samples: k.Count, Error: k.Error})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"total_samples": total,
+				"names":         names,
+			},
+		})
+	}
+}
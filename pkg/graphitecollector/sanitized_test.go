@@ -0,0 +1,98 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizedNames(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: app.*.requests
+  name: requests_total
+  labels:
+    app: $1
+- match: app.*.latency
+  name: ${1}_latency
+`))
+	c := NewCollector(Options{Logger: log.NewNopLogger(), TrackSanitizedNames: 10})
+	c.SetMapper(m)
+	c.Run(context.Background())
+	defer c.Stop()
+
+	sanitized, mapped := testutil.ToFloat64(sanitizedNames), testutil.ToFloat64(mappedNamesSanitized)
+	// Mapped names are only sanitized if a capture holds invalid
+	// characters, unmapped ones if their path does.
+	for _, line := range []string{
+		"app.web.requests 1 100",
+		"app.web-1.latency 1 100",
+		"app.api.latency 1 100",
+		"app.web-1.latency 1 100",
+		"host-1.cpu 1 100",
+		"app.web.requests 1 100",
+	} {
+		c.processLine(line, LineSource{})
+	}
+	assert.Equal(t, sanitized+3, testutil.ToFloat64(sanitizedNames))
+	assert.Equal(t, mapped+2, testutil.ToFloat64(mappedNamesSanitized))
+	rules := m.effectiveRules(MapSettings{})
+	assert.Equal(t, []uint64{0, 2}, []uint64{rules[0].SanitizedNames, rules[1].SanitizedNames})
+
+	rec := httptest.NewRecorder()
+	SanitizedNamesHandler(c)(rec, httptest.NewRequest("GET", "/debug/sanitized", nil))
+	var resp struct {
+		Data struct {
+			TotalSamples uint64               `json:"total_samples"`
+			Names        []sanitizedNameCount `json:"names"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp), rec.Body.String())
+	assert.Equal(t, uint64(3), resp.Data.TotalSamples)
+	assert.Equal(t, []sanitizedNameCount{
+		{Original: "web-1_latency", Name: "web_1_latency", Samples: 2},
+		{Original: "host-1.cpu", Name: "host_1_cpu", Samples: 1},
+	}, resp.Data.Names)
+}
+
+func TestStrictMappedNames(t *testing.T) {
+	// Invalid characters in the name of a mapping fail the load.
+	assert.Error(t, (&Mapper{}).InitFromYAMLString(`
+mappings:
+- match: app.*.requests
+  name: requests-total
+`))
+
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: app.*.latency
+  name: ${1}_latency
+`))
+	s := MapSettings{StrictMappedNames: true}
+	mm, ok := MapMetric(m, "app.web-1.latency", s)
+	assert.False(t, ok)
+	assert.Equal(t, dropReasonInvalidMappedName, mm.DropReason)
+	mm, ok = MapMetric(m, "app.web.latency", s)
+	assert.True(t, ok)
+	assert.Equal(t, "web_latency", mm.Name)
+}
@@ -0,0 +1,436 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	RegisterFeature("self_limits")
+}
+
+// memoryCheckInterval is how often the live heap is compared with
+// Options.MemorySoftLimit.
+const memoryCheckInterval = time.Second
+
+// maxForcedGCInterval bounds the backoff between the garbage collections
+// forced to measure the live heap while the heap exceeds a soft limit.
+const maxForcedGCInterval = 30 * time.Second
+
+// memoryEvictFraction is the fraction of the stored samples removed each
+// time the live heap exceeds Options.MemorySoftLimit.
+const memoryEvictFraction = 0.1
+
+var (
+	parseRateLimitDesc = prometheus.NewDesc(
+		"graphite_parse_rate_limit_lines_per_second",
+		"Maximum number of lines processed per second. Only exported if a limit is set.",
+		nil, nil,
+	)
+	memorySoftLimitDesc = prometheus.NewDesc(
+		"graphite_memory_soft_limit_bytes",
+		"Live heap size above which the oldest samples are removed and samples of new series are rejected. Only exported if a limit is set.",
+		nil, nil,
+	)
+	memoryLimitExceededDesc = prometheus.NewDesc(
+		"graphite_memory_soft_limit_exceeded",
+		"Whether the live heap exceeded the soft memory limit at the last check with the oldest samples of this pipeline being removed. Only exported if a limit is set.",
+		nil, nil,
+	)
+	seriesLimitDesc = prometheus.NewDesc(
+		"graphite_series_limit",
+		"Maximum number of stored series. Only exported if a limit is set.",
+		nil, nil,
+	)
+	udpMaxPendingDesc = prometheus.NewDesc(
+		"graphite_udp_max_pending_packets",
+		"Maximum number of received UDP packets waiting to be processed.",
+		nil, nil,
+	)
+	parseThrottledLines = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "graphite_parse_throttled_lines_total",
+			Help: "Total count of lines whose processing was delayed by the parse rate limit.",
+		},
+	)
+	parseThrottledSeconds = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "graphite_parse_throttled_seconds_total",
+			Help: "Total time lines were delayed by the parse rate limit.",
+		},
+	)
+	memoryLimitChecks = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "graphite_memory_soft_limit_exceeded_total",
+			Help: "Total count of checks finding the live heap above the soft memory limit.",
+		},
+	)
+	memoryLimitEvictions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "graphite_memory_soft_limit_evicted_samples_total",
+			Help: "Total count of samples removed before expiring because the live heap exceeded the soft memory limit.",
+		},
+	)
+)
+
+// throttleParse waits until the parse rate limit admits another line. It
+// returns false if stop is closed first.
+func (c *Collector) throttleParse(stop <-chan struct{}) bool {
+	wait := c.currentParseLimiter().reserve(time.Now())
+	if wait <= 0 {
+		return true
+	}
+	parseThrottledLines.Inc()
+	parseThrottledSeconds.Add(wait.Seconds())
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// heapSampler measures the live heap for all memory guards of the process
+// and decides which of them shed samples, so that collectors sharing the
+// process, such as those of tenants, neither each force garbage collections
+// nor all shed samples when one of them floods.
+type heapSampler struct {
+	mu sync.Mutex
+	// heapAlloc returns the size of the heap including garbage not
+	// collected yet, and gc forces a garbage collection.
+	heapAlloc func() uint64
+	gc        func()
+	// live is the heap measured after the last forced collection, at gcAt.
+	live uint64
+	gcAt time.Time
+	// backoff is the wait before the next forced collection.
+	backoff time.Duration
+	// guards are the memory guards of the running collectors.
+	guards map[*memoryGuard]struct{}
+}
+
+// processHeap is the heapSampler of the memory guards of the process.
+var processHeap = &heapSampler{heapAlloc: readHeapAlloc, gc: runtime.GC}
+
+func readHeapAlloc() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+func (s *heapSampler) register(g *memoryGuard) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.guards == nil {
+		s.guards = map[*memoryGuard]struct{}{}
+	}
+	s.guards[g] = struct{}{}
+}
+
+func (s *heapSampler) unregister(g *memoryGuard) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.guards, g)
+}
+
+// measure returns the live heap at now as compared with limit, and whether
+// it was measured now rather than at an earlier forced collection. Garbage
+// counts against the limit until it is collected, so a heap above the limit
+// is only measured by forcing a collection. While the heap stays above a
+// limit, the forced collections back off up to maxForcedGCInterval, as each
+// stops the world when the process is short of memory already. s.mu must be
+// held.
+func (s *heapSampler) measure(now time.Time, limit uint64) (uint64, bool) {
+	heap := s.heapAlloc()
+	if heap <= limit {
+		// The heap including garbage bounds the live heap.
+		s.backoff = 0
+		return heap, true
+	}
+	if !s.gcAt.IsZero() && now.Sub(s.gcAt) < s.backoff {
+		return s.live, false
+	}
+	s.gc()
+	s.live, s.gcAt = s.heapAlloc(), now
+	s.backoff *= 2
+	if s.backoff == 0 {
+		s.backoff = memoryCheckInterval
+	}
+	if s.backoff > maxForcedGCInterval {
+		s.backoff = maxForcedGCInterval
+	}
+	return s.live, true
+}
+
+// check measures the live heap at now against the limit of g and, for a new
+// measurement, updates the guards with that limit: under the limit, their
+// stored series become their baseline; above it, the guards that stored
+// more series than their baseline shed down to it, and if none did, all of
+// them shed.
+func (s *heapSampler) check(g *memoryGuard, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	limit := g.Limit()
+	heap, measured := s.measure(now, limit)
+	if !measured {
+		return
+	}
+	guards := []*memoryGuard{g}
+	for other := range s.guards {
+		if other != g && other.Limit() == limit {
+			guards = append(guards, other)
+		}
+	}
+	growth := make([]int, len(guards))
+	grown := false
+	for i, guard := range guards {
+		series := guard.series()
+		if heap <= limit {
+			guard.baseline = series
+		}
+		growth[i] = series - guard.baseline
+		if growth[i] > 0 {
+			grown = true
+		}
+	}
+	if heap <= limit {
+		for _, guard := range guards {
+			atomic.StoreInt32(&guard.exceeded, 0)
+			atomic.StoreInt64(&guard.shed, 0)
+		}
+		return
+	}
+	memoryLimitChecks.Inc()
+	for i, guard := range guards {
+		switch {
+		case !grown:
+			atomic.StoreInt32(&guard.exceeded, 1)
+			atomic.StoreInt64(&guard.shed, math.MaxInt64)
+		case growth[i] > 0:
+			atomic.StoreInt32(&guard.exceeded, 1)
+			atomic.StoreInt64(&guard.shed, int64(growth[i]))
+		default:
+			atomic.StoreInt32(&guard.exceeded, 0)
+			atomic.StoreInt64(&guard.shed, 0)
+		}
+	}
+}
+
+// memoryGuard keeps the live heap under a soft limit. Unlike GOMEMLIMIT,
+// which makes the runtime collect garbage more often, it sheds samples, as
+// the sample store is what grows with the input.
+type memoryGuard struct {
+	// limit is the soft limit in bytes, 0 if there is none. It may change
+	// at runtime and must be accessed atomically.
+	limit uint64
+	// shed is the number of samples the collector may still remove for the
+	// last measurement. It must be accessed atomically.
+	shed int64
+	// exceeded is 1 while the live heap is above the limit and the
+	// collector sheds samples. It must be accessed atomically.
+	exceeded int32
+	heap     *heapSampler
+	// series returns the number of stored samples, and baseline is that
+	// number when the heap was last under the limit. baseline is guarded
+	// by heap.mu.
+	series   func() int
+	baseline int
+}
+
+func newMemoryGuard(limit uint64, series func() int) *memoryGuard {
+	return &memoryGuard{limit: limit, heap: processHeap, series: series}
+}
+
+// Limit returns the soft limit in bytes, 0 if there is none.
+func (g *memoryGuard) Limit() uint64 {
+	return atomic.LoadUint64(&g.limit)
+}
+
+// Exceeded reports whether the live heap was above the limit at the last
+// check with the collector shedding samples. It is false on a nil
+// memoryGuard.
+func (g *memoryGuard) Exceeded() bool {
+	return g != nil && atomic.LoadInt32(&g.exceeded) == 1
+}
+
+// watchMemory checks the live heap until the collector is stopped, asking
+// the sample goroutine to remove the oldest samples while it exceeds the
+// limit and the collector sheds samples.
+func (c *Collector) watchMemory() {
+	c.memory.heap.register(c.memory)
+	defer c.memory.heap.unregister(c.memory)
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+	last := false
+	for {
+		select {
+		case <-ticker.C:
+			if c.memory.Limit() == 0 {
+				atomic.StoreInt32(&c.memory.exceeded, 0)
+				atomic.StoreInt64(&c.memory.shed, 0)
+			} else {
+				c.memory.heap.check(c.memory, time.Now())
+			}
+			exceeded := c.memory.Exceeded()
+			if exceeded != last {
+				if exceeded {
+					level.Warn(c.logger).Log("msg", "Live heap exceeds the soft memory limit, removing the oldest samples and rejecting new series", "limit", c.memory.Limit())
+				} else {
+					level.Info(c.logger).Log("msg", "Live heap is back under the soft memory limit or other pipelines grew", "limit", c.memory.Limit())
+				}
+			}
+			last = exceeded
+			if atomic.LoadInt64(&c.memory.shed) == 0 {
+				continue
+			}
+			// A pending request is as good as a new one.
+			select {
+			case c.evictCh <- struct{}{}:
+			default:
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// ParseRateLimit returns the maximum number of lines processed per second,
+// 0 if there is no limit.
+func (c *Collector) ParseRateLimit() float64 {
+	return c.currentParseLimiter().rate
+}
+
+// SetParseRateLimit changes the parse rate limit at runtime. The new limit
+// starts with a full burst.
+func (c *Collector) SetParseRateLimit(rate float64) {
+	c.parseLimiter.Store(newRateLimiter(rate))
+}
+
+func (c *Collector) currentParseLimiter() *rateLimiter {
+	return c.parseLimiter.Load().(*rateLimiter)
+}
+
+// MaxSeries returns the maximum number of stored series, 0 if there is no
+// limit.
+func (c *Collector) MaxSeries() int {
+	return int(atomic.LoadInt64(c.maxSeries))
+}
+
+// SetMaxSeries changes the series limit at runtime. Lowering it below the
+// number of stored series removes none of them; samples of new series are
+// rejected until enough of them expired.
+func (c *Collector) SetMaxSeries(n int) {
+	atomic.StoreInt64(c.maxSeries, int64(n))
+}
+
+// MaxSamplesPerScrape returns the maximum number of samples Collect emits,
+// 0 if there is no limit.
+func (c *Collector) MaxSamplesPerScrape() int {
+	return int(atomic.LoadInt64(c.maxSamples))
+}
+
+// SetMaxSamplesPerScrape changes the limit of samples per scrape at runtime.
+func (c *Collector) SetMaxSamplesPerScrape(n int) {
+	atomic.StoreInt64(c.maxSamples, int64(n))
+}
+
+// MemorySoftLimit returns the soft memory limit in bytes, 0 if there is
+// none.
+func (c *Collector) MemorySoftLimit() uint64 {
+	return c.memory.Limit()
+}
+
+// SetMemorySoftLimit changes the soft memory limit at runtime, 0 removing
+// it. It takes effect at the next check of the live heap.
+func (c *Collector) SetMemorySoftLimit(limit uint64) {
+	atomic.StoreUint64(&c.memory.limit, limit)
+}
+
+// rejectNewSeries returns the rejection of a sample of a series that is not
+// stored, if the series limit is reached or the live heap exceeds the soft
+// memory limit. It must only be called from the goroutine that owns the
+// sample store.
+func (c *Collector) rejectNewSeries(sample *Sample) error {
+	if maxSeries := c.MaxSeries(); maxSeries > 0 && len(c.samples) >= maxSeries {
+		return c.rejectSample(sample, "series_limit", fmt.Errorf("the limit of %d series is reached, new series %s is not stored", maxSeries, sample.Name))
+	}
+	if c.memory.Exceeded() {
+		return c.rejectSample(sample, "memory_limit", fmt.Errorf("the soft memory limit is exceeded, new series %s is not stored", sample.Name))
+	}
+	return nil
+}
+
+// evictOldest removes the given fraction of the stored samples, those with
+// the oldest timestamps first, without tombstones, but no more than the
+// memory guard allows for its last measurement. It must only be called from
+// the goroutine that owns the sample store.
+func (c *Collector) evictOldest(fraction float64) {
+	allowed := atomic.SwapInt64(&c.memory.shed, 0)
+	// Only this goroutine writes to the sample store, so it can be read
+	// without holding the lock.
+	samples := make([]*Sample, 0, len(c.samples))
+	for _, sample := range c.samples {
+		if !isSelftest(sample.OriginalName) {
+			samples = append(samples, sample)
+		}
+	}
+	n := int(math.Ceil(float64(len(samples)) * fraction))
+	if int64(n) > allowed {
+		n = int(allowed)
+	}
+	if n == 0 {
+		return
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].Timestamp.Before(samples[j].Timestamp)
+	})
+	c.mu.Lock()
+	for _, sample := range samples[:n] {
+		delete(c.samples, sample.OriginalName)
+	}
+	c.mu.Unlock()
+	memoryLimitEvictions.Add(float64(n))
+	c.rebuildStrings()
+}
+
+// collectSelfLimits emits the limits the exporter applies to itself.
+func (c *Collector) collectSelfLimits(ch chan<- prometheus.Metric) {
+	if rate := c.ParseRateLimit(); rate > 0 {
+		ch <- prometheus.MustNewConstMetric(parseRateLimitDesc, prometheus.GaugeValue, rate)
+	}
+	if limit := c.memory.Limit(); limit > 0 {
+		exceeded := 0.0
+		if c.memory.Exceeded() {
+			exceeded = 1
+		}
+		ch <- prometheus.MustNewConstMetric(memorySoftLimitDesc, prometheus.GaugeValue, float64(limit))
+		ch <- prometheus.MustNewConstMetric(memoryLimitExceededDesc, prometheus.GaugeValue, exceeded)
+	}
+	if maxSeries := c.MaxSeries(); maxSeries > 0 {
+		ch <- prometheus.MustNewConstMetric(seriesLimitDesc, prometheus.GaugeValue, float64(maxSeries))
+	}
+	ch <- prometheus.MustNewConstMetric(udpMaxPendingDesc, prometheus.GaugeValue, float64(cap(c.udpPending)))
+}
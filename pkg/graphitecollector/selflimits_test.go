@@ -0,0 +1,223 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	c := NewCollector(Options{Logger: log.NewNopLogger(), ParseRateLimit: 200})
+	c.Run(context.Background())
+	defer c.Stop()
+
+	var lines strings.Builder
+	for i := 0; i < 250; i++ {
+		fmt.Fprintf(&lines, "app.metric%d 1 100\n", i)
+	}
+	throttled := testutil.ToFloat64(parseThrottledLines)
+	start := time.Now()
+	results, err := c.ingestBatch(context.Background(), strings.NewReader(lines.String()), LineSource{})
+	assert.NoError(t, err)
+	assert.Len(t, results, 250)
+	// The burst of 200 lines passes right away, the rest at 200 per second.
+	assert.True(t, time.Since(start) >= 200*time.Millisecond, "took %s", time.Since(start))
+	assert.True(t, testutil.ToFloat64(parseThrottledLines) > throttled)
+
+	// Waiting requests give up at their timeout.
+	c = NewCollector(Options{Logger: log.NewNopLogger(), ParseRateLimit: 1})
+	c.Run(context.Background())
+	defer c.Stop()
+	rec := httptest.NewRecorder()
+	IngestBatchHandler(c, 1024, 50*time.Millisecond).ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/ingest/batch", strings.NewReader("a.b 1 100\na.c 1 100\n")))
+	assert.Equal(t, 503, rec.Code)
+}
+
+func TestMemorySoftLimit(t *testing.T) {
+	c := NewCollector(Options{Logger: log.NewNopLogger(), MemorySoftLimit: 1000})
+	var heap uint64
+	c.memory.heap = &heapSampler{heapAlloc: func() uint64 { return atomic.LoadUint64(&heap) }, gc: func() {}}
+	c.Run(context.Background())
+	defer c.Stop()
+
+	for i := 0; i < 10; i++ {
+		c.processLine(fmt.Sprintf("app.metric%d 1 %d", i, 100+i), LineSource{})
+	}
+	c.removeCh <- ""
+	assert.Equal(t, 10, c.SampleCount())
+	assert.False(t, c.memory.Exceeded())
+
+	evicted := testutil.ToFloat64(memoryLimitEvictions)
+	atomic.StoreUint64(&heap, 2000)
+	assert.Eventually(t, func() bool {
+		return c.memory.Exceeded() && c.SampleCount() == 9
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, evicted+1, testutil.ToFloat64(memoryLimitEvictions))
+	c.mu.Lock()
+	assert.NotContains(t, c.samples, "app.metric0", "the oldest sample is removed first")
+	c.mu.Unlock()
+
+	// While the limit is exceeded, only stored series are updated.
+	rejected := testutil.ToFloat64(invalidSamples.WithLabelValues("memory_limit"))
+	c.processLine("app.new 1 200", LineSource{})
+	c.processLine("app.metric5 2 200", LineSource{})
+	c.removeCh <- ""
+	assert.Equal(t, rejected+1, testutil.ToFloat64(invalidSamples.WithLabelValues("memory_limit")))
+	c.mu.Lock()
+	assert.NotContains(t, c.samples, "app.new")
+	assert.Equal(t, 2.0, c.samples["app.metric5"].Value)
+	c.mu.Unlock()
+
+	atomic.StoreUint64(&heap, 500)
+	assert.Eventually(t, func() bool { return !c.memory.Exceeded() }, 5*time.Second, time.Millisecond)
+	c.processLine("app.new 1 200", LineSource{})
+	c.removeCh <- ""
+	c.mu.Lock()
+	assert.Contains(t, c.samples, "app.new")
+	c.mu.Unlock()
+}
+
+func TestMaxSeries(t *testing.T) {
+	c := NewCollector(Options{Logger: log.NewNopLogger(), MaxSeries: 2})
+	c.Run(context.Background())
+	defer c.Stop()
+
+	rejected := testutil.ToFloat64(invalidSamples.WithLabelValues("series_limit"))
+	for _, line := range []string{"app.a 1 100", "app.b 1 100", "app.c 1 100", "app.a 2 110"} {
+		c.processLine(line, LineSource{})
+	}
+	c.removeCh <- ""
+	assert.Equal(t, rejected+1, testutil.ToFloat64(invalidSamples.WithLabelValues("series_limit")))
+	c.mu.Lock()
+	assert.NotContains(t, c.samples, "app.c")
+	assert.Equal(t, 2.0, c.samples["app.a"].Value, "stored series are still updated")
+	c.mu.Unlock()
+
+	// Raising the limit at runtime admits further series.
+	c.SetMaxSeries(3)
+	c.processLine("app.c 1 120", LineSource{})
+	c.removeCh <- ""
+	assert.Equal(t, 3, c.SampleCount())
+}
+
+func TestHeapSamplerBackoff(t *testing.T) {
+	heap, gcs := uint64(2000), 0
+	s := &heapSampler{heapAlloc: func() uint64 { return heap }, gc: func() { gcs++ }}
+	now := time.Unix(1000, 0)
+	measure := func(at time.Duration) (uint64, bool) {
+		return s.measure(now.Add(at), 1000)
+	}
+
+	live, measured := measure(0)
+	assert.Equal(t, uint64(2000), live)
+	assert.True(t, measured)
+	assert.Equal(t, 1, gcs)
+
+	// Guards checking within the backoff, such as those of other tenants,
+	// get the last measurement without forcing another collection.
+	heap = 2500
+	live, measured = measure(500 * time.Millisecond)
+	assert.Equal(t, uint64(2000), live)
+	assert.False(t, measured)
+	assert.Equal(t, 1, gcs)
+
+	// The backoff doubles while the heap stays above the limit.
+	_, measured = measure(time.Second)
+	assert.True(t, measured)
+	_, measured = measure(2 * time.Second)
+	assert.False(t, measured)
+	_, measured = measure(3 * time.Second)
+	assert.True(t, measured)
+	assert.Equal(t, 3, gcs)
+
+	// A heap under the limit needs no collection and resets the backoff.
+	heap = 800
+	live, measured = measure(4 * time.Second)
+	assert.Equal(t, uint64(800), live)
+	assert.True(t, measured)
+	heap = 2000
+	_, measured = measure(5 * time.Second)
+	assert.True(t, measured)
+	assert.Equal(t, 4, gcs)
+}
+
+func TestMemorySoftLimitSheddingGrownPipelines(t *testing.T) {
+	var heap uint64 = 500
+	sampler := &heapSampler{heapAlloc: func() uint64 { return atomic.LoadUint64(&heap) }, gc: func() {}}
+	flood := NewCollector(Options{Logger: log.NewNopLogger(), MemorySoftLimit: 1000})
+	quiet := NewCollector(Options{Logger: log.NewNopLogger(), MemorySoftLimit: 1000})
+	for _, c := range []*Collector{flood, quiet} {
+		c.memory.heap = sampler
+		c.Run(context.Background())
+		defer c.Stop()
+		for i := 0; i < 5; i++ {
+			c.processLine(fmt.Sprintf("app.metric%d 1 %d", i, 100+i), LineSource{})
+		}
+		c.removeCh <- ""
+	}
+	baselines := func() (int, int) {
+		sampler.mu.Lock()
+		defer sampler.mu.Unlock()
+		return flood.memory.baseline, quiet.memory.baseline
+	}
+	assert.Eventually(t, func() bool {
+		f, q := baselines()
+		return f == 5 && q == 5
+	}, 5*time.Second, time.Millisecond)
+
+	// One pipeline floods the process. Only its samples are removed, and
+	// only its new series are rejected.
+	for i := 0; i < 20; i++ {
+		flood.processLine(fmt.Sprintf("app.flood%d 1 %d", i, 200+i), LineSource{})
+	}
+	flood.removeCh <- ""
+	atomic.StoreUint64(&heap, 2000)
+	assert.Eventually(t, func() bool {
+		return flood.memory.Exceeded() && flood.SampleCount() < 25
+	}, 5*time.Second, time.Millisecond)
+	assert.False(t, quiet.memory.Exceeded())
+	assert.Equal(t, 5, quiet.SampleCount())
+
+	rejected := testutil.ToFloat64(invalidSamples.WithLabelValues("memory_limit"))
+	flood.processLine("app.new 1 300", LineSource{})
+	quiet.processLine("app.new 1 300", LineSource{})
+	flood.removeCh <- ""
+	quiet.removeCh <- ""
+	assert.Equal(t, rejected+1, testutil.ToFloat64(invalidSamples.WithLabelValues("memory_limit")))
+	assert.Equal(t, 6, quiet.SampleCount())
+
+	// The flooding pipeline sheds no further than the number of series it
+	// stored before the flood.
+	evictions := testutil.ToFloat64(memoryLimitEvictions)
+	evictOldest := func(c *Collector) {
+		atomic.StoreInt64(&c.memory.shed, 3)
+		c.evictCh <- struct{}{}
+		c.removeCh <- ""
+	}
+	for flood.SampleCount() > 5 {
+		evictOldest(flood)
+	}
+	assert.Equal(t, 5, flood.SampleCount())
+	assert.True(t, testutil.ToFloat64(memoryLimitEvictions) > evictions)
+}
@@ -0,0 +1,147 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+func init() {
+	RegisterFeature("selftest")
+}
+
+// selftestPrefix starts the metric paths injected by the self-test. Samples
+// with these paths are stored like any other, but are not exported and do not
+// count as processed samples.
+const selftestPrefix = "graphite_exporter_selftest."
+
+// selftestTimeout bounds how long a self-test waits for its sample.
+const selftestTimeout = 5 * time.Second
+
+func isSelftest(originalName string) bool {
+	return strings.HasPrefix(originalName, selftestPrefix)
+}
+
+// selftestResult reports a self-test. The durations are measured from the
+// start of the test.
+type selftestResult struct {
+	Passed  bool    `json:"passed"`
+	Error   string  `json:"error,omitempty"`
+	Path    string  `json:"path"`
+	Queued  float64 `json:"queued_seconds"`
+	Stored  float64 `json:"stored_seconds"`
+	Removed float64 `json:"removed_seconds"`
+}
+
+// selftest sends a synthetic line through the ingestion pipeline, waits for
+// the resulting sample to be stored, verifies it and removes it again.
+func (c *Collector) selftest(ctx context.Context) selftestResult {
+	start := time.Now()
+	value := float64(start.UnixNano() % 1e6)
+	result := selftestResult{Path: fmt.Sprintf("%s%d", selftestPrefix, start.UnixNano())}
+	since := func() float64 { return time.Since(start).Seconds() }
+	fail := func(format string, args ...interface{}) selftestResult {
+		result.Error = fmt.Sprintf(format, args...)
+		return result
+	}
+
+	// The line is mapped with the same mapper as the expected sample, even
+	// if the mapping configuration is reloaded meanwhile.
+	mapper := c.currentMapper()
+	want, ok := MapMetric(mapper.m, result.Path, c.settings)
+	if !ok {
+		return fail("path %s is dropped by the mapping configuration", result.Path)
+	}
+
+	select {
+	case c.lineCh <- graphiteLine{
+		text:   fmt.Sprintf("%s %g %d", result.Path, value, start.Unix()),
+		source: LineSource{Protocol: "selftest"},
+		mapper: mapper,
+	}:
+		result.Queued = since()
+	case <-ctx.Done():
+		return fail("queueing line: %v", ctx.Err())
+	case <-c.done:
+		return fail("the collector is stopped")
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	var got *Sample
+	for got == nil {
+		select {
+		case <-ticker.C:
+			c.mu.Lock()
+			got = c.samples[result.Path]
+			c.mu.Unlock()
+		case <-ctx.Done():
+			return fail("waiting for sample: %v", ctx.Err())
+		}
+	}
+	result.Stored = since()
+
+	select {
+	case c.removeCh <- result.Path:
+		result.Removed = since()
+	case <-ctx.Done():
+		return fail("removing sample: %v", ctx.Err())
+	}
+
+	switch {
+	case got.Name != want.Name:
+		return fail("stored name %q, expected %q", got.Name, want.Name)
+	case !labelsEqual(got.Labels, want.Labels) && len(got.Labels)+len(want.Labels) > 0:
+		return fail("stored labels %v, expected %v", got.Labels, want.Labels)
+	case got.Value != value*want.Scale:
+		return fail("stored value %g, expected %g", got.Value, value*want.Scale)
+	case got.Timestamp.Unix() != start.Unix():
+		return fail("stored timestamp %d, expected %d", got.Timestamp.Unix(), start.Unix())
+	}
+	result.Passed = true
+	return result
+}
+
+// SelftestHandler runs a self-test and responds with its result. A failed
+// test is answered with HTTP 500.
+func SelftestHandler(c *Collector, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "This endpoint requires a POST or PUT request.\n")
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), selftestTimeout)
+		defer cancel()
+		result := c.selftest(ctx)
+
+		resp := map[string]interface{}{"status": "success", "data": result}
+		w.Header().Set("Content-Type", "application/json")
+		if !result.Passed {
+			level.Error(logger).Log("msg", "Self-test failed", "err", result.Error)
+			resp["status"] = "error"
+			resp["error"] = result.Error
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelftest(t *testing.T) {
+
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.SetMapper(&Mapper{})
+	c.Run(context.Background())
+	defer c.Stop()
+
+	rec := httptest.NewRecorder()
+	SelftestHandler(c, log.NewNopLogger())(rec, httptest.NewRequest("POST", "/debug/selftest", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var resp struct {
+		Status string         `json:"status"`
+		Data   selftestResult `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "success", resp.Status)
+	assert.True(t, resp.Data.Passed)
+	assert.True(t, resp.Data.Stored >= resp.Data.Queued)
+	assert.Eventually(t, func() bool { return c.SampleCount() == 0 }, time.Second, 10*time.Millisecond)
+	assert.True(t, c.LastProcessedTime().IsZero(), "self-test samples do not count as processed")
+
+	// Self-test samples are never exported, even while they are stored.
+	c.mu.Lock()
+	c.samples[selftestPrefix+"1"] = &Sample{
+		OriginalName: selftestPrefix + "1",
+		Name:         "graphite_exporter_selftest_1",
+		Value:        1,
+		Type:         prometheus.GaugeValue,
+		Timestamp:    time.Now(),
+	}
+	c.mu.Unlock()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	count, err := testutil.GatherAndCount(reg, "graphite_exporter_selftest_1")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	c.settings.StrictMatch = true
+	rec = httptest.NewRecorder()
+	SelftestHandler(c, log.NewNopLogger())(rec, httptest.NewRequest("POST", "/debug/selftest", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Contains(t, rec.Body.String(), "is dropped by the mapping configuration")
+
+	rec = httptest.NewRecorder()
+	SelftestHandler(c, log.NewNopLogger())(rec, httptest.NewRequest("GET", "/debug/selftest", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
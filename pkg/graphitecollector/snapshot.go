@@ -0,0 +1,186 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	RegisterFeature("snapshot")
+}
+
+// writeSnapshot writes every stored sample to w as OpenMetrics text, with
+// the timestamp of the sample. Only references to the samples are copied, so
+// that the store is locked for as short as possible and the text is streamed
+// to w.
+func (c *Collector) writeSnapshot(w io.Writer) error {
+	samples := c.snapshot()
+
+	// Samples of one metric family must be contiguous.
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].Name != samples[j].Name {
+			return samples[i].Name < samples[j].Name
+		}
+		return samples[i].OriginalName < samples[j].OriginalName
+	})
+
+	bw := bufio.NewWriter(w)
+	for start := 0; start < len(samples); {
+		end := start + 1
+		for end < len(samples) && samples[end].Name == samples[start].Name {
+			end++
+		}
+		family := samples[start:end]
+		name := family[0].Name
+		typ := openMetricsType(family[0])
+		for _, s := range family[1:] {
+			if openMetricsType(s) != typ {
+				typ = "unknown"
+			}
+		}
+		familyName := name
+		if typ == "counter" {
+			familyName = strings.TrimSuffix(name, "_total")
+		}
+
+		fmt.Fprintf(bw, "# TYPE %s %s\n", familyName, typ)
+		fmt.Fprintf(bw, "# HELP %s %s\n", familyName, escapeOpenMetrics(family[0].HelpText(), false))
+		for _, s := range family {
+			bw.WriteString(name)
+			writeOpenMetricsLabels(bw, s.Labels)
+			fmt.Fprintf(bw, " %s %s\n", formatOpenMetricsFloat(s.Value), strconv.FormatFloat(float64(s.Timestamp.UnixNano())/1e9, 'f', -1, 64))
+		}
+		start = end
+	}
+	bw.WriteString("# EOF\n")
+	return bw.Flush()
+}
+
+// openMetricsType returns the OpenMetrics type of a sample. OpenMetrics
+// requires counter samples to end in _total, so counters named otherwise
+// are written as unknown.
+func openMetricsType(s *Sample) string {
+	switch {
+	case s.Type == prometheus.GaugeValue:
+		return "gauge"
+	case s.Type == prometheus.CounterValue && strings.HasSuffix(s.Name, "_total"):
+		return "counter"
+	default:
+		return "unknown"
+	}
+}
+
+func writeOpenMetricsLabels(w *bufio.Writer, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		fmt.Fprintf(w, `%s="%s"`, name, escapeOpenMetrics(labels[name], true))
+	}
+	w.WriteByte('}')
+}
+
+func escapeOpenMetrics(s string, quotes bool) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	if quotes {
+		s = strings.Replace(s, `"`, `\"`, -1)
+	}
+	return s
+}
+
+func formatOpenMetricsFloat(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// SnapshotHandler writes a snapshot of the sample store to a new file in dir
+// and responds with the name of the file.
+func SnapshotHandler(c *Collector, dir string, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			fmt.Fprintf(w, "This endpoint requires a POST or PUT request.\n")
+			return
+		}
+		name, err := c.snapshotToDir(dir)
+		if err != nil {
+			level.Error(logger).Log("msg", "Error writing snapshot", "err", err)
+			http.Error(w, fmt.Sprintf("failed to write snapshot: %s", err), http.StatusInternalServerError)
+			return
+		}
+		level.Info(logger).Log("msg", "Wrote snapshot", "file", filepath.Join(dir, name))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   map[string]string{"name": name},
+		})
+	}
+}
+
+func (c *Collector) snapshotToDir(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("snapshot-%s.om", time.Now().UTC().Format("20060102T150405.000000000Z"))
+	tmp := filepath.Join(dir, name+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return "", err
+	}
+	if err := c.writeSnapshot(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return name, os.Rename(tmp, filepath.Join(dir, name))
+}
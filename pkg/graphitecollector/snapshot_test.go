@@ -0,0 +1,84 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.Run(context.Background())
+	defer c.Stop()
+	c.samples["my.requests.a"] = &Sample{
+		OriginalName: "my.requests.a",
+		Name:         "requests_total",
+		Labels:       map[string]string{"path": `a"b`},
+		Help:         "Graphite metric requests_total",
+		Value:        3,
+		Type:         prometheus.CounterValue,
+		Timestamp:    time.Unix(1534620625, 500000000),
+	}
+	c.samples["my.temperature"] = &Sample{
+		OriginalName: "my.temperature",
+		Name:         "temperature",
+		Help:         "Graphite metric temperature",
+		Value:        -1.5,
+		Type:         prometheus.GaugeValue,
+		Timestamp:    time.Unix(1534620625, 0),
+	}
+
+	dir, err := ioutil.TempDir("", "graphite_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec := httptest.NewRecorder()
+	SnapshotHandler(c, dir, log.NewNopLogger())(rec, httptest.NewRequest("POST", "/debug/snapshot", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var resp struct {
+		Data struct {
+			Name string `json:"name"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+
+	snapshot, err := ioutil.ReadFile(filepath.Join(dir, resp.Data.Name))
+	assert.NoError(t, err)
+	assert.Equal(t, `# TYPE requests counter
+# HELP requests Graphite metric requests_total
+requests_total{path="a\"b"} 3 1534620625.5
+# TYPE temperature gauge
+# HELP temperature Graphite metric temperature
+temperature -1.5 1534620625
+# EOF
+`, string(snapshot))
+
+	rec = httptest.NewRecorder()
+	SnapshotHandler(c, dir, log.NewNopLogger())(rec, httptest.NewRequest("GET", "/debug/snapshot", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
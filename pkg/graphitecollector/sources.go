@@ -0,0 +1,96 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	RegisterFeature("source_tracking")
+}
+
+var topSourceLinesDesc = prometheus.NewDesc(
+	"graphite_top_source_lines",
+	"Estimated number of lines received from each of the sources sending the most lines.",
+	[]string{"source"}, nil,
+)
+
+// sourceCount is the estimated number of lines received from a source. The
+// true count lies between Lines-Error and Lines.
+type sourceCount struct {
+	Source string `json:"source"`
+	Lines  uint64 `json:"lines"`
+	Error  uint64 `json:"error"`
+}
+
+// sourceTracker counts lines per source IP. Sources sending more than
+// 1/capacity of all lines are guaranteed to be tracked, however many
+// distinct sources there are.
+type sourceTracker struct {
+	counts *topKeys
+	// export is the number of top sources exported as metrics.
+	export int
+}
+
+func newSourceTracker(capacity, export int) *sourceTracker {
+	return &sourceTracker{counts: newTopKeys(capacity), export: export}
+}
+
+// add counts a line received from address, which may include a port.
+func (t *sourceTracker) add(address string) {
+	source := address
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		source = host
+	}
+	t.counts.add(source, "")
+}
+
+// top returns the n sources with the most lines, most first. A negative n
+// returns all tracked sources.
+func (t *sourceTracker) top(n int) (uint64, []sourceCount) {
+	total, keys := t.counts.top(n)
+	counts := make([]sourceCount, 0, len(keys))
+	for _, k := range keys {
+		counts = append(counts, sourceCount{Source: k.Key, Lines: k.Count, Error: k.Error})
+	}
+	return total, counts
+}
+
+func (t *sourceTracker) collect(ch chan<- prometheus.Metric) {
+	_, counts := t.top(t.export)
+	for _, c := range counts {
+		ch <- prometheus.MustNewConstMetric(topSourceLinesDesc, prometheus.GaugeValue, float64(c.Lines), c.Source)
+	}
+}
+
+// SourcesHandler responds with all sources tracked by c and their line
+// counts. It must only be used if c was created with Options.TrackSources.
+func SourcesHandler(c *Collector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		total, counts := c.sources.top(-1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data": map[string]interface{}{
+				"total_lines": total,
+				"sources":     counts,
+			},
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSourceTracker(t *testing.T) {
+	tracker := newSourceTracker(10, 2)
+	for i := 0; i < 50; i++ {
+		tracker.add("192.0.2.1:1234")
+		if i%2 == 0 {
+			tracker.add("192.0.2.2:5678")
+		}
+		// Many sources sending a single line each must not push out the
+		// sources sending more than a tenth of all lines.
+		tracker.add(fmt.Sprintf("198.51.100.%d:2003", i))
+	}
+
+	total, top := tracker.top(2)
+	assert.Equal(t, uint64(125), total)
+	assert.Equal(t, "192.0.2.1", top[0].Source)
+	assert.True(t, top[0].Lines-top[0].Error <= 50 && top[0].Lines >= 50)
+	assert.Equal(t, "192.0.2.2", top[1].Source)
+	assert.True(t, top[1].Lines-top[1].Error <= 25 && top[1].Lines >= 25)
+
+	c := NewCollector(Options{Logger: log.NewNopLogger()})
+	c.sources = tracker
+	c.Run(context.Background())
+	defer c.Stop()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	count, err := testutil.GatherAndCount(reg, "graphite_top_source_lines")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	rec := httptest.NewRecorder()
+	SourcesHandler(c)(rec, httptest.NewRequest("GET", "/debug/sources", nil))
+	var resp struct {
+		Data struct {
+			TotalLines uint64        `json:"total_lines"`
+			Sources    []sourceCount `json:"sources"`
+		} `json:"data"`
+	}
+	assert.NoError(t, json.NewDecoder(strings.NewReader(rec.Body.String())).Decode(&resp))
+	assert.Equal(t, uint64(125), resp.Data.TotalLines)
+	assert.Len(t, resp.Data.Sources, 10)
+}
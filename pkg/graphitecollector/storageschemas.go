@@ -0,0 +1,196 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterFeature("storage_schemas")
+}
+
+// StorageSchemas derives the expiry of samples from the retention rules of a
+// carbon storage-schemas.conf file: a sample expires after a multiple of the
+// resolution at which carbon would store its path, i.e. after missing that
+// many of its sender's updates.
+type StorageSchemas struct {
+	schemas []storageSchema
+	factor  float64
+}
+
+// storageSchema is a section of the file. Only the resolution of the first,
+// most precise, retention is used.
+type storageSchema struct {
+	name       string
+	pattern    *regexp.Regexp
+	resolution time.Duration
+}
+
+// LoadStorageSchemas reads the storage schemas file at path. The expiry of a
+// path is factor times the resolution of the first schema whose pattern
+// matches it.
+func LoadStorageSchemas(path string, factor float64) (*StorageSchemas, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseStorageSchemas(f, factor)
+}
+
+// ParseStorageSchemas parses storage schemas in the carbon configuration
+// format, see LoadStorageSchemas.
+func ParseStorageSchemas(r io.Reader, factor float64) (*StorageSchemas, error) {
+	if factor <= 0 {
+		return nil, fmt.Errorf("storage schema expiry factor must be positive")
+	}
+	s := &StorageSchemas{factor: factor}
+	var (
+		section                string
+		pattern, retentions    string
+		hasPattern, hasSection bool
+	)
+	finish := func() error {
+		if !hasSection {
+			return nil
+		}
+		if !hasPattern {
+			return fmt.Errorf("storage schema %q sets no pattern", section)
+		}
+		schema, err := newStorageSchema(section, pattern, retentions)
+		if err != nil {
+			return err
+		}
+		s.schemas = append(s.schemas, schema)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			if err := finish(); err != nil {
+				return nil, err
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			pattern, retentions = "", ""
+			hasPattern, hasSection = false, true
+			continue
+		}
+		i := strings.IndexAny(line, "=:")
+		if i < 0 || !hasSection {
+			return nil, fmt.Errorf("line %d of storage schemas: expected a section or key = value, got %q", n, line)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		switch key {
+		case "pattern":
+			pattern, hasPattern = value, true
+		case "retentions":
+			retentions = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func newStorageSchema(name, pattern, retentions string) (storageSchema, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return storageSchema{}, fmt.Errorf("storage schema %q: %v", name, err)
+	}
+	first := strings.TrimSpace(strings.SplitN(retentions, ",", 2)[0])
+	if first == "" {
+		return storageSchema{}, fmt.Errorf("storage schema %q sets no retentions", name)
+	}
+	precision := strings.SplitN(first, ":", 2)[0]
+	resolution, err := parseRetentionDuration(precision)
+	if err != nil {
+		return storageSchema{}, fmt.Errorf("storage schema %q: invalid retention %q: %v", name, first, err)
+	}
+	return storageSchema{name: name, pattern: re, resolution: resolution}, nil
+}
+
+var retentionDuration = regexp.MustCompile(`^(\d+)([a-z]*)$`)
+
+// retentionUnits are the units of carbon retentions. A bare number of a
+// precision is in seconds.
+var retentionUnits = map[string]time.Duration{
+	"":        time.Second,
+	"s":       time.Second,
+	"sec":     time.Second,
+	"second":  time.Second,
+	"seconds": time.Second,
+	"m":       time.Minute,
+	"min":     time.Minute,
+	"minute":  time.Minute,
+	"minutes": time.Minute,
+	"h":       time.Hour,
+	"hour":    time.Hour,
+	"hours":   time.Hour,
+	"d":       24 * time.Hour,
+	"day":     24 * time.Hour,
+	"days":    24 * time.Hour,
+	"w":       7 * 24 * time.Hour,
+	"week":    7 * 24 * time.Hour,
+	"weeks":   7 * 24 * time.Hour,
+	"y":       365 * 24 * time.Hour,
+	"year":    365 * 24 * time.Hour,
+	"years":   365 * 24 * time.Hour,
+}
+
+func parseRetentionDuration(s string) (time.Duration, error) {
+	m := retentionDuration.FindStringSubmatch(strings.ToLower(s))
+	if m == nil {
+		return 0, fmt.Errorf("not a number with an optional unit")
+	}
+	unit, ok := retentionUnits[m[2]]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q", m[2])
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("resolution must not be zero")
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// Expiry returns the expiry of samples of the graphite path, or zero if no
+// schema matches it.
+func (s *StorageSchemas) Expiry(path string) time.Duration {
+	for _, schema := range s.schemas {
+		if schema.pattern.MatchString(path) {
+			return time.Duration(float64(schema.resolution) * s.factor)
+		}
+	}
+	return 0
+}
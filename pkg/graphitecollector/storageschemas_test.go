@@ -0,0 +1,98 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+const testStorageSchemas = `
+# Schema definitions for Whisper files.
+[carbon]
+pattern = ^carbon\.
+retentions = 60:90d
+
+[collectd]
+pattern = ^collectd\.
+retentions = 10s:1d,1min:30d
+
+[hourly]
+pattern = \.hourly\.
+retentions = 1h:5y
+
+[default]
+pattern = .*
+retentions = 30s:7d
+`
+
+func TestParseStorageSchemas(t *testing.T) {
+	s, err := ParseStorageSchemas(strings.NewReader(testStorageSchemas), 2)
+	assert.NoError(t, err)
+	for path, want := range map[string]time.Duration{
+		"carbon.agents.a.cpuUsage": 2 * time.Minute,
+		"collectd.web1.load":       20 * time.Second,
+		"app.hourly.jobs":          2 * time.Hour,
+		"app.requests":             time.Minute,
+	} {
+		assert.Equal(t, want, s.Expiry(path), "expiry of %s", path)
+	}
+
+	s, err = ParseStorageSchemas(strings.NewReader("[carbon]\npattern = ^carbon\\.\nretentions = 60:90d\n"), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), s.Expiry("app.requests"), "no schema matches")
+
+	for _, config := range []string{
+		"[a]\nretentions = 60:90d\n",
+		"[a]\npattern = (\nretentions = 60:90d\n",
+		"[a]\npattern = .*\n",
+		"[a]\npattern = .*\nretentions = 1fortnight:90d\n",
+		"[a]\npattern = .*\nretentions = 0:90d\n",
+		"pattern = .*\n",
+	} {
+		_, err := ParseStorageSchemas(strings.NewReader(config), 1)
+		assert.Error(t, err, "config %q", config)
+	}
+	_, err = ParseStorageSchemas(strings.NewReader(testStorageSchemas), 0)
+	assert.Error(t, err)
+}
+
+func TestStorageSchemaExpiry(t *testing.T) {
+	schemas, err := ParseStorageSchemas(strings.NewReader("[collectd]\npattern = ^collectd\\.\nretentions = 10s:1d\n"), 3)
+	assert.NoError(t, err)
+	c := NewCollector(Options{
+		Logger:       log.NewNopLogger(),
+		MapSettings:  MapSettings{StorageSchemas: schemas},
+		SampleExpiry: time.Hour,
+	})
+	c.Run(context.Background())
+	defer c.Stop()
+
+	ts := time.Now().Add(-time.Minute).Unix()
+	c.processLine(fmt.Sprintf("collectd.web1.load 1 %d", ts), LineSource{})
+	c.processLine(fmt.Sprintf("app.requests 2 %d", ts), LineSource{})
+	c.removeCh <- ""
+
+	var names []string
+	for _, s := range c.CurrentSamples(time.Now()) {
+		names = append(names, s.OriginalName)
+	}
+	assert.Equal(t, []string{"app.requests"}, names, "collectd samples expire after 30s")
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The subsystems whose errors are tracked.
+const (
+	SubsystemTCPListener = "tcp-listener"
+	SubsystemUDPListener = "udp-listener"
+	SubsystemMapper      = "mapper"
+	SubsystemHTTP        = "http"
+)
+
+var (
+	subsystems = []string{SubsystemTCPListener, SubsystemUDPListener, SubsystemMapper, SubsystemHTTP}
+
+	subsystemLastErrorDesc = prometheus.NewDesc(
+		"graphite_subsystem_last_error_timestamp_seconds",
+		"Unix timestamp of the last error of each subsystem that it has not recovered from, or 0.",
+		[]string{"subsystem"}, nil,
+	)
+
+	errorTracker = &subsystemErrors{errors: map[string]SubsystemError{}}
+)
+
+// SubsystemError is the most recent error of a subsystem.
+type SubsystemError struct {
+	Subsystem string    `json:"subsystem"`
+	Message   string    `json:"message"`
+	Time      time.Time `json:"time"`
+	// Source is what in the subsystem failed, e.g. an HTTP handler. Only a
+	// recovery of the same source clears the error.
+	Source string `json:"source,omitempty"`
+}
+
+// subsystemErrors holds the most recent unrecovered error of each subsystem.
+// Like the exporter's metrics, it is shared by all collectors of a process.
+type subsystemErrors struct {
+	mu     sync.Mutex
+	errors map[string]SubsystemError
+}
+
+// RecordError records err as the most recent error of subsystem, raised by
+// source, which may be empty.
+func RecordError(subsystem, source string, err error) {
+	errorTracker.mu.Lock()
+	defer errorTracker.mu.Unlock()
+	errorTracker.errors[subsystem] = SubsystemError{
+		Subsystem: subsystem,
+		Message:   err.Error(),
+		Time:      time.Now(),
+		Source:    source,
+	}
+}
+
+// ClearError marks subsystem as recovered, if its most recent error was
+// raised by source.
+func ClearError(subsystem, source string) {
+	errorTracker.mu.Lock()
+	defer errorTracker.mu.Unlock()
+	if e, ok := errorTracker.errors[subsystem]; ok && e.Source == source {
+		delete(errorTracker.errors, subsystem)
+	}
+}
+
+// SubsystemErrors returns the unrecovered errors, ordered by subsystem.
+func SubsystemErrors() []SubsystemError {
+	errorTracker.mu.Lock()
+	defer errorTracker.mu.Unlock()
+	errs := make([]SubsystemError, 0, len(errorTracker.errors))
+	for _, e := range errorTracker.errors {
+		errs = append(errs, e)
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Subsystem < errs[j].Subsystem })
+	return errs
+}
+
+func collectSubsystemErrors(ch chan<- prometheus.Metric) {
+	errorTracker.mu.Lock()
+	defer errorTracker.mu.Unlock()
+	for _, s := range subsystems {
+		var ts float64
+		if e, ok := errorTracker.errors[s]; ok {
+			ts = float64(e.Time.UnixNano()) / 1e9
+		}
+		ch <- prometheus.MustNewConstMetric(subsystemLastErrorDesc, prometheus.GaugeValue, ts, s)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// lastErrorTimestamps returns the value of the last error gauge of each
+// subsystem.
+func lastErrorTimestamps(t *testing.T) map[string]float64 {
+	ch := make(chan prometheus.Metric, len(subsystems))
+	collectSubsystemErrors(ch)
+	close(ch)
+	values := map[string]float64{}
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		values[pb.GetLabel()[0].GetValue()] = pb.GetGauge().GetValue()
+	}
+	return values
+}
+
+// httpErrors returns the unrecovered errors of the HTTP subsystem.
+func httpErrors() []SubsystemError {
+	var errs []SubsystemError
+	for _, e := range SubsystemErrors() {
+		if e.Subsystem == SubsystemHTTP {
+			errs = append(errs, e)
+		}
+	}
+	return errs
+}
+
+func TestSubsystemErrors(t *testing.T) {
+	RecordError(SubsystemHTTP, "/a", errors.New("first"))
+	RecordError(SubsystemHTTP, "/b", errors.New("second"))
+	errs := httpErrors()
+	if assert.Len(t, errs, 1) {
+		assert.Equal(t, "second", errs[0].Message, "only the most recent error is kept")
+	}
+	assert.NotZero(t, lastErrorTimestamps(t)[SubsystemHTTP])
+
+	ClearError(SubsystemHTTP, "/a")
+	assert.Len(t, httpErrors(), 1, "a recovery of another source does not clear the error")
+	ClearError(SubsystemHTTP, "/b")
+	assert.Empty(t, httpErrors())
+	assert.Zero(t, lastErrorTimestamps(t)[SubsystemHTTP])
+	assert.Len(t, lastErrorTimestamps(t), len(subsystems), "every subsystem is exported")
+}
+
+func TestMappingLoadErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graphite_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mapping.yml")
+
+	_, err = LoadMappingConfig(&Mapper{}, path, "", "test", log.NewNopLogger())
+	assert.Error(t, err)
+	assert.NotZero(t, lastErrorTimestamps(t)[SubsystemMapper])
+
+	if err := ioutil.WriteFile(path, []byte("mappings: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadMappingConfig(&Mapper{}, path, "", "test", log.NewNopLogger())
+	assert.NoError(t, err)
+	assert.Zero(t, lastErrorTimestamps(t)[SubsystemMapper], "a successful load clears the error")
+}
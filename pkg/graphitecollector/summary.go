@@ -0,0 +1,171 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// totals counts the outcome of the lines a collector processed over its
+// lifetime. Unlike the package's Prometheus counters, which are shared by
+// all collectors, they can be reported as a Summary, e.g. on shutdown.
+type totals struct {
+	// lines must be accessed atomically.
+	lines uint64
+
+	mu           sync.Mutex
+	invalidLines map[string]uint64
+	rejected     map[string]uint64
+	dropped      map[string]uint64
+	skipped      map[string]uint64
+	seriesPeak   int
+
+	// outcomes is the recent history of the totals.
+	outcomes outcomeHistory
+}
+
+func newTotals() *totals {
+	return &totals{
+		invalidLines: map[string]uint64{},
+		rejected:     map[string]uint64{},
+		dropped:      map[string]uint64{},
+		skipped:      map[string]uint64{},
+	}
+}
+
+func (t *totals) line() {
+	atomic.AddUint64(&t.lines, 1)
+}
+
+func (t *totals) count(counts map[string]uint64, reason string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts[reason]++
+}
+
+func (t *totals) outcome(o outcome) {
+	t.outcomes.add(time.Now(), o)
+}
+
+func (t *totals) series(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n > t.seriesPeak {
+		t.seriesPeak = n
+	}
+}
+
+// Summary is the totals of the lines a Collector processed since it was
+// created.
+type Summary struct {
+	Since          time.Time `json:"since"`
+	LinesProcessed uint64    `json:"lines_processed"`
+	// InvalidLines counts the lines that could not be parsed by reason.
+	InvalidLines map[string]uint64 `json:"invalid_lines"`
+	// RejectedSamples counts the samples that were not stored by reason,
+	// as graphite_invalid_samples_total.
+	RejectedSamples map[string]uint64 `json:"rejected_samples"`
+	// SkippedSamples counts the stored samples left out of scrapes by
+	// reason, as graphite_collect_skipped_samples_total.
+	SkippedSamples map[string]uint64 `json:"skipped_samples"`
+	// DroppedSamples counts the samples dropped by the mapping
+	// configuration by reason, including strict matching.
+	DroppedSamples   map[string]uint64 `json:"dropped_samples"`
+	StrictMatchDrops uint64            `json:"strict_match_drops"`
+	// SeriesPeak is the largest number of samples stored at once.
+	SeriesPeak int `json:"series_peak"`
+	// Collisions is the number of samples left out of scrapes because
+	// another path was mapped to the same series. Each sample is counted
+	// once, however many scrapes leave it out.
+	Collisions uint64 `json:"collisions"`
+}
+
+// Summary returns the totals of the lines c processed since it was created.
+func (c *Collector) Summary() Summary {
+	t := c.totals
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	copyCounts := func(counts map[string]uint64) map[string]uint64 {
+		copied := make(map[string]uint64, len(counts))
+		for k, v := range counts {
+			copied[k] = v
+		}
+		return copied
+	}
+	return Summary{
+		Since:            c.createdAt,
+		LinesProcessed:   atomic.LoadUint64(&t.lines),
+		InvalidLines:     copyCounts(t.invalidLines),
+		RejectedSamples:  copyCounts(t.rejected),
+		SkippedSamples:   copyCounts(t.skipped),
+		DroppedSamples:   copyCounts(t.dropped),
+		StrictMatchDrops: t.dropped[dropReasonStrictMatch],
+		SeriesPeak:       t.seriesPeak,
+		Collisions:       t.skipped["duplicate"],
+	}
+}
+
+// LogSummary logs the Summary of c as a single structured Info entry, with
+// a field for each reason, e.g. "invalid_lines.part_count".
+func (c *Collector) LogSummary(logger log.Logger) {
+	s := c.Summary()
+	keyvals := []interface{}{
+		"msg", "Summary of processed lines",
+		"since", s.Since,
+		"lines_processed", s.LinesProcessed,
+		"series_peak", s.SeriesPeak,
+		"collisions", s.Collisions,
+		"strict_match_drops", s.StrictMatchDrops,
+	}
+	for _, counts := range []struct {
+		key    string
+		counts map[string]uint64
+	}{
+		{"invalid_lines", s.InvalidLines},
+		{"rejected_samples", s.RejectedSamples},
+		{"skipped_samples", s.SkippedSamples},
+		{"dropped_samples", s.DroppedSamples},
+	} {
+		reasons := make([]string, 0, len(counts.counts))
+		for reason := range counts.counts {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			keyvals = append(keyvals, counts.key+"."+reason, counts.counts[reason])
+		}
+	}
+	level.Info(logger).Log(keyvals...)
+}
+
+// SummaryHandler logs the Summary of c, as on shutdown, and responds with
+// it.
+func SummaryHandler(c *Collector, logger log.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.LogSummary(logger)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   c.Summary(),
+		})
+	}
+}
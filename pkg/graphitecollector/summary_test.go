@@ -0,0 +1,110 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummary(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: app.*.requests
+  name: requests
+  labels:
+    app: $1
+- match: noisy.*
+  name: noisy
+  action: drop
+`))
+	c := NewCollector(Options{Logger: log.NewNopLogger(), Mapper: m})
+	c.Run(context.Background())
+	defer c.Stop()
+	for _, line := range []string{
+		"app.web.requests 1 1000",
+		"noisy.metric 1 1000",
+		"noisy.other 1 1000",
+		"broken",
+		"other.metric 1 1000",
+	} {
+		c.processLine(line, LineSource{})
+	}
+	c.removeCh <- ""
+
+	s := c.Summary()
+	assert.Equal(t, c.createdAt, s.Since)
+	assert.Equal(t, Summary{
+		Since:           s.Since,
+		LinesProcessed:  5,
+		InvalidLines:    map[string]uint64{"part_count": 1},
+		RejectedSamples: map[string]uint64{},
+		SkippedSamples:  map[string]uint64{},
+		DroppedSamples:  map[string]uint64{dropReasonMapping: 2},
+		SeriesPeak:      2,
+	}, s)
+
+	var buf bytes.Buffer
+	c.LogSummary(log.NewLogfmtLogger(&buf))
+	assert.Contains(t, buf.String(), `msg="Summary of processed lines"`)
+	assert.Contains(t, buf.String(), "lines_processed=5 series_peak=2 collisions=0 strict_match_drops=0 invalid_lines.part_count=1 dropped_samples.mapping_drop=2\n")
+
+	buf.Reset()
+	rec := httptest.NewRecorder()
+	SummaryHandler(c, log.NewLogfmtLogger(&buf))(rec, httptest.NewRequest("GET", "/debug/summary", nil))
+	var resp struct {
+		Status string
+		Data   Summary
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp), rec.Body.String())
+	assert.Equal(t, "success", resp.Status)
+	assert.Equal(t, uint64(5), resp.Data.LinesProcessed)
+	assert.Contains(t, buf.String(), "lines_processed=5")
+}
+
+func TestSummaryCollisions(t *testing.T) {
+	m := &Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: alpha.*.requests
+  name: requests
+- match: beta.*.requests
+  name: requests
+`))
+	c := NewCollector(Options{Logger: log.NewNopLogger(), Mapper: m, Clock: &manualClock{now: time.Unix(1001, 0)}})
+	c.Run(context.Background())
+	defer c.Stop()
+	c.processLine("alpha.x.requests 1 1000", LineSource{})
+	c.processLine("beta.x.requests 1 1001", LineSource{})
+	c.removeCh <- ""
+	exportedSamples(t, c)
+	exportedSamples(t, c)
+	// A new sample collides again.
+	c.processLine("alpha.x.requests 2 1001", LineSource{})
+	c.removeCh <- ""
+	exportedSamples(t, c)
+
+	s := c.Summary()
+	assert.Equal(t, uint64(2), s.Collisions)
+	assert.Equal(t, map[string]uint64{"duplicate": 2}, s.SkippedSamples)
+	assert.Empty(t, s.RejectedSamples)
+}
@@ -0,0 +1,58 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import "time"
+
+// expirySweepInterval is how often the stored samples are swept for expired
+// ones, before jitter.
+const expirySweepInterval = time.Minute
+
+// sweepTimer fires the expiry sweeps. It is a time.Timer, except in tests.
+type sweepTimer interface {
+	C() <-chan time.Time
+	// Reset must only be called once the timer fired and its channel was
+	// drained.
+	Reset(d time.Duration)
+	Stop()
+}
+
+type systemTimer struct {
+	t *time.Timer
+}
+
+func newSystemTimer(d time.Duration) sweepTimer {
+	return systemTimer{t: time.NewTimer(d)}
+}
+
+func (t systemTimer) C() <-chan time.Time   { return t.t.C }
+func (t systemTimer) Reset(d time.Duration) { t.t.Reset(d) }
+func (t systemTimer) Stop()                 { t.t.Stop() }
+
+// nextSweep returns how long to wait for the next expiry sweep. The first
+// sweep waits a random duration up to the initial jitter, if set, so that
+// exporters started together do not sweep in step. Later sweeps wait the
+// sweep interval moved randomly by up to the jitter fraction of it in either
+// direction, so that they do not fall back into step.
+func (c *Collector) nextSweep(first bool) time.Duration {
+	if first && c.sweepInitialJitter > 0 {
+		// random is in [0, 1), so the delay is never zero.
+		return time.Duration((1 - c.random()) * float64(c.sweepInitialJitter))
+	}
+	d := expirySweepInterval
+	if c.sweepJitter > 0 {
+		d += time.Duration((2*c.random() - 1) * c.sweepJitter * float64(d))
+	}
+	return d
+}
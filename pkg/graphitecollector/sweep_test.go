@@ -0,0 +1,102 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTimer is a sweepTimer that fires when the test sends on c, and reports
+// every delay it is set to on delays.
+type fakeTimer struct {
+	c      chan time.Time
+	delays chan time.Duration
+}
+
+func newFakeTimer() *fakeTimer {
+	return &fakeTimer{c: make(chan time.Time), delays: make(chan time.Duration, 1)}
+}
+
+func (t *fakeTimer) C() <-chan time.Time   { return t.c }
+func (t *fakeTimer) Reset(d time.Duration) { t.delays <- d }
+func (t *fakeTimer) Stop()                 {}
+
+func TestNextSweep(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		initialJitter time.Duration
+		jitter        float64
+		random        float64
+		first, next   time.Duration
+	}{
+		{name: "no jitter", random: 0.5, first: time.Minute, next: time.Minute},
+		{name: "initial jitter", initialJitter: 40 * time.Second, random: 0.75, first: 10 * time.Second, next: time.Minute},
+		{name: "initial jitter is never zero", initialJitter: 40 * time.Second, random: 0, first: 40 * time.Second, next: time.Minute},
+		{name: "jitter early", jitter: 0.1, random: 0, first: 54 * time.Second, next: 54 * time.Second},
+		{name: "jitter late", jitter: 0.1, random: 0.75, first: 63 * time.Second, next: 63 * time.Second},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := NewCollector(Options{
+				Logger:                   log.NewNopLogger(),
+				ExpirySweepInitialJitter: tc.initialJitter,
+				ExpirySweepJitter:        tc.jitter,
+			})
+			c.random = func() float64 { return tc.random }
+			assert.Equal(t, tc.first, c.nextSweep(true))
+			assert.Equal(t, tc.next, c.nextSweep(false))
+		})
+	}
+}
+
+func TestExpirySweepJitter(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	c := NewCollector(Options{
+		Logger:                   log.NewNopLogger(),
+		Clock:                    clock,
+		SampleExpiry:             time.Minute,
+		ExpirySweepInitialJitter: 30 * time.Second,
+		ExpirySweepJitter:        0.1,
+	})
+	randoms := []float64{0.5, 1, 0}
+	c.random = func() float64 {
+		r := randoms[0]
+		randoms = randoms[1:]
+		return r
+	}
+	timer := newFakeTimer()
+	c.newTimer = func(d time.Duration) sweepTimer {
+		timer.delays <- d
+		return timer
+	}
+	c.Run(context.Background())
+	defer c.Stop()
+	assert.Equal(t, 15*time.Second, <-timer.delays)
+
+	c.processLine("my.metric 1 1000", LineSource{})
+	c.removeCh <- ""
+	assert.Equal(t, 1, c.SampleCount())
+	clock.now = clock.now.Add(2 * time.Minute)
+
+	// Each sweep expires the samples and sets the timer for the next one.
+	timer.c <- clock.now
+	assert.Equal(t, 66*time.Second, <-timer.delays)
+	assert.Equal(t, 0, c.SampleCount())
+	timer.c <- clock.now
+	assert.Equal(t, 54*time.Second, <-timer.delays)
+}
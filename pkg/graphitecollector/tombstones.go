@@ -0,0 +1,137 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import "github.com/prometheus/client_golang/prometheus"
+
+func init() {
+	RegisterFeature("tombstones")
+}
+
+// tombstoneLabel marks the final sample of an expired series.
+const tombstoneLabel = "graphite_expired"
+
+var tombstonesEmitted = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "graphite_tombstones_emitted_total",
+		Help: "Total number of final samples emitted for expired series.",
+	},
+)
+
+// tombstones holds the expired samples whose series get one final sample
+// with a fixed value in the next Collect, so that rules on absent series
+// fire deterministically rather than when the series goes stale.
+type tombstones struct {
+	value float64
+	label bool
+	// pending holds the tombstones by original name. It is guarded by the
+	// collector's mu.
+	pending map[string]*tombstone
+}
+
+type tombstone struct {
+	sample  *Sample
+	emitted bool
+}
+
+func newTombstones(value float64, label bool) *tombstones {
+	return &tombstones{value: value, label: label, pending: map[string]*tombstone{}}
+}
+
+// expire records that sample, which was removed from the store by the
+// expiry sweep, needs a tombstone unless it already got one. It must be
+// called with the collector's mu held.
+func (t *tombstones) expire(sample *Sample) {
+	if ts, ok := t.pending[sample.OriginalName]; ok && ts.sample == sample {
+		if ts.emitted {
+			delete(t.pending, sample.OriginalName)
+		}
+		return
+	}
+	t.pending[sample.OriginalName] = &tombstone{sample: sample}
+}
+
+// takeTombstones records tombstones for the expired samples Collect found
+// that are still stored, and returns the samples whose tombstone was not
+// emitted yet, marking them emitted. Tombstones of samples that are no
+// longer stored are forgotten once emitted, while the others are kept until
+// the expiry sweep removes their sample, so that no further tombstone is
+// emitted in the meantime.
+func (c *Collector) takeTombstones(expired []*Sample) []*Sample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range expired {
+		if c.samples[s.OriginalName] != s {
+			continue
+		}
+		if ts, ok := c.tombstones.pending[s.OriginalName]; !ok || ts.sample != s {
+			c.tombstones.pending[s.OriginalName] = &tombstone{sample: s}
+		}
+	}
+	var samples []*Sample
+	for name, ts := range c.tombstones.pending {
+		if ts.emitted {
+			continue
+		}
+		samples = append(samples, ts.sample)
+		ts.emitted = true
+		if c.samples[name] != ts.sample {
+			delete(c.tombstones.pending, name)
+		}
+	}
+	return samples
+}
+
+// labels returns the labels of the tombstone of s.
+func (t *tombstones) labels(s *Sample) map[string]string {
+	if !t.label {
+		return s.Labels
+	}
+	labels := make(map[string]string, len(s.Labels)+1)
+	for k, v := range s.Labels {
+		labels[k] = v
+	}
+	labels[tombstoneLabel] = "true"
+	return labels
+}
+
+// collectTombstones emits the tombstones of the expired samples, except for
+// series that are still exported by another sample, or whose metric is
+// exported with a different type.
+func (c Collector) collectTombstones(ch chan<- prometheus.Metric, expired []*Sample, series seriesSet, types map[string]*Sample) {
+	identity := c.IdentityLabels()
+	for _, sample := range c.takeTombstones(expired) {
+		labels := identity.apply(c.tombstones.labels(sample))
+		if series.get(sample.Name, labels) != nil {
+			continue
+		}
+		if t, ok := types[sample.Name]; ok && t.Type != sample.Type {
+			continue
+		}
+		m, err := prometheus.NewConstMetric(
+			prometheus.NewDesc(sample.Name, sample.HelpText(), []string{}, labels),
+			sample.Type,
+			c.tombstones.value,
+		)
+		if err != nil {
+			continue
+		}
+		series.set(sample, labels)
+		if _, ok := types[sample.Name]; !ok {
+			types[sample.Name] = sample
+		}
+		ch <- m
+		tombstonesEmitted.Inc()
+	}
+}
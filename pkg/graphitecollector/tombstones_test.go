@@ -0,0 +1,133 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// exportedSeries returns the series of the ingested metrics that c exports,
+// with their values.
+func exportedSeries(t *testing.T, c *Collector) []string {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	assert.NoError(t, err)
+	var series []string
+	for _, f := range families {
+		if !strings.HasPrefix(f.GetHelp(), "Graphite metric ") {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			value := m.GetUntyped().GetValue()
+			if m.Gauge != nil {
+				value = m.GetGauge().GetValue()
+			}
+			series = append(series, fmt.Sprintf("%s %v", seriesString(f.GetName(), labels), value))
+		}
+	}
+	sort.Strings(series)
+	return series
+}
+
+func TestTombstones(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	c := NewCollector(Options{
+		Logger:         log.NewNopLogger(),
+		Clock:          clock,
+		SampleExpiry:   time.Minute,
+		Tombstones:     true,
+		TombstoneValue: math.NaN(),
+		TombstoneLabel: true,
+	})
+	timer := newFakeTimer()
+	c.newTimer = func(d time.Duration) sweepTimer {
+		timer.delays <- d
+		return timer
+	}
+	c.Run(context.Background())
+	defer c.Stop()
+	<-timer.delays
+	sweep := func() {
+		timer.c <- clock.now
+		<-timer.delays
+	}
+
+	// A series expiring before the sweep gets its tombstone once.
+	c.processLine("first 1 1000", LineSource{})
+	c.processLine("live 1 1000", LineSource{})
+	c.removeCh <- ""
+	clock.now = clock.now.Add(50 * time.Second)
+	c.processLine("live 2 1050", LineSource{})
+	c.removeCh <- ""
+	assert.Equal(t, []string{"first 1", "live 2"}, exportedSeries(t, c))
+	clock.now = clock.now.Add(20 * time.Second)
+	assert.Equal(t, []string{`first{graphite_expired="true"} NaN`, "live 2"}, exportedSeries(t, c))
+	assert.Equal(t, []string{"live 2"}, exportedSeries(t, c))
+	sweep()
+	assert.Equal(t, []string{"live 2"}, exportedSeries(t, c))
+
+	// A series removed by the sweep before any scrape still gets its
+	// tombstone.
+	clock.now = clock.now.Add(time.Minute)
+	sweep()
+	assert.Equal(t, 0, c.SampleCount())
+	assert.Equal(t, []string{`live{graphite_expired="true"} NaN`}, exportedSeries(t, c))
+	assert.Empty(t, exportedSeries(t, c))
+
+	// A series that is current again gets no tombstone.
+	c.processLine("revived 1 1120", LineSource{})
+	c.removeCh <- ""
+	clock.now = clock.now.Add(2 * time.Minute)
+	sweep()
+	c.processLine("revived 2 1240", LineSource{})
+	c.removeCh <- ""
+	assert.Equal(t, []string{"revived 2"}, exportedSeries(t, c))
+
+	c.mu.Lock()
+	assert.Empty(t, c.tombstones.pending)
+	c.mu.Unlock()
+}
+
+func TestTombstonesWithoutLabel(t *testing.T) {
+	clock := &manualClock{now: time.Unix(1000, 0)}
+	c := NewCollector(Options{
+		Logger:       log.NewNopLogger(),
+		Clock:        clock,
+		SampleExpiry: time.Minute,
+		Tombstones:   true,
+	})
+	c.Run(context.Background())
+	defer c.Stop()
+
+	c.processLine("my.metric 5 1000", LineSource{})
+	c.removeCh <- ""
+	clock.now = clock.now.Add(2 * time.Minute)
+	assert.Equal(t, []string{"my_metric 0"}, exportedSeries(t, c))
+	assert.Empty(t, exportedSeries(t, c))
+}
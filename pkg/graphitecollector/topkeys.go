@@ -0,0 +1,123 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+// keyCount is the estimated number of occurrences of a key. The true count
+// lies between Count-Error and Count.
+type keyCount struct {
+	Key string
+	// Value is a detail of the key, as given with its last occurrence.
+	Value string
+	Count uint64
+	Error uint64
+
+	index int
+}
+
+// topKeys counts the occurrences of keys with the Space-Saving algorithm: it
+// keeps a fixed number of counters, and a key that is not tracked takes over
+// the smallest one. Keys making up more than 1/capacity of all occurrences
+// are guaranteed to be tracked, however many distinct keys there are.
+type topKeys struct {
+	mu       sync.Mutex
+	capacity int
+	total    uint64
+	counts   map[string]*keyCount
+	// heap orders the counters by count, smallest first.
+	heap keyHeap
+}
+
+func newTopKeys(capacity int) *topKeys {
+	return &topKeys{
+		capacity: capacity,
+		counts:   make(map[string]*keyCount, capacity),
+	}
+}
+
+// add counts an occurrence of key, with value as its detail.
+func (t *topKeys) add(key, value string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.total++
+	if c, ok := t.counts[key]; ok {
+		c.Count++
+		c.Value = value
+		heap.Fix(&t.heap, c.index)
+		return
+	}
+	if len(t.heap) < t.capacity {
+		c := &keyCount{Key: key, Value: value, Count: 1}
+		t.counts[key] = c
+		heap.Push(&t.heap, c)
+		return
+	}
+	min := t.heap[0]
+	delete(t.counts, min.Key)
+	min.Key, min.Value, min.Error = key, value, min.Count
+	min.Count++
+	t.counts[key] = min
+	heap.Fix(&t.heap, 0)
+}
+
+// top returns the total number of occurrences and the n keys with the most,
+// most first. A negative n returns all tracked keys.
+func (t *topKeys) top(n int) (uint64, []keyCount) {
+	t.mu.Lock()
+	counts := make([]keyCount, 0, len(t.heap))
+	for _, c := range t.heap {
+		counts = append(counts, *c)
+	}
+	total := t.total
+	t.mu.Unlock()
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Key < counts[j].Key
+	})
+	if n >= 0 && len(counts) > n {
+		counts = counts[:n]
+	}
+	return total, counts
+}
+
+type keyHeap []*keyCount
+
+func (h keyHeap) Len() int           { return len(h) }
+func (h keyHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h keyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *keyHeap) Push(x interface{}) {
+	c := x.(*keyCount)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var pipelineHealthyDesc = prometheus.NewDesc(
+	"graphite_pipeline_healthy",
+	"Whether the line and sample processing loops keep up with the work queued for them, 0 if one of them is stalled. Only exported if the watchdog is enabled.",
+	nil, nil,
+)
+
+// loopBeat tracks whether a processing loop keeps taking the work queued for
+// it. Times are Unix nanoseconds and must be accessed atomically.
+type loopBeat struct {
+	// beat is the time the loop last finished processing or woke up idle.
+	beat int64
+	// queued is the time work was last queued for the loop.
+	queued int64
+}
+
+func (b *loopBeat) alive(now time.Time) {
+	atomic.StoreInt64(&b.beat, now.UnixNano())
+}
+
+func (b *loopBeat) enqueued(now time.Time) {
+	atomic.StoreInt64(&b.queued, now.UnixNano())
+}
+
+// stalled reports whether work was queued since the last heartbeat, which is
+// older than threshold.
+func (b *loopBeat) stalled(now time.Time, threshold time.Duration) bool {
+	beat := atomic.LoadInt64(&b.beat)
+	return atomic.LoadInt64(&b.queued) > beat && now.UnixNano()-beat > int64(threshold)
+}
+
+// watchdog detects a stalled sample pipeline, such as a deadlocked or dead
+// processing loop, which would otherwise leave scrapes serving ever staler
+// samples without any error.
+type watchdog struct {
+	lines   loopBeat
+	samples loopBeat
+	// threshold is how long a loop may go without a heartbeat while work is
+	// queued for it. Zero disables the checks.
+	threshold time.Duration
+	// unhealthy is 1 while a loop is stalled. It must be accessed
+	// atomically.
+	unhealthy int32
+}
+
+// check updates the health of the pipeline, returning the stalled loop, if
+// any.
+func (w *watchdog) check(now time.Time) string {
+	stalled := ""
+	switch {
+	case w.lines.stalled(now, w.threshold):
+		stalled = "line"
+	case w.samples.stalled(now, w.threshold):
+		stalled = "sample"
+	}
+	unhealthy := int32(0)
+	if stalled != "" {
+		unhealthy = 1
+	}
+	atomic.StoreInt32(&w.unhealthy, unhealthy)
+	return stalled
+}
+
+// watchPipeline checks the pipeline several times per threshold until the
+// collector is stopped, logging when a loop stalls.
+func (c *Collector) watchPipeline() {
+	interval := c.watchdog.threshold / 4
+	if interval <= 0 {
+		interval = c.watchdog.threshold
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := ""
+	for {
+		select {
+		case now := <-ticker.C:
+			stalled := c.watchdog.check(now)
+			if stalled != "" && stalled != last {
+				level.Error(c.logger).Log("msg", "Processing loop stalled, no heartbeat while lines are waiting", "loop", stalled, "threshold", c.watchdog.threshold)
+			}
+			last = stalled
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// PipelineHealthy reports whether the processing loops keep up with the
+// queued work. It is always true if Options.PipelineStallThreshold is zero.
+func (c *Collector) PipelineHealthy() bool {
+	return atomic.LoadInt32(&c.watchdog.unhealthy) == 0
+}
+
+func (c *Collector) collectPipelineHealth(ch chan<- prometheus.Metric) {
+	if c.watchdog.threshold <= 0 {
+		return
+	}
+	healthy := 0.0
+	if c.PipelineHealthy() {
+		healthy = 1
+	}
+	ch <- prometheus.MustNewConstMetric(pipelineHealthyDesc, prometheus.GaugeValue, healthy)
+}
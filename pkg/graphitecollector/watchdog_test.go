@@ -0,0 +1,80 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphitecollector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoopBeat(t *testing.T) {
+	now := time.Unix(1534620625, 0)
+	var b loopBeat
+	b.alive(now)
+	assert.False(t, b.stalled(now.Add(time.Hour), time.Minute), "an idle loop is not stalled")
+	b.enqueued(now.Add(time.Second))
+	assert.False(t, b.stalled(now.Add(30*time.Second), time.Minute))
+	assert.True(t, b.stalled(now.Add(2*time.Minute), time.Minute), "queued work waits past the threshold")
+	b.alive(now.Add(2 * time.Minute))
+	assert.False(t, b.stalled(now.Add(time.Hour), time.Minute))
+}
+
+func TestWatchdog(t *testing.T) {
+	c := NewCollector(Options{Logger: log.NewNopLogger(), PipelineStallThreshold: 50 * time.Millisecond})
+	c.Run(context.Background())
+	defer c.Stop()
+
+	c.processLine("my.metric 1 1534620625", LineSource{})
+	c.removeCh <- ""
+	assert.Eventually(t, func() bool {
+		return c.PipelineHealthy()
+	}, 5*time.Second, time.Millisecond)
+
+	// Holding the lock of the sample store stalls the sample loop while it
+	// stores the sample.
+	c.mu.Lock()
+	c.processLine("my.metric 2 1534620626", LineSource{})
+	assert.Eventually(t, func() bool {
+		return !c.PipelineHealthy()
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, 0.0, testutil.ToFloat64(pipelineHealthyCollector{c}))
+
+	c.mu.Unlock()
+	c.removeCh <- ""
+	assert.Eventually(t, func() bool {
+		return c.PipelineHealthy()
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, 1.0, testutil.ToFloat64(pipelineHealthyCollector{c}))
+
+	assert.True(t, NewCollector(Options{}).PipelineHealthy(), "the watchdog is disabled by default")
+}
+
+// pipelineHealthyCollector collects only graphite_pipeline_healthy.
+type pipelineHealthyCollector struct {
+	c *Collector
+}
+
+func (p pipelineHealthyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pipelineHealthyDesc
+}
+
+func (p pipelineHealthyCollector) Collect(ch chan<- prometheus.Metric) {
+	p.c.collectPipelineHealth(ch)
+}
@@ -0,0 +1,258 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	promconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/common/version"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+func init() {
+	graphitecollector.RegisterFeature("pull")
+}
+
+var (
+	pullPolls = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "graphite_pull_polls_total",
+			Help: "Number of polls of the Graphite render API, by target and result.",
+		},
+		[]string{"target", "result"},
+	)
+	pullDatapoints = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "graphite_pull_datapoints_total",
+			Help: "Number of datapoints fetched from the Graphite render API, by target and whether they were ingested, already ingested by an earlier poll, or older than the maximum staleness.",
+		},
+		[]string{"target", "outcome"},
+	)
+	pullLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "graphite_pull_last_success_timestamp_seconds",
+			Help: "Unix timestamp of the last successful poll of each target.",
+		},
+		[]string{"target"},
+	)
+)
+
+// maxRenderErrorBody bounds how much of an error response is logged.
+const maxRenderErrorBody = 512
+
+// pullConfig configures the render API poller.
+type pullConfig struct {
+	// URL is the base URL of the Graphite web API.
+	URL     string
+	Targets []string
+	// From is the start of the fetched window relative to now, in the
+	// syntax of the render API, e.g. -5min.
+	From         string
+	Interval     time.Duration
+	Timeout      time.Duration
+	MaxStaleness time.Duration
+	HTTPClient   promconfig.HTTPClientConfig
+}
+
+// renderSeries is a series in a format=json render response. Datapoints are
+// [value, timestamp] pairs, where the value is null if there is none.
+type renderSeries struct {
+	Target     string        `json:"target"`
+	Datapoints [][2]*float64 `json:"datapoints"`
+}
+
+// lineIngester stores plaintext lines, such as a Collector.
+type lineIngester interface {
+	IngestLines(ctx context.Context, r io.Reader, source graphitecollector.LineSource) (int, error)
+}
+
+// renderPoller periodically fetches the targets from the Graphite render API
+// and ingests the datapoints, for Graphite installations that cannot push to
+// the exporter.
+type renderPoller struct {
+	cfg     pullConfig
+	client  *http.Client
+	store   lineIngester
+	logger  log.Logger
+	done    chan struct{}
+	stopped chan struct{}
+	// last holds the timestamp of the newest datapoint ingested for each
+	// series of each target, so that the overlapping windows of
+	// consecutive polls do not ingest a datapoint twice, which would count
+	// delta counters twice. Only the series of the last poll are kept.
+	last map[string]map[string]int64
+}
+
+func newRenderPoller(store lineIngester, cfg pullConfig, logger log.Logger) (*renderPoller, error) {
+	client, err := promconfig.NewClientFromConfig(cfg.HTTPClient, "graphite_pull", false, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range cfg.Targets {
+		pullPolls.WithLabelValues(target, "success")
+		pullPolls.WithLabelValues(target, "failure")
+	}
+	return &renderPoller{
+		cfg:     cfg,
+		client:  client,
+		store:   store,
+		logger:  logger,
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		last:    map[string]map[string]int64{},
+	}, nil
+}
+
+// run polls every interval, starting right away, until stop is called.
+func (p *renderPoller) run() {
+	defer close(p.stopped)
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		p.poll(time.Now())
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// stop ends the poll loop, cancelling a poll in progress.
+func (p *renderPoller) stop() {
+	close(p.done)
+	<-p.stopped
+}
+
+// poll fetches and ingests every target. A failing target does not keep the
+// others from being polled.
+func (p *renderPoller) poll(now time.Time) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for _, target := range p.cfg.Targets {
+		if err := p.pollTarget(ctx, target, now); err != nil {
+			pullPolls.WithLabelValues(target, "failure").Inc()
+			level.Warn(p.logger).Log("msg", "Error polling the Graphite render API", "target", target, "err", err)
+			continue
+		}
+		pullPolls.WithLabelValues(target, "success").Inc()
+		pullLastSuccess.WithLabelValues(target).Set(float64(now.UnixNano()) / 1e9)
+	}
+}
+
+func (p *renderPoller) pollTarget(ctx context.Context, target string, now time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+	series, err := p.fetch(ctx, target)
+	if err != nil {
+		return err
+	}
+	lines, last := p.lines(target, series, now)
+	if len(lines) > 0 {
+		source := graphitecollector.LineSource{Protocol: "pull", Address: p.cfg.URL}
+		if _, err := p.store.IngestLines(ctx, strings.NewReader(strings.Join(lines, "\n")), source); err != nil {
+			return fmt.Errorf("storing datapoints: %v", err)
+		}
+	}
+	p.last[target] = last
+	return nil
+}
+
+// fetch requests target from the render API.
+func (p *renderPoller) fetch(ctx context.Context, target string) ([]renderSeries, error) {
+	query := url.Values{}
+	query.Set("target", target)
+	query.Set("format", "json")
+	query.Set("from", p.cfg.From)
+	req, err := http.NewRequest("GET", strings.TrimSuffix(p.cfg.URL, "/")+"/render?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "graphite_exporter/"+version.Version)
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxRenderErrorBody))
+		return nil, fmt.Errorf("server returned HTTP status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var series []renderSeries
+	if err := json.NewDecoder(resp.Body).Decode(&series); err != nil {
+		return nil, fmt.Errorf("decoding render response: %v", err)
+	}
+	return series, nil
+}
+
+// lines returns the plaintext lines of the datapoints of series that were
+// not ingested before and are not older than the maximum staleness, so that
+// a poll that only finds old data does not export it as current, and the
+// newest datapoint timestamp of each series.
+func (p *renderPoller) lines(target string, series []renderSeries, now time.Time) ([]string, map[string]int64) {
+	previous := p.last[target]
+	last := make(map[string]int64, len(series))
+	var lines []string
+	ingested, repeated, stale := 0, 0, 0
+	for _, s := range series {
+		newest, seen := previous[s.Target]
+		for _, dp := range s.Datapoints {
+			if dp[0] == nil || dp[1] == nil {
+				continue
+			}
+			ts := int64(*dp[1])
+			switch {
+			case seen && ts <= newest:
+				repeated++
+				continue
+			case p.cfg.MaxStaleness > 0 && now.Sub(time.Unix(ts, 0)) > p.cfg.MaxStaleness:
+				stale++
+				continue
+			}
+			lines = append(lines, s.Target+" "+strconv.FormatFloat(*dp[0], 'g', -1, 64)+" "+strconv.FormatInt(ts, 10))
+			ingested++
+			if !seen || ts > newest {
+				newest, seen = ts, true
+			}
+		}
+		if seen {
+			last[s.Target] = newest
+		}
+	}
+	pullDatapoints.WithLabelValues(target, "ingested").Add(float64(ingested))
+	pullDatapoints.WithLabelValues(target, "repeated").Add(float64(repeated))
+	pullDatapoints.WithLabelValues(target, "stale").Add(float64(stale))
+	return lines, last
+}
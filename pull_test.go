@@ -0,0 +1,102 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	promconfig "github.com/prometheus/common/config"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+func TestRenderPoller(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graphite_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/render" || r.FormValue("format") != "json" || r.FormValue("from") != "-5min" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.FormValue("target") != "servers.*.cpu" {
+			http.Error(w, "no such target", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `[{"target": "servers.a.cpu", "datapoints": [[5, %d], [1, %d], [2, %d], [null, %d]]}]`, now-3600, now-120, now-60, now)
+	}))
+	defer server.Close()
+
+	c := graphitecollector.NewCollector(graphitecollector.Options{Logger: log.NewNopLogger()})
+	c.Run(context.Background())
+	defer c.Stop()
+	p, err := newRenderPoller(c, pullConfig{
+		URL:          server.URL + "/",
+		Targets:      []string{"servers.*.cpu", "missing"},
+		From:         "-5min",
+		Interval:     time.Minute,
+		Timeout:      time.Second,
+		MaxStaleness: 5 * time.Minute,
+		HTTPClient:   promconfig.HTTPClientConfig{BearerTokenFile: tokenFile},
+	}, log.NewNopLogger())
+	assert.NoError(t, err)
+
+	counter := func(target, outcome string) float64 {
+		return testutil.ToFloat64(pullDatapoints.WithLabelValues(target, outcome))
+	}
+	ingested, repeated, stale := counter("servers.*.cpu", "ingested"), counter("servers.*.cpu", "repeated"), counter("servers.*.cpu", "stale")
+	successes := testutil.ToFloat64(pullPolls.WithLabelValues("servers.*.cpu", "success"))
+	failures := testutil.ToFloat64(pullPolls.WithLabelValues("missing", "failure"))
+	p.poll(time.Unix(now, 0))
+	assert.Equal(t, ingested+2, counter("servers.*.cpu", "ingested"))
+	assert.Equal(t, stale+1, counter("servers.*.cpu", "stale"), "the datapoint of an hour ago is stale")
+	assert.Equal(t, successes+1, testutil.ToFloat64(pullPolls.WithLabelValues("servers.*.cpu", "success")))
+	assert.Equal(t, failures+1, testutil.ToFloat64(pullPolls.WithLabelValues("missing", "failure")))
+	assert.Equal(t, float64(now), testutil.ToFloat64(pullLastSuccess.WithLabelValues("servers.*.cpu")))
+
+	samples := c.CurrentSamples(time.Now())
+	if assert.Len(t, samples, 1) {
+		assert.Equal(t, "servers_a_cpu", samples[0].Name)
+		assert.Equal(t, 2.0, samples[0].Value)
+		assert.Equal(t, now-60, samples[0].Timestamp.Unix())
+	}
+
+	// The overlapping window of the next poll ingests nothing twice.
+	p.poll(time.Unix(now, 0))
+	assert.Equal(t, ingested+2, counter("servers.*.cpu", "ingested"))
+	assert.Equal(t, repeated+3, counter("servers.*.cpu", "repeated"))
+}
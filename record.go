@@ -0,0 +1,274 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+func init() {
+	graphitecollector.RegisterFeature("record")
+}
+
+var recordedLines = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "graphite_recorded_lines_total",
+		Help: "Total count of received lines handled by the line recorder, by outcome.",
+	},
+	[]string{"outcome"},
+)
+
+// lineRecorder appends received lines to a file, each prefixed with the time
+// it was received in Unix seconds. Lines are written asynchronously; when the
+// writer falls behind or the file reaches its size limit, lines are dropped
+// rather than slowing down ingestion.
+type lineRecorder struct {
+	ch       chan recordedLine
+	done     chan struct{}
+	maxBytes int64
+	logger   log.Logger
+}
+
+type recordedLine struct {
+	received time.Time
+	line     string
+}
+
+// newLineRecorder opens path for appending and starts the writer. A
+// maxBytes of zero means no size limit.
+func newLineRecorder(path string, maxBytes int64, logger log.Logger) (*lineRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r := &lineRecorder{
+		ch:       make(chan recordedLine, 10000),
+		done:     make(chan struct{}),
+		maxBytes: maxBytes,
+		logger:   logger,
+	}
+	go r.run(f, info.Size())
+	return r, nil
+}
+
+// record queues a line for writing without blocking.
+func (r *lineRecorder) record(line string) {
+	select {
+	case r.ch <- recordedLine{received: time.Now(), line: line}:
+	default:
+		recordedLines.WithLabelValues("dropped_queue_full").Inc()
+	}
+}
+
+// close flushes the queued lines and closes the file.
+func (r *lineRecorder) close() {
+	close(r.ch)
+	<-r.done
+}
+
+func (r *lineRecorder) run(f *os.File, size int64) {
+	defer close(r.done)
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	flush := time.NewTicker(time.Second)
+	defer flush.Stop()
+	for {
+		select {
+		case l, ok := <-r.ch:
+			if !ok {
+				if err := w.Flush(); err != nil {
+					level.Error(r.logger).Log("msg", "Error writing recorded lines", "err", err)
+				}
+				return
+			}
+			entry := formatRecordedLine(l.received, l.line)
+			if r.maxBytes > 0 && size+int64(len(entry)) > r.maxBytes {
+				recordedLines.WithLabelValues("dropped_size_limit").Inc()
+				continue
+			}
+			if _, err := w.WriteString(entry); err != nil {
+				level.Error(r.logger).Log("msg", "Error writing recorded lines", "err", err)
+				recordedLines.WithLabelValues("dropped_write_error").Inc()
+				continue
+			}
+			size += int64(len(entry))
+			recordedLines.WithLabelValues("written").Inc()
+		case <-flush.C:
+			if err := w.Flush(); err != nil {
+				level.Error(r.logger).Log("msg", "Error writing recorded lines", "err", err)
+			}
+		}
+	}
+}
+
+func formatRecordedLine(received time.Time, line string) string {
+	return fmt.Sprintf("%d.%09d %s\n", received.Unix(), received.Nanosecond(), line)
+}
+
+// parseRecordedLine splits a recorded line into the receive time and the
+// original line.
+func parseRecordedLine(entry string) (time.Time, string, error) {
+	i := strings.IndexByte(entry, ' ')
+	if i < 0 {
+		return time.Time{}, "", fmt.Errorf("missing receive timestamp")
+	}
+	parts := strings.SplitN(entry[:i], ".", 2)
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("invalid receive timestamp: %v", err)
+	}
+	var nsec int64
+	if len(parts) == 2 {
+		if nsec, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			return time.Time{}, "", fmt.Errorf("invalid receive timestamp: %v", err)
+		}
+	}
+	return time.Unix(sec, nsec), entry[i+1:], nil
+}
+
+// replaySummary reports the outcome of a replay.
+type replaySummary struct {
+	Lines       int
+	ParseErrors int
+	SendErrors  int
+	Duration    time.Duration
+}
+
+// replay sends the lines recorded in r to target over TCP. With a rate of
+// zero, the original pacing between lines is kept; otherwise lines are sent
+// at rate lines per second.
+func replay(r io.Reader, target string, rate float64, logger log.Logger) (replaySummary, error) {
+	var summary replaySummary
+
+	conn, err := net.Dial("tcp", target)
+	if err != nil {
+		return summary, err
+	}
+	w := bufio.NewWriter(conn)
+	defer func() {
+		if conn != nil {
+			w.Flush()
+			conn.Close()
+		}
+	}()
+
+	var (
+		start         = time.Now()
+		firstReceived time.Time
+		scanner       = bufio.NewScanner(r)
+	)
+	for scanner.Scan() {
+		received, line, err := parseRecordedLine(scanner.Text())
+		if err != nil {
+			summary.ParseErrors++
+			level.Debug(logger).Log("msg", "Skipping unparsable recorded line", "err", err)
+			continue
+		}
+		if firstReceived.IsZero() {
+			firstReceived = received
+		}
+
+		var due time.Time
+		if rate > 0 {
+			due = start.Add(time.Duration(float64(summary.Lines) / rate * float64(time.Second)))
+		} else {
+			due = start.Add(received.Sub(firstReceived))
+		}
+		if wait := time.Until(due); wait > 0 {
+			// Flush before waiting, so that paced lines arrive on time.
+			if err := w.Flush(); err != nil {
+				summary.SendErrors++
+				if conn, w, err = redial(conn, target); err != nil {
+					return summary, err
+				}
+			}
+			time.Sleep(wait)
+		}
+
+		if _, err := w.WriteString(line + "\n"); err != nil {
+			summary.SendErrors++
+			level.Debug(logger).Log("msg", "Error sending line", "err", err)
+			if conn, w, err = redial(conn, target); err != nil {
+				return summary, err
+			}
+			continue
+		}
+		summary.Lines++
+	}
+	if err := w.Flush(); err != nil {
+		summary.SendErrors++
+	}
+	summary.Duration = time.Since(start)
+	return summary, scanner.Err()
+}
+
+func redial(conn net.Conn, target string) (net.Conn, *bufio.Writer, error) {
+	conn.Close()
+	conn, err := net.Dial("tcp", target)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, bufio.NewWriter(conn), nil
+}
+
+// runReplay runs the replay command and returns the exit code.
+func runReplay(logger log.Logger) int {
+	f, err := os.Open(*replayFile)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error opening recording", "err", err)
+		return 1
+	}
+	defer f.Close()
+
+	summary, err := replay(f, *replayTarget, *replayRate, logger)
+	rate := 0.0
+	if summary.Duration > 0 {
+		rate = float64(summary.Lines) / summary.Duration.Seconds()
+	}
+	level.Info(logger).Log(
+		"msg", "Finished replay",
+		"lines", summary.Lines,
+		"lines_per_second", fmt.Sprintf("%.1f", rate),
+		"parse_errors", summary.ParseErrors,
+		"send_errors", summary.SendErrors,
+		"duration", summary.Duration,
+	)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error replaying recording", "err", err)
+		return 1
+	}
+	if summary.ParseErrors > 0 || summary.SendErrors > 0 {
+		return 2
+	}
+	return 0
+}
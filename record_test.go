@@ -0,0 +1,80 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	f, err := ioutil.TempFile("", "graphite_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	// Every entry is 46 bytes long, so the limit leaves room for two.
+	r, err := newLineRecorder(f.Name(), 100, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.record("my.metric.a 1 1534620625")
+	r.record("my.metric.b 2 1534620625")
+	r.record("my.metric.c 3 1534620625")
+	r.close()
+
+	recording, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := strings.Split(strings.TrimSpace(string(recording)), "\n")
+	if assert.Len(t, entries, 2, "the size limit is respected") {
+		received, line, err := parseRecordedLine(entries[1])
+		assert.NoError(t, err)
+		assert.Equal(t, "my.metric.b 2 1534620625", line)
+		assert.WithinDuration(t, time.Now(), received, time.Minute)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan string)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		b, _ := ioutil.ReadAll(conn)
+		received <- string(b)
+	}()
+
+	summary, err := replay(bytes.NewReader(append(recording, "garbage\n"...)), l.Addr().String(), 1000, log.NewNopLogger())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, summary.Lines)
+	assert.Equal(t, 1, summary.ParseErrors)
+	assert.Equal(t, 0, summary.SendErrors)
+	assert.Equal(t, "my.metric.a 1 1534620625\nmy.metric.b 2 1534620625\n", <-received)
+}
@@ -0,0 +1,104 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// The exit codes of the exporter. A component failing at runtime makes the
+// exporter exit with its code, so that the failed component can be told from
+// the exit status alone.
+const (
+	// exitFailure is the exit code of failures at startup and of failures
+	// of the web servers or of the shutdown.
+	exitFailure = 1
+	// exitGraphiteTCP and exitGraphiteUDP are the exit codes of failures to
+	// bind or serve the Graphite listeners.
+	exitGraphiteTCP = 3
+	exitGraphiteUDP = 4
+	// exitPipeline is the exit code if the sample pipeline stops on its own.
+	exitPipeline = 5
+)
+
+// component is a part of the exporter that runs until it fails or is
+// stopped, such as a listener or a web server.
+type component struct {
+	name     string
+	exitCode int
+	// run runs the component until it fails or stop is called. It returns
+	// nil if the component ended as requested, e.g. on a shutdown signal.
+	run func() error
+	// stop makes run return. It is called once, even if run already
+	// returned, and may wait for the component to shut down. Components
+	// are stopped in the reverse order of being added, so that a
+	// component is stopped before those added before it, which it may
+	// depend on.
+	stop func() error
+}
+
+// runGroup runs the components of the exporter together, so that any of
+// them ending shuts down all of them instead of leaving the exporter half
+// working.
+type runGroup struct {
+	logger     log.Logger
+	components []component
+}
+
+// add adds a component. exitCode is the exit code of the exporter if the
+// component is the first to end, with an error.
+func (g *runGroup) add(name string, exitCode int, run func() error, stop func() error) {
+	g.components = append(g.components, component{name: name, exitCode: exitCode, run: run, stop: stop})
+}
+
+// run runs all components until the first of them returns, then stops them
+// in the reverse order of being added and waits for all of them to return. It
+// returns the exit code of the exporter: that of the first component if it
+// failed, exitFailure if stopping a component failed, and 0 otherwise.
+func (g *runGroup) run() int {
+	if len(g.components) == 0 {
+		return 0
+	}
+	type result struct {
+		component component
+		err       error
+	}
+	results := make(chan result, len(g.components))
+	for _, c := range g.components {
+		go func(c component) {
+			results <- result{component: c, err: c.run()}
+		}(c)
+	}
+
+	first := <-results
+	exitCode := 0
+	if first.err != nil {
+		level.Error(g.logger).Log("msg", "Component failed, shutting down", "component", first.component.name, "err", first.err)
+		exitCode = first.component.exitCode
+	}
+	for i := len(g.components) - 1; i >= 0; i-- {
+		c := g.components[i]
+		if err := c.stop(); err != nil {
+			level.Error(g.logger).Log("msg", "Error stopping component", "component", c.name, "err", err)
+			if exitCode == 0 {
+				exitCode = exitFailure
+			}
+		}
+	}
+	for i := 1; i < len(g.components); i++ {
+		<-results
+	}
+	return exitCode
+}
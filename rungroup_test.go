@@ -0,0 +1,80 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingComponent returns the run and stop functions of a component that
+// runs until stopped, recording its stop in stopped.
+func blockingComponent(name string, stopped *[]string) (func() error, func() error) {
+	done := make(chan struct{})
+	return func() error {
+			<-done
+			return nil
+		}, func() error {
+			*stopped = append(*stopped, name)
+			close(done)
+			return nil
+		}
+}
+
+func TestRunGroup(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		err      error
+		stopErr  error
+		exitCode int
+	}{
+		{name: "shutdown request", exitCode: 0},
+		{name: "component failure", err: errors.New("bind: address already in use"), exitCode: exitGraphiteUDP},
+		{name: "failed stop", stopErr: errors.New("context deadline exceeded"), exitCode: exitFailure},
+		{name: "component failure and failed stop", err: errors.New("bind: address already in use"), stopErr: errors.New("context deadline exceeded"), exitCode: exitGraphiteUDP},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := &runGroup{logger: log.NewNopLogger()}
+			var stopped []string
+			run, stop := blockingComponent("tcp", &stopped)
+			g.add("tcp", exitGraphiteTCP, run, stop)
+
+			fail := make(chan struct{})
+			g.add("udp", exitGraphiteUDP, func() error {
+				<-fail
+				return tc.err
+			}, func() error {
+				stopped = append(stopped, "udp")
+				return nil
+			})
+
+			run, stop = blockingComponent("web", &stopped)
+			g.add("web", exitFailure, run, func() error {
+				stop()
+				return tc.stopErr
+			})
+
+			close(fail)
+			assert.Equal(t, tc.exitCode, g.run())
+			assert.Equal(t, []string{"web", "udp", "tcp"}, stopped, "all components are stopped in reverse order")
+		})
+	}
+}
+
+func TestRunGroupEmpty(t *testing.T) {
+	assert.Equal(t, 0, (&runGroup{logger: log.NewNopLogger()}).run())
+}
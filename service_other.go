@@ -0,0 +1,37 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import "github.com/go-kit/kit/log"
+
+// serviceControl connects the exporter to the service manager of the
+// platform. Service managers on this platform stop the exporter with a
+// signal, so there is nothing to connect to.
+type serviceControl struct{}
+
+func startService(logger log.Logger) (*serviceControl, error) {
+	return &serviceControl{}, nil
+}
+
+// stopRequests is closed when the service manager asks the exporter to stop.
+func (*serviceControl) stopRequests() <-chan struct{} {
+	return nil
+}
+
+// exited reports the exit code of the exporter to the service manager once it
+// has shut down.
+func (*serviceControl) exited(code int) {}
@@ -0,0 +1,105 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/windows/svc"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+func init() {
+	graphitecollector.RegisterFeature("windows_service")
+}
+
+// serviceName is the name the exporter runs under as a Windows service. The
+// service control manager ignores it for services in their own process.
+const serviceName = "graphite_exporter"
+
+// serviceControl connects the exporter to the Windows service control
+// manager if it was started as a service. Stop and shutdown requests of the
+// manager trigger the same graceful shutdown as a signal, and the manager is
+// told that the service stopped only once the shutdown is complete.
+type serviceControl struct {
+	stop     chan struct{}
+	exitCode chan int
+	// done is closed once the service control manager has been told that
+	// the service stopped.
+	done chan struct{}
+}
+
+func startService(logger log.Logger) (*serviceControl, error) {
+	s := &serviceControl{}
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		return nil, err
+	}
+	if interactive {
+		return s, nil
+	}
+
+	s.stop = make(chan struct{})
+	s.exitCode = make(chan int, 1)
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		if err := svc.Run(serviceName, s); err != nil {
+			level.Error(logger).Log("msg", "Error running as a Windows service", "err", err)
+		}
+	}()
+	return s, nil
+}
+
+// Execute implements svc.Handler.
+func (s *serviceControl) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				close(s.stop)
+				code := <-s.exitCode
+				return code != 0, uint32(code)
+			}
+		case code := <-s.exitCode:
+			// The exporter shut down on its own.
+			return code != 0, uint32(code)
+		}
+	}
+}
+
+// stopRequests is closed when the service control manager asks the exporter
+// to stop. It is nil if the exporter does not run as a service.
+func (s *serviceControl) stopRequests() <-chan struct{} {
+	return s.stop
+}
+
+// exited reports the exit code of the exporter to the service control
+// manager once it has shut down.
+func (s *serviceControl) exited(code int) {
+	if s.exitCode == nil {
+		return
+	}
+	s.exitCode <- code
+	<-s.done
+}
@@ -0,0 +1,261 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+func init() {
+	graphitecollector.RegisterFeature("tenants")
+}
+
+// tenantLabel is the label identifying the tenant of a sample with
+// --web.tenant-metrics=label.
+const tenantLabel = "tenant"
+
+// tenantNamePattern restricts tenant names to what is safe in a URL path.
+var tenantNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+var tenantStoredSamplesDesc = prometheus.NewDesc(
+	"graphite_tenant_stored_samples",
+	"Number of samples in the store of each tenant.",
+	[]string{"tenant"}, nil,
+)
+
+// tenantConfig configures a tenant in the tenants section of the
+// configuration file. Settings left out are taken from the flags.
+type tenantConfig struct {
+	Name                string        `yaml:"name"`
+	ListenAddress       string        `yaml:"listen-address"`
+	MappingConfig       string        `yaml:"mapping-config"`
+	SampleExpiry        time.Duration `yaml:"sample-expiry"`
+	MaxSeries           int           `yaml:"max-series"`
+	MaxSamplesPerScrape int           `yaml:"max-samples-per-scrape"`
+	ParseRateLimit      float64       `yaml:"parse-rate-limit"`
+}
+
+// tenants reads the tenants section of the file, a list of tenant
+// configurations.
+func (f *configFile) tenants() ([]tenantConfig, error) {
+	content, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Tenants []tenantConfig `yaml:"tenants"`
+		// The flags are read by read.
+		Flags map[string]interface{} `yaml:",inline"`
+	}
+	if err := yaml.UnmarshalStrict(content, &doc); err != nil {
+		return nil, err
+	}
+	return doc.Tenants, nil
+}
+
+// validateTenants checks that every tenant has a unique name and Graphite
+// listen address, and that its limits are not negative. graphiteAddress is
+// the listen address of the flags.
+func validateTenants(configs []tenantConfig, graphiteAddress string) error {
+	names := map[string]bool{}
+	addresses := map[string]bool{graphiteAddress: true}
+	for _, tc := range configs {
+		if !tenantNamePattern.MatchString(tc.Name) {
+			return fmt.Errorf("invalid tenant name %q, it must consist of letters, digits, '_' and '-'", tc.Name)
+		}
+		if names[tc.Name] {
+			return fmt.Errorf("duplicate tenant %q", tc.Name)
+		}
+		names[tc.Name] = true
+		if tc.ListenAddress == "" {
+			return fmt.Errorf("tenant %q: listen-address is required", tc.Name)
+		}
+		if addresses[tc.ListenAddress] {
+			return fmt.Errorf("tenant %q: listen-address %s is already in use", tc.Name, tc.ListenAddress)
+		}
+		addresses[tc.ListenAddress] = true
+		if tc.SampleExpiry < 0 || tc.MaxSeries < 0 || tc.MaxSamplesPerScrape < 0 || tc.ParseRateLimit < 0 {
+			return fmt.Errorf("tenant %q: sample-expiry, max-series, max-samples-per-scrape and parse-rate-limit must not be negative", tc.Name)
+		}
+	}
+	return nil
+}
+
+// tenant is a pipeline isolated from the others, with its own Graphite
+// listeners, mapping configuration and sample store, so that the senders of
+// one tenant cannot crowd out the series of another.
+type tenant struct {
+	tenantConfig
+	c *graphitecollector.Collector
+	// labelled adds the tenant label to the exported samples.
+	labelled bool
+}
+
+// newTenant returns the tenant configured by tc. Settings tc leaves out are
+// those of base, the options of the flags.
+func newTenant(tc tenantConfig, base graphitecollector.Options, labelled bool) (*tenant, error) {
+	m, err := loadTenantMapping(tc, "startup", base.Logger)
+	if err != nil {
+		return nil, fmt.Errorf("tenant %q: loading mapping config: %v", tc.Name, err)
+	}
+	// The memory soft limit of base is enforced for the whole process, so
+	// that the tenants flooding it are the ones shedding samples.
+	opts := base
+	opts.Logger = log.With(base.Logger, "tenant", tc.Name)
+	opts.Mapper = m
+	// A recording is replayed into a single pipeline, so it only holds the
+	// lines of the flags' listener.
+	opts.RecordLine = nil
+	tc.override(&opts)
+	t := &tenant{tenantConfig: tc, labelled: labelled}
+	opts.IdentityLabels = t.identityLabels(base.IdentityLabels)
+	t.c = graphitecollector.NewCollector(opts)
+	return t, nil
+}
+
+// override sets the settings of opts that tc sets, leaving the others.
+func (tc tenantConfig) override(opts *graphitecollector.Options) {
+	if tc.SampleExpiry > 0 {
+		opts.SampleExpiry = tc.SampleExpiry
+	}
+	if tc.MaxSeries > 0 {
+		opts.MaxSeries = tc.MaxSeries
+	}
+	if tc.MaxSamplesPerScrape > 0 {
+		opts.MaxSamplesPerScrape = tc.MaxSamplesPerScrape
+	}
+	if tc.ParseRateLimit > 0 {
+		opts.ParseRateLimit = tc.ParseRateLimit
+	}
+}
+
+// loadTenantMapping loads the mapping configuration of tc, recording the
+// load in the load metrics, see graphitecollector.LoadMappingConfig. A
+// tenant without a mapping configuration gets a mapper without mappings.
+func loadTenantMapping(tc tenantConfig, trigger string, logger log.Logger) (*graphitecollector.Mapper, error) {
+	m := &graphitecollector.Mapper{}
+	if tc.MappingConfig == "" {
+		return m, nil
+	}
+	logger = log.With(logger, "tenant", tc.Name)
+	if _, err := graphitecollector.LoadMappingConfig(m, tc.MappingConfig, "tenant "+tc.Name, trigger, logger); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// identityLabels returns id with the tenant label added, if the samples of
+// the tenant are exported with it. The tenant label overrides an identity
+// label of the same name, so that tenants cannot clash.
+func (t *tenant) identityLabels(id *graphitecollector.IdentityLabels) *graphitecollector.IdentityLabels {
+	if !t.labelled {
+		return id
+	}
+	withTenant := &graphitecollector.IdentityLabels{Labels: map[string]string{}}
+	if id != nil {
+		withTenant.File, withTenant.Hash = id.File, id.Hash
+		for name, value := range id.Labels {
+			withTenant.Labels[name] = value
+		}
+	}
+	withTenant.Labels[tenantLabel] = t.Name
+	return withTenant
+}
+
+// reload applies the reloadable settings of tc, all but the listen address,
+// whose change is logged and ignored. Settings tc leaves out are those of
+// base, the options of the flags, as when the tenant was created. trigger
+// names what caused the reload.
+func (t *tenant) reload(tc tenantConfig, base graphitecollector.Options, trigger string, logger log.Logger) error {
+	if tc.ListenAddress != t.ListenAddress {
+		level.Warn(logger).Log("msg", "Tenant configuration change requires a restart", "tenant", t.Name)
+	}
+	m, err := loadTenantMapping(tc, trigger, logger)
+	if err != nil {
+		return err
+	}
+	t.c.SetMapper(m)
+	opts := base
+	tc.override(&opts)
+	t.c.SetSampleExpiry(opts.SampleExpiry)
+	t.c.SetMaxSeries(opts.MaxSeries)
+	t.c.SetMaxSamplesPerScrape(opts.MaxSamplesPerScrape)
+	// A new rate limiter starts with a full burst, so it only replaces
+	// the current one on a change.
+	if opts.ParseRateLimit != t.c.ParseRateLimit() {
+		t.c.SetParseRateLimit(opts.ParseRateLimit)
+	}
+	t.MappingConfig, t.SampleExpiry = tc.MappingConfig, tc.SampleExpiry
+	t.MaxSeries, t.MaxSamplesPerScrape, t.ParseRateLimit = tc.MaxSeries, tc.MaxSamplesPerScrape, tc.ParseRateLimit
+	return nil
+}
+
+// reloadTenants reloads each tenant from its configuration in configs. A
+// tenant failing to reload keeps its previous settings and does not keep
+// the others from reloading. Tenants cannot be added or removed without a
+// restart. base are the options of the flags in force, providing the
+// settings a tenant leaves out. trigger names what caused the reload.
+func reloadTenants(tenants []*tenant, configs []tenantConfig, base graphitecollector.Options, trigger string, logger log.Logger) error {
+	byName := make(map[string]tenantConfig, len(configs))
+	for _, tc := range configs {
+		byName[tc.Name] = tc
+	}
+	var failed []string
+	for _, t := range tenants {
+		tc, ok := byName[t.Name]
+		if !ok {
+			level.Warn(logger).Log("msg", "Removing a tenant requires a restart", "tenant", t.Name)
+			continue
+		}
+		delete(byName, t.Name)
+		if err := t.reload(tc, base, trigger, logger); err != nil {
+			level.Error(logger).Log("msg", "Error reloading tenant", "tenant", t.Name, "err", err)
+			failed = append(failed, t.Name)
+			continue
+		}
+		level.Info(logger).Log("msg", "Reloaded tenant", "tenant", t.Name, "mapping_config", t.MappingConfig)
+	}
+	for name := range byName {
+		level.Warn(logger).Log("msg", "Adding a tenant requires a restart", "tenant", name)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("tenants %s failed to reload", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// tenantStats exports the state of the tenants alongside the exporter's own
+// metrics, which are shared by all tenants.
+type tenantStats []*tenant
+
+func (ts tenantStats) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tenantStoredSamplesDesc
+}
+
+func (ts tenantStats) Collect(ch chan<- prometheus.Metric) {
+	for _, t := range ts {
+		ch <- prometheus.MustNewConstMetric(tenantStoredSamplesDesc, prometheus.GaugeValue, float64(t.c.SampleCount()), t.Name)
+	}
+}
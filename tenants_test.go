@@ -0,0 +1,196 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+func TestTenantsConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graphite_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := kingpin.New("test", "")
+	app.Flag("config.file", "").String()
+	expiry := app.Flag("graphite.sample-expiry", "").Default("5m").Duration()
+	args := []string{"--config.file", path}
+	if _, err := app.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	write(`
+graphite:
+  sample-expiry: 10m
+tenants:
+- name: team-a
+  listen-address: ":9110"
+  mapping-config: a.yml
+  sample-expiry: 1m
+  max-series: 1000
+- name: team-b
+  listen-address: ":9111"
+`)
+	config, err := newConfigFile(app, path, args)
+	assert.NoError(t, err)
+	assert.NoError(t, config.load(), "the tenants are not flags")
+	assert.Equal(t, 10*time.Minute, *expiry)
+	tenants, err := config.tenants()
+	assert.NoError(t, err)
+	assert.Equal(t, []tenantConfig{
+		{Name: "team-a", ListenAddress: ":9110", MappingConfig: "a.yml", SampleExpiry: time.Minute, MaxSeries: 1000},
+		{Name: "team-b", ListenAddress: ":9111"},
+	}, tenants)
+	assert.NoError(t, validateTenants(tenants, ":9109"))
+
+	write("tenants:\n- name: a\n  listen-adress: \":9110\"\n")
+	_, err = config.tenants()
+	assert.Error(t, err, "unknown tenant keys are rejected")
+}
+
+func TestValidateTenants(t *testing.T) {
+	for _, tc := range []struct {
+		tenants []tenantConfig
+		want    string
+	}{
+		{
+			tenants: []tenantConfig{{Name: "a/b", ListenAddress: ":9110"}},
+			want:    `invalid tenant name "a/b", it must consist of letters, digits, '_' and '-'`,
+		},
+		{
+			tenants: []tenantConfig{{Name: "a", ListenAddress: ":9110"}, {Name: "a", ListenAddress: ":9111"}},
+			want:    `duplicate tenant "a"`,
+		},
+		{
+			tenants: []tenantConfig{{Name: "a"}},
+			want:    `tenant "a": listen-address is required`,
+		},
+		{
+			tenants: []tenantConfig{{Name: "a", ListenAddress: ":9109"}},
+			want:    `tenant "a": listen-address :9109 is already in use`,
+		},
+		{
+			tenants: []tenantConfig{{Name: "a", ListenAddress: ":9110", MaxSeries: -1}},
+			want:    `tenant "a": sample-expiry, max-series, max-samples-per-scrape and parse-rate-limit must not be negative`,
+		},
+	} {
+		assert.EqualError(t, validateTenants(tc.tenants, ":9109"), tc.want)
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graphite_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mapping := filepath.Join(dir, "mapping.yml")
+	writeMapping := func(content string) {
+		if err := ioutil.WriteFile(mapping, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeMapping("mappings:\n- match: app.*.load\n  name: load\n  labels:\n    app: $1\n")
+
+	base := graphitecollector.Options{
+		Logger:         log.NewNopLogger(),
+		IdentityLabels: &graphitecollector.IdentityLabels{Labels: map[string]string{"team": "x", "tenant": "y"}},
+	}
+	a, err := newTenant(tenantConfig{Name: "a", MappingConfig: mapping, MaxSeries: 1}, base, true)
+	assert.NoError(t, err)
+	b, err := newTenant(tenantConfig{Name: "b"}, base, true)
+	assert.NoError(t, err)
+	_, err = newTenant(tenantConfig{Name: "c", MappingConfig: filepath.Join(dir, "missing.yml")}, base, true)
+	assert.Error(t, err)
+
+	reg := prometheus.NewRegistry()
+	for _, tenant := range []*tenant{a, b} {
+		tenant.c.Run(context.Background())
+		defer tenant.c.Stop()
+		reg.MustRegister(tenant.c.SampleCollector())
+	}
+	ingest := func(tenant *tenant, lines ...string) {
+		rec := httptest.NewRecorder()
+		graphitecollector.IngestBatchHandler(tenant.c, 1024, time.Second).ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/ingest/batch", strings.NewReader(strings.Join(lines, "\n"))))
+		assert.Equal(t, 200, rec.Code)
+	}
+	line := func(path string, value int) string {
+		return fmt.Sprintf("%s %d %d", path, value, time.Now().Unix())
+	}
+	// Tenant a reaches its series limit, which leaves tenant b unaffected.
+	ingest(a, line("app.web.load", 1), line("app.db.load", 2))
+	ingest(b, line("app.web.load", 3), line("app.db.load", 4))
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP app_db_load Graphite metric app_db_load
+# TYPE app_db_load gauge
+app_db_load{team="x",tenant="b"} 4
+# HELP app_web_load Graphite metric app_web_load
+# TYPE app_web_load gauge
+app_web_load{team="x",tenant="b"} 3
+# HELP load Graphite metric load
+# TYPE load gauge
+load{app="web",team="x",tenant="a"} 1
+`)))
+	assert.NoError(t, testutil.CollectAndCompare(tenantStats{a, b}, strings.NewReader(`
+# HELP graphite_tenant_stored_samples Number of samples in the store of each tenant.
+# TYPE graphite_tenant_stored_samples gauge
+graphite_tenant_stored_samples{tenant="a"} 1
+graphite_tenant_stored_samples{tenant="b"} 2
+`)))
+
+	// A tenant failing to reload keeps its mapping, and the others reload.
+	writeMapping("mappings: [")
+	err = reloadTenants([]*tenant{a, b}, []tenantConfig{
+		{Name: "a", MappingConfig: mapping, MaxSeries: 1},
+		{Name: "b", SampleExpiry: time.Minute, MaxSeries: 5, ParseRateLimit: 100},
+	}, base, "http", log.NewNopLogger())
+	assert.EqualError(t, err, "tenants a failed to reload")
+	assert.Equal(t, time.Minute, b.c.SampleExpiry())
+	assert.Equal(t, 5, b.c.MaxSeries(), "the limits of a tenant are reloadable")
+	assert.Equal(t, 100.0, b.c.ParseRateLimit())
+	assert.NotNil(t, a.c.Mapper())
+
+	// Settings removed from a tenant fall back to those of the flags.
+	base.SampleExpiry = 10 * time.Minute
+	base.MaxSamplesPerScrape = 50
+	assert.NoError(t, reloadTenants([]*tenant{b}, []tenantConfig{{Name: "b"}}, base, "http", log.NewNopLogger()))
+	assert.Equal(t, 10*time.Minute, b.c.SampleExpiry())
+	assert.Equal(t, 0, b.c.MaxSeries())
+	assert.Equal(t, 50, b.c.MaxSamplesPerScrape())
+	assert.Equal(t, 0.0, b.c.ParseRateLimit())
+	assert.Equal(t, tenantConfig{Name: "b"}, b.tenantConfig)
+}
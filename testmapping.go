@@ -0,0 +1,117 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+// Actions reported by test-mapping.
+const (
+	mappingActionMap        = "map"
+	mappingActionDrop       = "drop"
+	mappingActionStrictDrop = "strict-drop"
+)
+
+// mappingResult is one line of test-mapping output. The field order is part
+// of the output format.
+type mappingResult struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	// Reason is why a drop that is not due to a rule happened, as in the
+	// reason label of graphite_samples_dropped_total.
+	Reason string            `json:"reason,omitempty"`
+	Name   string            `json:"name,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Type   string            `json:"type,omitempty"`
+	Rule   string            `json:"rule,omitempty"`
+}
+
+// testMapping maps every metric path read from r, one per line, and writes
+// the result for each as a line of JSON to w.
+func testMapping(m graphitecollector.MetricMapper, settings graphitecollector.MapSettings, r io.Reader, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		path := strings.TrimSpace(scanner.Text())
+		if path == "" {
+			continue
+		}
+
+		result := mappingResult{Path: path, Action: mappingActionMap}
+		mapping, _, present := m.GetMapping(path, mapper.MetricTypeGauge)
+		if present {
+			result.Rule = mapping.Match
+		}
+		switch {
+		case present && mapping.Action == mapper.ActionTypeDrop:
+			result.Action = mappingActionDrop
+		case !present && settings.StrictMatch:
+			result.Action = mappingActionStrictDrop
+		default:
+			mm, ok := graphitecollector.MapMetric(m, path, settings)
+			if !ok {
+				// The mapped name is invalid, e.g. with
+				// --graphite.drop-invalid-names, or has invalid
+				// characters with --graphite.mapping-strict-names.
+				result.Action = mappingActionDrop
+				result.Reason = mm.DropReason
+				break
+			}
+			result.Name = mm.Name
+			result.Labels = mm.Labels
+			result.Type = valueTypeName(mm.Type)
+		}
+		if err := enc.Encode(result); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func valueTypeName(t prometheus.ValueType) string {
+	switch t {
+	case prometheus.CounterValue:
+		return "counter"
+	case prometheus.GaugeValue:
+		return "gauge"
+	default:
+		return "untyped"
+	}
+}
+
+// runTestMapping runs the test-mapping command and returns the exit code.
+func runTestMapping(logger log.Logger) int {
+	m, err := graphitecollector.LoadMapping(*mappingConfig)
+	if err != nil {
+		level.Error(logger).Log("msg", "Error loading metric mapping config", "err", err)
+		return 1
+	}
+	if err := testMapping(m, mapSettingsFromFlags(), os.Stdin, os.Stdout); err != nil {
+		level.Error(logger).Log("msg", "Error testing mapping", "err", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+func TestTestMapping(t *testing.T) {
+	m := &graphitecollector.Mapper{}
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: servers.*.requests
+  name: requests_total
+  type: counter
+  labels:
+    host: $1
+- match: servers.*.debug
+  name: dropped
+  action: drop
+`))
+	input := "servers.web1.requests\n\nservers.web1.debug\nother.metric\n"
+
+	var out bytes.Buffer
+	assert.NoError(t, testMapping(m, graphitecollector.MapSettings{}, strings.NewReader(input), &out))
+	assert.Equal(t, `{"path":"servers.web1.requests","action":"map","name":"requests_total","labels":{"host":"web1"},"type":"counter","rule":"servers.*.requests"}
+{"path":"servers.web1.debug","action":"drop","rule":"servers.*.debug"}
+{"path":"other.metric","action":"map","name":"other_metric","type":"gauge"}
+`, out.String())
+
+	out.Reset()
+	assert.NoError(t, testMapping(m, graphitecollector.MapSettings{StrictMatch: true}, strings.NewReader("other.metric\n"), &out))
+	assert.Equal(t, `{"path":"other.metric","action":"strict-drop"}
+`, out.String())
+
+	// Names that are invalid even after sanitizing are dropped as the
+	// exporter would.
+	out.Reset()
+	assert.NoError(t, testMapping(m, graphitecollector.MapSettings{}, strings.NewReader("1xx.errors\n"), &out))
+	assert.Equal(t, `{"path":"1xx.errors","action":"drop","reason":"invalid_name"}
+`, out.String())
+
+	// So are names from a capture with invalid characters, with strict
+	// mapped names.
+	assert.NoError(t, m.InitFromYAMLString(`
+mappings:
+- match: jobs.*.runs
+  name: runs_$1
+`))
+	out.Reset()
+	assert.NoError(t, testMapping(m, graphitecollector.MapSettings{}, strings.NewReader("jobs.nightly-backup.runs\n"), &out))
+	assert.Equal(t, `{"path":"jobs.nightly-backup.runs","action":"map","name":"runs_nightly_backup","type":"gauge","rule":"jobs.*.runs"}
+`, out.String())
+	out.Reset()
+	assert.NoError(t, testMapping(m, graphitecollector.MapSettings{StrictMappedNames: true}, strings.NewReader("jobs.nightly-backup.runs\n"), &out))
+	assert.Equal(t, `{"path":"jobs.nightly-backup.runs","action":"drop","reason":"invalid_mapped_name","rule":"jobs.*.runs"}
+`, out.String())
+}
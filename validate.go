@@ -0,0 +1,342 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+// flagRules reject flag values, and combinations of them, that cannot work or
+// would silently make the exporter useless. Each returns nil if the flags
+// are fine.
+var flagRules = []func() error{
+	func() error {
+		if *maxRequests < 0 {
+			return fmt.Errorf("--web.max-requests must not be negative")
+		}
+		return nil
+	},
+	func() error {
+		if *metricsTimeout < 0 {
+			return fmt.Errorf("--web.telemetry-timeout must not be negative")
+		}
+		return nil
+	},
+	func() error {
+		if *enableBatchIngest && *batchMaxBytes <= 0 {
+			return fmt.Errorf("--web.batch-ingest-max-bytes must be positive")
+		}
+		return nil
+	},
+	func() error {
+		if *enableBatchIngest && *batchTimeout <= 0 {
+			return fmt.Errorf("--web.batch-ingest-timeout must be positive")
+		}
+		return nil
+	},
+	func() error {
+		if *strictMatch && *mappingConfig == "" {
+			return fmt.Errorf("--graphite.mapping-strict-match requires --graphite.mapping-config, as every sample would be dropped")
+		}
+		return nil
+	},
+	func() error {
+		if *normalizeNames && *mappingConfig == "" {
+			return fmt.Errorf("--graphite.normalize-names requires --graphite.mapping-config, as only mapped metrics are normalized")
+		}
+		return nil
+	},
+	func() error {
+		if *metricPrefix != "" && !graphitecollector.ValidMetricPrefix.MatchString(*metricPrefix) {
+			return fmt.Errorf("invalid --graphite.metric-prefix %q, it must match %s", *metricPrefix, graphitecollector.ValidMetricPrefix)
+		}
+		return nil
+	},
+	func() error {
+		if !graphitecollector.ValidMetricPrefix.MatchString(*invalidNamePrefix) {
+			return fmt.Errorf("invalid --graphite.invalid-name-prefix %q, it must match %s", *invalidNamePrefix, graphitecollector.ValidMetricPrefix)
+		}
+		return nil
+	},
+	func() error {
+		if *splitDepth < 0 {
+			return fmt.Errorf("--graphite.unmapped-split-depth must not be negative")
+		}
+		return nil
+	},
+	func() error {
+		if !model.LabelName(*splitLabel).IsValid() {
+			return fmt.Errorf("invalid label name %q for --graphite.unmapped-split-label", *splitLabel)
+		}
+		return nil
+	},
+	func() error {
+		if *instanceComponent < 0 {
+			return fmt.Errorf("--graphite.instance-component must not be negative")
+		}
+		if *instanceComponent > 0 && *splitDepth > 0 && *splitLabel == "instance" {
+			return fmt.Errorf("--graphite.unmapped-split-label must not be instance with --graphite.instance-component")
+		}
+		return nil
+	},
+	func() error {
+		if *maxScrapeSamples < 0 {
+			return fmt.Errorf("--graphite.max-samples-per-scrape must not be negative")
+		}
+		return nil
+	},
+	func() error {
+		if *schemaFactor <= 0 {
+			return fmt.Errorf("--graphite.storage-schemas-expiry-factor must be positive")
+		}
+		return nil
+	},
+	func() error {
+		if *startupGrace < 0 {
+			return fmt.Errorf("--graphite.startup-grace-period must not be negative")
+		}
+		return nil
+	},
+	func() error {
+		if *backfillNoMetrics && !*backfillMode {
+			return fmt.Errorf("--graphite.backfill-disable-exposition requires --graphite.backfill-mode")
+		}
+		return nil
+	},
+	func() error {
+		// Backfill mode disables expiry, which both rely on. Tombstones
+		// would also be exported as current values.
+		if *backfillMode && *replayMode {
+			return fmt.Errorf("only one of --graphite.backfill-mode and --graphite.replay-mode may be set")
+		}
+		if *backfillMode && *expiredTombstones {
+			return fmt.Errorf("--graphite.expired-tombstones cannot be used with --graphite.backfill-mode, in which samples never expire")
+		}
+		return nil
+	},
+	func() error {
+		_, err := valueCoercionsFromFlags()
+		return err
+	},
+	func() error {
+		_, err := valueSuffixesFromFlags()
+		return err
+	},
+	func() error {
+		if *drainTimeout < 0 {
+			return fmt.Errorf("--graphite.tcp-drain-timeout must not be negative")
+		}
+		return nil
+	},
+	func() error {
+		if *sweepInitialJitter < 0 {
+			return fmt.Errorf("--graphite.expiry-sweep-initial-jitter must not be negative")
+		}
+		if *sweepJitter < 0 || *sweepJitter >= 1 {
+			return fmt.Errorf("--graphite.expiry-sweep-jitter must be at least 0 and less than 1")
+		}
+		return nil
+	},
+	func() error {
+		if *bindRetries < 0 {
+			return fmt.Errorf("--graphite.bind-retry-count must not be negative")
+		}
+		if *bindRetries > 0 && *bindRetryInterval <= 0 {
+			return fmt.Errorf("--graphite.bind-retry-interval must be positive")
+		}
+		return nil
+	},
+	func() error {
+		if *bindInterface == "" {
+			return nil
+		}
+		if host, _, err := net.SplitHostPort(*graphiteAddress); err != nil || host != "" {
+			return fmt.Errorf("--graphite.bind-interface requires a --graphite.listen-address without a host, such as :9109")
+		}
+		return nil
+	},
+	func() error {
+		if *udpMaxPending < 0 {
+			return fmt.Errorf("--graphite.udp-max-pending-packets must not be negative")
+		}
+		return nil
+	},
+	func() error {
+		if *minUpdates < 1 {
+			return fmt.Errorf("--graphite.min-updates must be at least 1")
+		}
+		if *probationExpiry < 0 {
+			return fmt.Errorf("--graphite.probation-expiry must not be negative")
+		}
+		return nil
+	},
+	func() error {
+		if *parseRateLimit < 0 {
+			return fmt.Errorf("--graphite.parse-rate-limit must not be negative")
+		}
+		return nil
+	},
+	func() error {
+		if *dedupWindow > 0 && *dedupMaxLines <= 0 {
+			return fmt.Errorf("--graphite.dedup-max-lines must be positive")
+		}
+		return nil
+	},
+	func() error {
+		if *trackSources < 0 {
+			return fmt.Errorf("--graphite.track-sources must not be negative")
+		}
+		return nil
+	},
+	func() error {
+		if *trackIntervals < 0 {
+			return fmt.Errorf("--graphite.track-update-intervals must not be negative")
+		}
+		return nil
+	},
+	func() error {
+		if *trackSanitized < 0 {
+			return fmt.Errorf("--graphite.track-sanitized-names must not be negative")
+		}
+		return nil
+	},
+	func() error {
+		if *stallThreshold < 0 {
+			return fmt.Errorf("--graphite.pipeline-stall-threshold must not be negative")
+		}
+		return nil
+	},
+	func() error {
+		if *maxNameLength < 0 || *maxLabelValueLen < 0 {
+			return fmt.Errorf("--graphite.max-name-length and --graphite.max-label-value-length must not be negative")
+		}
+		return nil
+	},
+	func() error {
+		if *lengthLimitAction == "truncate" && ((*maxNameLength > 0 && *maxNameLength < 32) || (*maxLabelValueLen > 0 && *maxLabelValueLen < 32)) {
+			return fmt.Errorf("--graphite.length-limit-action=truncate requires length limits of at least 32, to leave room for the hash")
+		}
+		return nil
+	},
+	func() error {
+		if *deadLetterFile != "" && *deadLetterAddress != "" {
+			return fmt.Errorf("only one of --graphite.dead-letter-file and --graphite.dead-letter-address may be set")
+		}
+		return nil
+	},
+	func() error {
+		if *deadLetterAddress == "" && (*deadLetterTLS || *deadLetterCompress != "none") {
+			return fmt.Errorf("--graphite.dead-letter-tls.enabled and --graphite.dead-letter-compression require --graphite.dead-letter-address")
+		}
+		return nil
+	},
+	func() error {
+		if !*deadLetterTLS && (*deadLetterCAFile != "" || *deadLetterCertFile != "" || *deadLetterKeyFile != "" || *deadLetterSrvName != "" || *deadLetterNoVerify) {
+			return fmt.Errorf("the --graphite.dead-letter-tls flags require --graphite.dead-letter-tls.enabled")
+		}
+		return nil
+	},
+	func() error {
+		if *deadLetterRate < 0 {
+			return fmt.Errorf("--graphite.dead-letter-rate must not be negative")
+		}
+		return nil
+	},
+	func() error {
+		if *dumpFSMAndExit && *dumpFSMPath == "" {
+			return fmt.Errorf("--debug.dump-fsm-and-exit requires --debug.dump-fsm")
+		}
+		return nil
+	},
+	func() error {
+		if *otlpEndpoint != "" && *otlpBatchSize <= 0 {
+			return fmt.Errorf("--otlp.batch-size must be positive")
+		}
+		return nil
+	},
+	func() error {
+		if *otlpInsecure && (*otlpCAFile != "" || *otlpCertFile != "" || *otlpKeyFile != "" || *otlpServerName != "" || *otlpSkipVerify) {
+			return fmt.Errorf("--otlp.insecure disables TLS, so no --otlp.tls flag may be set")
+		}
+		return nil
+	},
+	func() error {
+		if *otlpEndpoint == "" && (*otlpInsecure || *otlpCAFile != "" || *otlpCertFile != "" || *otlpKeyFile != "" || *otlpServerName != "" || *otlpSkipVerify || len(*otlpHeaders) > 0 ||
+			*otlpCompression != "none" || *otlpBearerFile != "" || *otlpUsername != "" || *otlpPasswordFile != "") {
+			return fmt.Errorf("the --otlp flags require --otlp.endpoint")
+		}
+		return nil
+	},
+	func() error {
+		if *otlpBearerFile != "" && (*otlpUsername != "" || *otlpPasswordFile != "") {
+			return fmt.Errorf("only one of --otlp.bearer-token-file and --otlp.basic-auth may be set")
+		}
+		return nil
+	},
+	func() error {
+		if *otlpPasswordFile != "" && *otlpUsername == "" {
+			return fmt.Errorf("--otlp.basic-auth.password-file requires --otlp.basic-auth.username")
+		}
+		return nil
+	},
+	func() error {
+		if *pullURL == "" {
+			if len(*pullTargets) > 0 || *pullBearerFile != "" || *pullUsername != "" || *pullPasswordFile != "" ||
+				*pullCAFile != "" || *pullCertFile != "" || *pullKeyFile != "" || *pullServerName != "" || *pullSkipVerify {
+				return fmt.Errorf("the --pull flags require --pull.url")
+			}
+			return nil
+		}
+		if u, err := url.Parse(*pullURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("--pull.url must be an http or https URL")
+		}
+		if len(*pullTargets) == 0 {
+			return fmt.Errorf("--pull.url requires at least one --pull.target")
+		}
+		if *pullInterval <= 0 || *pullTimeout <= 0 {
+			return fmt.Errorf("--pull.interval and --pull.timeout must be positive")
+		}
+		if *pullMaxStaleness < 0 {
+			return fmt.Errorf("--pull.max-staleness must not be negative")
+		}
+		return nil
+	},
+	func() error {
+		if *pullBearerFile != "" && (*pullUsername != "" || *pullPasswordFile != "") {
+			return fmt.Errorf("only one of --pull.bearer-token-file and --pull.basic-auth may be set")
+		}
+		if *pullPasswordFile != "" && *pullUsername == "" {
+			return fmt.Errorf("--pull.basic-auth.password-file requires --pull.basic-auth.username")
+		}
+		return nil
+	},
+}
+
+// validateFlags checks the parsed flags against all rules, returning every
+// violation found.
+func validateFlags() []error {
+	var errs []error
+	for _, rule := range flagRules {
+		if err := rule(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
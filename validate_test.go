@@ -0,0 +1,292 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// parseFlags parses args as the command line. Flags with a default that are
+// not given are reset to it; the others are reset explicitly.
+func parseFlags(args []string) error {
+	*strictMatch, *normalizeNames, *carbon2Lines, *logDroppedPaths, *rejectMalformed, *dropInvalidNames = false, false, false, false, false, false
+	*exposeMapping, *enableLifecycle, *enableBatchIngest, *disableCompression, *dumpFSMAndExit = false, false, false, false, false
+	*observeValues, *replayMode, *readOnlyReplica, *otlpInsecure, *otlpSkipVerify = false, false, false, false, false
+	*expiredTombstones, *lenientFieldOrder, *commaDecimal, *backfillMode, *backfillNoMetrics = false, false, false, false, false
+	*deadLetterTLS, *deadLetterNoVerify, *defaultSuffixes, *multiDatapoints, *pullSkipVerify = false, false, false, false, false
+	*strictMappedNames = false
+	*pullTargets = nil
+	*otlpHeaders, *valueCoercions, *valueSuffixes = map[string]string{}, map[string]string{}, map[string]string{}
+	_, err := kingpin.CommandLine.Parse(args)
+	return err
+}
+
+func TestValidateFlags(t *testing.T) {
+	defer parseFlags([]string{})
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{args: []string{}},
+		{
+			args: []string{"--web.max-requests=-1"},
+			want: "--web.max-requests must not be negative",
+		},
+		{
+			args: []string{"--web.telemetry-timeout=-1s"},
+			want: "--web.telemetry-timeout must not be negative",
+		},
+		{args: []string{"--web.batch-ingest-timeout=0s"}},
+		{
+			args: []string{"--web.enable-batch-ingest", "--web.batch-ingest-max-bytes=0B"},
+			want: "--web.batch-ingest-max-bytes must be positive",
+		},
+		{
+			args: []string{"--web.enable-batch-ingest", "--web.batch-ingest-timeout=0s"},
+			want: "--web.batch-ingest-timeout must be positive",
+		},
+		{args: []string{"--graphite.mapping-strict-match", "--graphite.mapping-config=m.yml"}},
+		{
+			args: []string{"--graphite.mapping-strict-match"},
+			want: "--graphite.mapping-strict-match requires --graphite.mapping-config, as every sample would be dropped",
+		},
+		{
+			args: []string{"--graphite.normalize-names"},
+			want: "--graphite.normalize-names requires --graphite.mapping-config, as only mapped metrics are normalized",
+		},
+		{
+			args: []string{"--graphite.metric-prefix=vendor-x_"},
+			want: `invalid --graphite.metric-prefix "vendor-x_", it must match ^[a-zA-Z_:][a-zA-Z0-9_:]*$`,
+		},
+		{
+			args: []string{"--graphite.invalid-name-prefix=1x_"},
+			want: `invalid --graphite.invalid-name-prefix "1x_", it must match ^[a-zA-Z_:][a-zA-Z0-9_:]*$`,
+		},
+		{
+			args: []string{"--graphite.unmapped-split-depth=-1"},
+			want: "--graphite.unmapped-split-depth must not be negative",
+		},
+		{
+			args: []string{"--graphite.unmapped-split-label=graphite.hierarchy"},
+			want: `invalid label name "graphite.hierarchy" for --graphite.unmapped-split-label`,
+		},
+		{args: []string{"--graphite.instance-component=2", "--graphite.unmapped-split-depth=1"}},
+		{
+			args: []string{"--graphite.instance-component=-1"},
+			want: "--graphite.instance-component must not be negative",
+		},
+		{
+			args: []string{"--graphite.instance-component=2", "--graphite.unmapped-split-depth=1", "--graphite.unmapped-split-label=instance"},
+			want: "--graphite.unmapped-split-label must not be instance with --graphite.instance-component",
+		},
+		{
+			args: []string{"--graphite.max-samples-per-scrape=-1"},
+			want: "--graphite.max-samples-per-scrape must not be negative",
+		},
+		{
+			args: []string{"--graphite.storage-schemas-expiry-factor=0"},
+			want: "--graphite.storage-schemas-expiry-factor must be positive",
+		},
+		{
+			args: []string{"--graphite.startup-grace-period=-1m"},
+			want: "--graphite.startup-grace-period must not be negative",
+		},
+		{
+			args: []string{"--graphite.value-coercion=on=yes"},
+			want: "invalid --graphite.value-coercion on=yes, the replacement must be a number",
+		},
+		{args: []string{"--graphite.value-coercion=on=1", "--graphite.value-coercion=off=0"}},
+		{
+			args: []string{"--graphite.value-suffix=ms=abc"},
+			want: "invalid --graphite.value-suffix ms=abc, the multiplier must be a number",
+		},
+		{
+			args: []string{"--graphite.value-suffix=2x=2"},
+			want: "invalid --graphite.value-suffix 2x=2, the suffix must be non-empty and contain no digits or dots",
+		},
+		{args: []string{"--graphite.value-suffixes", "--graphite.value-suffix=h=3600"}},
+		{
+			args: []string{"--graphite.bind-retry-count=-1"},
+			want: "--graphite.bind-retry-count must not be negative",
+		},
+		{
+			args: []string{"--graphite.bind-retry-count=3", "--graphite.bind-retry-interval=0s"},
+			want: "--graphite.bind-retry-interval must be positive",
+		},
+		{args: []string{"--graphite.bind-retry-interval=0s"}},
+		{args: []string{"--graphite.bind-interface=eth1"}},
+		{
+			args: []string{"--graphite.bind-interface=eth1", "--graphite.listen-address=10.0.0.1:9109"},
+			want: "--graphite.bind-interface requires a --graphite.listen-address without a host, such as :9109",
+		},
+		{args: []string{"--graphite.backfill-mode", "--graphite.backfill-disable-exposition"}},
+		{
+			args: []string{"--graphite.backfill-disable-exposition"},
+			want: "--graphite.backfill-disable-exposition requires --graphite.backfill-mode",
+		},
+		{
+			args: []string{"--graphite.backfill-mode", "--graphite.replay-mode"},
+			want: "only one of --graphite.backfill-mode and --graphite.replay-mode may be set",
+		},
+		{
+			args: []string{"--graphite.backfill-mode", "--graphite.expired-tombstones"},
+			want: "--graphite.expired-tombstones cannot be used with --graphite.backfill-mode, in which samples never expire",
+		},
+		{args: []string{"--graphite.expiry-sweep-initial-jitter=1m", "--graphite.expiry-sweep-jitter=0.1"}},
+		{
+			args: []string{"--graphite.tcp-drain-timeout=-1s"},
+			want: "--graphite.tcp-drain-timeout must not be negative",
+		},
+		{
+			args: []string{"--graphite.expiry-sweep-initial-jitter=-1s"},
+			want: "--graphite.expiry-sweep-initial-jitter must not be negative",
+		},
+		{
+			args: []string{"--graphite.expiry-sweep-jitter=1"},
+			want: "--graphite.expiry-sweep-jitter must be at least 0 and less than 1",
+		},
+		{
+			args: []string{"--graphite.udp-max-pending-packets=-1"},
+			want: "--graphite.udp-max-pending-packets must not be negative",
+		},
+		{
+			args: []string{"--graphite.min-updates=0"},
+			want: "--graphite.min-updates must be at least 1",
+		},
+		{
+			args: []string{"--graphite.probation-expiry=-1s"},
+			want: "--graphite.probation-expiry must not be negative",
+		},
+		{
+			args: []string{"--graphite.parse-rate-limit=-1"},
+			want: "--graphite.parse-rate-limit must not be negative",
+		},
+		{args: []string{"--graphite.dedup-max-lines=0"}},
+		{
+			args: []string{"--graphite.dedup-window=1m", "--graphite.dedup-max-lines=0"},
+			want: "--graphite.dedup-max-lines must be positive",
+		},
+		{
+			args: []string{"--graphite.track-sources=-1"},
+			want: "--graphite.track-sources must not be negative",
+		},
+		{
+			args: []string{"--graphite.track-update-intervals=-1"},
+			want: "--graphite.track-update-intervals must not be negative",
+		},
+		{
+			args: []string{"--graphite.track-sanitized-names=-1"},
+			want: "--graphite.track-sanitized-names must not be negative",
+		},
+		{
+			args: []string{"--graphite.pipeline-stall-threshold=-1s"},
+			want: "--graphite.pipeline-stall-threshold must not be negative",
+		},
+		{
+			args: []string{"--graphite.max-label-value-length=-1"},
+			want: "--graphite.max-name-length and --graphite.max-label-value-length must not be negative",
+		},
+		{
+			args: []string{"--graphite.max-name-length=16", "--graphite.length-limit-action=truncate"},
+			want: "--graphite.length-limit-action=truncate requires length limits of at least 32, to leave room for the hash",
+		},
+		{
+			args: []string{"--graphite.max-name-length=16", "--graphite.max-label-value-length=32", "--graphite.length-limit-action=reject"},
+		},
+		{
+			args: []string{"--graphite.dead-letter-file=dead.txt", "--graphite.dead-letter-address=localhost:2003"},
+			want: "only one of --graphite.dead-letter-file and --graphite.dead-letter-address may be set",
+		},
+		{
+			args: []string{"--graphite.dead-letter-address=localhost:2003", "--graphite.dead-letter-tls.enabled", "--graphite.dead-letter-compression=snappy"},
+		},
+		{
+			args: []string{"--graphite.dead-letter-compression=gzip"},
+			want: "--graphite.dead-letter-tls.enabled and --graphite.dead-letter-compression require --graphite.dead-letter-address",
+		},
+		{
+			args: []string{"--graphite.dead-letter-address=localhost:2003", "--graphite.dead-letter-tls.ca-file=ca.pem"},
+			want: "the --graphite.dead-letter-tls flags require --graphite.dead-letter-tls.enabled",
+		},
+		{
+			args: []string{"--graphite.dead-letter-rate=-1"},
+			want: "--graphite.dead-letter-rate must not be negative",
+		},
+		{
+			args: []string{"--debug.dump-fsm-and-exit"},
+			want: "--debug.dump-fsm-and-exit requires --debug.dump-fsm",
+		},
+		{
+			args: []string{"--otlp.endpoint=localhost:4317", "--otlp.batch-size=0"},
+			want: "--otlp.batch-size must be positive",
+		},
+		{
+			args: []string{"--otlp.endpoint=localhost:4317", "--otlp.insecure", "--otlp.tls.ca-file=ca.pem"},
+			want: "--otlp.insecure disables TLS, so no --otlp.tls flag may be set",
+		},
+		{
+			args: []string{"--otlp.header=X-Scope-OrgID=1"},
+			want: "the --otlp flags require --otlp.endpoint",
+		},
+		{
+			args: []string{"--otlp.compression=gzip"},
+			want: "the --otlp flags require --otlp.endpoint",
+		},
+		{
+			args: []string{"--otlp.endpoint=localhost:4317", "--otlp.bearer-token-file=token", "--otlp.basic-auth.username=user"},
+			want: "only one of --otlp.bearer-token-file and --otlp.basic-auth may be set",
+		},
+		{
+			args: []string{"--otlp.endpoint=localhost:4317", "--otlp.basic-auth.password-file=password"},
+			want: "--otlp.basic-auth.password-file requires --otlp.basic-auth.username",
+		},
+		{args: []string{"--pull.url=https://graphite.example.com", "--pull.target=servers.*.cpu"}},
+		{
+			args: []string{"--pull.target=servers.*.cpu"},
+			want: "the --pull flags require --pull.url",
+		},
+		{
+			args: []string{"--pull.url=graphite.example.com", "--pull.target=servers.*.cpu"},
+			want: "--pull.url must be an http or https URL",
+		},
+		{
+			args: []string{"--pull.url=https://graphite.example.com"},
+			want: "--pull.url requires at least one --pull.target",
+		},
+		{
+			args: []string{"--pull.url=https://graphite.example.com", "--pull.target=a", "--pull.interval=0s"},
+			want: "--pull.interval and --pull.timeout must be positive",
+		},
+		{
+			args: []string{"--pull.url=https://graphite.example.com", "--pull.target=a", "--pull.bearer-token-file=token", "--pull.basic-auth.username=user"},
+			want: "only one of --pull.bearer-token-file and --pull.basic-auth may be set",
+		},
+	} {
+		if err := parseFlags(tc.args); err != nil {
+			t.Fatalf("parsing %v: %v", tc.args, err)
+		}
+		errs := validateFlags()
+		if tc.want == "" {
+			assert.Empty(t, errs, "flags %v", tc.args)
+			continue
+		}
+		if assert.Len(t, errs, 1, "flags %v", tc.args) {
+			assert.EqualError(t, errs[0], tc.want, "flags %v", tc.args)
+		}
+	}
+}
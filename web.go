@@ -0,0 +1,351 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/version"
+	"github.com/prometheus/exporter-toolkit/web"
+	"gopkg.in/alecthomas/kingpin.v2"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+var (
+	httpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "graphite_exporter_http_request_duration_seconds",
+			Help:    "Duration of HTTP requests to the exporter.",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		},
+		[]string{"handler", "code"},
+	)
+	httpRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "graphite_exporter_http_requests_total",
+			Help: "Total count of HTTP requests to the exporter.",
+		},
+		[]string{"handler", "code"},
+	)
+	scrapeResponseSize = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "graphite_exporter_last_scrape_response_size_bytes",
+			Help: "Size of the body of the last response of the metrics endpoint, after compression.",
+		},
+	)
+	replicaMode = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "graphite_exporter_replica_mode",
+			Help: "Always 1, labelled by whether the exporter is a read_only replica exporting none of the samples it receives, or normal.",
+		},
+		[]string{"mode"},
+	)
+)
+
+// metricsHandler returns the handler of the metrics endpoint, which records
+// the size of each response in scrapeResponseSize.
+func metricsHandler(opts promhttp.HandlerOpts) http.Handler {
+	handler := promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, opts),
+	)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &countingWriter{ResponseWriter: w}
+		handler.ServeHTTP(cw, r)
+		scrapeResponseSize.Set(float64(cw.n))
+	})
+}
+
+// countingWriter counts the bytes of the response body.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// instrumentedMux is an http.ServeMux that instruments every handler
+// registered on it, labelled by the pattern it is registered for, and logs
+// each request at debug level.
+type instrumentedMux struct {
+	*http.ServeMux
+	logger log.Logger
+}
+
+func newInstrumentedMux(logger log.Logger) *instrumentedMux {
+	return &instrumentedMux{ServeMux: http.NewServeMux(), logger: logger}
+}
+
+func (m *instrumentedMux) Handle(pattern string, handler http.Handler) {
+	labels := prometheus.Labels{"handler": pattern}
+	handler = promhttp.InstrumentHandlerDuration(
+		httpRequestDuration.MustCurryWith(labels),
+		promhttp.InstrumentHandlerCounter(httpRequestsTotal.MustCurryWith(labels), handler),
+	)
+	m.ServeMux.Handle(pattern, accessLog(m.logger, handler))
+}
+
+func (m *instrumentedMux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.Handle(pattern, http.HandlerFunc(handler))
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func accessLog(logger log.Logger, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		handler.ServeHTTP(rec, r)
+		// Server errors are shown on the landing page until the same path
+		// is served successfully.
+		if rec.code >= 500 {
+			graphitecollector.RecordError(graphitecollector.SubsystemHTTP, r.URL.Path, fmt.Errorf("%s %s returned HTTP %d", r.Method, r.URL.Path, rec.code))
+		} else {
+			graphitecollector.ClearError(graphitecollector.SubsystemHTTP, r.URL.Path)
+		}
+		level.Debug(logger).Log(
+			"msg", "HTTP request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"remote_addr", r.RemoteAddr,
+			"code", rec.code,
+			"duration", time.Since(start),
+		)
+	})
+}
+
+// exporterStatus collects the runtime state shown on the landing page.
+type exporterStatus struct {
+	mu sync.Mutex
+
+	listeners       graphitecollector.Listeners
+	readOnly        bool
+	tlsEnabled      bool
+	basicAuth       bool
+	mappingConfig   string
+	mappingChecksum string
+	mappingContents []byte
+	mappingLoadedAt time.Time
+}
+
+// setMappingConfig records a successful load of the mapping configuration.
+func (s *exporterStatus) setMappingConfig(path string, contents []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mappingConfig = path
+	s.mappingChecksum = fmt.Sprintf("%x", sha256.Sum256(contents))
+	s.mappingContents = contents
+	s.mappingLoadedAt = time.Now()
+}
+
+// setWebConfig records whether the web configuration file enables TLS and
+// basic authentication. The file must have been validated before.
+func (s *exporterStatus) setWebConfig(path string) error {
+	if path == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var c web.Config
+	if err := yaml.Unmarshal(content, &c); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tlsEnabled = c.TLSConfig.TLSCertPath != ""
+	s.basicAuth = len(c.Users) > 0
+	return nil
+}
+
+type landingPageData struct {
+	Version         string
+	Revision        string
+	Listeners       []graphitecollector.ListenerStats
+	ReadOnly        bool
+	TLSEnabled      bool
+	BasicAuth       bool
+	MappingConfig   string
+	MappingChecksum string
+	MappingLoadedAt time.Time
+	StoredSamples   int
+	LastProcessed   time.Time
+	Errors          []graphitecollector.SubsystemError
+	MetricsPath     string
+	DebugAddress    string
+}
+
+var landingPageTemplate = template.Must(template.New("landing").Parse(`<html>
+<head><title>Graphite Exporter</title></head>
+<body>
+<h1>Graphite Exporter</h1>
+<p>Version {{.Version}} (revision {{.Revision}})</p>
+{{if .ReadOnly}}<p><strong>Read-only replica:</strong> received lines are processed, but the metrics endpoint exports only the exporter's own metrics.</p>
+{{end}}<h2>Listeners</h2>
+<table>
+<tr><th>Name</th><th>Protocol</th><th>Address</th><th>TLS</th><th>Connections</th><th>Datagrams</th><th>Last error</th></tr>
+{{range .Listeners}}<tr><td>{{.Name}}</td><td>{{.Protocol}}</td><td>{{.Address}}</td><td>{{if .TLS}}yes{{else}}no{{end}}</td><td>{{.Connections}}</td><td>{{.Datagrams}}</td><td>{{if .LastError}}{{.LastErrorAt.Format "2006-01-02T15:04:05Z07:00"}}: {{.LastError}}{{end}}</td></tr>
+{{end}}</table>
+<p>TLS: {{if .TLSEnabled}}enabled{{else}}disabled{{end}}, basic authentication: {{if .BasicAuth}}enabled{{else}}disabled{{end}}</p>
+<h2>Mapping configuration</h2>
+{{if .MappingConfig}}<p>{{.MappingConfig}} (sha256 {{.MappingChecksum}}), loaded at {{.MappingLoadedAt.Format "2006-01-02T15:04:05Z07:00"}}</p>
+{{else}}<p>No mapping configuration loaded.</p>
+{{end}}<h2>Samples</h2>
+<p>Stored samples: {{.StoredSamples}}</p>
+<p>Last processed sample: {{if .LastProcessed.IsZero}}never{{else}}{{.LastProcessed.Format "2006-01-02T15:04:05Z07:00"}}{{end}}</p>
+<h2>Errors</h2>
+{{if .Errors}}<table>
+<tr><th>Subsystem</th><th>Time</th><th>Error</th></tr>
+{{range .Errors}}<tr><td>{{.Subsystem}}</td><td>{{.Time.Format "2006-01-02T15:04:05Z07:00"}}</td><td>{{.Message}}</td></tr>
+{{end}}</table>
+{{else}}<p>No unrecovered errors.</p>
+{{end}}<h2>Links</h2>
+<ul>
+<li><a href="{{.MetricsPath}}">Metrics</a></li>
+<li><a href="/-/healthy">Health</a></li>
+<li><a href="/-/ready">Readiness</a></li>
+</ul>
+{{if .DebugAddress}}<p>Profiling and debug endpoints are served on {{.DebugAddress}} under /debug/.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// landingPage renders the runtime status of the exporter.
+func landingPage(s *exporterStatus, c *graphitecollector.Collector, metricsPath, debugAddress string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		s.mu.Lock()
+		data := landingPageData{
+			Version:         version.Version,
+			Revision:        version.Revision,
+			ReadOnly:        s.readOnly,
+			TLSEnabled:      s.tlsEnabled,
+			BasicAuth:       s.basicAuth,
+			MappingConfig:   s.mappingConfig,
+			MappingChecksum: s.mappingChecksum,
+			MappingLoadedAt: s.mappingLoadedAt,
+			MetricsPath:     metricsPath,
+			DebugAddress:    debugAddress,
+		}
+		s.mu.Unlock()
+		data.Listeners = s.listeners.Stats()
+		data.StoredSamples = c.SampleCount()
+		data.LastProcessed = c.LastProcessedTime()
+		data.Errors = graphitecollector.SubsystemErrors()
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := landingPageTemplate.Execute(w, data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// buildInfoData is the build information and the features of the exporter,
+// which lets orchestration detect features without parsing versions.
+type buildInfoData struct {
+	Version   string   `json:"version"`
+	Revision  string   `json:"revision"`
+	Branch    string   `json:"branch"`
+	BuildUser string   `json:"build_user"`
+	BuildDate string   `json:"build_date"`
+	GoVersion string   `json:"go_version"`
+	Features  []string `json:"features"`
+}
+
+// buildInfo reports the version of the exporter and the features compiled
+// into it, as registered with graphitecollector.RegisterFeature.
+func buildInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"data": buildInfoData{
+			Version:   version.Version,
+			Revision:  version.Revision,
+			Branch:    version.Branch,
+			BuildUser: version.BuildUser,
+			BuildDate: version.BuildDate,
+			GoVersion: version.GoVersion,
+			Features:  graphitecollector.Features(),
+		},
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+type configStatusData struct {
+	Flags         map[string]string `json:"flags"`
+	MappingConfig *string           `json:"mapping_config,omitempty"`
+}
+
+// configStatus reports the effective value of every flag of app. Flags that
+// name files, such as the web configuration holding TLS keys and basic auth
+// users, are reported by path only. The contents of the mapping configuration
+// are included only if exposeMapping is set.
+func configStatus(app *kingpin.Application, s *exporterStatus, exposeMapping bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data := configStatusData{Flags: map[string]string{}}
+		for _, f := range app.Model().Flags {
+			if f.Hidden || f.Name == "help" || f.Name == "version" {
+				continue
+			}
+			data.Flags[f.Name] = f.Value.String()
+		}
+		if exposeMapping {
+			s.mu.Lock()
+			contents := string(s.mappingContents)
+			s.mu.Unlock()
+			data.MappingConfig = &contents
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   data,
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
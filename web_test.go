@@ -0,0 +1,181 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/prometheus/graphite_exporter/pkg/graphitecollector"
+)
+
+func TestLandingPage(t *testing.T) {
+	c := graphitecollector.NewCollector(graphitecollector.Options{})
+	c.Run(context.Background())
+	defer c.Stop()
+	c.ProcessLine("my.metric 1 1534620625")
+	assert.Eventually(t, func() bool { return c.SampleCount() == 1 }, time.Second, time.Millisecond)
+
+	s := &exporterStatus{}
+	s.listeners.Add("graphite", "tcp", "127.0.0.1:9109", false)
+	s.listeners.Add("graphite", "udp", "127.0.0.1:9109", false).RecordError(fmt.Errorf("read: connection refused"))
+	s.listeners.Add("http", "http", "127.0.0.1:9108", true)
+	s.setMappingConfig("/etc/graphite/mapping.yml", []byte("mappings: []\n"))
+
+	rec := httptest.NewRecorder()
+	landingPage(s, c, "/metrics", "")(rec, httptest.NewRequest("GET", "/", nil))
+
+	body := rec.Body.String()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, body, "<td>graphite</td><td>tcp</td><td>127.0.0.1:9109</td><td>no</td><td>0</td><td>0</td><td></td>")
+	assert.Contains(t, body, ": read: connection refused</td>")
+	assert.Contains(t, body, "<td>http</td><td>http</td><td>127.0.0.1:9108</td><td>yes</td>")
+	assert.Contains(t, body, "TLS: disabled")
+	assert.Contains(t, body, "/etc/graphite/mapping.yml (sha256 93878a88ea06f4d0")
+	assert.Contains(t, body, "Stored samples: 1")
+	assert.NotContains(t, body, "Last processed sample: never")
+	assert.Contains(t, body, `<a href="/metrics">`)
+
+	assert.NotContains(t, body, "Read-only replica")
+
+	rec = httptest.NewRecorder()
+	landingPage(s, c, "/metrics", "")(rec, httptest.NewRequest("GET", "/other", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	s.readOnly = true
+	rec = httptest.NewRecorder()
+	landingPage(s, c, "/metrics", "")(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Contains(t, rec.Body.String(), "Read-only replica")
+}
+
+func TestConfigStatus(t *testing.T) {
+	app := kingpin.New("test", "")
+	app.Flag("web.config.file", "").Default("").String()
+	app.Flag("graphite.sample-expiry", "").Default("5m").Duration()
+	_, err := app.Parse([]string{"--web.config.file=/etc/graphite/web.yml"})
+	assert.NoError(t, err)
+
+	s := &exporterStatus{}
+	s.setMappingConfig("/etc/graphite/mapping.yml", []byte("mappings: []\n"))
+
+	for _, expose := range []bool{false, true} {
+		rec := httptest.NewRecorder()
+		configStatus(app, s, expose)(rec, httptest.NewRequest("GET", "/api/v1/status/config", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var resp struct {
+			Status string           `json:"status"`
+			Data   configStatusData `json:"data"`
+		}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		assert.Equal(t, "success", resp.Status)
+		assert.Equal(t, map[string]string{
+			"web.config.file":        "/etc/graphite/web.yml",
+			"graphite.sample-expiry": "5m0s",
+		}, resp.Data.Flags)
+		if expose {
+			if assert.NotNil(t, resp.Data.MappingConfig) {
+				assert.Equal(t, "mappings: []\n", *resp.Data.MappingConfig)
+			}
+		} else {
+			assert.Nil(t, resp.Data.MappingConfig)
+		}
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	rec := httptest.NewRecorder()
+	buildInfo(rec, httptest.NewRequest("GET", "/api/v1/status/buildinfo", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var resp struct {
+		Status string        `json:"status"`
+		Data   buildInfoData `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "success", resp.Status)
+	assert.Equal(t, runtime.Version(), resp.Data.GoVersion)
+	// Features of both packages are registered by the files implementing
+	// them.
+	assert.Contains(t, resp.Data.Features, "carbon2")
+	assert.Contains(t, resp.Data.Features, "otlp")
+	assert.Equal(t, graphitecollector.Features(), resp.Data.Features)
+}
+
+func TestInstrumentedMux(t *testing.T) {
+	mux := newInstrumentedMux(log.NewNopLogger())
+	mux.HandleFunc("/-/test", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	before := testutil.ToFloat64(httpRequestsTotal.WithLabelValues("/-/test", "418"))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/-/test", nil))
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+	assert.Equal(t, before+1, testutil.ToFloat64(httpRequestsTotal.WithLabelValues("/-/test", "418")))
+	assert.Equal(t, 1, testutil.CollectAndCount(httpRequestDuration.MustCurryWith(map[string]string{"handler": "/-/test"})))
+}
+
+func TestMetricsHandler(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		metricsHandler(promhttp.HandlerOpts{DisableCompression: disable}).ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		if disable {
+			assert.Empty(t, rec.Header().Get("Content-Encoding"))
+		} else {
+			assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+		}
+		assert.NotZero(t, rec.Body.Len())
+		assert.Equal(t, float64(rec.Body.Len()), testutil.ToFloat64(scrapeResponseSize), "compression disabled: %v", disable)
+	}
+}
+
+func TestHTTPErrorsOnLandingPage(t *testing.T) {
+	fail := true
+	mux := newInstrumentedMux(log.NewNopLogger())
+	mux.HandleFunc("/-/flaky", func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	c := graphitecollector.NewCollector(graphitecollector.Options{})
+	render := func() string {
+		rec := httptest.NewRecorder()
+		landingPage(&exporterStatus{}, c, "/metrics", "")(rec, httptest.NewRequest("GET", "/", nil))
+		return rec.Body.String()
+	}
+
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/-/flaky", nil))
+	assert.Contains(t, render(), "<td>GET /-/flaky returned HTTP 500</td>")
+
+	fail = false
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/-/flaky", nil))
+	assert.NotContains(t, render(), "/-/flaky")
+}